@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// fetchViewCount returns the total view count of a page from the Confluence Cloud analytics API
+func fetchViewCount(ctx context.Context, config *Config, page Page) (int, error) {
+	viewsURL := fmt.Sprintf("%s/rest/api/analytics/content/%s/views", strings.TrimSuffix(config.ConfluenceURL, "/"), page.ID)
+	body, err := fetchWithContext(ctx, config, opContentFetch, viewsURL)
+	if err != nil {
+		return 0, err
+	}
+
+	var views struct {
+		Count int `json:"count"`
+	}
+	if err := json.Unmarshal(body, &views); err != nil {
+		return 0, fmt.Errorf("parsing view count: %w", err)
+	}
+	return views.Count, nil
+}
+
+// selectTopViewed fetches view counts for every listed page and keeps the
+// limit most-viewed ones. Pages whose count can't be read rank last.
+func selectTopViewed(config *Config, pages []Page, limit int) []Page {
+	fmt.Fprintf(os.Stderr, "DEBUG: Fetching view counts for %d pages to select the top %d\n", len(pages), limit)
+
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < config.MaxWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range indexes {
+				count, err := fetchViewCount(context.Background(), config, pages[index])
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "DEBUG: Failed to get view count for page %s: %v\n", pages[index].Title, err)
+					continue
+				}
+				pages[index].Views = &count
+			}
+		}()
+	}
+	for i := range pages {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+
+	sort.SliceStable(pages, func(i, j int) bool {
+		return viewsOrMinusOne(pages[i]) > viewsOrMinusOne(pages[j])
+	})
+	if len(pages) > limit {
+		pages = pages[:limit]
+	}
+	return pages
+}
+
+func viewsOrMinusOne(page Page) int {
+	if page.Views == nil {
+		return -1
+	}
+	return *page.Views
+}
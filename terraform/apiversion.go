@@ -0,0 +1,307 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// API version pinning. The default mixes v2 listing with the v1 content endpoint;
+// proxied or allow-listed environments can restrict the importer to one family.
+const (
+	apiVersionAuto = "auto"
+	apiVersionV1   = "v1"
+	apiVersionV2   = "v2"
+)
+
+// validateAPIVersion normalizes the api_version option
+func validateAPIVersion(version string) (string, error) {
+	switch strings.ToLower(strings.TrimSpace(version)) {
+	case "", apiVersionAuto:
+		return apiVersionAuto, nil
+	case apiVersionV1:
+		return apiVersionV1, nil
+	case apiVersionV2:
+		return apiVersionV2, nil
+	default:
+		return "", fmt.Errorf("unknown api_version %q (expected \"auto\", \"v1\" or \"v2\")", version)
+	}
+}
+
+// connectionTestURL returns an endpoint from the pinned API family for the connection test
+func connectionTestURL(config *Config) string {
+	baseURL := strings.TrimSuffix(config.ConfluenceURL, "/")
+	if config.APIVersion == apiVersionV1 {
+		return baseURL + "/rest/api/content?limit=1"
+	}
+	return baseURL + "/api/v2/pages?limit=1"
+}
+
+// fetchSpacePagesV1 lists a space's pages with the v1 start/limit pagination.
+// Only an unknown space is an error; other lookup failures skip the space.
+func fetchSpacePagesV1(config *Config, spaceKey string, pagesPerSpace int) ([]Page, error) {
+	baseURL := strings.TrimSuffix(config.ConfluenceURL, "/")
+
+	space, err := resolveSpace(config, spaceKey, true)
+	if err != nil {
+		if errors.Is(err, errSpaceNotFound) {
+			return nil, unknownSpaceError(config, spaceKey)
+		}
+		fmt.Fprintf(os.Stderr, "DEBUG: Failed to get space info for %s: %v\n", spaceKey, err)
+		return nil, nil // Skip this space and continue with others
+	}
+	spaceKey = firstNonEmpty(space.Key, spaceKey) // A personal space may have been named by its owner
+
+	var pages []Page
+	start := 0
+	// Offsets past stale pages aren't known ahead, so modified_since lists serially
+	if config.ListingConcurrency > 1 && config.ModifiedSince == "" {
+		if total := approximatePageCount(config, baseURL, spaceKey); total > config.ListingLimit {
+			pages = fetchSpacePagesV1Parallel(config, spaceKey, pagesPerSpace, total)
+			start = len(pages)
+		}
+	}
+	// Blog posts count against the same per-space limit, after the pages
+	for _, contentType := range listedTypes(config) {
+		if contentType != "page" {
+			start = 0
+		}
+		for {
+			if pagesPerSpace > 0 && len(pages) >= pagesPerSpace {
+				fmt.Fprintf(os.Stderr, "DEBUG: Reached max pages limit (%d) for space %s, stopping\n", pagesPerSpace, spaceKey)
+				break
+			}
+
+			listURL := v1ListingURL(config, spaceKey, contentType, start)
+			fmt.Fprintf(os.Stderr, "DEBUG: Fetching %s\n", listURL)
+
+			body, err := fetchWithPolicy(config, opPageListing, listURL)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "DEBUG: Failed to fetch %ss from space %s: %v\n", contentType, spaceKey, err)
+				break
+			}
+
+			var response struct {
+				Results []Page `json:"results"`
+				Size    int    `json:"size"`
+				Links   struct {
+					Next string `json:"next"`
+				} `json:"_links"`
+			}
+			if err := json.Unmarshal(body, &response); err != nil {
+				fmt.Fprintf(os.Stderr, "DEBUG: Failed to parse response for space %s: %v\n", spaceKey, err)
+				break
+			}
+
+			batch, dropped := dropStale(config, response.Results)
+			if dropped > 0 {
+				fmt.Fprintf(os.Stderr, "DEBUG: Skipping %d %ss of space %s not modified since %s\n", dropped, contentType, spaceKey, config.ModifiedSince)
+			}
+			if pagesPerSpace > 0 && len(pages)+len(batch) > pagesPerSpace {
+				batch = batch[:pagesPerSpace-len(pages)]
+			}
+			for i := range batch {
+				batch[i].SpaceKey = spaceKey
+			}
+			pages = append(pages, batch...)
+			fmt.Fprintf(os.Stderr, "DEBUG: Fetched %d %ss from space %s, total from this space: %d\n", len(batch), contentType, spaceKey, len(pages))
+
+			if response.Links.Next == "" || len(response.Results) == 0 {
+				break
+			}
+			start += len(response.Results)
+		}
+	}
+	return pages, nil
+}
+
+// Listing page sizes. Data Center nodes often answer smaller pages much
+// faster; Cloud accepts up to 250 per call.
+const (
+	defaultListingLimit = 100
+	maxListingLimit     = 250
+)
+
+// defaultContentExpand is the expansion set of v1 content and search calls
+const defaultContentExpand = "body.storage,metadata.labels,version,history"
+
+// validateListing checks the listing_limit and content_expand options
+func validateListing(config *Config) error {
+	if config.ListingLimit < 1 || config.ListingLimit > maxListingLimit {
+		return fmt.Errorf("listing_limit must be between 1 and %d", maxListingLimit)
+	}
+	if !hasExpansion(config.ContentExpand, "body.storage") {
+		return fmt.Errorf("content_expand must include body.storage")
+	}
+	return nil
+}
+
+// hasExpansion reports whether a comma-separated expand parameter includes name
+func hasExpansion(expand, name string) bool {
+	for _, expansion := range strings.Split(expand, ",") {
+		if strings.TrimSpace(expansion) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// listedTypes returns the content types a space listing covers: pages, and
+// blog posts with include_blogs
+func listedTypes(config *Config) []string {
+	if config.IncludeBlogs == "true" {
+		return []string{"page", "blogpost"}
+	}
+	return []string{"page"}
+}
+
+// listsVersions reports whether listings must say each page's version: for
+// the recency order, modified_since and state_file
+func listsVersions(config *Config) bool {
+	return config.QueueOrder == queueOrderRecency || config.ModifiedSince != "" || config.StateFile != ""
+}
+
+func v1ListingURL(config *Config, spaceKey, contentType string, start int) string {
+	listURL := fmt.Sprintf("%s/rest/api/content?spaceKey=%s&type=%s&limit=%d&start=%d", strings.TrimSuffix(config.ConfluenceURL, "/"), url.QueryEscape(spaceKey), contentType, config.ListingLimit, start)
+	if listsVersions(config) {
+		listURL += "&expand=version"
+	}
+	return listURL
+}
+
+// fetchSpacePagesV1Parallel fetches the listing offsets covering a space's
+// probed page count with listing_concurrency requests in flight, keeping the
+// listing order. It returns the pages up to the first offset that failed or
+// came back short; the serial loop picks up from there, including pages
+// created since the probe.
+func fetchSpacePagesV1Parallel(config *Config, spaceKey string, pagesPerSpace, total int) []Page {
+	if pagesPerSpace > 0 {
+		total = min(total, pagesPerSpace)
+	}
+	batches := make([][]Page, (total+config.ListingLimit-1)/config.ListingLimit)
+	complete := make([]bool, len(batches))
+	fmt.Fprintf(os.Stderr, "DEBUG: Listing %d pages of space %s in %d batches, %d at a time\n", total, spaceKey, len(batches), config.ListingConcurrency)
+
+	var wg sync.WaitGroup
+	semaphore := make(chan struct{}, config.ListingConcurrency)
+	for i := range batches {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			semaphore <- struct{}{}
+			defer func() { <-semaphore }()
+
+			body, err := fetchWithPolicy(config, opPageListing, v1ListingURL(config, spaceKey, "page", i*config.ListingLimit))
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "DEBUG: Failed to fetch pages %d+ from space %s: %v\n", i*config.ListingLimit, spaceKey, err)
+				return
+			}
+			var response struct {
+				Results []Page `json:"results"`
+			}
+			if err := json.Unmarshal(body, &response); err != nil {
+				fmt.Fprintf(os.Stderr, "DEBUG: Failed to parse response for space %s: %v\n", spaceKey, err)
+				return
+			}
+			batches[i] = response.Results
+			complete[i] = len(response.Results) == config.ListingLimit
+		}(i)
+	}
+	wg.Wait()
+
+	var pages []Page
+	for i, batch := range batches {
+		for j := range batch {
+			batch[j].SpaceKey = spaceKey
+		}
+		pages = append(pages, batch...)
+		if !complete[i] {
+			break
+		}
+	}
+	if pagesPerSpace > 0 && len(pages) > pagesPerSpace {
+		pages = pages[:pagesPerSpace]
+	}
+	fmt.Fprintf(os.Stderr, "DEBUG: Fetched %d pages from space %s in parallel\n", len(pages), spaceKey)
+	return pages
+}
+
+// listVisibleSpaceKeysV1 is listSpaceKeys for v1-only instances
+func listVisibleSpaceKeysV1(config *Config, category string, types []string) ([]string, error) {
+	baseURL := strings.TrimSuffix(config.ConfluenceURL, "/")
+	filter := ""
+	if category != "" {
+		filter = "&label=" + url.QueryEscape(category)
+	}
+	var keys []string
+	for start := 0; ; {
+		body, err := fetchWithPolicy(config, opSpaceLookup, fmt.Sprintf("%s/rest/api/space?limit=100&start=%d%s", baseURL, start, filter))
+		if err != nil {
+			return nil, fmt.Errorf("listing spaces: %w", err)
+		}
+
+		var response struct {
+			Results []struct {
+				Key  string `json:"key"`
+				Type string `json:"type"`
+			} `json:"results"`
+			Links struct {
+				Next string `json:"next"`
+			} `json:"_links"`
+		}
+		if err := json.Unmarshal(body, &response); err != nil {
+			return nil, fmt.Errorf("parsing spaces response: %w", err)
+		}
+
+		for _, space := range response.Results {
+			if len(types) == 0 || slices.Contains(types, space.Type) {
+				keys = append(keys, space.Key)
+			}
+		}
+		if response.Links.Next == "" || len(response.Results) == 0 {
+			return keys, nil
+		}
+		start += len(response.Results)
+	}
+}
+
+// contentCollection returns the v2 path segment for a page's content type
+func contentCollection(page Page) string {
+	if page.Type == "blogpost" {
+		return "blogposts"
+	}
+	return "pages"
+}
+
+// fetchContentV2 retrieves a page or blog post body and its labels with v2 endpoints only
+func fetchContentV2(ctx context.Context, config *Config, page Page) (*ContentResponse, error) {
+	baseURL := strings.TrimSuffix(config.ConfluenceURL, "/")
+	collection := contentCollection(page)
+
+	body, err := fetchWithContext(ctx, config, opContentFetch, fmt.Sprintf("%s/api/v2/%s/%s?body-format=storage", baseURL, collection, page.ID))
+	if err != nil {
+		return nil, err
+	}
+
+	var contentResponse ContentResponse
+	if err := json.Unmarshal(body, &contentResponse); err != nil {
+		return nil, fmt.Errorf("parsing content response: %w", err)
+	}
+
+	labelsBody, err := fetchWithContext(ctx, config, opContentFetch, fmt.Sprintf("%s/api/v2/%s/%s/labels?limit=250", baseURL, collection, page.ID))
+	if err != nil {
+		// Labels are optional metadata; keep the content
+		fmt.Fprintf(os.Stderr, "DEBUG: Failed to get labels for page %s: %v\n", page.Title, err)
+		return &contentResponse, nil
+	}
+	if err := json.Unmarshal(labelsBody, &contentResponse.Metadata.Labels); err != nil {
+		fmt.Fprintf(os.Stderr, "DEBUG: Failed to parse labels for page %s: %v\n", page.Title, err)
+	}
+	return &contentResponse, nil
+}
@@ -0,0 +1,476 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// How the text of attachments is emitted
+const (
+	attachmentsAppend = "append" // Added to the page's content under a heading per attachment
+	attachmentsItems  = "items"  // One attachment item per attachment, with parent_page_id
+)
+
+// maxAttachmentBytes skips attachments too large to download and extract
+const maxAttachmentBytes = maxPDFBytes
+
+// Attachment is a file attached to a page, as listed in its item's attachments
+type Attachment struct {
+	ID          string `json:"id"`
+	Title       string `json:"title"`
+	MediaType   string `json:"media_type,omitempty"`
+	FileSize    int64  `json:"file_size,omitempty"`
+	DownloadURL string `json:"download_url"`
+	Version     int    `json:"version,omitempty"`
+	ModifiedAt  string `json:"modified_at,omitempty"`
+}
+
+// validateAttachments checks the attachment options
+func validateAttachments(config *Config) error {
+	switch config.AttachmentMode {
+	case "":
+		config.AttachmentMode = attachmentsAppend
+	case attachmentsAppend, attachmentsItems:
+	default:
+		return fmt.Errorf("invalid attachment_mode %q (expected %q or %q)", config.AttachmentMode, attachmentsAppend, attachmentsItems)
+	}
+	if config.IncludeAttachments != "true" {
+		if config.AttachmentText == "true" {
+			return fmt.Errorf("extract_attachments needs include_attachments")
+		}
+		return nil
+	}
+	if isOfflineSource(config) {
+		return fmt.Errorf("include_attachments needs the confluence source")
+	}
+	return nil
+}
+
+// addAttachments lists a page's attachments into its item. With
+// extract_attachments their text is appended to the item's content, or,
+// in the items attachment_mode, returned as attachment items.
+func addAttachments(ctx context.Context, config *Config, page Page, item *ProcessedItem) []*ProcessedItem {
+	attachments, err := fetchAttachments(ctx, config, page)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "DEBUG: Failed to get attachments of page %s from space %s: %v\n", page.Title, page.SpaceKey, err)
+		return nil
+	}
+	item.Attachments = attachments
+	if len(attachments) == 0 {
+		return nil
+	}
+
+	var items []*ProcessedItem
+	var appended strings.Builder
+	for _, attachment := range attachments {
+		var text string
+		if config.AttachmentText == "true" {
+			text, err = attachmentText(ctx, config, attachment)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "DEBUG: Failed to extract attachment %s of page %s: %v\n", attachment.Title, page.Title, err)
+			}
+		}
+		if config.AttachmentMode == attachmentsAppend {
+			if text != "" {
+				appended.WriteString("\n\n## Attachment: " + attachment.Title + "\n\n" + text)
+			}
+			continue
+		}
+
+		if text == "" {
+			text = fmt.Sprintf("[Attachment: %s (%s, %d bytes)]", attachment.Title, firstNonEmpty(attachment.MediaType, "unknown type"), attachment.FileSize)
+		}
+		if len(text) > config.MaxContentLength {
+			text = text[:config.MaxContentLength] + "\n\n[Content truncated due to size limits]"
+		}
+		items = append(items, &ProcessedItem{
+			ID:       attachment.ID,
+			Title:    attachment.Title,
+			Content:  text,
+			Type:     "attachment",
+			SpaceKey: page.SpaceKey,
+
+			ParentPageID: page.ID,
+			MediaType:    attachment.MediaType,
+			DownloadURL:  attachment.DownloadURL,
+		})
+	}
+
+	if appended.Len() > 0 {
+		item.Content += appended.String()
+		if len(item.Content) > config.MaxContentLength {
+			item.Content = item.Content[:config.MaxContentLength] + "\n\n[Content truncated due to size limits]"
+		}
+	}
+	fmt.Fprintf(os.Stderr, "DEBUG: Added %d attachments of page %s from space %s\n", len(attachments), page.Title, page.SpaceKey)
+	return items
+}
+
+// fetchAttachments lists every attachment of a page, with v2 endpoints when
+// api_version is "v2"
+func fetchAttachments(ctx context.Context, config *Config, page Page) ([]Attachment, error) {
+	baseURL := strings.TrimSuffix(config.ConfluenceURL, "/")
+	var attachments []Attachment
+
+	if config.APIVersion == apiVersionV2 {
+		endpoint := fmt.Sprintf("/api/v2/%s/%s/attachments?limit=%d", contentCollection(page), page.ID, config.ListingLimit)
+		for endpoint != "" {
+			body, err := fetchWithContext(ctx, config, opContentFetch, baseURL+endpoint)
+			if err != nil {
+				return nil, err
+			}
+			var response struct {
+				Results []struct {
+					ID           string         `json:"id"`
+					Title        string         `json:"title"`
+					MediaType    string         `json:"mediaType"`
+					FileSize     int64          `json:"fileSize"`
+					DownloadLink string         `json:"downloadLink"`
+					Version      *listedVersion `json:"version"`
+				} `json:"results"`
+				Links struct {
+					Next string `json:"next"`
+				} `json:"_links"`
+			}
+			if err := json.Unmarshal(body, &response); err != nil {
+				return nil, fmt.Errorf("parsing attachments: %w", err)
+			}
+			for _, result := range response.Results {
+				attachment := Attachment{ID: result.ID, Title: result.Title, MediaType: result.MediaType, FileSize: result.FileSize, DownloadURL: baseURL + result.DownloadLink}
+				if result.Version != nil {
+					attachment.Version, attachment.ModifiedAt = result.Version.Number, result.Version.CreatedAt
+				}
+				attachments = append(attachments, attachment)
+			}
+			endpoint = strings.TrimPrefix(response.Links.Next, "/wiki")
+		}
+		return attachments, nil
+	}
+
+	for start := 0; ; {
+		body, err := fetchWithContext(ctx, config, opContentFetch, fmt.Sprintf("%s/rest/api/content/%s/child/attachment?limit=%d&start=%d&expand=version", baseURL, page.ID, config.ListingLimit, start))
+		if err != nil {
+			return nil, err
+		}
+		var response struct {
+			Results []struct {
+				ID       string `json:"id"`
+				Title    string `json:"title"`
+				Metadata struct {
+					MediaType string `json:"mediaType"`
+				} `json:"metadata"`
+				Extensions struct {
+					MediaType string `json:"mediaType"`
+					FileSize  int64  `json:"fileSize"`
+				} `json:"extensions"`
+				Version *listedVersion `json:"version"`
+				Links   struct {
+					Download string `json:"download"`
+				} `json:"_links"`
+			} `json:"results"`
+			Links struct {
+				Next string `json:"next"`
+			} `json:"_links"`
+		}
+		if err := json.Unmarshal(body, &response); err != nil {
+			return nil, fmt.Errorf("parsing attachments: %w", err)
+		}
+		for _, result := range response.Results {
+			attachment := Attachment{
+				ID:          result.ID,
+				Title:       result.Title,
+				MediaType:   firstNonEmpty(result.Extensions.MediaType, result.Metadata.MediaType),
+				FileSize:    result.Extensions.FileSize,
+				DownloadURL: baseURL + result.Links.Download,
+			}
+			if result.Version != nil {
+				attachment.Version, attachment.ModifiedAt = result.Version.Number, result.Version.When
+			}
+			attachments = append(attachments, attachment)
+		}
+		if response.Links.Next == "" || len(response.Results) == 0 {
+			return attachments, nil
+		}
+		start += len(response.Results)
+	}
+}
+
+// attachmentText downloads an attachment and extracts its text: PDFs through
+// pdftohtml, Word, PowerPoint and Excel files from their XML, and text files
+// as they are. Other types return no text.
+func attachmentText(ctx context.Context, config *Config, attachment Attachment) (string, error) {
+	extension := strings.ToLower(path.Ext(attachment.Title))
+	switch extension {
+	case ".pdf", ".docx", ".pptx", ".xlsx", ".txt", ".md", ".csv":
+	default:
+		return "", nil
+	}
+	if attachment.FileSize > maxAttachmentBytes {
+		fmt.Fprintf(os.Stderr, "DEBUG: Skipping attachment %s (%d bytes)\n", attachment.Title, attachment.FileSize)
+		return "", nil
+	}
+	data, err := fetchWithContext(ctx, config, opAttachmentDownload, attachment.DownloadURL)
+	if err != nil {
+		return "", err
+	}
+	if len(data) > maxAttachmentBytes {
+		fmt.Fprintf(os.Stderr, "DEBUG: Skipping attachment %s (%d bytes)\n", attachment.Title, len(data))
+		return "", nil
+	}
+
+	switch extension {
+	case ".pdf":
+		return extractPDFText(ctx, config, data, attachment.Title)
+	case ".docx", ".pptx", ".xlsx":
+		return officeText(data, extension)
+	}
+	if !utf8.Valid(data) {
+		return "", fmt.Errorf("not UTF-8 text")
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// officeText extracts the text of a Word document, the slides of a PowerPoint
+// deck in order, or the sheets of an Excel workbook as Markdown tables
+func officeText(data []byte, extension string) (string, error) {
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return "", fmt.Errorf("reading %s archive: %w", extension, err)
+	}
+	files := map[string]*zip.File{}
+	for _, file := range archive.File {
+		files[file.Name] = file
+	}
+
+	switch extension {
+	case ".docx":
+		return ooxmlText(files["word/document.xml"])
+	case ".pptx":
+		slides := partsNumbered(files, "ppt/slides/slide")
+		var parts []string
+		for i, name := range slides {
+			text, err := ooxmlText(files[name])
+			if err != nil {
+				return "", err
+			}
+			if text != "" {
+				parts = append(parts, fmt.Sprintf("### Slide %d\n\n%s", i+1, text))
+			}
+		}
+		return strings.Join(parts, "\n\n"), nil
+	}
+
+	shared, err := sharedStrings(files["xl/sharedStrings.xml"])
+	if err != nil {
+		return "", err
+	}
+	var parts []string
+	for i, name := range partsNumbered(files, "xl/worksheets/sheet") {
+		table, err := sheetTable(files[name], shared)
+		if err != nil {
+			return "", err
+		}
+		if table != "" {
+			parts = append(parts, fmt.Sprintf("### Sheet %d\n\n%s", i+1, table))
+		}
+	}
+	return strings.Join(parts, "\n\n"), nil
+}
+
+// partsNumbered returns the archive parts named prefix<N>.xml in order of N
+func partsNumbered(files map[string]*zip.File, prefix string) []string {
+	var names []string
+	for name := range files {
+		if number := strings.TrimSuffix(strings.TrimPrefix(name, prefix), ".xml"); strings.HasPrefix(name, prefix) && number != name {
+			if _, err := strconv.Atoi(number); err == nil {
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Slice(names, func(i, j int) bool {
+		a, _ := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(names[i], prefix), ".xml"))
+		b, _ := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(names[j], prefix), ".xml"))
+		return a < b
+	})
+	return names
+}
+
+// ooxmlText collects the text runs (<w:t>, <a:t>) of a WordprocessingML or
+// DrawingML part, a line per paragraph
+func ooxmlText(file *zip.File) (string, error) {
+	if file == nil {
+		return "", nil
+	}
+	reader, err := file.Open()
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+
+	var out, line strings.Builder
+	inText := false
+	decoder := xml.NewDecoder(reader)
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", fmt.Errorf("parsing %s: %w", file.Name, err)
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			switch t.Name.Local {
+			case "t":
+				inText = true
+			case "tab":
+				line.WriteString("\t")
+			case "br":
+				line.WriteString("\n")
+			}
+		case xml.EndElement:
+			switch t.Name.Local {
+			case "t":
+				inText = false
+			case "p":
+				if text := strings.TrimSpace(line.String()); text != "" {
+					out.WriteString(text + "\n")
+				}
+				line.Reset()
+			}
+		case xml.CharData:
+			if inText {
+				line.Write(t)
+			}
+		}
+	}
+	return strings.TrimSpace(out.String()), nil
+}
+
+// sharedStrings reads the shared string table of a workbook
+func sharedStrings(file *zip.File) ([]string, error) {
+	if file == nil {
+		return nil, nil
+	}
+	reader, err := file.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	var table struct {
+		Items []struct {
+			Text string `xml:"t"`
+			Runs []struct {
+				Text string `xml:"t"`
+			} `xml:"r"`
+		} `xml:"si"`
+	}
+	if err := xml.NewDecoder(reader).Decode(&table); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", file.Name, err)
+	}
+	strs := make([]string, len(table.Items))
+	for i, item := range table.Items {
+		strs[i] = item.Text
+		for _, run := range item.Runs {
+			strs[i] += run.Text
+		}
+	}
+	return strs, nil
+}
+
+// sheetTable lays out a worksheet's rows as a Markdown table, the first row
+// holding a value as its header. Cells are placed by the column of their
+// reference, since sheets leave empty cells out, and only the columns that
+// hold a value somewhere are kept.
+func sheetTable(file *zip.File, shared []string) (string, error) {
+	reader, err := file.Open()
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+	var sheet struct {
+		Rows []struct {
+			Cells []struct {
+				Ref    string `xml:"r,attr"`
+				Type   string `xml:"t,attr"`
+				Value  string `xml:"v"`
+				Inline string `xml:"is>t"`
+			} `xml:"c"`
+		} `xml:"sheetData>row"`
+	}
+	if err := xml.NewDecoder(reader).Decode(&sheet); err != nil {
+		return "", fmt.Errorf("parsing %s: %w", file.Name, err)
+	}
+
+	var rows []map[int]string
+	used := map[int]bool{}
+	for _, row := range sheet.Rows {
+		values := map[int]string{}
+		column := -1
+		for _, cell := range row.Cells {
+			column++
+			if index, ok := columnIndex(cell.Ref); ok {
+				column = index
+			}
+			value := cell.Value
+			switch cell.Type {
+			case "s":
+				if index, err := strconv.Atoi(cell.Value); err == nil && index < len(shared) {
+					value = shared[index]
+				}
+			case "inlineStr":
+				value = cell.Inline
+			}
+			if value = strings.TrimSpace(value); value != "" {
+				values[column] = strings.ReplaceAll(value, "|", "\\|")
+				used[column] = true
+			}
+		}
+		if len(values) > 0 {
+			rows = append(rows, values)
+		}
+	}
+	columns := make([]int, 0, len(used))
+	for column := range used {
+		columns = append(columns, column)
+	}
+	sort.Ints(columns)
+
+	var out strings.Builder
+	for i, row := range rows {
+		out.WriteString("|")
+		for _, column := range columns {
+			out.WriteString(" " + row[column] + " |")
+		}
+		out.WriteString("\n")
+		if i == 0 {
+			out.WriteString("|" + strings.Repeat(" --- |", len(columns)) + "\n")
+		}
+	}
+	return strings.TrimSpace(out.String()), nil
+}
+
+// columnIndex returns the zero-based column of a cell reference like "C7"
+func columnIndex(ref string) (int, bool) {
+	index := 0
+	letters := 0
+	for _, r := range strings.ToUpper(ref) {
+		if r < 'A' || r > 'Z' {
+			break
+		}
+		index = index*26 + int(r-'A'+1)
+		letters++
+	}
+	return index - 1, letters > 0
+}
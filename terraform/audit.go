@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// Audit outcomes: whether content that was accessed ended up in the output
+const (
+	auditEmitted = "emitted"
+	auditSkipped = "skipped" // Fetched but filtered out, e.g. by required_status
+	auditFailed  = "failed"
+)
+
+// auditEntry is one line of the audit log
+type auditEntry struct {
+	Time       string `json:"time"`
+	ContentID  string `json:"content_id"`
+	Type       string `json:"type,omitempty"`
+	SpaceKey   string `json:"space_key,omitempty"`
+	Title      string `json:"title,omitempty"`
+	Credential string `json:"credential,omitempty"` // CONFLUENCE_USERNAME the content was read with
+	ActAs      string `json:"act_as,omitempty"`     // act_as_user whose visibility the content was read with
+	Instance   string `json:"instance"`
+	Outcome    string `json:"outcome"`
+	Items      int    `json:"items"` // Items emitted for the content, including page versions
+	Error      string `json:"error,omitempty"`
+}
+
+// auditLog appends a JSON line per content ID the run accessed to audit_log,
+// so access to restricted spaces can be reviewed afterwards. Runs append to
+// the same file. A nil log records nothing.
+type auditLog struct {
+	mu      sync.Mutex
+	file    *os.File
+	writer  *bufio.Writer
+	encoder *json.Encoder
+	err     error // First write error, reported by Close
+}
+
+// openAuditLog opens audit_log for appending, when set
+func openAuditLog(config *Config) (*auditLog, error) {
+	if config.AuditLog == "" {
+		return nil, nil
+	}
+	file, err := os.OpenFile(config.AuditLog, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("opening audit_log: %w", err)
+	}
+	writer := bufio.NewWriter(file)
+	return &auditLog{file: file, writer: writer, encoder: json.NewEncoder(writer)}, nil
+}
+
+// page records the outcome of processing a listed page
+func (l *auditLog) page(config *Config, page Page, items []*ProcessedItem, err error) {
+	if l == nil {
+		return
+	}
+	entry := auditEntry{ContentID: page.ID, Type: page.Type, SpaceKey: page.SpaceKey, Title: page.Title, Items: len(items), Outcome: auditEmitted}
+	switch {
+	case err != nil:
+		entry.Outcome = auditFailed
+		entry.Error = err.Error()
+	case len(items) == 0:
+		entry.Outcome = auditSkipped
+	}
+	l.write(config, entry)
+}
+
+// items records items emitted without a listed page, e.g. templates
+func (l *auditLog) items(config *Config, items []*ProcessedItem) {
+	if l == nil {
+		return
+	}
+	for _, item := range items {
+		l.write(config, auditEntry{ContentID: item.ID, Type: item.Type, SpaceKey: item.SpaceKey, Title: item.Title, Items: 1, Outcome: auditEmitted})
+	}
+}
+
+func (l *auditLog) write(config *Config, entry auditEntry) {
+	entry.Time = time.Now().UTC().Format(time.RFC3339Nano)
+	entry.Credential = config.Username
+	entry.ActAs = config.ActAsUser
+	entry.Instance = itemInstance(config)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.encoder.Encode(entry); err != nil && l.err == nil {
+		l.err = err
+	}
+}
+
+// Close flushes the log and reports any entry that couldn't be written
+func (l *auditLog) Close() error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	flushErr := l.writer.Flush()
+	closeErr := l.file.Close()
+	for _, err := range []error{l.err, flushErr, closeErr} {
+		if err != nil {
+			return fmt.Errorf("writing audit_log: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Boilerplate detection bounds. Spaces with fewer pages don't say what's
+// repeated; short blocks (a lone "TODO", a rule) aren't worth a guess.
+const (
+	defaultBoilerplateThreshold = 50 // Percent of a space's pages a block must appear on
+	boilerplateMinPages         = 5
+	boilerplateMinBlockPages    = 3
+	boilerplateMinBlockLength   = 20
+	boilerplateMinNavLinks      = 3
+)
+
+// boilerplateFile is the file in cache_dir keeping the blocks the last full run
+// found repeated in each space, which runs that see only some pages strip too
+// since they see too few to find them
+const boilerplateFile = "boilerplate.json"
+
+var (
+	templateInstructionsHeading = regexp.MustCompile(`(?i)^how to use this template\W*$`)
+	navLinkLine                 = regexp.MustCompile(`^\s*- \[[^\]]*\]\([^)]*\)\s*$`)
+)
+
+// boilerplateSink holds every item back until the run is done, counting on how
+// many of its space's pages each block of text appears, then strips the
+// blocks found on most of them before passing the items on. Items wait in a
+// temporary file so memory stays flat.
+type boilerplateSink struct {
+	itemSink
+	config *Config
+	spool  *os.File
+	writer *bufio.Writer
+	count  int
+	pages  map[string]int             // Space -> pages seen
+	blocks map[string]map[string]int  // Space -> block hash -> pages it appears on
+	known  map[string]map[string]bool // Space -> boilerplate block hashes of the last full run
+}
+
+// validateBoilerplate checks the strip_boilerplate options
+func validateBoilerplate(config *Config) error {
+	if config.StripBoilerplate != "true" {
+		return nil
+	}
+	if config.BoilerplateThreshold < 1 || config.BoilerplateThreshold > 100 {
+		return fmt.Errorf("boilerplate_threshold must be between 1 and 100")
+	}
+	if config.Encryption != "" {
+		return fmt.Errorf("strip_boilerplate can't be combined with encryption; items wait unencrypted on disk for the second pass")
+	}
+	return nil
+}
+
+// newBoilerplateSink wraps the sink when strip_boilerplate is enabled, or
+// returns the sink unchanged
+func newBoilerplateSink(config *Config, sink itemSink) (itemSink, error) {
+	if config.StripBoilerplate != "true" {
+		return sink, nil
+	}
+	if config.CacheDir != "" {
+		if err := os.MkdirAll(config.CacheDir, 0o755); err != nil {
+			return nil, fmt.Errorf("creating cache_dir: %w", err)
+		}
+	}
+	spool, err := os.CreateTemp(config.CacheDir, "boilerplate-*.jsonl")
+	if err != nil {
+		return nil, fmt.Errorf("creating boilerplate spool: %w", err)
+	}
+	s := &boilerplateSink{
+		itemSink: sink,
+		config:   config,
+		spool:    spool,
+		writer:   bufio.NewWriter(spool),
+		pages:    map[string]int{},
+		blocks:   map[string]map[string]int{},
+		known:    loadBoilerplate(config),
+	}
+	return s, nil
+}
+
+func (s *boilerplateSink) Write(item *ProcessedItem) error {
+	if !item.Template {
+		s.pages[item.SpaceKey]++
+		if s.blocks[item.SpaceKey] == nil {
+			s.blocks[item.SpaceKey] = map[string]int{}
+		}
+		seen := map[string]bool{}
+		for _, block := range contentBlocks(item.Content) {
+			if hash, ok := blockHash(block); ok && !seen[hash] {
+				seen[hash] = true
+				s.blocks[item.SpaceKey][hash]++
+			}
+		}
+	}
+	line, err := json.Marshal(item)
+	if err != nil {
+		return fmt.Errorf("marshaling item %s: %w", item.ID, err)
+	}
+	s.writer.Write(line)
+	if err := s.writer.WriteByte('\n'); err != nil {
+		return fmt.Errorf("writing boilerplate spool: %w", err)
+	}
+	s.count++
+	return nil
+}
+
+func (s *boilerplateSink) Count() int { return s.count }
+
+// Close strips the boilerplate from every held item, writes them to the
+// wrapped sink and closes it
+func (s *boilerplateSink) Close() (Result, error) {
+	defer os.Remove(s.spool.Name())
+	defer s.spool.Close()
+	if err := s.writer.Flush(); err != nil {
+		return Result{}, fmt.Errorf("writing boilerplate spool: %w", err)
+	}
+
+	repeated := s.repeatedBlocks()
+	if err := s.strip(repeated); err != nil {
+		return Result{}, err
+	}
+	if _, stopped := s.config.Memory.Stopped(); seesEveryPage(s.config) && !stopped {
+		saveBoilerplate(s.config, repeated)
+	}
+	return s.itemSink.Close()
+}
+
+// repeatedBlocks returns each space's blocks that appear on at least
+// boilerplate_threshold percent of its pages, or those the last full run
+// found when this run sees only some of them
+func (s *boilerplateSink) repeatedBlocks() map[string]map[string]bool {
+	if _, stopped := s.config.Memory.Stopped(); !seesEveryPage(s.config) || stopped {
+		return s.known
+	}
+	repeated := map[string]map[string]bool{}
+	for space, counts := range s.blocks {
+		pages := s.pages[space]
+		if pages < boilerplateMinPages {
+			continue
+		}
+		for hash, count := range counts {
+			if count >= boilerplateMinBlockPages && count*100 >= s.config.BoilerplateThreshold*pages {
+				if repeated[space] == nil {
+					repeated[space] = map[string]bool{}
+				}
+				repeated[space][hash] = true
+			}
+		}
+		fmt.Fprintf(os.Stderr, "DEBUG: Found %d boilerplate blocks across %d pages of space %s\n", len(repeated[space]), pages, space)
+	}
+	return repeated
+}
+
+// seesEveryPage reports whether the run converts every page of its spaces,
+// rather than merging a few into the output, taking those modified lately or
+// changed since state_file, or stopping at max_pages or select_top_viewed
+func seesEveryPage(config *Config) bool {
+	return !mergesIntoOutput(config) && config.ModifiedSince == "" && config.StateFile == "" && config.MaxPages == 0 && config.SelectTopViewed == 0
+}
+
+func (s *boilerplateSink) strip(repeated map[string]map[string]bool) error {
+	if _, err := s.spool.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	reader := bufio.NewReader(s.spool)
+	stripped := 0
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF && len(line) == 0 {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("reading boilerplate spool: %w", err)
+		}
+		var item ProcessedItem
+		if err := json.Unmarshal(line, &item); err != nil {
+			return fmt.Errorf("reading boilerplate spool: %w", err)
+		}
+		if !item.Template {
+			var removed int
+			item.Content, removed = stripBoilerplate(item.Content, repeated[item.SpaceKey])
+			stripped += removed
+		}
+		if err := s.itemSink.Write(&item); err != nil {
+			return err
+		}
+	}
+	fmt.Fprintf(os.Stderr, "DEBUG: Stripped %d boilerplate blocks from %d items\n", stripped, s.count)
+	return nil
+}
+
+// stripBoilerplate removes from converted content the repeated blocks, "How
+// to use this template" sections, and lists made only of links (navigation
+// macros like children or pagetree), returning how many blocks it removed
+func stripBoilerplate(content string, repeated map[string]bool) (string, int) {
+	blocks := contentBlocks(content)
+	kept := make([]string, 0, len(blocks))
+	removed := 0
+	skipBelow := 0 // Heading level whose section is being skipped
+	for _, block := range blocks {
+		level := headingLevel(block)
+		if skipBelow > 0 {
+			if level == 0 || level > skipBelow {
+				removed++
+				continue
+			}
+			skipBelow = 0
+		}
+		if level > 0 && templateInstructionsHeading.MatchString(strings.TrimSpace(strings.TrimLeft(block, "#"))) {
+			skipBelow = level
+			removed++
+			continue
+		}
+		if hash, ok := blockHash(block); (ok && repeated[hash]) || isNavLinkList(block) {
+			removed++
+			continue
+		}
+		kept = append(kept, block)
+	}
+	if removed == 0 {
+		return content, 0
+	}
+	return strings.Join(kept, "\n\n"), removed
+}
+
+// contentBlocks splits converted content into its paragraphs, lists, tables
+// and headings
+func contentBlocks(content string) []string {
+	var blocks []string
+	for _, block := range strings.Split(content, "\n\n") {
+		if block = strings.Trim(block, "\n"); strings.TrimSpace(block) != "" {
+			blocks = append(blocks, block)
+		}
+	}
+	return blocks
+}
+
+// blockHash identifies a block by its text, ignoring case and spacing.
+// Headings structure pages rather than repeat content, and short blocks
+// aren't counted, so neither is ever reported as repeated.
+func blockHash(block string) (string, bool) {
+	normalized := strings.ToLower(strings.Join(strings.Fields(block), " "))
+	if len(normalized) < boilerplateMinBlockLength || headingLevel(block) > 0 {
+		return "", false
+	}
+	hash := sha256.Sum256([]byte(normalized))
+	return hex.EncodeToString(hash[:12]), true
+}
+
+// headingLevel returns the level of a heading block, or 0
+func headingLevel(block string) int {
+	if strings.Contains(block, "\n") {
+		return 0
+	}
+	level := len(block) - len(strings.TrimLeft(block, "#"))
+	if level == 0 || level > 6 || !strings.HasPrefix(block[level:], " ") {
+		return 0
+	}
+	return level
+}
+
+// isNavLinkList reports whether a block is a list of nothing but links
+func isNavLinkList(block string) bool {
+	lines := strings.Split(block, "\n")
+	if len(lines) < boilerplateMinNavLinks {
+		return false
+	}
+	for _, line := range lines {
+		if !navLinkLine.MatchString(line) {
+			return false
+		}
+	}
+	return true
+}
+
+// loadBoilerplate reads the blocks the last full run found repeated
+func loadBoilerplate(config *Config) map[string]map[string]bool {
+	known := map[string]map[string]bool{}
+	if config.CacheDir == "" {
+		return known
+	}
+	data, err := os.ReadFile(filepath.Join(config.CacheDir, boilerplateFile))
+	if err != nil {
+		return known
+	}
+	var hashes map[string][]string
+	if err := json.Unmarshal(data, &hashes); err != nil {
+		fmt.Fprintf(os.Stderr, "DEBUG: Failed to parse %s: %v\n", boilerplateFile, err)
+		return known
+	}
+	for space, list := range hashes {
+		known[space] = map[string]bool{}
+		for _, hash := range list {
+			known[space][hash] = true
+		}
+	}
+	return known
+}
+
+// saveBoilerplate keeps the repeated blocks in cache_dir for later merge runs
+func saveBoilerplate(config *Config, repeated map[string]map[string]bool) {
+	if config.CacheDir == "" {
+		return
+	}
+	hashes := map[string][]string{}
+	for space, set := range repeated {
+		for hash := range set {
+			hashes[space] = append(hashes[space], hash)
+		}
+	}
+	path := filepath.Join(config.CacheDir, boilerplateFile)
+	data, _ := json.Marshal(hashes)
+	err := os.WriteFile(path+".tmp", data, 0o644)
+	if err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "DEBUG: Failed to write %s: %v\n", boilerplateFile, err)
+	}
+}
@@ -5,13 +5,23 @@ set -e
 
 echo "Building Confluence import tool..."
 
-# Check if binary exists and compare timestamps
-if [ -f "import_confluence" ] && [ "import_confluence" -nt "import_confluence.go" ]; then
+# Check if binary exists and is newer than every Go source file
+up_to_date=false
+if [ -f "import_confluence" ]; then
+  up_to_date=true
+  for src in *.go; do
+    if [ "$src" -nt "import_confluence" ]; then
+      up_to_date=false
+    fi
+  done
+fi
+
+if [ "$up_to_date" = true ]; then
   echo "✅ Binary is already up to date!"
 else
   echo "🔨 Building new binary..."
   # Build the Go binary for Linux (Terraform Cloud runs on Linux)
-  GOOS=linux GOARCH=amd64 go build -o import_confluence import_confluence.go
+  GOOS=linux GOARCH=amd64 go build -o import_confluence *.go
   
   # Make it executable
   chmod +x import_confluence
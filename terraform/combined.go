@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// modeCombined imports Confluence and SharePoint in one run: this importer and
+// import_sharepoint.py run side by side on the same input, and their items are
+// merged into one array told apart by each item's source
+const modeCombined = "combined"
+
+// sharepointScript is the SharePoint importer combined mode runs, looked up
+// next to this binary unless sharepoint_script says otherwise
+const sharepointScript = "import_sharepoint.py"
+
+// combinedStats is the stats block of one importer of a combined run
+type combinedStats struct {
+	Items       int     `json:"items"`
+	FailedPages int     `json:"failed_pages,omitempty"`
+	Partial     string  `json:"partial,omitempty"`
+	Skipped     bool    `json:"skipped,omitempty"` // The input has no config for this source
+	Seconds     float64 `json:"seconds"`
+}
+
+// combinedFields are the v1 item fields both importers emit. Each merged item
+// carries all of them, empty when its importer had nothing for one, so the
+// items of both sources read alike; source-specific fields are kept as well.
+var combinedFields = []string{"schema_version", "source", "instance", "id", "title", "content", "type", "labels", "url", "created_at", "updated_at", "author"}
+
+// combinedError is one entry of a combined run's error list
+type combinedError struct {
+	Source string `json:"source"`
+	Error  string `json:"error"`
+}
+
+// combinedRun is the outcome of one importer of a combined run
+type combinedRun struct {
+	source string
+	items  []json.RawMessage
+	stats  combinedStats
+	failed string // JSON array of failed pages, Confluence only
+	err    error
+}
+
+// validateCombined checks that a combined run returns its items in the result,
+// the only place both importers' items meet, in the v1 schema the SharePoint
+// importer writes
+func validateCombined(config *Config) error {
+	if config.Mode != modeCombined {
+		return nil
+	}
+	switch {
+	case config.OutputFile != "" || config.Sinks != "" || config.Routes != "":
+		return fmt.Errorf("mode %q returns the items of both importers in its result; output_file, sinks and routes aren't supported", modeCombined)
+	case config.QueueDir != "":
+		return fmt.Errorf("mode %q can't be combined with queue_dir", modeCombined)
+	case config.Encryption != "":
+		return fmt.Errorf("mode %q can't be combined with encryption", modeCombined)
+	case config.SchemaVersion == schemaV2:
+		return fmt.Errorf("mode %q can't be combined with schema_version %q; the SharePoint importer only writes v1 items", modeCombined, schemaV2)
+	}
+	return nil
+}
+
+// runCombined runs the importers the input has config for concurrently, each
+// in a child process, and merges their results. The run only fails when every
+// importer it started failed; otherwise the failures are listed in Errors.
+func runCombined(config *Config, inputMap map[string]interface{}) (Result, error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return Result{}, fmt.Errorf("finding the importer binary: %w", err)
+	}
+	script := firstNonEmpty(config.SharePointScript, filepath.Join(filepath.Dir(executable), sharepointScript))
+
+	// Profiles are already applied, so the children get the resolved input
+	input := make(map[string]interface{}, len(inputMap))
+	for key, value := range inputMap {
+		input[key] = value
+	}
+	delete(input, "config_file")
+	delete(input, "profile")
+	delete(input, "mode")
+	payload, _ := json.Marshal(input)
+
+	runs := []*combinedRun{{source: "confluence"}, {source: "sharepoint"}}
+	var wg sync.WaitGroup
+	for _, run := range runs {
+		var cmd *exec.Cmd
+		switch {
+		case run.source == "confluence" && config.ConfluenceURL == "" && config.Source == "":
+			run.stats.Skipped = true
+		case run.source == "sharepoint" && !hasSharePointConfig(inputMap):
+			run.stats.Skipped = true
+		case run.source == "confluence":
+			cmd = exec.Command(executable)
+		default:
+			cmd = exec.Command("python3", script)
+		}
+		if cmd == nil {
+			fmt.Fprintf(os.Stderr, "DEBUG: Combined run has no %s config, skipping it\n", run.source)
+			continue
+		}
+		wg.Add(1)
+		go func(run *combinedRun, cmd *exec.Cmd) {
+			defer wg.Done()
+			run.runChild(cmd, payload)
+		}(run, cmd)
+	}
+	wg.Wait()
+
+	if runs[0].stats.Skipped && runs[1].stats.Skipped {
+		return Result{}, fmt.Errorf("mode %q needs CONFLUENCE_URL (or source) and SharePoint sites", modeCombined)
+	}
+
+	items := []json.RawMessage{}
+	stats := map[string]combinedStats{}
+	errs := []combinedError{}
+	var result Result
+	var partial []string
+	started, failed := 0, 0
+	for _, run := range runs {
+		stats[run.source] = run.stats
+		if run.stats.Skipped {
+			continue
+		}
+		started++
+		if run.err != nil {
+			failed++
+			errs = append(errs, combinedError{Source: run.source, Error: run.err.Error()})
+			fmt.Fprintf(os.Stderr, "DEBUG: Combined run: %s import failed: %v\n", run.source, run.err)
+			continue
+		}
+		items = append(items, run.items...)
+		if run.stats.Partial != "" {
+			partial = append(partial, run.source+": "+run.stats.Partial)
+		}
+		if run.failed != "" {
+			result.FailedPages = run.failed
+		}
+	}
+
+	statsJSON, _ := json.Marshal(stats)
+	errsJSON, _ := json.Marshal(errs)
+	result.Stats, result.Errors = string(statsJSON), string(errsJSON)
+	result.Partial = strings.Join(partial, "; ")
+	if failed == started {
+		messages := make([]string, len(errs))
+		for i, e := range errs {
+			messages[i] = e.Source + ": " + e.Error
+		}
+		result.Error = "every import of the combined run failed: " + strings.Join(messages, "; ")
+		return result, nil
+	}
+	itemsJSON, _ := json.Marshal(items)
+	result.Items = string(itemsJSON)
+	result.ItemCount = strconv.Itoa(len(items))
+	fmt.Fprintf(os.Stderr, "DEBUG: Combined run returned %d items (confluence: %d, sharepoint: %d)\n",
+		len(items), stats["confluence"].Items, stats["sharepoint"].Items)
+	return result, nil
+}
+
+// hasSharePointConfig reports whether the input names SharePoint sites to
+// import, or asks for every site of the tenant
+func hasSharePointConfig(inputMap map[string]interface{}) bool {
+	return stringValue(inputMap["SHAREPOINT_SITE_URL"]) != "" ||
+		stringValue(inputMap["sharepoint_sites"]) != "" ||
+		stringValue(inputMap["discover_sites"]) == "true"
+}
+
+// runChild runs one importer with the input on stdin and reads its result.
+// Its log passes through to stderr, prefixed with the source; the SharePoint
+// importer reports errors there rather than on stdout.
+func (run *combinedRun) runChild(cmd *exec.Cmd, payload []byte) {
+	start := time.Now()
+	defer func() { run.stats.Seconds = time.Since(start).Round(time.Millisecond).Seconds() }()
+
+	cmd.Stdin = bytes.NewReader(payload)
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		run.err = err
+		return
+	}
+	if err := cmd.Start(); err != nil {
+		run.err = fmt.Errorf("starting %s importer: %w", run.source, err)
+		return
+	}
+	lastError := run.relayLog(stderr)
+	runErr := cmd.Wait()
+
+	var result Result
+	parseErr := json.Unmarshal(stdout.Bytes(), &result)
+	switch {
+	case parseErr == nil && result.Error != "":
+		run.err = fmt.Errorf("%s", result.Error)
+		return
+	case runErr != nil && lastError != "":
+		run.err = fmt.Errorf("%s", lastError)
+		return
+	case runErr != nil:
+		run.err = runErr
+		return
+	case parseErr != nil:
+		run.err = fmt.Errorf("unreadable result: %v", parseErr)
+		return
+	}
+	if err := json.Unmarshal([]byte(result.Items), &run.items); err != nil {
+		run.err = fmt.Errorf("unreadable items: %v", err)
+		return
+	}
+	for i, item := range run.items {
+		normalized, err := normalizeCombinedItem(item)
+		if err != nil {
+			run.err = fmt.Errorf("unreadable item %d: %v", i, err)
+			return
+		}
+		run.items[i] = normalized
+	}
+	run.stats.Items = len(run.items)
+	run.stats.Partial = result.Partial
+	run.failed = result.FailedPages
+	if result.FailedPages != "" {
+		var pages []json.RawMessage
+		json.Unmarshal([]byte(result.FailedPages), &pages)
+		run.stats.FailedPages = len(pages)
+	}
+}
+
+// normalizeCombinedItem fills in the combinedFields an item lacks
+func normalizeCombinedItem(item json.RawMessage) (json.RawMessage, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(item, &fields); err != nil {
+		return nil, err
+	}
+	for _, name := range combinedFields {
+		if _, ok := fields[name]; !ok {
+			fields[name] = json.RawMessage(`""`)
+		}
+	}
+	fields["schema_version"] = json.RawMessage(`"` + schemaV1 + `"`)
+	return json.Marshal(fields)
+}
+
+// relayLog copies a child's log to stderr line by line and returns the last
+// {"error": ...} line it wrote
+func (run *combinedRun) relayLog(log io.Reader) string {
+	var lastError string
+	scanner := bufio.NewScanner(log)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16<<20)
+	for scanner.Scan() {
+		line := scanner.Text()
+		fmt.Fprintf(os.Stderr, "[%s] %s\n", run.source, line)
+		var report struct {
+			Error string `json:"error"`
+		}
+		if strings.HasPrefix(line, "{") && json.Unmarshal([]byte(line), &report) == nil && report.Error != "" {
+			lastError = report.Error
+		}
+	}
+	return lastError
+}
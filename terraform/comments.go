@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Inline comment modes. Review discussions often hold the real caveats, so
+// comments are imported with the text they highlight, either next to that text
+// in the content or as structured annotations on the item.
+const (
+	inlineCommentsInline      = "inline"
+	inlineCommentsAnnotations = "annotations"
+)
+
+// InlineComment is an inline comment with the page text it is anchored to
+type InlineComment struct {
+	Selection string          `json:"selection,omitempty"` // Highlighted page text
+	Status    string          `json:"status,omitempty"`    // open, reopened, resolved or dangling
+	Author    string          `json:"author,omitempty"`
+	Body      string          `json:"body"`
+	Replies   []InlineComment `json:"replies,omitempty"`
+
+	markerRef string
+}
+
+// validateInlineComments checks the inline_comments option
+func validateInlineComments(config *Config) error {
+	switch config.InlineComments {
+	case "":
+		return nil
+	case inlineCommentsInline, inlineCommentsAnnotations:
+		if isOfflineSource(config) {
+			return fmt.Errorf("inline_comments needs the confluence source")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown inline_comments %q (expected %q or %q)", config.InlineComments, inlineCommentsInline, inlineCommentsAnnotations)
+	}
+}
+
+// fetchInlineComments returns a page's inline comments with their replies
+func fetchInlineComments(ctx context.Context, config *Config, converter *HTMLConverter, page Page) ([]InlineComment, error) {
+	if config.APIVersion == apiVersionV2 {
+		return fetchInlineCommentsV2(ctx, config, converter, page)
+	}
+
+	baseURL := strings.TrimSuffix(config.ConfluenceURL, "/")
+	expand := "body.storage,history,extensions.inlineProperties,extensions.resolution,children.comment.body.storage,children.comment.history"
+
+	var comments []InlineComment
+	start := 0
+	for {
+		commentsURL := fmt.Sprintf("%s/rest/api/content/%s/child/comment?location=inline&expand=%s&start=%d&limit=50", baseURL, page.ID, expand, start)
+		body, err := fetchWithContext(ctx, config, opContentFetch, commentsURL)
+		if err != nil {
+			return comments, err
+		}
+
+		var response struct {
+			Results []struct {
+				commentV1
+				Extensions struct {
+					InlineProperties struct {
+						MarkerRef         string `json:"markerRef"`
+						OriginalSelection string `json:"originalSelection"`
+					} `json:"inlineProperties"`
+					Resolution struct {
+						Status string `json:"status"`
+					} `json:"resolution"`
+				} `json:"extensions"`
+				Children struct {
+					Comment struct {
+						Results []commentV1 `json:"results"`
+					} `json:"comment"`
+				} `json:"children"`
+			} `json:"results"`
+			Links struct {
+				Next string `json:"next"`
+			} `json:"_links"`
+		}
+		if err := json.Unmarshal(body, &response); err != nil {
+			return comments, fmt.Errorf("parsing inline comments: %w", err)
+		}
+
+		for _, result := range response.Results {
+			comment := InlineComment{
+				Selection: result.Extensions.InlineProperties.OriginalSelection,
+				Status:    result.Extensions.Resolution.Status,
+				Author:    result.History.CreatedBy.name(),
+				Body:      converter.htmlToText(result.Body.Storage.Value),
+				markerRef: result.Extensions.InlineProperties.MarkerRef,
+			}
+			for _, reply := range result.Children.Comment.Results {
+				comment.Replies = append(comment.Replies, InlineComment{
+					Author: reply.History.CreatedBy.name(),
+					Body:   converter.htmlToText(reply.Body.Storage.Value),
+				})
+			}
+			comments = append(comments, comment)
+		}
+
+		if response.Links.Next == "" || len(response.Results) == 0 {
+			break
+		}
+		start += len(response.Results)
+	}
+	return comments, nil
+}
+
+// commentV1 is the part of a v1 comment shared by top-level comments and replies
+type commentV1 struct {
+	Body struct {
+		Storage struct {
+			Value string `json:"value"`
+		} `json:"storage"`
+	} `json:"body"`
+	History struct {
+		CreatedBy confluenceUser `json:"createdBy"`
+	} `json:"history"`
+}
+
+// commentV2 is an inline comment or reply from the v2 API
+type commentV2 struct {
+	ID               string `json:"id"`
+	ResolutionStatus string `json:"resolutionStatus"`
+	Properties       struct {
+		MarkerRef         string `json:"inlineMarkerRef"`
+		OriginalSelection string `json:"inlineOriginalSelection"`
+	} `json:"properties"`
+	Version struct {
+		AuthorID string `json:"authorId"`
+	} `json:"version"`
+	Body struct {
+		Storage struct {
+			Value string `json:"value"`
+		} `json:"storage"`
+	} `json:"body"`
+}
+
+func fetchInlineCommentsV2(ctx context.Context, config *Config, converter *HTMLConverter, page Page) ([]InlineComment, error) {
+	topLevel, err := fetchCommentsV2(ctx, config, fmt.Sprintf("/api/v2/%s/%s/inline-comments?body-format=storage&limit=100", contentCollection(page), page.ID))
+	if err != nil {
+		return nil, err
+	}
+
+	var comments []InlineComment
+	for _, result := range topLevel {
+		comment := InlineComment{
+			Selection: result.Properties.OriginalSelection,
+			Status:    result.ResolutionStatus,
+			Author:    result.Version.AuthorID,
+			Body:      converter.htmlToText(result.Body.Storage.Value),
+			markerRef: result.Properties.MarkerRef,
+		}
+		replies, err := fetchCommentsV2(ctx, config, fmt.Sprintf("/api/v2/inline-comments/%s/children?body-format=storage&limit=100", result.ID))
+		if err != nil {
+			return comments, fmt.Errorf("fetching replies: %w", err)
+		}
+		for _, reply := range replies {
+			comment.Replies = append(comment.Replies, InlineComment{
+				Author: reply.Version.AuthorID,
+				Body:   converter.htmlToText(reply.Body.Storage.Value),
+			})
+		}
+		comments = append(comments, comment)
+	}
+	return comments, nil
+}
+
+// fetchCommentsV2 follows the cursor links of a v2 comment listing
+func fetchCommentsV2(ctx context.Context, config *Config, endpoint string) ([]commentV2, error) {
+	var comments []commentV2
+	for endpoint != "" {
+		body, err := fetchWithContext(ctx, config, opContentFetch, strings.TrimSuffix(config.ConfluenceURL, "/")+endpoint)
+		if err != nil {
+			return comments, err
+		}
+		var response struct {
+			Results []commentV2 `json:"results"`
+			Links   struct {
+				Next string `json:"next"`
+			} `json:"_links"`
+		}
+		if err := json.Unmarshal(body, &response); err != nil {
+			return comments, fmt.Errorf("parsing comments: %w", err)
+		}
+		comments = append(comments, response.Results...)
+		endpoint = strings.TrimPrefix(response.Links.Next, "/wiki")
+	}
+	return comments, nil
+}
+
+// anchorInlineComments places each comment right after the text it highlights
+// in a storage-format body. Comments whose marker is gone (dangling) are
+// collected at the end of the page.
+func anchorInlineComments(body string, comments []InlineComment) string {
+	var unanchored []string
+	for _, comment := range comments {
+		rendered := ocrTextEscaper.Replace(comment.render())
+
+		anchored := false
+		if comment.markerRef != "" {
+			marker := regexp.MustCompile(`(?is)<ac:inline-comment-marker[^>]*ac:ref="` + regexp.QuoteMeta(comment.markerRef) + `"[^>]*>.*?</ac:inline-comment-marker>`)
+			if location := marker.FindStringIndex(body); location != nil {
+				body = body[:location[1]] + " " + rendered + body[location[1]:]
+				anchored = true
+			}
+		}
+		if !anchored {
+			unanchored = append(unanchored, "<p>"+rendered+"</p>")
+		}
+	}
+
+	if len(unanchored) > 0 {
+		body += "<h2>Inline comments</h2>" + strings.Join(unanchored, "")
+	}
+	return body
+}
+
+// render formats a comment and its replies as one line of text
+func (c InlineComment) render() string {
+	var text strings.Builder
+	text.WriteString("[Inline comment")
+	if c.Status != "" {
+		text.WriteString(" (" + c.Status + ")")
+	}
+	if c.Author != "" {
+		text.WriteString(" by " + c.Author)
+	}
+	if c.Selection != "" {
+		text.WriteString(` on "` + c.Selection + `"`)
+	}
+	text.WriteString(": " + c.Body)
+	for _, reply := range c.Replies {
+		text.WriteString(" / Reply")
+		if reply.Author != "" {
+			text.WriteString(" by " + reply.Author)
+		}
+		text.WriteString(": " + reply.Body)
+	}
+	text.WriteString("]")
+	return text.String()
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Content types beyond pages and blog posts that Cloud exposes through v2
+// endpoints, imported when listed in include_content_types
+const (
+	contentWhiteboard = "whiteboard"
+	contentDatabase   = "database"
+	contentEmbed      = "embed" // Smart link embedded as its own content
+)
+
+// parseContentTypes returns the content types listed in include_content_types
+func parseContentTypes(config *Config) []string {
+	var types []string
+	for _, contentType := range strings.Split(config.IncludeContentTypes, ",") {
+		if contentType = strings.ToLower(strings.TrimSpace(contentType)); contentType != "" {
+			types = append(types, contentType)
+		}
+	}
+	return types
+}
+
+// validateContentTypes checks the include_content_types option
+func validateContentTypes(config *Config) error {
+	types := parseContentTypes(config)
+	if len(types) == 0 {
+		return nil
+	}
+	for _, contentType := range types {
+		switch contentType {
+		case contentWhiteboard, contentDatabase, contentEmbed:
+		default:
+			return fmt.Errorf("invalid include_content_types entry %q (expected %q, %q or %q)", contentType, contentWhiteboard, contentDatabase, contentEmbed)
+		}
+	}
+	if isOfflineSource(config) {
+		return fmt.Errorf("include_content_types needs the confluence source")
+	}
+	if config.APIVersion == apiVersionV1 {
+		return fmt.Errorf("include_content_types uses v2 endpoints and can't be combined with api_version %q", apiVersionV1)
+	}
+	return nil
+}
+
+// fetchSpaceContentTypes returns the whiteboards, databases and embeds of each
+// configured space as items of that type, found through CQL search and read
+// with their v2 endpoints. Their text is rendered best-effort: whiteboard text
+// as bullets, database rows as a table, embeds as a link. Those with nothing to
+// render keep a placeholder so their title stays searchable.
+func fetchSpaceContentTypes(config *Config, converter *HTMLConverter) []*ProcessedItem {
+	types := parseContentTypes(config)
+	baseURL := strings.TrimSuffix(config.ConfluenceURL, "/")
+
+	var items []*ProcessedItem
+	for _, spaceKey := range parseSpaceKeys(config) {
+		cql := fmt.Sprintf(`space = "%s" and type in (%s)`, spaceKey, strings.Join(types, ", "))
+		endpoint := fmt.Sprintf("/rest/api/content/search?cql=%s&limit=%d", url.QueryEscape(cql), min(config.ListingLimit, searchListingLimit))
+		for endpoint != "" {
+			body, err := fetchWithPolicy(config, opPageListing, baseURL+endpoint)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "DEBUG: Failed to list %s of space %s: %v\n", strings.Join(types, ", "), spaceKey, err)
+				break
+			}
+			var response struct {
+				Results []struct {
+					ID    string `json:"id"`
+					Type  string `json:"type"`
+					Title string `json:"title"`
+				} `json:"results"`
+				Links struct {
+					Next string `json:"next"`
+				} `json:"_links"`
+			}
+			if err := json.Unmarshal(body, &response); err != nil {
+				fmt.Fprintf(os.Stderr, "DEBUG: Failed to parse %s of space %s: %v\n", strings.Join(types, ", "), spaceKey, err)
+				break
+			}
+
+			for _, result := range response.Results {
+				if result.Type == "" {
+					continue
+				}
+				content, err := renderContentType(config, converter, result.Type, result.ID)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "DEBUG: Failed to get %s %s of space %s: %v\n", result.Type, result.Title, spaceKey, err)
+					continue
+				}
+				if strings.TrimSpace(content) == "" {
+					content = fmt.Sprintf("[%s: %s]", strings.ToUpper(result.Type[:1])+result.Type[1:], result.Title)
+				}
+				if len(content) > config.MaxContentLength {
+					content = content[:config.MaxContentLength] + "\n\n[Content truncated due to size limits]"
+				}
+				items = append(items, &ProcessedItem{
+					ID:       result.ID,
+					Title:    result.Title,
+					Content:  content,
+					Type:     result.Type,
+					SpaceKey: spaceKey,
+				})
+			}
+
+			if len(response.Results) == 0 {
+				break
+			}
+			endpoint = strings.TrimPrefix(response.Links.Next, "/wiki")
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "DEBUG: Added %d whiteboards, databases and embeds\n", len(items))
+	return items
+}
+
+// renderContentType reads one whiteboard, database or embed and renders its
+// text. The v2 object says what an embed links to; the body, where the
+// instance returns one, holds the text of whiteboards and databases.
+func renderContentType(config *Config, converter *HTMLConverter, contentType, id string) (string, error) {
+	baseURL := strings.TrimSuffix(config.ConfluenceURL, "/")
+	body, err := fetchWithPolicy(config, opContentFetch, fmt.Sprintf("%s/api/v2/%ss/%s", baseURL, contentType, id))
+	if err != nil {
+		return "", err
+	}
+	var object map[string]interface{}
+	if err := json.Unmarshal(body, &object); err != nil {
+		return "", fmt.Errorf("parsing %s: %w", contentType, err)
+	}
+	if contentType == contentEmbed {
+		link := firstNonEmpty(stringValue(object["embedUrl"]), stringValue(object["url"]))
+		if link == "" {
+			return "", nil
+		}
+		return fmt.Sprintf("[%s](%s)", firstNonEmpty(stringValue(object["title"]), link), link), nil
+	}
+
+	body, err = fetchWithPolicy(config, opContentFetch, fmt.Sprintf("%s/rest/api/content/%s?expand=body.atlas_doc_format,body.storage", baseURL, id))
+	if err != nil {
+		// Not every instance serves these types through the v1 content API
+		fmt.Fprintf(os.Stderr, "DEBUG: No body for %s %s: %v\n", contentType, id, err)
+		return "", nil
+	}
+	var content struct {
+		Body struct {
+			AtlasDocFormat struct {
+				Value string `json:"value"`
+			} `json:"atlas_doc_format"`
+			Storage struct {
+				Value string `json:"value"`
+			} `json:"storage"`
+		} `json:"body"`
+	}
+	if err := json.Unmarshal(body, &content); err != nil {
+		return "", fmt.Errorf("parsing %s body: %w", contentType, err)
+	}
+
+	var document interface{}
+	if json.Unmarshal([]byte(content.Body.AtlasDocFormat.Value), &document) == nil {
+		if contentType == contentDatabase {
+			if table := jsonRowsTable(document); table != "" {
+				return table, nil
+			}
+		}
+		var texts []string
+		collectJSONText(document, &texts)
+		if len(texts) > 0 {
+			return "- " + strings.Join(texts, "\n- "), nil
+		}
+	}
+	return converter.htmlToText(content.Body.Storage.Value), nil
+}
+
+// collectJSONText gathers the "text" values of a JSON document in order
+func collectJSONText(value interface{}, texts *[]string) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if text, ok := v["text"].(string); ok && strings.TrimSpace(text) != "" {
+			*texts = append(*texts, strings.Join(strings.Fields(text), " "))
+		}
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if key != "text" {
+				collectJSONText(v[key], texts)
+			}
+		}
+	case []interface{}:
+		for _, item := range v {
+			collectJSONText(item, texts)
+		}
+	}
+}
+
+// jsonRowsTable renders the first "rows" array of a JSON document, the shape
+// database rows take, as a Markdown table of the rows' scalar fields
+func jsonRowsTable(value interface{}) string {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if table := rowsTable(v["rows"]); table != "" {
+			return table
+		}
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if table := jsonRowsTable(v[key]); table != "" {
+				return table
+			}
+		}
+	case []interface{}:
+		for _, item := range v {
+			if table := jsonRowsTable(item); table != "" {
+				return table
+			}
+		}
+	}
+	return ""
+}
+
+func rowsTable(value interface{}) string {
+	list, ok := value.([]interface{})
+	if !ok {
+		return ""
+	}
+	var columns []string
+	seen := map[string]bool{}
+	var rows []map[string]interface{}
+	for _, item := range list {
+		row, ok := item.(map[string]interface{})
+		if !ok {
+			return ""
+		}
+		for key, cell := range row {
+			switch cell.(type) {
+			case string, float64, bool:
+				if !seen[key] {
+					seen[key] = true
+					columns = append(columns, key)
+				}
+			}
+		}
+		rows = append(rows, row)
+	}
+	if len(columns) == 0 {
+		return ""
+	}
+	sort.Strings(columns)
+	var out strings.Builder
+	out.WriteString("| " + strings.Join(columns, " | ") + " |\n")
+	out.WriteString("|" + strings.Repeat(" --- |", len(columns)) + "\n")
+	for _, row := range rows {
+		cells := make([]string, len(columns))
+		for i, column := range columns {
+			if cell, ok := row[column]; ok && cell != nil {
+				cells[i] = strings.ReplaceAll(fmt.Sprint(cell), "|", "\\|")
+			}
+		}
+		out.WriteString("| " + strings.Join(cells, " | ") + " |\n")
+	}
+	return strings.TrimSpace(out.String())
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// minCredentialReread keeps a burst of 401s from every worker from re-reading
+// credentials_file once per request
+const minCredentialReread = 5 * time.Second
+
+// credentialStore tracks the Confluence credentials in use. When a request is
+// rejected with 401 part way through a run, e.g. because the API token was
+// rotated or the session expired, credentials_file is read again; requests
+// still holding the replaced token are sent with the new one from then on.
+type credentialStore struct {
+	mu            sync.Mutex
+	path          string
+	baseURL       string
+	username      string
+	apiToken      string
+	sessionCookie string
+	bearer        bool          // apiToken is a Personal Access Token or OAuth access token, see usesBearerToken
+	oauth         *oauthSession // Refreshes apiToken instead of credentials_file, with OAuth
+	actAsHeader   string        // Header naming actAsUser, the user requests run as
+	actAsUser     string
+	replaced      map[string]bool // Tokens superseded by apiToken
+	generation    int             // Incremented whenever the credentials change
+	readAt        time.Time       // Last re-read that found no new credentials
+}
+
+// credentials is consulted by every request made with Confluence credentials
+var credentials = &credentialStore{}
+
+// credentialsFile is the shape of credentials_file, using the input's keys
+type credentialsFile struct {
+	Username      string `json:"CONFLUENCE_USERNAME"`
+	APIToken      string `json:"CONFLUENCE_API_TOKEN"`
+	SessionCookie string `json:"session_cookie"`
+}
+
+// loadCredentials reads credentials_file, when set, over the username, token
+// and session cookie given as input, and remembers them for refreshing after
+// a 401
+func loadCredentials(config *Config) error {
+	credentials = &credentialStore{path: config.CredentialsFile, baseURL: config.ConfluenceURL, actAsHeader: config.ActAsHeader, actAsUser: config.ActAsUser, replaced: map[string]bool{}}
+	if config.CredentialsFile != "" {
+		file, err := readCredentialsFile(config.CredentialsFile)
+		if err != nil {
+			return err
+		}
+		if file.Username != "" {
+			config.Username = file.Username
+		}
+		if file.APIToken != "" {
+			config.APIToken = file.APIToken
+		}
+		if file.SessionCookie != "" {
+			config.SessionCookie = file.SessionCookie
+		}
+	}
+	if config.SessionCookie != "" && !isOfflineSource(config) {
+		if err := installSessionCookie(config.ConfluenceURL, config.SessionCookie); err != nil {
+			return err
+		}
+	}
+	if usesOAuth(config) && !isOfflineSource(config) {
+		session, err := startOAuth(config)
+		if err != nil {
+			return err
+		}
+		credentials.oauth = session
+	}
+	credentials.username, credentials.apiToken, credentials.sessionCookie = config.Username, config.APIToken, config.SessionCookie
+	credentials.bearer = usesBearerToken(config)
+	return nil
+}
+
+func readCredentialsFile(path string) (credentialsFile, error) {
+	var file credentialsFile
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return file, fmt.Errorf("reading credentials_file: %w", err)
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return file, fmt.Errorf("parsing credentials_file: %w", err)
+	}
+	file.Username, file.APIToken, file.SessionCookie = strings.TrimSpace(file.Username), strings.TrimSpace(file.APIToken), strings.TrimSpace(file.SessionCookie)
+	return file, nil
+}
+
+// current returns the credentials to send in place of the ones a caller holds.
+// An OAuth access token about to expire is replaced first.
+func (s *credentialStore) current(username, apiToken string) (string, string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.oauth != nil && s.oauth.expiring() {
+		s.rotateOAuth()
+	}
+	if s.replaced[apiToken] {
+		return s.username, s.apiToken
+	}
+	return username, apiToken
+}
+
+// impersonate names the user a request runs as, when act_as_user is set. The
+// fields never change after loadCredentials, so no lock is needed.
+func (s *credentialStore) impersonate(req *http.Request) {
+	if s.actAsUser != "" {
+		req.Header.Set(s.actAsHeader, s.actAsUser)
+	}
+}
+
+// generation identifies the credentials in use, for passing to refresh
+func (s *credentialStore) currentGeneration() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.generation
+}
+
+// refresh is called after a request sent with apiToken, while the credentials
+// were at generation, got a 401. It reports whether there are different
+// credentials to retry with: ones another worker already refreshed to, or a
+// new token or session cookie found in credentials_file.
+func (s *credentialStore) refresh(apiToken string, generation int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.path == "" && s.oauth == nil {
+		return false
+	}
+	if s.replaced[apiToken] || generation != s.generation {
+		return true
+	}
+	if s.oauth != nil {
+		if apiToken != s.apiToken || time.Since(s.readAt) < minCredentialReread {
+			return false
+		}
+		s.readAt = time.Now()
+		return s.rotateOAuth()
+	}
+	if apiToken != s.apiToken || time.Since(s.readAt) < minCredentialReread {
+		return false
+	}
+	file, err := readCredentialsFile(s.path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "DEBUG: Failed to refresh credentials: %v\n", err)
+	}
+	newToken := err == nil && file.APIToken != "" && file.APIToken != s.apiToken
+	newCookie := err == nil && file.SessionCookie != "" && file.SessionCookie != s.sessionCookie
+	if !newToken && !newCookie {
+		s.readAt = time.Now()
+		return false
+	}
+	if newCookie {
+		if err := installSessionCookie(s.baseURL, file.SessionCookie); err != nil {
+			fmt.Fprintf(os.Stderr, "DEBUG: Failed to refresh credentials: %v\n", err)
+			s.readAt = time.Now()
+			return false
+		}
+		s.sessionCookie = file.SessionCookie
+	}
+	if newToken {
+		s.replaced[s.apiToken] = true
+		if file.Username != "" {
+			s.username = file.Username
+		}
+		s.apiToken = file.APIToken
+	}
+	fmt.Fprintf(os.Stderr, "DEBUG: Credentials were rejected; retrying with the ones now in credentials_file\n")
+	s.generation++
+	return true
+}
+
+// rotateOAuth replaces the OAuth access token, reporting whether it got a new
+// one. The caller holds s.mu, so the workers wait for a single refresh.
+func (s *credentialStore) rotateOAuth() bool {
+	accessToken, err := s.oauth.refresh()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "DEBUG: Failed to refresh credentials: %v\n", err)
+		// Keep using the current token until it's rejected, without retrying every request
+		s.oauth.expires = time.Time{}
+		return false
+	}
+	s.replaced[s.apiToken] = true
+	s.apiToken = accessToken
+	s.generation++
+	return true
+}
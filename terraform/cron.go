@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronSchedule is a parsed schedule: a five-field cron expression (minute,
+// hour, day of month, month, day of week) in local time, one of the @hourly,
+// @daily, @weekly and @monthly shorthands, or "@every <duration>"
+type cronSchedule struct {
+	every  time.Duration // Set for "@every"; the fields below are unused then
+	fields [5]map[int]bool
+	// Cron matches a day when either day field matches, unless one of them is *
+	anyDayOfMonth bool
+	anyDayOfWeek  bool
+}
+
+var cronShorthands = map[string]string{
+	"@hourly":  "0 * * * *",
+	"@daily":   "0 0 * * *",
+	"@weekly":  "0 0 * * 0",
+	"@monthly": "0 0 1 * *",
+}
+
+// Bounds of each cron field
+var cronFieldRanges = [5][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 6}}
+
+// parseCron parses a schedule
+func parseCron(spec string) (*cronSchedule, error) {
+	spec = strings.TrimSpace(spec)
+	if rest, ok := strings.CutPrefix(spec, "@every "); ok {
+		every, err := time.ParseDuration(strings.TrimSpace(rest))
+		if err != nil || every < time.Minute {
+			return nil, fmt.Errorf("invalid schedule %q (@every needs a duration of at least 1m)", spec)
+		}
+		return &cronSchedule{every: every}, nil
+	}
+	if expanded, ok := cronShorthands[spec]; ok {
+		spec = expanded
+	}
+	parts := strings.Fields(spec)
+	if len(parts) != 5 {
+		return nil, fmt.Errorf("invalid schedule %q (expected 5 cron fields, a shorthand like @daily, or @every <duration>)", spec)
+	}
+	schedule := &cronSchedule{anyDayOfMonth: parts[2] == "*", anyDayOfWeek: parts[4] == "*"}
+	for i, part := range parts {
+		values, err := parseCronField(part, cronFieldRanges[i][0], cronFieldRanges[i][1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid schedule %q: %w", spec, err)
+		}
+		schedule.fields[i] = values
+	}
+	// Sunday may be written as 7
+	if schedule.fields[4][7] {
+		schedule.fields[4][0] = true
+	}
+	return schedule, nil
+}
+
+// parseCronField parses a comma-separated list of *, n, n-m, each optionally
+// followed by /step
+func parseCronField(field string, low, high int) (map[int]bool, error) {
+	values := map[int]bool{}
+	if low == 0 && high == 6 {
+		high = 7 // Day of week accepts 7 for Sunday
+	}
+	for _, part := range strings.Split(field, ",") {
+		rangePart, stepPart, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			var err error
+			if step, err = strconv.Atoi(stepPart); err != nil || step <= 0 {
+				return nil, fmt.Errorf("invalid step in %q", part)
+			}
+		}
+		start, end := low, high
+		if rangePart != "*" {
+			first, last, isRange := strings.Cut(rangePart, "-")
+			var err error
+			if start, err = strconv.Atoi(first); err != nil {
+				return nil, fmt.Errorf("invalid value %q", part)
+			}
+			end = start
+			if isRange {
+				if end, err = strconv.Atoi(last); err != nil {
+					return nil, fmt.Errorf("invalid range %q", part)
+				}
+			} else if hasStep {
+				end = high
+			}
+		}
+		if start < low || end > high || start > end {
+			return nil, fmt.Errorf("%q is outside %d-%d", part, low, high)
+		}
+		for value := start; value <= end; value += step {
+			values[value] = true
+		}
+	}
+	return values, nil
+}
+
+// next returns the first time after t the schedule fires
+func (s *cronSchedule) next(t time.Time) time.Time {
+	if s.every > 0 {
+		return t.Add(s.every)
+	}
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	// Every combination of fields recurs within a few years
+	for limit := t.AddDate(5, 0, 0); t.Before(limit); {
+		switch {
+		case !s.fields[3][int(t.Month())]:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !s.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case !s.fields[1][t.Hour()]:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case !s.fields[0][t.Minute()]:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+func (s *cronSchedule) dayMatches(t time.Time) bool {
+	dayOfMonth := s.fields[2][t.Day()]
+	dayOfWeek := s.fields[4][int(t.Weekday())]
+	switch {
+	case s.anyDayOfMonth && s.anyDayOfWeek:
+		return true
+	case s.anyDayOfMonth:
+		return dayOfWeek
+	case s.anyDayOfWeek:
+		return dayOfMonth
+	}
+	return dayOfMonth || dayOfWeek
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Deployments the importer talks to. Server and Data Center have no v2 API, and
+// authenticate with Personal Access Tokens as well as Basic auth.
+const (
+	deploymentCloud  = "cloud"
+	deploymentServer = "server"
+)
+
+// validateDeployment normalizes the deployment option. The server deployment
+// pins api_version to v1 and rejects the options that need Cloud-only APIs.
+// It runs after validateAPIVersion.
+func validateDeployment(config *Config) error {
+	switch strings.ToLower(strings.TrimSpace(config.Deployment)) {
+	case "", deploymentCloud:
+		config.Deployment = deploymentCloud
+		return nil
+	case deploymentServer, "datacenter", "data_center":
+		config.Deployment = deploymentServer
+	default:
+		return fmt.Errorf("unknown deployment %q (expected %q or %q)", config.Deployment, deploymentCloud, deploymentServer)
+	}
+
+	switch {
+	case config.APIVersion == apiVersionV2:
+		return fmt.Errorf("deployment %q has no v2 API and can't be combined with api_version %q", deploymentServer, apiVersionV2)
+	case config.FetchViews == "true":
+		return fmt.Errorf("fetch_views uses the Cloud analytics API and can't be combined with deployment %q", deploymentServer)
+	case config.IncludeContentTypes != "":
+		return fmt.Errorf("include_content_types uses v2 endpoints and can't be combined with deployment %q", deploymentServer)
+	}
+	config.APIVersion = apiVersionV1
+	return nil
+}
+
+// usesBearerToken reports whether CONFLUENCE_API_TOKEN is sent as a Bearer
+// token: an OAuth access token, or a Personal Access Token on Server and Data
+// Center when no username is given to pair it with for Basic auth
+func usesBearerToken(config *Config) bool {
+	if usesOAuth(config) {
+		return true
+	}
+	return config.Deployment == deploymentServer && config.Username == "" && config.APIToken != ""
+}
+
+// authorize sets the Authorization header for a request sent with apiToken
+func (s *credentialStore) authorize(req *http.Request, username, apiToken string) {
+	switch {
+	case apiToken == "":
+		// With only a session cookie, the cookie jar authenticates
+	case s.bearer:
+		req.Header.Set("Authorization", "Bearer "+apiToken)
+	default:
+		req.SetBasicAuth(username, apiToken)
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"html"
+	"io"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Diagram handling for draw.io and Gliffy macros, which are often the only
+// documentation of a system's architecture and otherwise vanish from the text.
+const (
+	diagramsName   = "name"   // Placeholder with the diagram name
+	diagramsLabels = "labels" // Placeholder with the name and the node labels from the diagram source
+	diagramsPNG    = "png"    // Placeholder with the name and a link to the rendered PNG attachment
+)
+
+var (
+	diagramMacroRegex   = regexp.MustCompile(`(?is)<ac:structured-macro[^>]*ac:name="(drawio|inc-drawio|gliffy)"[^>]*>(.*?)</ac:structured-macro>`)
+	macroParameterRegex = regexp.MustCompile(`(?is)<ac:parameter[^>]*ac:name="([^"]+)"[^>]*>(.*?)</ac:parameter>`)
+	drawioValueRegex    = regexp.MustCompile(`(?i)\b(?:value|label)="([^"]*)"`)
+	drawioDiagramRegex  = regexp.MustCompile(`(?is)<diagram[^>]*>(.*?)</diagram>`)
+	diagramTagRegex     = regexp.MustCompile(`<[^>]+>`)
+	diagramSpaceRegex   = regexp.MustCompile(`\s+`)
+)
+
+const (
+	maxDiagramLabels      = 200
+	maxDiagramSourceBytes = 10 * 1024 * 1024
+)
+
+// validateDiagrams checks the diagrams option
+func validateDiagrams(config *Config) error {
+	switch config.Diagrams {
+	case "", diagramsName:
+		return nil
+	case diagramsLabels, diagramsPNG:
+		if isOfflineSource(config) {
+			return fmt.Errorf("diagrams = %q needs the confluence source", config.Diagrams)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown diagrams %q (expected %q, %q or %q)", config.Diagrams, diagramsName, diagramsLabels, diagramsPNG)
+	}
+}
+
+// renderDiagrams replaces draw.io and Gliffy macros with a descriptive placeholder
+func renderDiagrams(ctx context.Context, config *Config, page Page, body string) string {
+	return diagramMacroRegex.ReplaceAllStringFunc(body, func(element string) string {
+		match := diagramMacroRegex.FindStringSubmatch(element)
+		macro := strings.ToLower(match[1])
+
+		parameters := make(map[string]string)
+		for _, parameter := range macroParameterRegex.FindAllStringSubmatch(match[2], -1) {
+			parameters[parameter[1]] = strings.TrimSpace(html.UnescapeString(diagramTagRegex.ReplaceAllString(parameter[2], "")))
+		}
+
+		kind := "draw.io"
+		name := parameters["diagramName"]
+		pageID := firstNonEmpty(parameters["pageId"], page.ID)
+		if macro == "gliffy" {
+			kind = "Gliffy"
+			name = parameters["name"]
+			pageID = firstNonEmpty(parameters["pageid"], page.ID)
+		}
+		if name == "" {
+			return element
+		}
+
+		placeholder := fmt.Sprintf("[%s diagram: %s]", kind, name)
+		baseURL := strings.TrimSuffix(config.ConfluenceURL, "/")
+
+		switch config.Diagrams {
+		case diagramsLabels:
+			labels, err := fetchDiagramLabels(ctx, config, pageID, name, macro == "gliffy")
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "DEBUG: Failed to read %s diagram %s on page %s: %v\n", kind, name, page.Title, err)
+			} else if len(labels) > 0 {
+				placeholder += " Elements: " + strings.Join(labels, "; ")
+			}
+		case diagramsPNG:
+			placeholder += fmt.Sprintf(" (image: %s/download/attachments/%s/%s)", baseURL, pageID, url.PathEscape(name+".png"))
+		}
+
+		return "<p>" + ocrTextEscaper.Replace(placeholder) + "</p>"
+	})
+}
+
+// fetchDiagramLabels downloads a diagram's source attachment and returns its text labels
+func fetchDiagramLabels(ctx context.Context, config *Config, pageID, name string, gliffy bool) ([]string, error) {
+	baseURL := strings.TrimSuffix(config.ConfluenceURL, "/")
+
+	// Newer draw.io versions store the source with a .drawio extension
+	candidates := []string{name}
+	if !gliffy {
+		candidates = append(candidates, name+".drawio")
+	}
+
+	var source []byte
+	var err error
+	for _, candidate := range candidates {
+		source, err = fetchWithContext(ctx, config, opAttachmentDownload, fmt.Sprintf("%s/download/attachments/%s/%s", baseURL, pageID, url.PathEscape(candidate)))
+		if err == nil || !isNotFound(err) {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(source) > maxDiagramSourceBytes {
+		return nil, fmt.Errorf("diagram source too large (%d bytes)", len(source))
+	}
+
+	var labels []string
+	if gliffy {
+		labels, err = gliffyLabels(source)
+	} else {
+		labels, err = drawioLabels(source)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Keep the first occurrence of each label, in diagram order
+	seen := make(map[string]bool)
+	var unique []string
+	for _, label := range labels {
+		label = strings.TrimSpace(diagramSpaceRegex.ReplaceAllString(html.UnescapeString(diagramTagRegex.ReplaceAllString(label, " ")), " "))
+		if label != "" && !seen[label] {
+			seen[label] = true
+			unique = append(unique, label)
+		}
+		if len(unique) >= maxDiagramLabels {
+			break
+		}
+	}
+	return unique, nil
+}
+
+// drawioLabels extracts cell labels from a draw.io file. Each <diagram> holds
+// either a plain mxGraphModel or one that is deflated, base64 encoded and URL escaped.
+func drawioLabels(source []byte) ([]string, error) {
+	models := []string{string(source)}
+	if diagrams := drawioDiagramRegex.FindAllStringSubmatch(string(source), -1); len(diagrams) > 0 {
+		models = nil
+		for _, diagram := range diagrams {
+			content := strings.TrimSpace(diagram[1])
+			if strings.HasPrefix(content, "<") {
+				models = append(models, content)
+				continue
+			}
+			decoded, err := inflateDrawio(content)
+			if err != nil {
+				return nil, err
+			}
+			models = append(models, decoded)
+		}
+	}
+
+	var labels []string
+	for _, model := range models {
+		for _, match := range drawioValueRegex.FindAllStringSubmatch(model, -1) {
+			labels = append(labels, html.UnescapeString(match[1]))
+		}
+	}
+	return labels, nil
+}
+
+func inflateDrawio(content string) (string, error) {
+	compressed, err := base64.StdEncoding.DecodeString(content)
+	if err != nil {
+		return "", fmt.Errorf("decoding draw.io diagram: %w", err)
+	}
+	inflated, err := io.ReadAll(flate.NewReader(bytes.NewReader(compressed)))
+	if err != nil {
+		return "", fmt.Errorf("inflating draw.io diagram: %w", err)
+	}
+	model, err := url.QueryUnescape(string(inflated))
+	if err != nil {
+		return "", fmt.Errorf("unescaping draw.io diagram: %w", err)
+	}
+	return model, nil
+}
+
+// gliffyLabels collects the HTML text of every shape in a Gliffy JSON document
+func gliffyLabels(source []byte) ([]string, error) {
+	var document interface{}
+	if err := json.Unmarshal(source, &document); err != nil {
+		// Very old Gliffy diagrams are XML; fall back to their text content
+		var labels []string
+		decoder := xml.NewDecoder(bytes.NewReader(source))
+		for {
+			token, err := decoder.Token()
+			if err != nil {
+				break
+			}
+			if text, ok := token.(xml.CharData); ok {
+				labels = append(labels, string(text))
+			}
+		}
+		return labels, nil
+	}
+
+	var labels []string
+	var walk func(value interface{})
+	walk = func(value interface{}) {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			if text, ok := v["html"].(string); ok {
+				labels = append(labels, text)
+			}
+			// Visit keys in a fixed order, shapes before their children, so
+			// labels come out the same on every run
+			keys := make([]string, 0, len(v))
+			for key := range v {
+				keys = append(keys, key)
+			}
+			sort.Slice(keys, func(i, j int) bool {
+				if (keys[i] == "children") != (keys[j] == "children") {
+					return keys[j] == "children"
+				}
+				return keys[i] < keys[j]
+			})
+			for _, key := range keys {
+				walk(v[key])
+			}
+		case []interface{}:
+			for _, child := range v {
+				walk(child)
+			}
+		}
+	}
+	walk(document)
+	return labels, nil
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// itemStateFile is the file in cache_dir holding a fingerprint of every item
+// the last run emitted, which the next run's diff report compares against
+const itemStateFile = "item_state.json"
+
+// itemFingerprint is what the diff report remembers about an item
+type itemFingerprint struct {
+	Title  string `json:"title"`
+	URL    string `json:"url,omitempty"`
+	Hash   string `json:"hash"`              // Of title, labels and content
+	PageID string `json:"page_id,omitempty"` // Page of a page_version item
+}
+
+// diffEntry is an item listed in the diff report
+type diffEntry struct {
+	ID    string `json:"id"`
+	Title string `json:"title"`
+	URL   string `json:"url,omitempty"`
+}
+
+// diffReport lists how this run's items differ from the previous run's
+type diffReport struct {
+	GeneratedAt string      `json:"generated_at"`
+	Added       []diffEntry `json:"added"`
+	Changed     []diffEntry `json:"changed"`
+	Removed     []diffEntry `json:"removed"`
+	// Removals can only be told apart from pages this run never reached when
+	// it processed every listed page
+	RemovalsChecked bool `json:"removals_checked"`
+}
+
+// diffSink fingerprints every item on its way to the wrapped sink
+type diffSink struct {
+	itemSink
+	config *Config
+	seen   map[string]itemFingerprint
+}
+
+// validateDiffReport checks the diff_report option
+func validateDiffReport(config *Config) error {
+	if config.DiffReport != "" && config.CacheDir == "" {
+		return fmt.Errorf("diff_report needs cache_dir to keep the previous run's items")
+	}
+	return nil
+}
+
+// newDiffSink wraps the sink when diff_report is set, or returns nil
+func newDiffSink(config *Config, sink itemSink) *diffSink {
+	if config.DiffReport == "" {
+		return nil
+	}
+	return &diffSink{itemSink: sink, config: config, seen: map[string]itemFingerprint{}}
+}
+
+func (s *diffSink) Write(item *ProcessedItem) error {
+	if item.Action == actionDeleted {
+		return s.itemSink.Write(item)
+	}
+	hash := sha256.Sum256([]byte(item.Title + "\x00" + item.Labels + "\x00" + item.Content))
+	s.seen[item.ID] = itemFingerprint{Title: item.Title, URL: itemURL(s.config, item), Hash: hex.EncodeToString(hash[:16]), PageID: firstNonEmpty(item.PageID, item.ParentPageID)}
+	return s.itemSink.Write(item)
+}
+
+// finish compares the items seen against the previous run's, writes the
+// report to diff_report and saves this run's items for the next one. complete
+// is false when the run didn't process every listed page; previous items it
+// didn't see are then kept instead of being reported removed. Items of pages
+// that failed, and with state_file those of pages that emitted nothing as
+// they didn't change, are always kept.
+func (s *diffSink) finish(complete bool) error {
+	if s == nil {
+		return nil
+	}
+	statePath := filepath.Join(s.config.CacheDir, itemStateFile)
+	previous := map[string]itemFingerprint{}
+	if data, err := os.ReadFile(statePath); err == nil {
+		if err := json.Unmarshal(data, &previous); err != nil {
+			return fmt.Errorf("parsing %s: %w", itemStateFile, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("reading %s: %w", itemStateFile, err)
+	}
+
+	failed := s.config.Failures.pageIDs()
+	unchanged := s.config.Sync.itemIDs()
+	report := diffReport{
+		GeneratedAt:     time.Now().UTC().Format(time.RFC3339),
+		Added:           []diffEntry{},
+		Changed:         []diffEntry{},
+		Removed:         []diffEntry{},
+		RemovalsChecked: complete,
+	}
+	state := make(map[string]itemFingerprint, len(s.seen))
+	for id, current := range s.seen {
+		state[id] = current
+		old, existed := previous[id]
+		switch {
+		case !existed:
+			report.Added = append(report.Added, diffEntry{ID: id, Title: current.Title, URL: current.URL})
+		case old.Hash != current.Hash:
+			report.Changed = append(report.Changed, diffEntry{ID: id, Title: current.Title, URL: current.URL})
+		}
+	}
+	for id, old := range previous {
+		if _, ok := s.seen[id]; ok {
+			continue
+		}
+		if !complete || failed[id] || failed[old.PageID] || unchanged[id] {
+			state[id] = old
+			continue
+		}
+		report.Removed = append(report.Removed, diffEntry{ID: id, Title: old.Title, URL: old.URL})
+	}
+	for _, entries := range [][]diffEntry{report.Added, report.Changed, report.Removed} {
+		sort.Slice(entries, func(i, j int) bool { return entries[i].ID < entries[j].ID })
+	}
+
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encoding diff report: %w", err)
+	}
+	if err := os.WriteFile(s.config.DiffReport, data, 0o644); err != nil {
+		return fmt.Errorf("writing diff_report: %w", err)
+	}
+	fmt.Fprintf(os.Stderr, "DEBUG: Diff against the previous run: %d added, %d changed, %d removed\n", len(report.Added), len(report.Changed), len(report.Removed))
+
+	data, err = json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("encoding %s: %w", itemStateFile, err)
+	}
+	if err := os.WriteFile(statePath+".tmp", data, 0o644); err != nil {
+		return fmt.Errorf("writing %s: %w", itemStateFile, err)
+	}
+	return os.Rename(statePath+".tmp", statePath)
+}
+
+// itemURL links an item to its page in Confluence: the URL it was imported
+// with, or one built from its ID. It returns "" for offline sources.
+func itemURL(config *Config, item *ProcessedItem) string {
+	if item.URL != "" {
+		return item.URL
+	}
+	if isOfflineSource(config) {
+		return ""
+	}
+	baseURL := strings.TrimSuffix(firstNonEmpty(config.SiteURL, config.ConfluenceURL), "/")
+	switch item.Type {
+	case "page_version":
+		return fmt.Sprintf("%s/pages/viewpage.action?pageId=%s&pageVersion=%d", baseURL, url.QueryEscape(item.PageID), item.Version)
+	case "space_overview":
+		return fmt.Sprintf("%s/spaces/%s/overview", baseURL, url.PathEscape(item.SpaceKey))
+	case "template":
+		return ""
+	case "attachment":
+		return item.DownloadURL
+	}
+	return fmt.Sprintf("%s/pages/viewpage.action?pageId=%s", baseURL, url.QueryEscape(item.ID))
+}
@@ -0,0 +1,423 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Files of a queue_dir
+const (
+	queueMetaFile    = "queue.json"    // Written once the listing is queued; its presence means resumable
+	queuePagesFile   = "pages.jsonl"   // Listed pages, one per line
+	queueResultsFile = "results.jsonl" // Items of each finished page, one page per line
+	queueListingFile = "listing.jsonl" // v2 listing batches and the cursor after each, until the listing is queued
+)
+
+// queueMeta describes the import a queue_dir belongs to
+type queueMeta struct {
+	Listing   string   `json:"listing"`    // Fingerprint of the options that shape the listing
+	Pages     int      `json:"pages"`      // Pages queued
+	SpaceKeys []string `json:"space_keys"` // Spaces of the queued pages
+}
+
+// listingBatch is one line of the listing file: pages of a space's v2
+// listing and the cursor continuing it, "" once that listing is done
+type listingBatch struct {
+	Listing     string `json:"listing"` // Fingerprint of the options that shape the listing
+	SpaceKey    string `json:"space_key"`
+	ContentType string `json:"content_type"`
+	Next        string `json:"next"`
+	Pages       []Page `json:"pages"`
+}
+
+// listingProgress is how far a space's v2 listing of a content type got
+type listingProgress struct {
+	pages []Page
+	next  string
+}
+
+// queuedResult is one line of the results file
+type queuedResult struct {
+	PageID string           `json:"page_id"`
+	Items  []*ProcessedItem `json:"items"`
+}
+
+// diskQueue keeps a run's listed pages and the items of its finished pages in
+// queue_dir instead of memory, so imports of hundreds of thousands of pages
+// run in flat memory. A run that crashes or stops early leaves the queue
+// behind; the next run with the same queue_dir skips the listing and the
+// pages already finished, then writes the outputs from every page's items.
+type diskQueue struct {
+	dir         string
+	meta        queueMeta
+	listed      bool            // Resuming a queue whose listing is complete
+	done        map[string]bool // Pages whose items are in the results file
+	results     *os.File
+	writer      *bufio.Writer
+	fingerprint string
+	listing     map[string]*listingProgress // Space key and content type -> listing a crashed run got through
+	listingFile *os.File
+}
+
+// validateQueueDir checks that queue_dir is combined with options it supports
+func validateQueueDir(config *Config) error {
+	if config.QueueDir == "" {
+		return nil
+	}
+	switch {
+	case mergesIntoOutput(config):
+		return fmt.Errorf("queue_dir can't be combined with mode %q", config.Mode)
+	case config.OutputFile == "" && config.Sinks == "":
+		return fmt.Errorf("queue_dir needs output_file or sinks; items returned in the result are held in memory")
+	case config.PreserveOrder == "true":
+		return fmt.Errorf("queue_dir can't be combined with preserve_order")
+	case config.SearchListing == "true" || config.CQL != "":
+		return fmt.Errorf("queue_dir can't be combined with search_listing or cql, whose pages carry their content")
+	}
+	return nil
+}
+
+// listingFingerprint identifies the pages an import lists, so a queue isn't
+// resumed by a different import
+func listingFingerprint(config *Config) string {
+	hash := sha256.Sum256([]byte(strings.Join([]string{
+		firstNonEmpty(config.Source, "confluence"), config.ConfluenceURL, config.ExportPath,
+		strings.Join(parseSpaceKeys(config), ","), config.SpaceCategories, config.IncludeBlogs, config.ModifiedSince,
+		fmt.Sprint(config.MaxPages, config.MockPages, config.MockSeed),
+	}, "\x00")))
+	return hex.EncodeToString(hash[:8])
+}
+
+// openDiskQueue opens queue_dir, resuming the queue it holds when the listing
+// was completed by a previous run. It returns nil without queue_dir.
+func openDiskQueue(config *Config) (*diskQueue, error) {
+	if config.QueueDir == "" {
+		return nil, nil
+	}
+	if err := os.MkdirAll(config.QueueDir, 0o755); err != nil {
+		return nil, fmt.Errorf("creating queue_dir: %w", err)
+	}
+	q := &diskQueue{dir: config.QueueDir, done: map[string]bool{}, fingerprint: listingFingerprint(config), listing: map[string]*listingProgress{}}
+
+	data, err := os.ReadFile(q.path(queueMetaFile))
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		// A listing that never completed is started over, but v2 listings
+		// continue from the last cursor they saved
+		os.Remove(q.path(queuePagesFile))
+		os.Remove(q.path(queueResultsFile))
+		if err := q.openListing(); err != nil {
+			return nil, err
+		}
+		return q, nil
+	case err != nil:
+		return nil, fmt.Errorf("reading %s: %w", queueMetaFile, err)
+	}
+	if err := json.Unmarshal(data, &q.meta); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", queueMetaFile, err)
+	}
+	if q.meta.Listing != listingFingerprint(config) {
+		return nil, fmt.Errorf("queue_dir %s holds the queue of a different import; remove it or use another directory", config.QueueDir)
+	}
+	if err := q.openResults(); err != nil {
+		return nil, err
+	}
+	q.listed = true
+	fmt.Fprintf(os.Stderr, "DEBUG: Resuming the queue in %s: %d of %d pages already done\n", q.dir, len(q.done), q.meta.Pages)
+	return q, nil
+}
+
+func (q *diskQueue) path(name string) string {
+	return filepath.Join(q.dir, name)
+}
+
+// resuming reports whether the run continues a queue listed by an earlier run
+func (q *diskQueue) resuming() bool {
+	return q != nil && q.listed
+}
+
+// spacePages returns a page per space of a resumed queue, for the steps that
+// only need the listing's spaces (fetch_owners)
+func (q *diskQueue) spacePages() []Page {
+	if !q.resuming() {
+		return nil
+	}
+	pages := make([]Page, 0, len(q.meta.SpaceKeys))
+	for _, key := range q.meta.SpaceKeys {
+		pages = append(pages, Page{SpaceKey: key})
+	}
+	return pages
+}
+
+// openResults reads the results file's page IDs, cutting off a last line a
+// crash left half-written, and opens it for appending
+func (q *diskQueue) openResults() error {
+	file, err := os.OpenFile(q.path(queueResultsFile), os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return fmt.Errorf("opening %s: %w", queueResultsFile, err)
+	}
+	reader := bufio.NewReader(file)
+	var valid int64
+	for {
+		line, err := reader.ReadBytes('\n')
+		var result struct {
+			PageID string `json:"page_id"`
+		}
+		if err != nil || json.Unmarshal(line, &result) != nil {
+			break
+		}
+		q.done[result.PageID] = true
+		valid += int64(len(line))
+	}
+	if err := file.Truncate(valid); err != nil {
+		file.Close()
+		return fmt.Errorf("truncating %s: %w", queueResultsFile, err)
+	}
+	if _, err := file.Seek(valid, io.SeekStart); err != nil {
+		file.Close()
+		return err
+	}
+	q.results, q.writer = file, bufio.NewWriter(file)
+	return nil
+}
+
+// openListing reads the v2 listing batches of a run that crashed before
+// queueing its listing, cutting off a last line a crash left half-written,
+// and opens the file for appending. Batches of a different import are dropped.
+func (q *diskQueue) openListing() error {
+	file, err := os.OpenFile(q.path(queueListingFile), os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return fmt.Errorf("opening %s: %w", queueListingFile, err)
+	}
+	reader := bufio.NewReader(file)
+	var valid int64
+	for {
+		line, err := reader.ReadBytes('\n')
+		var batch listingBatch
+		if err != nil || json.Unmarshal(line, &batch) != nil {
+			break
+		}
+		if batch.Listing != q.fingerprint {
+			q.listing = map[string]*listingProgress{}
+			valid = 0
+			break
+		}
+		key := batch.SpaceKey + "\x00" + batch.ContentType
+		if q.listing[key] == nil {
+			q.listing[key] = &listingProgress{}
+		}
+		q.listing[key].pages = append(q.listing[key].pages, batch.Pages...)
+		q.listing[key].next = batch.Next
+		valid += int64(len(line))
+	}
+	if err := file.Truncate(valid); err != nil {
+		file.Close()
+		return fmt.Errorf("truncating %s: %w", queueListingFile, err)
+	}
+	if _, err := file.Seek(valid, io.SeekStart); err != nil {
+		file.Close()
+		return err
+	}
+	q.listingFile = file
+	return nil
+}
+
+// resumeListing returns the pages a crashed run listed of a space's content
+// type and the cursor to continue from, "" when that listing was done
+func (q *diskQueue) resumeListing(spaceKey, contentType string) ([]Page, string, bool) {
+	if q == nil {
+		return nil, "", false
+	}
+	progress, ok := q.listing[spaceKey+"\x00"+contentType]
+	if !ok {
+		return nil, "", false
+	}
+	return progress.pages, progress.next, true
+}
+
+// recordListing saves a batch of a space's v2 listing with the cursor after
+// it, so a run that crashes before queueing the listing continues from there
+func (q *diskQueue) recordListing(spaceKey, contentType, next string, pages []Page) error {
+	if q == nil || q.listingFile == nil {
+		return nil
+	}
+	line, err := json.Marshal(listingBatch{Listing: q.fingerprint, SpaceKey: spaceKey, ContentType: contentType, Next: next, Pages: pages})
+	if err != nil {
+		return err
+	}
+	if _, err := q.listingFile.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("writing %s: %w", queueListingFile, err)
+	}
+	return nil
+}
+
+// enqueue writes the listed pages to queue_dir. Once it returns, a later run
+// can resume the queue instead of listing again.
+func (q *diskQueue) enqueue(config *Config, pages []Page) error {
+	file, err := os.Create(q.path(queuePagesFile))
+	if err != nil {
+		return fmt.Errorf("creating %s: %w", queuePagesFile, err)
+	}
+	writer := bufio.NewWriter(file)
+	encoder := json.NewEncoder(writer)
+	spaces := map[string]bool{}
+	for _, page := range pages {
+		if err := encoder.Encode(page); err != nil {
+			file.Close()
+			return fmt.Errorf("writing %s: %w", queuePagesFile, err)
+		}
+		spaces[page.SpaceKey] = true
+	}
+	if err := writer.Flush(); err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("writing %s: %w", queuePagesFile, err)
+	}
+
+	q.meta = queueMeta{Listing: listingFingerprint(config), Pages: len(pages)}
+	for key := range spaces {
+		q.meta.SpaceKeys = append(q.meta.SpaceKeys, key)
+	}
+	sort.Strings(q.meta.SpaceKeys)
+	if err := q.openResults(); err != nil {
+		return err
+	}
+	data, _ := json.Marshal(q.meta)
+	if err := os.WriteFile(q.path(queueMetaFile)+".tmp", data, 0o644); err != nil {
+		return fmt.Errorf("writing %s: %w", queueMetaFile, err)
+	}
+	if err := os.Rename(q.path(queueMetaFile)+".tmp", q.path(queueMetaFile)); err != nil {
+		return fmt.Errorf("writing %s: %w", queueMetaFile, err)
+	}
+	// The queued pages supersede the listing batches
+	if q.listingFile != nil {
+		q.listingFile.Close()
+		q.listingFile = nil
+		os.Remove(q.path(queueListingFile))
+	}
+	fmt.Fprintf(os.Stderr, "DEBUG: Queued %d pages in %s\n", len(pages), q.dir)
+	return nil
+}
+
+// feed hands the queued pages that aren't done yet to the workers, reading
+// them from disk a label batch at a time
+func (q *diskQueue) feed(config *Config, pages chan<- Page) error {
+	file, err := os.Open(q.path(queuePagesFile))
+	if err != nil {
+		return fmt.Errorf("opening %s: %w", queuePagesFile, err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16<<20)
+	sequence := 0
+	batch := make([]Page, 0, labelBatchSize)
+	send := func() bool {
+		config.Labels.fetch(config, batch)
+		for _, page := range batch {
+			if _, stopped := config.Memory.Stopped(); stopped {
+				return false
+			}
+			pages <- page
+		}
+		batch = batch[:0]
+		return true
+	}
+	for scanner.Scan() {
+		var page Page
+		if err := json.Unmarshal(scanner.Bytes(), &page); err != nil {
+			return fmt.Errorf("parsing %s: %w", queuePagesFile, err)
+		}
+		page.Sequence = sequence
+		sequence++
+		if q.done[page.ID] {
+			continue
+		}
+		if batch = append(batch, page); len(batch) == labelBatchSize && !send() {
+			return nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("reading %s: %w", queuePagesFile, err)
+	}
+	send()
+	return nil
+}
+
+// record appends a finished page's items to the results file. Failed pages
+// aren't recorded, so a resumed run tries them again.
+func (q *diskQueue) record(result *pageResult) error {
+	if result.failed {
+		return nil
+	}
+	data, err := json.Marshal(queuedResult{PageID: result.pageID, Items: result.items})
+	if err != nil {
+		return err
+	}
+	q.writer.Write(data)
+	q.writer.WriteByte('\n')
+	// A line reaches the file whole, so a crash loses at most the pages in flight
+	if err := q.writer.Flush(); err != nil {
+		return fmt.Errorf("writing %s: %w", queueResultsFile, err)
+	}
+	q.done[result.pageID] = true
+	return nil
+}
+
+// replay writes the items of every finished page, this run's and earlier
+// runs', to the sink
+func (q *diskQueue) replay(sink itemSink) error {
+	if _, err := q.results.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	reader := bufio.NewReader(q.results)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) && len(line) == 0 {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("reading %s: %w", queueResultsFile, err)
+		}
+		var result queuedResult
+		if err := json.Unmarshal(line, &result); err != nil {
+			return fmt.Errorf("parsing %s: %w", queueResultsFile, err)
+		}
+		for _, item := range result.Items {
+			if err := sink.Write(item); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// finish removes the queue after a complete run, or keeps it for the next
+// run to resume
+func (q *diskQueue) finish(complete bool) {
+	if q == nil {
+		return
+	}
+	q.results.Close()
+	if !complete {
+		fmt.Fprintf(os.Stderr, "DEBUG: Keeping the queue in %s for the next run to resume\n", q.dir)
+		return
+	}
+	for _, name := range []string{queueMetaFile, queuePagesFile, queueResultsFile} {
+		if err := os.Remove(q.path(name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			fmt.Fprintf(os.Stderr, "DEBUG: Failed to remove %s from queue_dir: %v\n", name, err)
+		}
+	}
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// Output encryption methods
+const (
+	encryptionAESGCM = "aes-gcm"
+	encryptionAge    = "age"
+)
+
+// modeDecrypt decrypts an aes-gcm encrypted file into output_file
+const modeDecrypt = "decrypt"
+
+// The aes-gcm format: aesGCMMagic, a random nonce prefix, then the plaintext
+// sealed in aesGCMChunkSize chunks. Each chunk's nonce is the prefix, a chunk
+// counter and a final-chunk flag, so chunks can't be reordered, and a file
+// cut short at a chunk boundary fails to decrypt instead of looking complete.
+const (
+	aesGCMMagic       = "CFAESGCM1"
+	aesGCMChunkSize   = 64 * 1024
+	aesGCMNoncePrefix = 7
+)
+
+// validateEncryption checks the encryption options
+func validateEncryption(config *Config) error {
+	switch config.Encryption {
+	case "":
+		if config.Mode == modeDecrypt {
+			return fmt.Errorf("mode %q needs encryption %q and its encryption_key", modeDecrypt, encryptionAESGCM)
+		}
+		return nil
+	case encryptionAESGCM:
+		if _, err := encryptionKey(config); err != nil {
+			return err
+		}
+		if config.Mode == modeDecrypt && (config.EncryptedFile == "" || config.OutputFile == "") {
+			return fmt.Errorf("mode %q needs encrypted_file and output_file", modeDecrypt)
+		}
+	case encryptionAge:
+		if config.AgeRecipients == "" {
+			return fmt.Errorf("encryption %q needs age_recipients", encryptionAge)
+		}
+		if _, err := exec.LookPath("age"); err != nil {
+			return fmt.Errorf("encryption %q needs the age binary in PATH", encryptionAge)
+		}
+		if config.Mode == modeDecrypt {
+			return fmt.Errorf("decrypt age files with age -d")
+		}
+		// Only the recipients' identities can read an age file back
+		if mergesIntoOutput(config) {
+			return fmt.Errorf("encryption %q can't be combined with mode %q, which reads the previous output", encryptionAge, config.Mode)
+		}
+	default:
+		return fmt.Errorf("unknown encryption %q (expected %q or %q)", config.Encryption, encryptionAESGCM, encryptionAge)
+	}
+	return nil
+}
+
+// encryptionKey decodes encryption_key, a base64-encoded 32-byte AES-256 key
+func encryptionKey(config *Config) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(config.EncryptionKey))
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("encryption_key must be 32 bytes, base64-encoded (e.g. openssl rand -base64 32)")
+	}
+	return key, nil
+}
+
+// encryptOutput wraps a newly created output file so everything written to it
+// is encrypted, or returns the file itself when encryption is off
+func encryptOutput(config *Config, file *os.File) (io.WriteCloser, error) {
+	switch config.Encryption {
+	case encryptionAESGCM:
+		return newGCMWriter(config, file)
+	case encryptionAge:
+		return newAgeWriter(config, file)
+	}
+	return file, nil
+}
+
+// gcmWriter seals its input in chunks as described at aesGCMMagic
+type gcmWriter struct {
+	out     io.WriteCloser
+	aead    cipher.AEAD
+	prefix  [aesGCMNoncePrefix]byte
+	counter uint32
+	buf     []byte
+}
+
+func newGCMWriter(config *Config, out io.WriteCloser) (*gcmWriter, error) {
+	aead, err := newGCM(config)
+	if err != nil {
+		return nil, err
+	}
+	w := &gcmWriter{out: out, aead: aead}
+	if _, err := rand.Read(w.prefix[:]); err != nil {
+		return nil, err
+	}
+	if _, err := out.Write(append([]byte(aesGCMMagic), w.prefix[:]...)); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func newGCM(config *Config) (cipher.AEAD, error) {
+	key, err := encryptionKey(config)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func gcmNonce(prefix [aesGCMNoncePrefix]byte, counter uint32, final bool) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, prefix[:])
+	binary.BigEndian.PutUint32(nonce[aesGCMNoncePrefix:], counter)
+	if final {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+func (w *gcmWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	// Hold back a full chunk so Close always has a final chunk to seal
+	for len(w.buf) > aesGCMChunkSize {
+		if err := w.seal(w.buf[:aesGCMChunkSize], false); err != nil {
+			return 0, err
+		}
+		w.buf = w.buf[aesGCMChunkSize:]
+	}
+	return len(p), nil
+}
+
+func (w *gcmWriter) seal(chunk []byte, final bool) error {
+	if w.counter == ^uint32(0) {
+		return fmt.Errorf("output too large to encrypt")
+	}
+	sealed := w.aead.Seal(nil, gcmNonce(w.prefix, w.counter, final), chunk, nil)
+	w.counter++
+	_, err := w.out.Write(sealed)
+	return err
+}
+
+func (w *gcmWriter) Close() error {
+	sealErr := w.seal(w.buf, true)
+	closeErr := w.out.Close()
+	if sealErr != nil {
+		return sealErr
+	}
+	return closeErr
+}
+
+// decryptFile decrypts an aes-gcm encrypted file written by this tool
+func decryptFile(config *Config, inputPath, outputPath string) error {
+	input, err := os.Open(inputPath)
+	if err != nil {
+		return err
+	}
+	defer input.Close()
+
+	output, err := os.Create(outputPath)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(output)
+	if err := decryptGCM(config, input, inputPath, writer); err != nil {
+		output.Close()
+		return err
+	}
+	if err := writer.Flush(); err != nil {
+		output.Close()
+		return err
+	}
+	return output.Close()
+}
+
+// decryptOutput opens a previous output file for reading, decrypting it as it's
+// read when encryption is aes-gcm. A file that fails to decrypt fails the read.
+func decryptOutput(config *Config, path string) (io.ReadCloser, error) {
+	input, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if config.Encryption != encryptionAESGCM {
+		return input, nil
+	}
+	reader, writer := io.Pipe()
+	go func() {
+		err := decryptGCM(config, input, path, writer)
+		input.Close()
+		writer.CloseWithError(err)
+	}()
+	return reader, nil
+}
+
+// decryptGCM writes the plaintext of the aes-gcm encrypted input named name to w
+func decryptGCM(config *Config, input io.Reader, name string, w io.Writer) error {
+	aead, err := newGCM(config)
+	if err != nil {
+		return err
+	}
+	reader := bufio.NewReader(input)
+
+	header := make([]byte, len(aesGCMMagic)+aesGCMNoncePrefix)
+	if _, err := io.ReadFull(reader, header); err != nil || string(header[:len(aesGCMMagic)]) != aesGCMMagic {
+		return fmt.Errorf("%s is not an aes-gcm encrypted output", name)
+	}
+	var prefix [aesGCMNoncePrefix]byte
+	copy(prefix[:], header[len(aesGCMMagic):])
+
+	chunk := make([]byte, aesGCMChunkSize+aead.Overhead())
+	for counter := uint32(0); ; counter++ {
+		n, err := io.ReadFull(reader, chunk)
+		if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+			return fmt.Errorf("%s is truncated", name)
+		}
+		_, peekErr := reader.Peek(1)
+		final := peekErr == io.EOF
+		plain, err := aead.Open(nil, gcmNonce(prefix, counter, final), chunk[:n], nil)
+		if err != nil {
+			return fmt.Errorf("decrypting %s: wrong key, or the file was modified or truncated", name)
+		}
+		if _, err := w.Write(plain); err != nil {
+			return err
+		}
+		if final {
+			return nil
+		}
+	}
+}
+
+// ageWriter pipes its input through the age binary into the output file
+type ageWriter struct {
+	stdin io.WriteCloser
+	cmd   *exec.Cmd
+	out   *os.File
+}
+
+func newAgeWriter(config *Config, out *os.File) (*ageWriter, error) {
+	var args []string
+	for _, recipient := range strings.Split(config.AgeRecipients, ",") {
+		if recipient = strings.TrimSpace(recipient); recipient != "" {
+			args = append(args, "-r", recipient)
+		}
+	}
+	cmd := exec.Command("age", args...)
+	cmd.Stdout = out
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("starting age: %w", err)
+	}
+	return &ageWriter{stdin: stdin, cmd: cmd, out: out}, nil
+}
+
+func (w *ageWriter) Write(p []byte) (int, error) { return w.stdin.Write(p) }
+
+func (w *ageWriter) Close() error {
+	stdinErr := w.stdin.Close()
+	waitErr := w.cmd.Wait()
+	closeErr := w.out.Close()
+	for _, err := range []error{waitErr, stdinErr, closeErr} {
+		if err != nil {
+			return fmt.Errorf("age: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// exportDateLayout is how entities.xml writes dates, in the instance's zone
+const exportDateLayout = "2006-01-02 15:04:05.000"
+
+// exportSource reads a Confluence space export (the XML zip produced by Space
+// tools > Export, or its unpacked directory) so air-gapped instances can be
+// imported without any API access
+type exportSource struct {
+	once    sync.Once
+	pages   map[string]*exportPage
+	loadErr error
+}
+
+// exportPage is a current page or blog post reassembled from entities.xml
+type exportPage struct {
+	ID       string
+	Title    string
+	Type     string
+	SpaceKey string
+	Body     string
+	Labels   []string
+	Modified string // RFC 3339
+}
+
+// exportObject is one <object> element of entities.xml
+type exportObject struct {
+	Class       string             `xml:"class,attr"`
+	ID          string             `xml:"id"`
+	Properties  []exportProperty   `xml:"property"`
+	Collections []exportCollection `xml:"collection"`
+}
+
+// exportProperty is either a scalar value or a reference to another object by ID
+type exportProperty struct {
+	Name  string `xml:"name,attr"`
+	Class string `xml:"class,attr"`
+	ID    string `xml:"id"`
+	Value string `xml:",chardata"`
+}
+
+type exportCollection struct {
+	Name     string `xml:"name,attr"`
+	Elements []struct {
+		ID string `xml:"id"`
+	} `xml:"element"`
+}
+
+func (o *exportObject) property(name string) exportProperty {
+	for _, p := range o.Properties {
+		if p.Name == name {
+			return p
+		}
+	}
+	return exportProperty{}
+}
+
+func (o *exportObject) value(name string) string {
+	return strings.TrimSpace(o.property(name).Value)
+}
+
+func (o *exportObject) reference(name string) string {
+	return strings.TrimSpace(o.property(name).ID)
+}
+
+func (e *exportSource) TestConnection(config *Config) error {
+	if config.ExportPath == "" {
+		return fmt.Errorf("export_path is required for the export source")
+	}
+	if _, err := os.Stat(config.ExportPath); err != nil {
+		return fmt.Errorf("export not readable: %w", err)
+	}
+	return nil
+}
+
+// load parses the export the first time it's needed: by the listing, or by
+// the first page fetched when a retry_failed run or a queue_dir resume skips
+// the listing
+func (e *exportSource) load(config *Config) error {
+	e.once.Do(func() {
+		entities, closeEntities, err := openExportEntities(config.ExportPath)
+		if err != nil {
+			e.loadErr = err
+			return
+		}
+		defer closeEntities()
+		if e.pages, err = parseExportEntities(entities); err != nil {
+			e.loadErr = fmt.Errorf("parsing entities.xml: %w", err)
+		}
+	})
+	return e.loadErr
+}
+
+func (e *exportSource) ListPages(config *Config) ([]Page, error) {
+	if err := e.load(config); err != nil {
+		return nil, err
+	}
+
+	wanted := make(map[string]bool)
+	for _, key := range parseSpaceKeys(config) {
+		wanted[key] = true
+	}
+
+	var pages []Page
+	for _, page := range e.pages {
+		if (len(wanted) > 0 && !wanted[page.SpaceKey]) || spaceExcluded(config, page.SpaceKey) {
+			continue
+		}
+		if page.Type == "blogpost" && config.IncludeBlogs != "true" {
+			continue
+		}
+		listed := Page{ID: page.ID, Title: page.Title, Type: page.Type, SpaceKey: page.SpaceKey}
+		if page.Modified != "" {
+			listed.Version = &listedVersion{When: page.Modified}
+		}
+		if stale(config, listed) {
+			continue
+		}
+		pages = append(pages, listed)
+	}
+
+	// Deterministic order: by space, then title
+	sort.Slice(pages, func(i, j int) bool {
+		if pages[i].SpaceKey != pages[j].SpaceKey {
+			return pages[i].SpaceKey < pages[j].SpaceKey
+		}
+		return pages[i].Title < pages[j].Title
+	})
+
+	if config.MaxPages > 0 && len(pages) > config.MaxPages {
+		fmt.Fprintf(os.Stderr, "DEBUG: Limiting export to %d of %d pages\n", config.MaxPages, len(pages))
+		pages = pages[:config.MaxPages]
+	}
+
+	fmt.Fprintf(os.Stderr, "DEBUG: Export %s contains %d importable pages\n", config.ExportPath, len(pages))
+	return pages, nil
+}
+
+func (e *exportSource) FetchContent(_ context.Context, config *Config, page Page) (*ContentResponse, error) {
+	if err := e.load(config); err != nil {
+		return nil, err
+	}
+	exported, ok := e.pages[page.ID]
+	if !ok {
+		return nil, fmt.Errorf("page %s not in export", page.ID)
+	}
+
+	response := &ContentResponse{ID: exported.ID, Title: exported.Title}
+	response.Body.Storage.Value = exported.Body
+	response.Version.When = exported.Modified
+	for _, label := range exported.Labels {
+		response.Metadata.Labels.Results = append(response.Metadata.Labels.Results, struct {
+			Name string `json:"name"`
+		}{Name: label})
+	}
+	return response, nil
+}
+
+// openExportEntities opens entities.xml from an export zip or an unpacked export directory
+func openExportEntities(path string) (io.Reader, func(), error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if info.IsDir() {
+		file, err := os.Open(filepath.Join(path, "entities.xml"))
+		if err != nil {
+			return nil, nil, err
+		}
+		return file, func() { file.Close() }, nil
+	}
+
+	archive, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("opening export zip: %w", err)
+	}
+	for _, f := range archive.File {
+		if f.Name == "entities.xml" {
+			entities, err := f.Open()
+			if err != nil {
+				archive.Close()
+				return nil, nil, err
+			}
+			return entities, func() { entities.Close(); archive.Close() }, nil
+		}
+	}
+	archive.Close()
+	return nil, nil, fmt.Errorf("entities.xml not found in %s", path)
+}
+
+// parseExportEntities streams entities.xml and joins spaces, pages, bodies and
+// labels. Historical versions, drafts and trashed content are skipped.
+func parseExportEntities(r io.Reader) (map[string]*exportPage, error) {
+	spaceKeys := make(map[string]string)    // space ID -> key
+	pageSpaces := make(map[string]string)   // page ID -> space ID
+	bodies := make(map[string]string)       // content ID -> storage body
+	labelNames := make(map[string]string)   // label ID -> name
+	labellings := make(map[string][]string) // content ID -> label IDs
+	pages := make(map[string]*exportPage)
+
+	decoder := xml.NewDecoder(r)
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		start, ok := token.(xml.StartElement)
+		if !ok || start.Name.Local != "object" {
+			continue
+		}
+
+		var object exportObject
+		if err := decoder.DecodeElement(&object, &start); err != nil {
+			return nil, err
+		}
+
+		switch object.Class {
+		case "Space":
+			spaceKeys[object.ID] = object.value("key")
+		case "Page", "BlogPost":
+			// Old versions point at their current version; only the current one is imported
+			if object.reference("originalVersion") != "" {
+				continue
+			}
+			if status := object.value("contentStatus"); status != "" && status != "current" {
+				continue
+			}
+			pageType := "page"
+			if object.Class == "BlogPost" {
+				pageType = "blogpost"
+			}
+			pages[object.ID] = &exportPage{ID: object.ID, Title: object.value("title"), Type: pageType}
+			if modified, err := time.Parse(exportDateLayout, object.value("lastModificationDate")); err == nil {
+				pages[object.ID].Modified = modified.Format(time.RFC3339)
+			}
+			pageSpaces[object.ID] = object.reference("space")
+		case "BodyContent":
+			// bodyType 2 is storage format; legacy wiki markup bodies are not convertible
+			if bodyType := object.value("bodyType"); bodyType == "" || bodyType == "2" {
+				bodies[object.reference("content")] = object.value("body")
+			}
+		case "Label":
+			labelNames[object.ID] = object.value("name")
+		case "Labelling":
+			content := object.reference("content")
+			labellings[content] = append(labellings[content], object.reference("label"))
+		}
+	}
+
+	for id, page := range pages {
+		page.SpaceKey = spaceKeys[pageSpaces[id]]
+		page.Body = bodies[id]
+		for _, labelID := range labellings[id] {
+			if name := labelNames[labelID]; name != "" {
+				page.Labels = append(page.Labels, name)
+			}
+		}
+	}
+	return pages, nil
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// PageFailure is a page that should have been imported but wasn't
+type PageFailure struct {
+	ID       string `json:"id"`
+	Title    string `json:"title"`
+	SpaceKey string `json:"space_key"`
+	Type     string `json:"type,omitempty"` // Listing type, e.g. blogpost, needed to retry the page
+	Error    string `json:"error"`
+}
+
+// failureReport collects page failures from all workers. A nil report
+// records nothing.
+type failureReport struct {
+	mu       sync.Mutex
+	failures []PageFailure
+}
+
+func (r *failureReport) add(page Page, err error) {
+	if r == nil {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "DEBUG: Page %s from space %s failed: %v\n", page.Title, page.SpaceKey, err)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.failures = append(r.failures, PageFailure{ID: page.ID, Title: page.Title, SpaceKey: page.SpaceKey, Type: page.Type, Error: err.Error()})
+}
+
+// String returns the failures as a JSON array for the failed_pages field,
+// empty when every page went through
+func (r *failureReport) String() string {
+	if r == nil {
+		return ""
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.failures) == 0 {
+		return ""
+	}
+	data, err := json.Marshal(r.failures)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+// pageIDs returns the IDs of the pages that failed
+func (r *failureReport) pageIDs() map[string]bool {
+	ids := map[string]bool{}
+	if r == nil {
+		return ids
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, failure := range r.failures {
+		ids[failure.ID] = true
+	}
+	return ids
+}
+
+// validatePageTimeout checks the page_timeout_seconds option
+func validatePageTimeout(config *Config) error {
+	if config.PageTimeoutSeconds < 0 {
+		return fmt.Errorf("page_timeout_seconds must not be negative")
+	}
+	return nil
+}
+
+// processPageWithTimeout runs processPage with page_timeout_seconds as its
+// deadline, so one pathological page can't hold a worker for the rest of the
+// run. The deadline cancels the abandoned page's requests and external tools,
+// so its goroutine winds down instead of running on in the background.
+func processPageWithTimeout(config *Config, source Source, converter *HTMLConverter, page Page) ([]*ProcessedItem, error) {
+	if config.PageTimeoutSeconds <= 0 {
+		return processPage(context.Background(), config, source, converter, page)
+	}
+
+	type outcome struct {
+		items []*ProcessedItem
+		err   error
+	}
+	timeout := time.Duration(config.PageTimeoutSeconds) * time.Second
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	done := make(chan outcome, 1)
+	go func() {
+		items, err := processPage(ctx, config, source, converter, page)
+		done <- outcome{items: items, err: err}
+	}()
+
+	select {
+	case result := <-done:
+		// Failures past the deadline are the deadline's doing
+		if result.err == nil || ctx.Err() == nil {
+			return result.items, result.err
+		}
+	case <-ctx.Done():
+	}
+	return nil, fmt.Errorf("processing timed out after %s", timeout)
+}
+
+// modeRetryFailed re-imports only the pages the previous run reported as
+// failed, merging them into its output_file
+const modeRetryFailed = "retry_failed"
+
+// failedPagesFile is the file in cache_dir holding the last run's failures
+const failedPagesFile = "failed_pages.json"
+
+// save records the failures in cache_dir for a later retry_failed run,
+// replacing the previous run's list
+func (r *failureReport) save(config *Config) {
+	if r == nil || config.CacheDir == "" {
+		return
+	}
+	r.mu.Lock()
+	failures := r.failures
+	if failures == nil {
+		failures = []PageFailure{}
+	}
+	data, err := json.MarshalIndent(failures, "", "  ")
+	r.mu.Unlock()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "DEBUG: Failed to encode failed pages: %v\n", err)
+		return
+	}
+	path := filepath.Join(config.CacheDir, failedPagesFile)
+	if err := os.WriteFile(path+".tmp", data, 0o644); err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "DEBUG: Failed to save failed pages: %v\n", err)
+	}
+}
+
+// validateRetryFailed checks that a retry_failed run has the previous run's
+// failure list and output to work from
+func validateRetryFailed(config *Config) error {
+	if config.Mode != modeRetryFailed {
+		return nil
+	}
+	if config.CacheDir == "" || config.OutputFile == "" {
+		return fmt.Errorf("mode %q needs the cache_dir and output_file of the previous run", modeRetryFailed)
+	}
+	if _, err := os.Stat(filepath.Join(config.CacheDir, failedPagesFile)); err != nil {
+		return fmt.Errorf("no %s in cache_dir; run an import with cache_dir first", failedPagesFile)
+	}
+	if _, err := os.Stat(config.OutputFile); err != nil {
+		return fmt.Errorf("output_file of the previous run not found: %w", err)
+	}
+	return nil
+}
+
+// loadFailedPages returns the pages that failed in the previous run
+func loadFailedPages(config *Config) ([]Page, error) {
+	data, err := os.ReadFile(filepath.Join(config.CacheDir, failedPagesFile))
+	if err != nil {
+		return nil, err
+	}
+	var failures []PageFailure
+	if err := json.Unmarshal(data, &failures); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", failedPagesFile, err)
+	}
+	pages := make([]Page, 0, len(failures))
+	for _, failure := range failures {
+		pages = append(pages, Page{ID: failure.ID, Title: failure.Title, Type: failure.Type, SpaceKey: failure.SpaceKey})
+	}
+	fmt.Fprintf(os.Stderr, "DEBUG: Retrying %d pages that failed in the previous run\n", len(pages))
+	return pages, nil
+}
+
+// newRetrySink starts a new output_file from the previous run's items, minus
+// any of the given pages, and appends the pages' new items to it. The
+// previous file is only replaced when the run completes. With aes-gcm
+// encryption the previous file is decrypted and the new one encrypted.
+func newRetrySink(config *Config, pages []Page) (itemSink, error) {
+	retried := make(map[string]bool, len(pages))
+	for _, page := range pages {
+		retried[page.ID] = true
+	}
+
+	previous, err := decryptOutput(config, config.OutputFile)
+	if err != nil {
+		return nil, fmt.Errorf("opening output_file: %w", err)
+	}
+	defer previous.Close()
+
+	sink, err := newFileSink(config, config.OutputFile+".tmp")
+	if err != nil {
+		return nil, fmt.Errorf("creating output_file: %w", err)
+	}
+	sink.finalPath = config.OutputFile
+	discard := func() {
+		sink.file.Close()
+		os.Remove(sink.path)
+	}
+
+	scanner := bufio.NewScanner(previous)
+	scanner.Buffer(make([]byte, 0, 64*1024), 64<<20)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var item struct {
+			SchemaVersion string `json:"schema_version"`
+			ID            string `json:"id"`
+			PageID        string `json:"page_id"`
+			Metadata      struct {
+				Version *versionV2 `json:"version"`
+			} `json:"metadata"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &item); err != nil {
+			// Dropping the line would silently lose its item from the new output
+			discard()
+			return nil, fmt.Errorf("output_file line %d isn't an item: %w", line, err)
+		}
+		// Items written before schema_version existed are v1
+		if item.SchemaVersion == "" {
+			item.SchemaVersion = schemaV1
+		}
+		if item.SchemaVersion != config.SchemaVersion {
+			discard()
+			return nil, fmt.Errorf("output_file has schema_version %s items; retry with the schema_version of the previous run", item.SchemaVersion)
+		}
+		if item.Metadata.Version != nil {
+			item.PageID = item.Metadata.Version.PageID
+		}
+		if retried[item.ID] || retried[item.PageID] {
+			continue
+		}
+		sink.writer.Write(scanner.Bytes())
+		sink.writer.WriteByte('\n')
+		sink.count++
+	}
+	if err := scanner.Err(); err != nil {
+		discard()
+		return nil, fmt.Errorf("reading output_file: %w", err)
+	}
+	fmt.Fprintf(os.Stderr, "DEBUG: Kept %d items from the previous output\n", sink.count)
+	return sink, nil
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Sink kinds accepted by the sinks option
+const (
+	sinkStdout = "stdout"
+	sinkFile   = "file"
+	sinkHTTP   = "http"
+)
+
+// Items posted to an http sink per request, and the time one request may take
+const (
+	httpSinkBatchSize = 100
+	httpSinkTimeout   = 60 * time.Second
+)
+
+// sinkStatus is the outcome of one sink, reported in the sinks field of the Result
+type sinkStatus struct {
+	Sink  string `json:"sink"`
+	Items int    `json:"items"`
+	Error string `json:"error,omitempty"`
+}
+
+// parseSink splits one entry of the sinks option: stdout, file:<path>, or an
+// http(s) URL
+func parseSink(spec string) (kind, target string, ok bool) {
+	switch {
+	case spec == sinkStdout:
+		return sinkStdout, "", true
+	case strings.HasPrefix(spec, "file:") && len(spec) > len("file:"):
+		return sinkFile, strings.TrimPrefix(spec, "file:"), true
+	case strings.HasPrefix(spec, "http://"), strings.HasPrefix(spec, "https://"):
+		return sinkHTTP, spec, true
+	}
+	return "", "", false
+}
+
+// validateSinks checks the sinks option
+func validateSinks(config *Config) error {
+	if config.Sinks == "" {
+		return nil
+	}
+	if config.OutputFile != "" {
+		return fmt.Errorf("sinks replaces output_file; add it as file:%s instead", config.OutputFile)
+	}
+	if mergesIntoOutput(config) {
+		return fmt.Errorf("sinks can't be combined with mode %q, which only merges into output_file", config.Mode)
+	}
+	for _, spec := range strings.Split(config.Sinks, ",") {
+		if _, _, ok := parseSink(strings.TrimSpace(spec)); !ok {
+			return fmt.Errorf("invalid sink %q (expected stdout, file:<path> or an http(s) URL)", spec)
+		}
+	}
+	return nil
+}
+
+// fanoutSink writes every item to several sinks. A sink that fails stops
+// receiving items while the others carry on; the run only fails when none is
+// left.
+type fanoutSink struct {
+	names []string
+	sinks []itemSink
+	errs  []error
+	count int
+}
+
+func newFanoutSink(config *Config) (itemSink, error) {
+	fanout := &fanoutSink{}
+	for _, spec := range strings.Split(config.Sinks, ",") {
+		spec = strings.TrimSpace(spec)
+		kind, target, _ := parseSink(spec)
+		var sink itemSink
+		switch kind {
+		case sinkStdout:
+			sink = &resultSink{schemaVersion: config.SchemaVersion}
+		case sinkFile:
+			file, err := newFileSink(config, target)
+			if err != nil {
+				fanout.Close()
+				return nil, fmt.Errorf("creating sink %s: %w", spec, err)
+			}
+			sink = file
+		case sinkHTTP:
+			sink = &httpSink{url: target, token: config.HTTPSinkToken, schemaVersion: config.SchemaVersion}
+		}
+		fanout.names = append(fanout.names, spec)
+		fanout.sinks = append(fanout.sinks, sink)
+		fanout.errs = append(fanout.errs, nil)
+	}
+	return fanout, nil
+}
+
+func (s *fanoutSink) Write(item *ProcessedItem) error {
+	healthy := false
+	for i, sink := range s.sinks {
+		if s.errs[i] != nil {
+			continue
+		}
+		if s.errs[i] = sink.Write(item); s.errs[i] != nil {
+			fmt.Fprintf(os.Stderr, "DEBUG: Sink %s failed, the other sinks continue: %v\n", s.names[i], s.errs[i])
+			continue
+		}
+		healthy = true
+	}
+	if !healthy {
+		return fmt.Errorf("every sink failed")
+	}
+	s.count++
+	return nil
+}
+
+func (s *fanoutSink) Count() int { return s.count }
+
+// Close closes every sink and reports each one's outcome in the sinks field.
+// The items field comes from the stdout sink, when there is one.
+func (s *fanoutSink) Close() (Result, error) {
+	result := Result{Items: "[]", ItemCount: strconv.Itoa(s.count)}
+	statuses := make([]sinkStatus, len(s.sinks))
+	failed := 0
+	for i, sink := range s.sinks {
+		closed, err := sink.Close()
+		if s.errs[i] == nil {
+			s.errs[i] = err
+		}
+		statuses[i] = sinkStatus{Sink: s.names[i], Items: sink.Count()}
+		if s.errs[i] != nil {
+			statuses[i].Error = s.errs[i].Error()
+			failed++
+			continue
+		}
+		if _, ok := sink.(*resultSink); ok {
+			result.Items = closed.Items
+		}
+	}
+	data, err := json.Marshal(statuses)
+	if err != nil {
+		return Result{}, err
+	}
+	result.Sinks = string(data)
+	if failed == len(s.sinks) && failed > 0 {
+		return Result{}, fmt.Errorf("every sink failed: %s", result.Sinks)
+	}
+	return result, nil
+}
+
+// httpSink posts items to an endpoint, e.g. a vector store's ingestion API or
+// an archive service, as JSON Lines in batches of httpSinkBatchSize
+type httpSink struct {
+	url           string
+	token         string // Sent as a bearer token when set
+	schemaVersion string
+	batch         bytes.Buffer
+	pending       int
+	count         int
+}
+
+func (s *httpSink) Write(item *ProcessedItem) error {
+	line, err := json.Marshal(encodeItem(item, s.schemaVersion))
+	if err != nil {
+		return fmt.Errorf("marshaling item %s: %w", item.ID, err)
+	}
+	s.batch.Write(append(line, '\n'))
+	s.pending++
+	if s.pending >= httpSinkBatchSize {
+		return s.flush()
+	}
+	return nil
+}
+
+func (s *httpSink) Count() int { return s.count }
+
+func (s *httpSink) Close() (Result, error) {
+	if s.pending > 0 {
+		if err := s.flush(); err != nil {
+			return Result{}, err
+		}
+	}
+	return Result{Items: "[]", ItemCount: strconv.Itoa(s.count)}, nil
+}
+
+func (s *httpSink) flush() error {
+	ctx, cancel := context.WithTimeout(context.Background(), httpSinkTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", s.url, bytes.NewReader(s.batch.Bytes()))
+	if err != nil {
+		return fmt.Errorf("creating request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	if s.token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.token)
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("posting to sink: %w", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return &HTTPStatusError{StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+	s.count += s.pending
+	s.pending = 0
+	s.batch.Reset()
+	return nil
+}
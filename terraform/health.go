@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// modeHealth reports on every configured space instead of importing
+const modeHealth = "health"
+
+const (
+	healthStatusHealthy   = "healthy"
+	healthStatusDegraded  = "degraded"
+	healthStatusUnhealthy = "unhealthy"
+)
+
+// HealthReport is the structured output of health mode
+type HealthReport struct {
+	Status        string        `json:"status"` // healthy, degraded (some spaces failing) or unhealthy
+	CheckedAt     string        `json:"checked_at"`
+	ConfluenceURL string        `json:"confluence_url"`
+	Reachable     bool          `json:"reachable"`
+	Error         string        `json:"error,omitempty"`
+	Spaces        []SpaceHealth `json:"spaces"`
+}
+
+// SpaceHealth describes what the configured credential can do in one space
+type SpaceHealth struct {
+	SpaceKey        string `json:"space_key"`
+	SpaceID         string `json:"space_id,omitempty"`
+	Reachable       bool   `json:"reachable"`         // The space lookup returned a response
+	Readable        bool   `json:"readable"`          // Pages in the space can be listed
+	ApproxPageCount int    `json:"approx_page_count"` // -1 when the count could not be determined
+	APIVersion      string `json:"api_version"`       // API version that answered the space lookup
+	LatencyMillis   int64  `json:"latency_ms"`
+	Error           string `json:"error,omitempty"`
+}
+
+// runHealthCheck probes the instance and every configured space without importing anything
+func runHealthCheck(config *Config) *HealthReport {
+	baseURL := strings.TrimSuffix(config.ConfluenceURL, "/")
+	report := &HealthReport{
+		CheckedAt:     time.Now().UTC().Format(time.RFC3339),
+		ConfluenceURL: baseURL,
+		Spaces:        []SpaceHealth{},
+	}
+
+	if _, err := fetchWithPolicy(config, opSpaceLookup, connectionTestURL(config)); err != nil {
+		// Any HTTP response means the instance is up, even if v2 is not available
+		var statusErr *HTTPStatusError
+		report.Reachable = errors.As(err, &statusErr)
+		report.Error = err.Error()
+	} else {
+		report.Reachable = true
+	}
+
+	healthy := 0
+	for _, spaceKey := range parseSpaceKeys(config) {
+		health := checkSpaceHealth(config, baseURL, spaceKey)
+		if health.Readable {
+			healthy++
+		}
+		fmt.Fprintf(os.Stderr, "DEBUG: Health of space %s: reachable=%t readable=%t pages=%d api=%s\n",
+			spaceKey, health.Reachable, health.Readable, health.ApproxPageCount, health.APIVersion)
+		report.Spaces = append(report.Spaces, health)
+	}
+
+	switch {
+	case len(report.Spaces) > 0 && healthy == len(report.Spaces):
+		report.Status = healthStatusHealthy
+	case healthy > 0:
+		report.Status = healthStatusDegraded
+	default:
+		report.Status = healthStatusUnhealthy
+	}
+	return report
+}
+
+func checkSpaceHealth(config *Config, baseURL, spaceKey string) (health SpaceHealth) {
+	start := time.Now()
+	health = SpaceHealth{SpaceKey: spaceKey, ApproxPageCount: -1}
+	defer func() { health.LatencyMillis = time.Since(start).Milliseconds() }()
+
+	// Prefer the v2 space lookup and fall back to v1 for instances without it,
+	// unless the configuration pins one API family
+	var body []byte
+	err := fmt.Errorf("v2 API disabled by api_version")
+	if config.APIVersion != apiVersionV1 {
+		body, err = fetchWithPolicy(config, opSpaceLookup, fmt.Sprintf("%s/api/v2/spaces?keys=%s", baseURL, url.QueryEscape(spaceKey)))
+	}
+	if err == nil {
+		var spaceResponse struct {
+			Results []struct {
+				ID string `json:"id"`
+			} `json:"results"`
+		}
+		if err := json.Unmarshal(body, &spaceResponse); err != nil {
+			health.Reachable = true
+			health.Error = fmt.Sprintf("parsing space response: %v", err)
+			return health
+		}
+		health.Reachable = true
+		health.APIVersion = "v2"
+		if len(spaceResponse.Results) == 0 {
+			health.Error = unknownSpaceError(config, spaceKey).Error()
+			return health
+		}
+		health.SpaceID = spaceResponse.Results[0].ID
+
+		if _, err := fetchWithPolicy(config, opPageListing, fmt.Sprintf("%s/api/v2/spaces/%s/pages?limit=1", baseURL, health.SpaceID)); err != nil {
+			health.Error = fmt.Sprintf("listing pages: %v", err)
+			return health
+		}
+		health.Readable = true
+	} else if config.APIVersion == apiVersionV2 {
+		var statusErr *HTTPStatusError
+		health.Reachable = errors.As(err, &statusErr)
+		health.Error = err.Error()
+		return health
+	} else {
+		body, v1Err := fetchWithPolicy(config, opSpaceLookup, fmt.Sprintf("%s/rest/api/space/%s", baseURL, url.PathEscape(spaceKey)))
+		if v1Err != nil {
+			var statusErr *HTTPStatusError
+			health.Reachable = errors.As(v1Err, &statusErr)
+			if health.Reachable && (statusErr.StatusCode == http.StatusNotFound || statusErr.StatusCode == http.StatusForbidden) {
+				health.Error = "space not found or not visible to this user"
+			} else {
+				health.Error = fmt.Sprintf("v2: %v; v1: %v", err, v1Err)
+			}
+			return health
+		}
+		var space struct {
+			ID json.Number `json:"id"`
+		}
+		health.Reachable = true
+		if err := json.Unmarshal(body, &space); err != nil {
+			health.Error = fmt.Sprintf("parsing space response: %v", err)
+			return health
+		}
+		health.Readable = true
+		health.APIVersion = "v1"
+		health.SpaceID = space.ID.String()
+	}
+
+	// The count comes from v1 search, which api_version v2 rules out
+	if config.APIVersion != apiVersionV2 {
+		health.ApproxPageCount = approximatePageCount(config, baseURL, spaceKey)
+	}
+	return health
+}
+
+// approximatePageCount asks CQL search for the total number of pages in a space
+func approximatePageCount(config *Config, baseURL, spaceKey string) int {
+	cql := fmt.Sprintf(`space = "%s" and type = page`, spaceKey)
+	body, err := fetchWithPolicy(config, opPageListing, fmt.Sprintf("%s/rest/api/content/search?limit=1&cql=%s", baseURL, url.QueryEscape(cql)))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "DEBUG: Page count search failed for space %s: %v\n", spaceKey, err)
+		return -1
+	}
+
+	var searchResponse struct {
+		TotalSize *int `json:"totalSize"`
+	}
+	if err := json.Unmarshal(body, &searchResponse); err != nil {
+		fmt.Fprintf(os.Stderr, "DEBUG: Failed to parse page count search for space %s: %v\n", spaceKey, err)
+		return -1
+	}
+	if searchResponse.TotalSize == nil {
+		return -1
+	}
+	return *searchResponse.TotalSize
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// pageVersion is one entry of a page's version history
+type pageVersion struct {
+	Number  int
+	Message string
+	Author  string
+	When    string
+}
+
+// validateHistory checks the version history options
+func validateHistory(config *Config) error {
+	if config.HistoryVersions < 0 {
+		return fmt.Errorf("history_versions must not be negative")
+	}
+	if config.HistoryVersions > 0 && isOfflineSource(config) {
+		return fmt.Errorf("history_versions needs the confluence source")
+	}
+	return nil
+}
+
+// historySelected reports whether a page's history should be imported: every
+// page when history_pages is empty, otherwise pages listed by ID or title
+func historySelected(config *Config, page Page, title string) bool {
+	if config.HistoryPages == "" {
+		return true
+	}
+	for _, selected := range strings.Split(config.HistoryPages, ",") {
+		selected = strings.TrimSpace(selected)
+		if selected != "" && (selected == page.ID || strings.EqualFold(selected, title)) {
+			return true
+		}
+	}
+	return false
+}
+
+// fetchHistoryItems returns the history_versions versions preceding the current
+// one as page_version items, newest first, each with its change comment
+func fetchHistoryItems(ctx context.Context, config *Config, converter *HTMLConverter, page Page, title string) []*ProcessedItem {
+	versions, err := fetchPageVersions(ctx, config, page)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "DEBUG: Failed to get versions of page %s from space %s: %v\n", title, page.SpaceKey, err)
+		return nil
+	}
+
+	// The newest version is the current page, already imported as its own item
+	sort.Slice(versions, func(i, j int) bool { return versions[i].Number > versions[j].Number })
+	if len(versions) <= 1 {
+		return nil
+	}
+	versions = versions[1:min(len(versions), config.HistoryVersions+1)]
+
+	var items []*ProcessedItem
+	for _, version := range versions {
+		body, err := fetchVersionBody(ctx, config, page, version.Number)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "DEBUG: Failed to get version %d of page %s: %v\n", version.Number, title, err)
+			continue
+		}
+
+		content := converter.htmlToText(body)
+		if len(content) > config.MaxContentLength {
+			content = content[:config.MaxContentLength] + "\n\n[Content truncated due to size limits]"
+		}
+		items = append(items, &ProcessedItem{
+			ID:       fmt.Sprintf("%s-v%d", page.ID, version.Number),
+			Title:    fmt.Sprintf("%s (version %d)", title, version.Number),
+			Content:  content,
+			Type:     "page_version",
+			SpaceKey: page.SpaceKey,
+
+			PageID:         page.ID,
+			Version:        version.Number,
+			VersionComment: version.Message,
+			VersionAuthor:  version.Author,
+			VersionDate:    version.When,
+		})
+	}
+
+	fmt.Fprintf(os.Stderr, "DEBUG: Added %d previous versions of page %s from space %s\n", len(items), title, page.SpaceKey)
+	return items
+}
+
+// fetchPageVersions lists the most recent versions of a page, enough to cover
+// history_versions plus the current one
+func fetchPageVersions(ctx context.Context, config *Config, page Page) ([]pageVersion, error) {
+	baseURL := strings.TrimSuffix(config.ConfluenceURL, "/")
+	limit := config.HistoryVersions + 1
+
+	if config.APIVersion == apiVersionV2 {
+		body, err := fetchWithContext(ctx, config, opContentFetch, fmt.Sprintf("%s/api/v2/%s/%s/versions?limit=%d&sort=-modified-date", baseURL, contentCollection(page), page.ID, limit))
+		if err != nil {
+			return nil, err
+		}
+		var response struct {
+			Results []struct {
+				Number    int    `json:"number"`
+				Message   string `json:"message"`
+				AuthorID  string `json:"authorId"`
+				CreatedAt string `json:"createdAt"`
+			} `json:"results"`
+		}
+		if err := json.Unmarshal(body, &response); err != nil {
+			return nil, fmt.Errorf("parsing versions: %w", err)
+		}
+		var versions []pageVersion
+		for _, v := range response.Results {
+			versions = append(versions, pageVersion{Number: v.Number, Message: v.Message, Author: v.AuthorID, When: v.CreatedAt})
+		}
+		return versions, nil
+	}
+
+	body, err := fetchWithContext(ctx, config, opContentFetch, fmt.Sprintf("%s/rest/api/content/%s/version?limit=%d", baseURL, page.ID, limit))
+	if err != nil {
+		return nil, err
+	}
+	var response struct {
+		Results []struct {
+			Number  int            `json:"number"`
+			Message string         `json:"message"`
+			When    string         `json:"when"`
+			By      confluenceUser `json:"by"`
+		} `json:"results"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil {
+		return nil, fmt.Errorf("parsing versions: %w", err)
+	}
+	var versions []pageVersion
+	for _, v := range response.Results {
+		versions = append(versions, pageVersion{Number: v.Number, Message: v.Message, Author: v.By.name(), When: v.When})
+	}
+	return versions, nil
+}
+
+// fetchVersionBody returns the storage-format body of one historical version
+func fetchVersionBody(ctx context.Context, config *Config, page Page, number int) (string, error) {
+	baseURL := strings.TrimSuffix(config.ConfluenceURL, "/")
+
+	versionURL := fmt.Sprintf("%s/rest/api/content/%s?status=historical&version=%d&expand=body.storage", baseURL, page.ID, number)
+	if config.APIVersion == apiVersionV2 {
+		versionURL = fmt.Sprintf("%s/api/v2/%s/%s?version=%d&body-format=storage", baseURL, contentCollection(page), page.ID, number)
+	}
+
+	body, err := fetchWithContext(ctx, config, opContentFetch, versionURL)
+	if err != nil {
+		return "", err
+	}
+	var content ContentResponse
+	if err := json.Unmarshal(body, &content); err != nil {
+		return "", fmt.Errorf("parsing version content: %w", err)
+	}
+	return content.Body.Storage.Value, nil
+}
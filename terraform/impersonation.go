@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// defaultActAsHeader is the header Data Center SSO add-ons and authenticating
+// proxies commonly trust to name the user a request runs as
+const defaultActAsHeader = "X-Remote-User"
+
+// validateActAs checks the impersonation options
+func validateActAs(config *Config) error {
+	if config.ActAsUser == "" {
+		return nil
+	}
+	if isOfflineSource(config) {
+		return fmt.Errorf("act_as_user needs the confluence source")
+	}
+	if config.ActAsHeader == "" {
+		config.ActAsHeader = defaultActAsHeader
+	}
+	return nil
+}
+
+// verifyActAs asks the instance who the requests run as. An instance that
+// ignores the impersonation header would otherwise import with the service
+// account's visibility, leaking pages the user can't see into their corpus.
+func verifyActAs(config *Config) error {
+	if config.ActAsUser == "" {
+		return nil
+	}
+	body, err := fetchWithPolicy(config, opSpaceLookup, strings.TrimSuffix(config.ConfluenceURL, "/")+"/rest/api/user/current")
+	if err != nil {
+		return fmt.Errorf("checking act_as_user: %w", err)
+	}
+	var user struct {
+		Username  string `json:"username"`
+		Email     string `json:"email"`
+		AccountID string `json:"accountId"`
+	}
+	if err := json.Unmarshal(body, &user); err != nil {
+		return fmt.Errorf("checking act_as_user: %w", err)
+	}
+	for _, name := range []string{user.Username, user.Email, user.AccountID} {
+		if name != "" && strings.EqualFold(name, config.ActAsUser) {
+			return nil
+		}
+	}
+	return fmt.Errorf("the instance ignored the %s header: requests run as %q, not act_as_user %q", config.ActAsHeader, firstNonEmpty(user.Username, user.Email, user.AccountID), config.ActAsUser)
+}
@@ -1,13 +1,16 @@
 package main
 
 import (
-	"encoding/base64"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"os"
-	"regexp"
+	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
@@ -16,22 +19,146 @@ import (
 
 // Configuration and data structures
 type Config struct {
-	ConfluenceURL    string `json:"CONFLUENCE_URL"`
-	Username         string `json:"CONFLUENCE_USERNAME"`
-	APIToken         string `json:"CONFLUENCE_API_TOKEN"`
-	SpaceKeys        string `json:"space_keys"` // Comma-separated list of space keys
-	SpaceKey         string `json:"space_key"`  // For backward compatibility
-	IncludeBlogs     string `json:"include_blogs"`
-	MaxWorkers       int    // Number of concurrent workers
-	MaxContentLength int    // Maximum content length per page
-	MaxPages         int    // Maximum number of pages to fetch (0 = unlimited)
+	ConfluenceURL        string `json:"CONFLUENCE_URL"`
+	Username             string `json:"CONFLUENCE_USERNAME"`
+	APIToken             string `json:"CONFLUENCE_API_TOKEN"`
+	SpaceKeys            string `json:"space_keys"`         // Comma-separated list of space keys
+	SpaceKey             string `json:"space_key"`          // For backward compatibility
+	SpaceCategories      string `json:"space_categories"`   // Comma-separated space categories whose spaces are imported too
+	ExcludeSpaceKeys     string `json:"exclude_space_keys"` // Comma-separated space keys left out, e.g. of space_keys "*"
+	SpaceTypes           string `json:"space_types"`        // Comma-separated space types ("global", "personal") space_keys "*" and space_categories select
+	IncludeBlogs         string `json:"include_blogs"`
+	Source               string `json:"source"`                 // Content source: "confluence" (default), "mock" or "export"
+	ExportPath           string `json:"export_path"`            // Space export zip or unpacked directory for the export source
+	Mode                 string `json:"mode"`                   // Run mode: "import" (default), "health", "retry_failed", "update_pages", "decrypt", "verify", "serve" or "combined"
+	APIVersion           string `json:"api_version"`            // "auto" (default), or "v1"/"v2" to use only that API family
+	Deployment           string `json:"deployment"`             // "cloud" (default), or "server" for Server/Data Center (v1 only, PAT Bearer auth)
+	ScrollVersions       string `json:"scroll_versions"`        // "auto" (default) detects Scroll Versions spaces, "off" imports every copy
+	ScrollVersion        string `json:"scroll_version"`         // Scroll Versions version to import (default: newest)
+	Languages            string `json:"languages"`              // Comma-separated language codes recognized on translated pages
+	DefaultLanguage      string `json:"default_language"`       // Language of pages without a language marker
+	PreferredLanguage    string `json:"preferred_language"`     // Import only this translation of each page when set
+	WorkflowStatus       string `json:"workflow_status"`        // Where to read workflow state: "comala" or "property" (default: off)
+	WorkflowPropertyKey  string `json:"workflow_property_key"`  // Content property holding the state for "property"
+	WorkflowPropertyPath string `json:"workflow_property_path"` // Dot path to the state name inside the property value
+	RequiredStatus       string `json:"required_status"`        // Comma-separated states to import, e.g. "Approved"
+	RequiredProperties   string `json:"required_properties"`    // Comma-separated content property conditions, e.g. "ingest=true"
+	FetchViews           string `json:"fetch_views"`            // "true" to add view counts from the Cloud analytics API
+	FetchOwners          string `json:"fetch_owners"`           // "true" to add space admins as owners and page watchers
+	IncludeTemplates     string `json:"include_templates"`      // "true" to add space page templates as template items
+	IncludeContentTypes  string `json:"include_content_types"`  // Comma-separated v2 content types to add: "whiteboard", "database", "embed"
+	ExcludeBlueprints    string `json:"exclude_blueprints"`     // Comma-separated blueprint labels whose pages are skipped, e.g. "meeting-notes"
+	StateFile            string `json:"state_file"`             // File recording each page's version and content hash for incremental runs
+	ModifiedSince        string `json:"modified_since"`         // Only import content modified since this RFC 3339 time or age, e.g. "30d"
+	IncludeLabels        string `json:"include_labels"`         // Comma-separated labels; only pages carrying one are imported
+	ExcludeLabels        string `json:"exclude_labels"`         // Comma-separated labels whose pages are skipped
+	IncludeSpaceOverview string `json:"include_space_overview"` // "true" to add a space_overview item per space from its description and homepage
+	VisibleToGroup       string `json:"visible_to_group"`       // Only import pages readable by this Confluence group
+	OCR                  string `json:"ocr"`                    // "tesseract" or "endpoint" to recognize text in embedded images
+	OCREndpoint          string `json:"ocr_endpoint"`           // URL that receives image bytes and returns the text
+	OCRLanguage          string `json:"ocr_language"`           // Language hint, e.g. "eng" or "eng+deu" for tesseract
+	ExtractPDFs          string `json:"extract_pdfs"`           // "true" to extract the text of PDFs shown with the PDF viewer macros
+	IncludeAttachments   string `json:"include_attachments"`    // "true" to list each page's attachments in its item
+	AttachmentText       string `json:"extract_attachments"`    // "true" to extract the text of PDF, Office and text attachments
+	AttachmentMode       string `json:"attachment_mode"`        // "append" (default) adds attachment text to the page, "items" emits attachment items
+	Diagrams             string `json:"diagrams"`               // draw.io/Gliffy placeholders: "name" (default), "labels" or "png"
+	HistoryPages         string `json:"history_pages"`          // Comma-separated page IDs or titles whose history is imported (empty = all)
+	InlineComments       string `json:"inline_comments"`        // "inline" to place inline comments next to their text, "annotations" to attach them to the item
+	OutputFile           string `json:"output_file"`            // Write items as JSON Lines to this file instead of the items string
+	SearchListing        string `json:"search_listing"`         // "true" to list pages with CQL search, fetching bodies and labels in the same call
+	CQL                  string `json:"cql"`                    // CQL query selecting the content to import instead of whole spaces
+	CacheDir             string `json:"cache_dir"`              // Directory for caches kept between runs, e.g. resolved space IDs
+	PrefetchListing      string `json:"prefetch_listing"`       // "true" to start workers on each listed batch while the next one is fetched
+	ContentExpand        string `json:"content_expand"`         // Expansions of v1 content and search calls (default "body.storage,metadata.labels")
+	PreserveOrder        string `json:"preserve_order"`         // "true" to emit items in listing order instead of completion order
+	QueueOrder           string `json:"queue_order"`            // Order pages are processed in: "listing" (default) or "recency"
+	QueueDir             string `json:"queue_dir"`              // Directory keeping the page queue and finished items on disk, resumable after a crash
+	StripBoilerplate     string `json:"strip_boilerplate"`      // "true" to remove text repeated across a space's pages, template instructions and link lists
+	BatchLabels          string `json:"batch_labels"`           // "true" to fetch labels for many pages per search call instead of per page
+	SchemaVersion        string `json:"schema_version"`         // Output schema: "1" (default) or "2"
+	DiffReport           string `json:"diff_report"`            // File receiving the items added, changed and removed since the previous run
+	PseudonymFile        string `json:"pseudonym_file"`         // Mapping file of pseudonyms replacing user names and emails
+	AuditLog             string `json:"audit_log"`              // JSON Lines file recording every content ID accessed and its outcome
+	Routes               string `json:"routes"`                 // Rules sending items to other files by space, label or instance, e.g. "label:security=restricted.jsonl"
+	Sinks                string `json:"sinks"`                  // Comma-separated sinks written in parallel: stdout, file:<path> or http(s) URLs
+	HTTPSinkToken        string `json:"http_sink_token"`        // Bearer token sent to http sinks
+	Encryption           string `json:"encryption"`             // Encrypt file outputs: "aes-gcm" or "age"
+	EncryptionKey        string `json:"encryption_key"`         // Base64-encoded 32-byte key for aes-gcm
+	AgeRecipients        string `json:"age_recipients"`         // Comma-separated age recipients
+	EncryptedFile        string `json:"encrypted_file"`         // File read by the decrypt mode
+	ManifestFile         string `json:"manifest_file"`          // Manifest with the SHA-256 checksum of every output file
+	ManifestSigningKey   string `json:"manifest_signing_key"`   // Base64-encoded Ed25519 key signing manifest_file
+	ManifestPublicKey    string `json:"manifest_public_key"`    // Base64-encoded Ed25519 key the verify mode checks the signature with
+	RateLimitFile        string `json:"rate_limit_file"`        // Coordination file sharing rate_limit_per_second between instances
+	CredentialsFile      string `json:"credentials_file"`       // JSON file with CONFLUENCE_USERNAME and CONFLUENCE_API_TOKEN, re-read after a 401
+	SessionCookie        string `json:"session_cookie"`         // Cookie header authenticating instead of an API token, e.g. "JSESSIONID=..."
+	OAuthClientID        string `json:"oauth_client_id"`        // OAuth 2.0 (3LO) app the refresh token was issued to
+	OAuthClientSecret    string `json:"oauth_client_secret"`    // Secret of the OAuth app
+	OAuthRefreshToken    string `json:"oauth_refresh_token"`    // Rotating refresh token access tokens are obtained with
+	OAuthAccessToken     string `json:"oauth_access_token"`     // Access token used as-is, e.g. one issued by a broker
+	OAuthTokenFile       string `json:"oauth_token_file"`       // File keeping the newest rotated refresh token between runs
+	CloudID              string `json:"cloud_id"`               // Cloud ID of the site for the API gateway (default: looked up)
+	ActAsUser            string `json:"act_as_user"`            // Data Center user whose visibility the import runs with
+	ActAsHeader          string `json:"act_as_header"`          // Header naming act_as_user (default "X-Remote-User")
+	ConfigFile           string `json:"config_file"`            // File of named profiles (also IMPORT_CONFIG_FILE)
+	SharePointScript     string `json:"sharepoint_script"`      // SharePoint importer the combined mode runs (default: import_sharepoint.py next to this binary)
+	ServeAddr            string `json:"serve_addr"`             // Address of the serve mode status endpoint (default ":8080")
+	ServeProfiles        string `json:"serve_profiles"`         // Comma-separated profiles serve mode runs (default: every profile with a schedule)
+	ServeStateFile       string `json:"serve_state_file"`       // File keeping serve mode's run history between restarts
+	WebhookSecret        string `json:"webhook_secret"`         // Secret Confluence webhooks sign with (or pass as ?token=) in serve mode
+	WebhookBatchSeconds  string `json:"webhook_batch_seconds"`  // Seconds webhook events are collected before their pages are imported (default 30)
+	PageUpdates          string `json:"page_updates"`           // JSON array of pages {"id", "title", "space_key", "type"} the update_pages mode re-imports
+	RemovedPageIDs       string `json:"removed_page_ids"`       // Comma-separated page IDs the update_pages mode drops from output_file
+	MaxWorkers           int    // Number of concurrent workers (0 = size automatically)
+	MaxContentLength     int    // Maximum content length per page
+	MaxPages             int    // Maximum number of pages to fetch (0 = unlimited)
+	MockPages            int    // Number of synthetic pages generated by the mock source
+	RateLimitPerSecond   int    // Confluence requests per second, across instances sharing rate_limit_file (0 = unlimited)
+	MockSeed             int64  // Seed for the mock source so runs are reproducible
+	SelectTopViewed      int    // Import only this many of the most-viewed listed pages (0 = all)
+	PDFMaxPages          int    // Pages read from each PDF (0 = all)
+	HistoryVersions      int    // Previous versions imported per page (0 = none)
+	PageBuffer           int    // Capacity of the channel feeding pages to workers
+	ResultBuffer         int    // Capacity of the channel from workers to the output sink
+	ListingConcurrency   int    // v1 listing requests in flight per space (1 = serial)
+	SpaceCacheHours      int    // Age after which cached space lookups are refreshed
+	PageTimeoutSeconds   int    // Time one page may take to fetch and convert (0 = unlimited)
+	BoilerplateThreshold int    // Percent of a space's pages a block must appear on to be stripped
+	StreamThresholdBytes int    // Body size above which conversion stops at MaxContentLength (0 = never)
+	ListingLimit         int    // Pages requested per listing call
+	MemoryLimitMB        int    // Memory use at which the run stops taking pages (0 = unlimited)
+
+	RequestPolicies    map[string]RequestPolicy `json:"-"` // Timeout and retry settings per operation class
+	Transport          TransportSettings        `json:"-"` // Connection pool, timeouts and HTTP/2 of the shared transport
+	RateLimitHeadroom  float64                  `json:"-"` // Fraction of the rate-limit budget left at the connection test (-1 = unknown)
+	SpaceOwners        map[string][]string      `json:"-"` // Space key -> admins, filled when fetch_owners is enabled
+	GroupVisibility    *groupVisibility         `json:"-"` // Cached read restrictions for visible_to_group
+	SpaceCache         *spaceCache              `json:"-"` // Space lookups persisted in cache_dir
+	Failures           *failureReport           `json:"-"` // Pages that couldn't be imported, reported in failed_pages
+	Memory             *memoryWatchdog          `json:"-"` // Throttles or stops the run near memory_limit_mb
+	Labels             *labelCache              `json:"-"` // Labels fetched in batches when batch_labels is enabled
+	Pseudonyms         *pseudonymizer           `json:"-"` // Set when pseudonym_file is given
+	Audit              *auditLog                `json:"-"` // Set when audit_log is given
+	RouteRules         []routeRule              `json:"-"` // Parsed from routes
+	PropertyConditions []propertyCondition      `json:"-"` // Parsed from required_properties
+	ModifiedAfter      time.Time                `json:"-"` // Parsed from modified_since
+	Sync               *syncState               `json:"-"` // Set when state_file is given
+	Queue              *diskQueue               `json:"-"` // Set when queue_dir is given
+	SiteURL            string                   `json:"-"` // Site CONFLUENCE_URL was moved from to reach the OAuth API gateway
 }
 
 type Page struct {
-	ID       string `json:"id"`
-	Title    string `json:"title"`
-	Type     string `json:"type"`
-	SpaceKey string `json:"space_key"` // Add space key to track which space this page belongs to
+	ID       string         `json:"id"`
+	Title    string         `json:"title"`
+	Type     string         `json:"type"`
+	SpaceKey string         `json:"space_key"`         // Add space key to track which space this page belongs to
+	Version  *listedVersion `json:"version,omitempty"` // Last modification, when the listing reports it
+
+	Language         string           `json:"-"` // Detected language when translation handling is enabled
+	TranslationGroup string           `json:"-"` // Pages sharing a group are translations of each other
+	Views            *int             `json:"-"` // View count when fetched during selection
+	Content          *ContentResponse `json:"-"` // Body and labels when the listing already returned them
+	Sequence         int              `json:"-"` // Position in the listing, for preserve_order
 }
 
 type PagesResponse struct {
@@ -56,82 +183,114 @@ type ContentResponse struct {
 			} `json:"results"`
 		} `json:"labels"`
 	} `json:"metadata"`
+	Version contentVersion `json:"version"`
+	History struct {
+		CreatedDate string `json:"createdDate"`
+		CreatedBy   struct {
+			DisplayName string `json:"displayName"`
+		} `json:"createdBy"`
+	} `json:"history"`
+	CreatedAt string `json:"createdAt"` // v2 gives these instead of history
+	AuthorID  string `json:"authorId"`
+	Links     struct {
+		WebUI string `json:"webui"`
+	} `json:"_links"`
+}
+
+// contentVersion is the version a content call returns: v1 says when and by
+// whom, v2 gives createdAt
+type contentVersion struct {
+	Number    int    `json:"number"`
+	When      string `json:"when"`
+	CreatedAt string `json:"createdAt"`
+	By        struct {
+		DisplayName string `json:"displayName"`
+	} `json:"by"`
+}
+
+// listed returns the version as a listing reports it, or nil when the
+// response had none
+func (v contentVersion) listed() *listedVersion {
+	if v.Number == 0 && v.When == "" && v.CreatedAt == "" {
+		return nil
+	}
+	return &listedVersion{Number: v.Number, CreatedAt: v.CreatedAt, When: v.When}
 }
 
 type ProcessedItem struct {
+	SchemaVersion string `json:"schema_version,omitempty"` // Set when the item is written
+	Source        string `json:"source"`                   // Always "confluence"; SharePoint items say "sharepoint"
+	Instance      string `json:"instance,omitempty"`       // Base URL of the instance, or the export file
+
 	ID       string `json:"id"`
 	Title    string `json:"title"`
 	Content  string `json:"content"`
 	Type     string `json:"type"`
 	Labels   string `json:"labels"`
 	SpaceKey string `json:"space_key"` // Add space key to track which space this item belongs to
+
+	URL       string `json:"url,omitempty"`        // Link to the item in Confluence
+	CreatedAt string `json:"created_at,omitempty"` // When the page was created
+	UpdatedAt string `json:"updated_at,omitempty"` // When its current version was saved
+	Author    string `json:"author,omitempty"`     // Who created the page (an account ID with api_version v2)
+
+	Language         string   `json:"language,omitempty"`
+	TranslationGroup string   `json:"translation_group,omitempty"`
+	Status           string   `json:"status,omitempty"`   // Workflow state, e.g. from Comala
+	Views            *int     `json:"views,omitempty"`    // Total views from Confluence Cloud analytics
+	Owners           []string `json:"owners,omitempty"`   // Space admins
+	Watchers         []string `json:"watchers,omitempty"` // Users watching the page
+	Template         bool     `json:"template,omitempty"` // Space template rather than a page
+
+	// Set on page_version items from the version history; Version is also set
+	// on pages, to their current version
+	PageID         string `json:"page_id,omitempty"`
+	Version        int    `json:"version,omitempty"`
+	VersionComment string `json:"version_comment,omitempty"`
+	VersionAuthor  string `json:"version_author,omitempty"`
+	VersionDate    string `json:"version_date,omitempty"`
+
+	InlineComments []InlineComment `json:"inline_comments,omitempty"` // Set when inline_comments is "annotations"
+	Attachments    []Attachment    `json:"attachments,omitempty"`     // Set when include_attachments is enabled
+
+	// Set on attachment items
+	ParentPageID string `json:"parent_page_id,omitempty"`
+	MediaType    string `json:"media_type,omitempty"`
+	DownloadURL  string `json:"download_url,omitempty"`
+
+	Action string `json:"action,omitempty"` // "added", "updated" or "deleted" when state_file is set
 }
 
 type Result struct {
-	Items string `json:"items"`
-	Error string `json:"error,omitempty"`
+	SchemaVersion string `json:"schema_version,omitempty"`
+	Items         string `json:"items"`
+	OutputFile    string `json:"output_file,omitempty"` // Set when items were written to output_file
+	ItemCount     string `json:"item_count,omitempty"`
+	FailedPages   string `json:"failed_pages,omitempty"` // JSON array of pages that failed or timed out
+	Partial       string `json:"partial,omitempty"`      // Why the run stopped before every page was processed
+	RoutedItems   string `json:"routed_items,omitempty"` // JSON object of route file -> items written to it
+	Sinks         string `json:"sinks,omitempty"`        // JSON array with the outcome of each configured sink
+	Stats         string `json:"stats,omitempty"`        // JSON object of source -> items, failures and duration of a combined run
+	Errors        string `json:"errors,omitempty"`       // JSON array of {"source", "error"} of the importers a combined run lost
+	Error         string `json:"error,omitempty"`
 }
 
-// HTTP client with connection pooling
+// HTTP client with connection pooling; timeouts are applied per request by
+// operation type. The transport is rebuilt from the input's transport settings.
 var httpClient = &http.Client{
-	Timeout: 30 * time.Second,
-	Transport: &http.Transport{
-		MaxIdleConns:        100,
-		MaxIdleConnsPerHost: 10,
-		IdleConnTimeout:     90 * time.Second,
-	},
+	Transport: newTransport(defaultTransportSettings),
 }
 
-// HTML to text conversion with better performance
+// HTMLConverter turns storage-format XHTML into Markdown-flavoured text. It
+// walks the markup once, writing into a single builder, so large pages aren't
+// copied again for every element type. It holds no per-call state and is
+// shared by all workers.
 type HTMLConverter struct {
-	// Pre-compiled regular expressions for better performance
-	tableRegex        *regexp.Regexp
-	rowRegex          *regexp.Regexp
-	cellRegex         *regexp.Regexp
-	tagRegex          *regexp.Regexp
-	headerRegexes     map[int]*regexp.Regexp
-	listRegexes       map[string]*regexp.Regexp
-	formatRegexes     map[string]*regexp.Regexp
-	linkRegex         *regexp.Regexp
-	entityMap         map[string]string
-	multiNewlineRegex *regexp.Regexp
-	multiSpaceRegex   *regexp.Regexp
+	entityMap map[string]string
 }
 
 func NewHTMLConverter() *HTMLConverter {
 	return &HTMLConverter{
-		tableRegex: regexp.MustCompile(`(?i)<table[^>]*>.*?</table>`),
-		rowRegex:   regexp.MustCompile(`(?i)<tr[^>]*>(.*?)</tr>`),
-		cellRegex:  regexp.MustCompile(`(?i)<(?:th|td)[^>]*>(.*?)</(?:th|td)>`),
-		tagRegex:   regexp.MustCompile(`<[^>]+>`),
-		headerRegexes: map[int]*regexp.Regexp{
-			1: regexp.MustCompile(`(?i)<h1[^>]*>(.*?)</h1>`),
-			2: regexp.MustCompile(`(?i)<h2[^>]*>(.*?)</h2>`),
-			3: regexp.MustCompile(`(?i)<h3[^>]*>(.*?)</h3>`),
-			4: regexp.MustCompile(`(?i)<h4[^>]*>(.*?)</h4>`),
-			5: regexp.MustCompile(`(?i)<h5[^>]*>(.*?)</h5>`),
-			6: regexp.MustCompile(`(?i)<h6[^>]*>(.*?)</h6>`),
-		},
-		listRegexes: map[string]*regexp.Regexp{
-			"ul_start": regexp.MustCompile(`(?i)<ul[^>]*>`),
-			"ul_end":   regexp.MustCompile(`(?i)</ul>`),
-			"ol_start": regexp.MustCompile(`(?i)<ol[^>]*>`),
-			"ol_end":   regexp.MustCompile(`(?i)</ol>`),
-			"li":       regexp.MustCompile(`(?i)<li[^>]*>(.*?)</li>`),
-		},
-		formatRegexes: map[string]*regexp.Regexp{
-			"strong": regexp.MustCompile(`(?i)<strong[^>]*>(.*?)</strong>`),
-			"b":      regexp.MustCompile(`(?i)<b[^>]*>(.*?)</b>`),
-			"em":     regexp.MustCompile(`(?i)<em[^>]*>(.*?)</em>`),
-			"i":      regexp.MustCompile(`(?i)<i[^>]*>(.*?)</i>`),
-			"u":      regexp.MustCompile(`(?i)<u[^>]*>(.*?)</u>`),
-			"code":   regexp.MustCompile(`(?i)<code[^>]*>(.*?)</code>`),
-			"pre":    regexp.MustCompile(`(?is)<pre[^>]*>(.*?)</pre>`),
-			"p":      regexp.MustCompile(`(?i)<p[^>]*>(.*?)</p>`),
-			"div":    regexp.MustCompile(`(?i)<div[^>]*>(.*?)</div>`),
-			"br":     regexp.MustCompile(`(?i)<br[^>]*>`),
-		},
-		linkRegex: regexp.MustCompile(`(?i)<a[^>]*href="([^"]*)"[^>]*>(.*?)</a>`),
 		entityMap: map[string]string{
 			"&nbsp;":   " ",
 			"&lt;":     "<",
@@ -151,171 +310,458 @@ func NewHTMLConverter() *HTMLConverter {
 			"&darr;":   "↓",
 			"&hellip;": "...",
 		},
-		multiNewlineRegex: regexp.MustCompile(`\n{3,}`),
-		multiSpaceRegex:   regexp.MustCompile(` +`),
 	}
 }
 
-func (h *HTMLConverter) convertHTMLTable(tableHTML string) string {
-	rows := h.rowRegex.FindAllStringSubmatch(tableHTML, -1)
-	if len(rows) == 0 {
-		return "\n[Empty table]\n"
-	}
+// maxEntityLength bounds the search for the ';' ending an entity
+const maxEntityLength = 10
+
+// Inline formatting markers by tag name
+var inlineMarkers = map[string]string{
+	"strong": "**",
+	"b":      "**",
+	"em":     "*",
+	"i":      "*",
+	"u":      "_",
+	"code":   "`",
+}
 
-	var markdownRows []string
-	isHeader := true
+// textWriter builds converted text, collapsing runs of spaces, capping blank
+// lines at one and dropping leading and trailing whitespace as it goes
+type textWriter struct {
+	b        strings.Builder
+	space    bool // A space is pending
+	newlines int  // Line breaks pending, at most two
+}
 
-	for _, row := range rows {
-		if len(row) < 2 {
-			continue
-		}
+// breakLines requests n line breaks before the next text
+func (w *textWriter) breakLines(n int) {
+	w.newlines = min(w.newlines+n, 2)
+}
 
-		cells := h.cellRegex.FindAllStringSubmatch(row[1], -1)
-		if len(cells) == 0 {
-			continue
+func (w *textWriter) flush() {
+	if w.b.Len() > 0 {
+		if w.newlines > 0 {
+			w.b.WriteString("\n\n"[:w.newlines])
+		} else if w.space {
+			w.b.WriteByte(' ')
 		}
+	}
+	w.space = false
+	w.newlines = 0
+}
 
-		var cleanCells []string
-		for _, cell := range cells {
-			if len(cell) < 2 {
-				cleanCells = append(cleanCells, " ")
-				continue
-			}
-
-			// Clean cell content
-			cleanCell := h.tagRegex.ReplaceAllString(cell[1], " ")
+// raw writes s as is after any pending whitespace
+func (w *textWriter) raw(s string) {
+	w.flush()
+	w.b.WriteString(s)
+}
 
-			// Replace HTML entities
-			for entity, replacement := range h.entityMap {
-				cleanCell = strings.ReplaceAll(cleanCell, entity, replacement)
+// text writes a run of character data, decoding entities. Outside
+// preformatted blocks spaces collapse and line breaks are counted.
+func (w *textWriter) text(s string, entities map[string]string, preformatted bool) {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c == '&' {
+			if end := strings.IndexByte(s[i:min(len(s), i+maxEntityLength)], ';'); end > 0 {
+				if replacement, ok := entities[s[i:i+end+1]]; ok {
+					w.text(replacement, nil, preformatted)
+					i += end
+					continue
+				}
 			}
+		}
+		switch {
+		case preformatted:
+			w.flush()
+			w.b.WriteByte(c)
+		case c == ' ':
+			w.space = true
+		case c == '\n':
+			w.breakLines(1)
+		default:
+			w.flush()
+			w.b.WriteByte(c)
+		}
+	}
+}
 
-			// Normalize whitespace
-			cleanCell = strings.TrimSpace(h.multiSpaceRegex.ReplaceAllString(cleanCell, " "))
-
-			// Escape pipe characters
-			cleanCell = strings.ReplaceAll(cleanCell, "|", "\\|")
+func (w *textWriter) String() string {
+	return w.b.String()
+}
 
-			if cleanCell == "" {
-				cleanCell = " "
-			}
-			cleanCells = append(cleanCells, cleanCell)
-		}
+// tableState collects the rows of a table being converted
+type tableState struct {
+	rows [][]string
+	row  []string
+	cell *textWriter // Open cell, nil between cells
+}
 
-		// Format as markdown table row
-		markdownRow := "| " + strings.Join(cleanCells, " | ") + " |"
-		markdownRows = append(markdownRows, markdownRow)
+func (t *tableState) closeCell() {
+	if t.cell == nil {
+		return
+	}
+	cell := strings.ReplaceAll(strings.Join(strings.Fields(t.cell.String()), " "), "|", "\\|")
+	if cell == "" {
+		cell = " "
+	}
+	t.row = append(t.row, cell)
+	t.cell = nil
+}
 
-		// Add header separator after first row
-		if isHeader && len(cleanCells) > 0 {
-			separator := "|" + strings.Repeat(" --- |", len(cleanCells))
-			markdownRows = append(markdownRows, separator)
-			isHeader = false
-		}
+func (t *tableState) closeRow() {
+	t.closeCell()
+	if len(t.row) > 0 {
+		t.rows = append(t.rows, t.row)
 	}
+	t.row = nil
+}
 
-	if len(markdownRows) > 0 {
-		return "\n\n" + strings.Join(markdownRows, "\n") + "\n\n"
+// render writes the table as a Markdown table, the first row as its header
+func (t *tableState) render(w *textWriter) {
+	t.closeRow()
+	if len(t.rows) == 0 {
+		w.breakLines(1)
+		w.raw("[Empty table]")
+		w.breakLines(1)
+		return
+	}
+	w.breakLines(2)
+	for i, row := range t.rows {
+		if i > 0 {
+			w.breakLines(1)
+		}
+		w.raw("| " + strings.Join(row, " | ") + " |")
+		if i == 0 {
+			w.breakLines(1)
+			w.raw("|" + strings.Repeat(" --- |", len(row)))
+		}
 	}
-	return "\n[Empty table]\n"
+	w.breakLines(2)
 }
 
 func (h *HTMLConverter) htmlToText(htmlContent string) string {
-	// Handle special Confluence macros
-	htmlContent = regexp.MustCompile(`(?i)<ac:link[^>]*>.*?</ac:link>`).ReplaceAllString(htmlContent, "")
+	return h.htmlToTextPrefix(htmlContent, 0)
+}
 
-	// Handle headers
-	for level, regex := range h.headerRegexes {
-		prefix := strings.Repeat("#", level)
-		htmlContent = regex.ReplaceAllString(htmlContent, "\n\n"+prefix+" $1\n\n")
+// htmlToTextPrefix converts only as much of the markup as yields limit bytes
+// of text, stopping at the first element boundary outside a table past it
+// (0 = no limit). Very large bodies that will be truncated anyway then never
+// have their tail converted or buffered.
+func (h *HTMLConverter) htmlToTextPrefix(htmlContent string, limit int) string {
+	out := &textWriter{}
+	if limit > 0 {
+		out.b.Grow(min(len(htmlContent)/2, limit+limit/8))
+	} else {
+		out.b.Grow(len(htmlContent) / 2)
+	}
+
+	var tables []*tableState
+	var links []string // href of each open link, "" for anchors without one
+	preDepth := 0
+
+	// writer returns where text goes: the open table cell, nowhere between
+	// cells, or the page
+	writer := func() *textWriter {
+		if len(tables) == 0 {
+			return out
+		}
+		return tables[len(tables)-1].cell
 	}
 
-	// Handle lists
-	htmlContent = h.listRegexes["ul_start"].ReplaceAllString(htmlContent, "\n")
-	htmlContent = h.listRegexes["ul_end"].ReplaceAllString(htmlContent, "\n")
-	htmlContent = h.listRegexes["ol_start"].ReplaceAllString(htmlContent, "\n")
-	htmlContent = h.listRegexes["ol_end"].ReplaceAllString(htmlContent, "\n")
-	htmlContent = h.listRegexes["li"].ReplaceAllString(htmlContent, "- $1\n")
+	for i := 0; i < len(htmlContent); {
+		if limit > 0 && len(tables) == 0 && out.b.Len() > limit {
+			break
+		}
+		tagStart := strings.IndexByte(htmlContent[i:], '<')
+		if tagStart < 0 {
+			tagStart = len(htmlContent) - i
+		}
+		if tagStart > 0 {
+			if w := writer(); w != nil {
+				w.text(htmlContent[i:i+tagStart], h.entityMap, preDepth > 0)
+			}
+			i += tagStart
+			continue
+		}
+
+		// CDATA, e.g. the body of a code macro, is text as is, brackets included
+		if strings.HasPrefix(htmlContent[i:], "<![CDATA[") {
+			data := htmlContent[i+len("<![CDATA["):]
+			end := strings.Index(data, "]]>")
+			if end < 0 {
+				end = len(data)
+			}
+			if w := writer(); w != nil {
+				w.text(data[:end], nil, preDepth > 0)
+			}
+			i += len("<![CDATA[") + min(end+len("]]>"), len(data))
+			continue
+		}
+
+		tagEnd := strings.IndexByte(htmlContent[i+1:], '>')
+		if tagEnd <= 0 {
+			// Not a tag; keep the bracket as text
+			if w := writer(); w != nil {
+				w.text("<", nil, preDepth > 0)
+			}
+			i++
+			continue
+		}
+		tag := htmlContent[i+1 : i+1+tagEnd]
+		i += tagEnd + 2
 
-	// Handle text formatting
-	htmlContent = h.formatRegexes["strong"].ReplaceAllString(htmlContent, "**$1**")
-	htmlContent = h.formatRegexes["b"].ReplaceAllString(htmlContent, "**$1**")
-	htmlContent = h.formatRegexes["em"].ReplaceAllString(htmlContent, "*$1*")
-	htmlContent = h.formatRegexes["i"].ReplaceAllString(htmlContent, "*$1*")
-	htmlContent = h.formatRegexes["u"].ReplaceAllString(htmlContent, "_$1_")
-	htmlContent = h.formatRegexes["code"].ReplaceAllString(htmlContent, "`$1`")
-	htmlContent = h.formatRegexes["pre"].ReplaceAllString(htmlContent, "```\n$1\n```")
+		closing := strings.HasPrefix(tag, "/")
+		if closing {
+			tag = tag[1:]
+		}
+		nameEnd := strings.IndexAny(tag, " \t\r\n/")
+		if nameEnd < 0 {
+			nameEnd = len(tag)
+		}
+		name := strings.ToLower(tag[:nameEnd])
 
-	// Handle paragraphs and divs
-	htmlContent = h.formatRegexes["p"].ReplaceAllString(htmlContent, "\n\n$1\n\n")
-	htmlContent = h.formatRegexes["div"].ReplaceAllString(htmlContent, "\n$1\n")
-	htmlContent = h.formatRegexes["br"].ReplaceAllString(htmlContent, "\n")
+		// Confluence page links carry no useful text of their own
+		if name == "ac:link" && !closing && !strings.HasSuffix(tag, "/") {
+			if end := indexFold(htmlContent[i:], "</ac:link>"); end >= 0 {
+				i += end + len("</ac:link>")
+			}
+			continue
+		}
 
-	// Handle links
-	htmlContent = h.linkRegex.ReplaceAllString(htmlContent, "[$2]($1)")
+		switch name {
+		case "table":
+			if closing {
+				if len(tables) > 0 {
+					table := tables[len(tables)-1]
+					tables = tables[:len(tables)-1]
+					if w := writer(); w != nil {
+						table.render(w)
+					}
+				}
+			} else {
+				tables = append(tables, &tableState{})
+			}
+			continue
+		case "tr":
+			if len(tables) > 0 {
+				tables[len(tables)-1].closeRow()
+			}
+			continue
+		case "td", "th":
+			if len(tables) > 0 {
+				table := tables[len(tables)-1]
+				table.closeCell()
+				if !closing {
+					table.cell = &textWriter{}
+				}
+			}
+			continue
+		}
 
-	// Handle tables
-	htmlContent = h.tableRegex.ReplaceAllStringFunc(htmlContent, h.convertHTMLTable)
+		w := writer()
+		if w == nil {
+			continue
+		}
+		switch name {
+		case "h1", "h2", "h3", "h4", "h5", "h6":
+			w.breakLines(2)
+			if !closing {
+				w.raw(strings.Repeat("#", int(name[1]-'0')))
+				w.space = true
+			}
+		case "ul", "ol":
+			w.breakLines(1)
+		case "li":
+			if closing {
+				w.breakLines(1)
+			} else {
+				w.raw("- ")
+			}
+		case "p":
+			w.breakLines(2)
+		case "div", "br":
+			w.breakLines(1)
+		case "pre", "ac:plain-text-body":
+			// Fences go on lines of their own, after a code macro's language too
+			if !strings.HasSuffix(w.String(), "\n") {
+				w.breakLines(1)
+			}
+			w.raw("```")
+			if closing {
+				w.breakLines(1)
+				preDepth = max(preDepth-1, 0)
+			} else {
+				w.breakLines(1)
+				preDepth++
+			}
+		case "a":
+			if closing {
+				if len(links) == 0 {
+					w.space = true
+					break
+				}
+				href := links[len(links)-1]
+				links = links[:len(links)-1]
+				if href == "" {
+					w.space = true
+				} else {
+					w.raw("](")
+					w.b.WriteString(href)
+					w.b.WriteByte(')')
+				}
+			} else {
+				href := attributeValue(tag, "href")
+				links = append(links, href)
+				if href == "" {
+					w.space = true
+				} else {
+					w.raw("[")
+				}
+			}
+		default:
+			if marker, ok := inlineMarkers[name]; ok {
+				if preDepth == 0 {
+					w.raw(marker)
+				}
+			} else {
+				w.space = true
+			}
+		}
+	}
 
-	// Remove remaining HTML tags
-	htmlContent = h.tagRegex.ReplaceAllString(htmlContent, " ")
+	// Tables left open at the end still count
+	for len(tables) > 0 {
+		table := tables[len(tables)-1]
+		tables = tables[:len(tables)-1]
+		if w := writer(); w != nil {
+			table.render(w)
+		}
+	}
+	return out.String()
+}
+
+// attributeValue returns the double-quoted value of an attribute in a tag
+func attributeValue(tag, attribute string) string {
+	start := indexFold(tag, " "+attribute+`="`)
+	if start < 0 {
+		return ""
+	}
+	value := tag[start+len(attribute)+3:]
+	if end := strings.IndexByte(value, '"'); end >= 0 {
+		return value[:end]
+	}
+	return ""
+}
 
-	// Replace HTML entities
-	for entity, replacement := range h.entityMap {
-		htmlContent = strings.ReplaceAll(htmlContent, entity, replacement)
+// indexFold is strings.Index ignoring ASCII case
+func indexFold(s, substr string) int {
+	for i := 0; i+len(substr) <= len(s); i++ {
+		if strings.EqualFold(s[i:i+len(substr)], substr) {
+			return i
+		}
 	}
+	return -1
+}
 
-	// Clean up whitespace
-	htmlContent = h.multiNewlineRegex.ReplaceAllString(htmlContent, "\n\n")
-	htmlContent = h.multiSpaceRegex.ReplaceAllString(htmlContent, " ")
-	htmlContent = strings.TrimSpace(htmlContent)
+// HTTPStatusError is returned by makeRequest for non-200 responses so callers
+// can tell permission problems apart from transport failures
+type HTTPStatusError struct {
+	StatusCode int
+	Status     string
+}
 
-	return htmlContent
+func (e *HTTPStatusError) Error() string {
+	return fmt.Sprintf("HTTP %d: %s", e.StatusCode, e.Status)
+}
+
+// isNotFound reports whether err is an HTTP 404 from makeRequest
+func isNotFound(err error) bool {
+	var statusErr *HTTPStatusError
+	return errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusNotFound
 }
 
 // HTTP request helper
 func makeRequest(url, username, apiToken string) ([]byte, error) {
-	req, err := http.NewRequest("GET", url, nil)
+	body, _, err := makeRequestWithHeaders(url, username, apiToken)
+	return body, err
+}
+
+// makeRequestWithHeaders is makeRequest for callers that also need the response headers
+func makeRequestWithHeaders(url, username, apiToken string) ([]byte, http.Header, error) {
+	return makeRequestWithPolicy(context.Background(), url, username, apiToken, defaultRequestPolicy)
+}
+
+// makeSingleRequest performs one GET attempt bounded by timeout and ctx
+func makeSingleRequest(ctx context.Context, url, username, apiToken string, timeout time.Duration) ([]byte, http.Header, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
-		return nil, fmt.Errorf("creating request: %w", err)
+		return nil, nil, fmt.Errorf("creating request: %w", err)
 	}
 
-	// Set authorization header
-	auth := base64.StdEncoding.EncodeToString([]byte(username + ":" + apiToken))
-	req.Header.Set("Authorization", "Basic "+auth)
+	credentials.authorize(req, username, apiToken)
+	credentials.impersonate(req)
 	req.Header.Set("Accept", "application/json")
 
+	requestLimiter.wait()
 	resp, err := httpClient.Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("making request: %w", err)
+		return nil, nil, fmt.Errorf("making request: %w", err)
 	}
 	defer resp.Body.Close()
 
+	if sessionExpired(resp) {
+		return nil, resp.Header, &HTTPStatusError{StatusCode: http.StatusUnauthorized, Status: "401 session expired"}
+	}
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("HTTP %d: %s", resp.StatusCode, resp.Status)
+		return nil, resp.Header, &HTTPStatusError{StatusCode: resp.StatusCode, Status: resp.Status}
 	}
 
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return nil, fmt.Errorf("reading response: %w", err)
+		return nil, resp.Header, fmt.Errorf("reading response: %w", err)
 	}
 
-	return body, nil
+	return body, resp.Header, nil
 }
 
-// Fetch all pages with pagination from multiple spaces
-func fetchAllPages(config *Config) ([]Page, error) {
-	// Parse space keys - support both comma-separated list and single space key for backward compatibility
+// parseSpaceKeys returns the configured space keys - supports both comma-separated list and single space key for backward compatibility
+func parseSpaceKeys(config *Config) []string {
 	var spaceKeys []string
 	if config.SpaceKeys != "" {
-		spaceKeys = strings.Split(strings.TrimSpace(config.SpaceKeys), ",")
-		for i, key := range spaceKeys {
-			spaceKeys[i] = strings.TrimSpace(key)
+		for _, key := range strings.Split(config.SpaceKeys, ",") {
+			if key = strings.TrimSpace(key); key != "" {
+				spaceKeys = append(spaceKeys, key)
+			}
 		}
 	} else if config.SpaceKey != "" {
 		// Backward compatibility
 		spaceKeys = []string{strings.TrimSpace(config.SpaceKey)}
 	}
+	return spaceKeys
+}
+
+// Fetch all pages with pagination from multiple spaces
+func fetchAllPages(config *Config) ([]Page, error) {
+	return listAllPages(config, nil)
+}
+
+// listAllPages lists every configured space. A non-nil emit receives each
+// batch as soon as it's listed; v2 listings fetch the next batch meanwhile.
+func listAllPages(config *Config, emit func([]Page)) ([]Page, error) {
+	// A CQL query selects the content in place of the spaces
+	if config.CQL != "" {
+		pages := fetchCQLPages(config)
+		if emit != nil {
+			emit(pages)
+		}
+		return pages, nil
+	}
+
+	spaceKeys := parseSpaceKeys(config)
 
 	if len(spaceKeys) == 0 {
 		return nil, fmt.Errorf("no space keys provided")
@@ -339,122 +785,166 @@ func fetchAllPages(config *Config) ([]Page, error) {
 	for spaceIndex, spaceKey := range spaceKeys {
 		fmt.Fprintf(os.Stderr, "DEBUG: Processing space %d/%d: %s\n", spaceIndex+1, len(spaceKeys), spaceKey)
 
-		// First, get the space ID from the space key
-		spaceInfoURL := fmt.Sprintf("%s/api/v2/spaces?keys=%s", strings.TrimSuffix(config.ConfluenceURL, "/"), spaceKey)
-		fmt.Fprintf(os.Stderr, "DEBUG: Getting space ID from: %s\n", spaceInfoURL)
-
-		spaceBody, err := makeRequest(spaceInfoURL, config.Username, config.APIToken)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "DEBUG: Failed to get space info for %s: %v\n", spaceKey, err)
-			continue // Skip this space and continue with others
-		}
-
-		var spaceResponse struct {
-			Results []struct {
-				ID  string `json:"id"`
-				Key string `json:"key"`
-			} `json:"results"`
-		}
-
-		if err := json.Unmarshal(spaceBody, &spaceResponse); err != nil {
-			fmt.Fprintf(os.Stderr, "DEBUG: Failed to parse space response for %s: %v\n", spaceKey, err)
+		if config.SearchListing == "true" || config.APIVersion == apiVersionV1 {
+			fetchSpacePages := fetchSpacePagesV1
+			if config.SearchListing == "true" {
+				fetchSpacePages = fetchSpacePagesSearch
+			}
+			spacePages, err := fetchSpacePages(config, spaceKey, pagesPerSpace)
+			if err != nil {
+				return nil, err
+			}
+			allPages = append(allPages, spacePages...)
+			fmt.Fprintf(os.Stderr, "DEBUG: Completed space %s: %d pages, total so far: %d\n", spaceKey, len(spacePages), len(allPages))
+			if emit != nil {
+				emit(spacePages)
+			}
 			continue
 		}
 
-		if len(spaceResponse.Results) == 0 {
+		// First, get the space ID from the space key
+		space, err := resolveSpace(config, spaceKey, false)
+		if errors.Is(err, errSpaceNotFound) {
 			fmt.Fprintf(os.Stderr, "DEBUG: Space not found: %s\n", spaceKey)
-			continue
+			return nil, unknownSpaceError(config, spaceKey)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "DEBUG: Failed to get space info for %s: %v\n", spaceKey, err)
+			continue // Skip this space and continue with others
 		}
 
-		spaceID := spaceResponse.Results[0].ID
+		spaceID := space.ID
 		fmt.Fprintf(os.Stderr, "DEBUG: Found space ID: %s for space key: %s\n", spaceID, spaceKey)
+		spaceKey = firstNonEmpty(space.Key, spaceKey) // A personal space may have been named by its owner
 
 		var spacePages []Page
-		endpoint := fmt.Sprintf("/api/v2/spaces/%s/pages?limit=100", spaceID)
 		pagesFromSpace := 0
 
-		fmt.Fprintf(os.Stderr, "DEBUG: Using API endpoint pattern: /api/v2/spaces/%s/pages (same as bash script)\n", spaceID)
-
-		for endpoint != "" {
-			// Check if we've reached the limit for this space
-			if pagesPerSpace > 0 && pagesFromSpace >= pagesPerSpace {
-				fmt.Fprintf(os.Stderr, "DEBUG: Reached max pages limit (%d) for space %s, stopping fetch\n", pagesPerSpace, spaceKey)
-				break
+		// Blog posts count against the same per-space limit, after the pages
+		for _, contentType := range listedTypes(config) {
+			endpoint := fmt.Sprintf("/api/v2/spaces/%s/%s?limit=%d", spaceID, contentCollection(Page{Type: contentType}), config.ListingLimit)
+			if config.QueueOrder == queueOrderRecency || config.ModifiedSince != "" {
+				// So max_pages keeps the most recently modified pages, and
+				// the listing stops at the first page older than modified_since
+				endpoint += "&sort=-modified-date"
 			}
 
-			fullURL := strings.TrimSuffix(config.ConfluenceURL, "/") + endpoint
-			fmt.Fprintf(os.Stderr, "DEBUG: Fetching %s\n", fullURL)
+			fmt.Fprintf(os.Stderr, "DEBUG: Using API endpoint pattern: /api/v2/spaces/%s/%s (same as bash script)\n", spaceID, contentCollection(Page{Type: contentType}))
 
-			body, err := makeRequest(fullURL, config.Username, config.APIToken)
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "DEBUG: Failed to fetch pages from space %s: %v\n", spaceKey, err)
-				break
+			// A queue_dir run that crashed while listing continues from the last cursor it saved
+			if listed, next, ok := config.Queue.resumeListing(spaceKey, contentType); ok {
+				spacePages = append(spacePages, listed...)
+				pagesFromSpace += len(listed)
+				endpoint = next
+				fmt.Fprintf(os.Stderr, "DEBUG: Resuming the %s listing of space %s after %d pages\n", contentType, spaceKey, len(listed))
 			}
 
-			var response PagesResponse
-			if err := json.Unmarshal(body, &response); err != nil {
-				fmt.Fprintf(os.Stderr, "DEBUG: Failed to parse response for space %s: %v\n", spaceKey, err)
-				break
-			}
+			var prefetched <-chan listingFetch
+			for endpoint != "" {
+				// Check if we've reached the limit for this space
+				if pagesPerSpace > 0 && pagesFromSpace >= pagesPerSpace {
+					fmt.Fprintf(os.Stderr, "DEBUG: Reached max pages limit (%d) for space %s, stopping fetch\n", pagesPerSpace, spaceKey)
+					break
+				}
 
-			// Debug: Show what types of content we're getting
-			if len(response.Results) > 0 {
-				typeCount := make(map[string]int)
-				for _, page := range response.Results {
-					if page.Type == "" {
-						typeCount["page"] = typeCount["page"] + 1 // Default to page if empty
-					} else {
-						typeCount[page.Type]++
-					}
+				var body []byte
+				if prefetched != nil {
+					fetched := <-prefetched
+					prefetched = nil
+					body, err = fetched.body, fetched.err
+				} else {
+					fullURL := strings.TrimSuffix(config.ConfluenceURL, "/") + endpoint
+					fmt.Fprintf(os.Stderr, "DEBUG: Fetching %s\n", fullURL)
+					body, err = fetchWithPolicy(config, opPageListing, fullURL)
 				}
-				fmt.Fprintf(os.Stderr, "DEBUG: Content types in this batch from space %s: %+v\n", spaceKey, typeCount)
-
-				// Show a few example titles
-				fmt.Fprintf(os.Stderr, "DEBUG: Example titles in this batch from space %s:\n", spaceKey)
-				for i, page := range response.Results[:min(3, len(response.Results))] {
-					pageType := page.Type
-					if pageType == "" {
-						pageType = "page"
-					}
-					fmt.Fprintf(os.Stderr, "  %d. [%s] %s (ID: %s)\n", i+1, pageType, page.Title, page.ID)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "DEBUG: Failed to fetch pages from space %s: %v\n", spaceKey, err)
+					break
 				}
-			}
 
-			// Add results, but respect the limit and set space key
-			pagesToAdd := response.Results
-			if pagesPerSpace > 0 {
-				remaining := pagesPerSpace - pagesFromSpace
-				if len(pagesToAdd) > remaining {
-					pagesToAdd = pagesToAdd[:remaining]
-					fmt.Fprintf(os.Stderr, "DEBUG: Limiting to %d pages to stay within space limit for %s\n", remaining, spaceKey)
+				var response PagesResponse
+				if err := json.Unmarshal(body, &response); err != nil {
+					fmt.Fprintf(os.Stderr, "DEBUG: Failed to parse response for space %s: %v\n", spaceKey, err)
+					break
 				}
-			}
 
-			// Set space key for each page
-			for i := range pagesToAdd {
-				pagesToAdd[i].SpaceKey = spaceKey
-			}
+				// Debug: Show what types of content we're getting
+				if len(response.Results) > 0 {
+					typeCount := make(map[string]int)
+					for _, page := range response.Results {
+						if page.Type == "" {
+							typeCount["page"] = typeCount["page"] + 1 // Default to page if empty
+						} else {
+							typeCount[page.Type]++
+						}
+					}
+					fmt.Fprintf(os.Stderr, "DEBUG: Content types in this batch from space %s: %+v\n", spaceKey, typeCount)
+
+					// Show a few example titles
+					fmt.Fprintf(os.Stderr, "DEBUG: Example titles in this batch from space %s:\n", spaceKey)
+					for i, page := range response.Results[:min(3, len(response.Results))] {
+						pageType := page.Type
+						if pageType == "" {
+							pageType = "page"
+						}
+						fmt.Fprintf(os.Stderr, "  %d. [%s] %s (ID: %s)\n", i+1, pageType, page.Title, page.ID)
+					}
+				}
 
-			spacePages = append(spacePages, pagesToAdd...)
-			pagesFromSpace += len(pagesToAdd)
-			fmt.Fprintf(os.Stderr, "DEBUG: Fetched %d pages from space %s, total from this space: %d\n", len(pagesToAdd), spaceKey, pagesFromSpace)
+				// Add results, but respect the limit and set space key
+				pagesToAdd, dropped := dropStale(config, response.Results)
+				if dropped > 0 {
+					// Newest first, so the rest of the listing is older still
+					fmt.Fprintf(os.Stderr, "DEBUG: Reached content of space %s not modified since %s, stopping\n", spaceKey, config.ModifiedSince)
+				}
+				if pagesPerSpace > 0 {
+					remaining := pagesPerSpace - pagesFromSpace
+					if len(pagesToAdd) > remaining {
+						pagesToAdd = pagesToAdd[:remaining]
+						fmt.Fprintf(os.Stderr, "DEBUG: Limiting to %d pages to stay within space limit for %s\n", remaining, spaceKey)
+					}
+				}
 
-			// Stop if we've reached the limit for this space
-			if pagesPerSpace > 0 && pagesFromSpace >= pagesPerSpace {
-				fmt.Fprintf(os.Stderr, "DEBUG: Reached max pages limit (%d) for space %s, stopping\n", pagesPerSpace, spaceKey)
-				break
-			}
+				// Set space key for each page; v2 listings don't say the type
+				for i := range pagesToAdd {
+					pagesToAdd[i].SpaceKey = spaceKey
+					if contentType == "blogpost" {
+						pagesToAdd[i].Type = contentType
+					}
+				}
 
-			// Get next endpoint - handle cursor-based pagination
-			if response.Links.Next != "" {
-				if strings.HasPrefix(response.Links.Next, "/wiki/") {
-					endpoint = response.Links.Next[5:] // Remove "/wiki" prefix
+				spacePages = append(spacePages, pagesToAdd...)
+				pagesFromSpace += len(pagesToAdd)
+				fmt.Fprintf(os.Stderr, "DEBUG: Fetched %d pages from space %s, total from this space: %d\n", len(pagesToAdd), spaceKey, pagesFromSpace)
+
+				// Stop if we've reached the limit for this space, otherwise get the
+				// next endpoint - handle cursor-based pagination
+				if pagesPerSpace > 0 && pagesFromSpace >= pagesPerSpace {
+					fmt.Fprintf(os.Stderr, "DEBUG: Reached max pages limit (%d) for space %s, stopping\n", pagesPerSpace, spaceKey)
+					endpoint = ""
+				} else if dropped > 0 {
+					endpoint = ""
+				} else if response.Links.Next != "" {
+					if strings.HasPrefix(response.Links.Next, "/wiki/") {
+						endpoint = response.Links.Next[5:] // Remove "/wiki" prefix
+					} else {
+						endpoint = response.Links.Next
+					}
+					fmt.Fprintf(os.Stderr, "DEBUG: Next endpoint for space %s: %s\n", spaceKey, endpoint)
 				} else {
-					endpoint = response.Links.Next
+					endpoint = ""
+				}
+				if err := config.Queue.recordListing(spaceKey, contentType, endpoint, pagesToAdd); err != nil {
+					fmt.Fprintf(os.Stderr, "DEBUG: Failed to save the listing cursor of space %s: %v\n", spaceKey, err)
+				}
+
+				// Hand the batch to the workers while the next one is fetched
+				if emit != nil {
+					if endpoint != "" {
+						prefetched = prefetchListing(config, strings.TrimSuffix(config.ConfluenceURL, "/")+endpoint)
+					}
+					emit(pagesToAdd)
 				}
-				fmt.Fprintf(os.Stderr, "DEBUG: Next endpoint for space %s: %s\n", spaceKey, endpoint)
-			} else {
-				endpoint = ""
 			}
 		}
 
@@ -480,99 +970,361 @@ func fetchAllPages(config *Config) ([]Page, error) {
 	return allPages, nil
 }
 
+// Source supplies the pages to import and their storage-format content
+type Source interface {
+	// TestConnection verifies the source is usable before listing starts
+	TestConnection(config *Config) error
+	// ListPages returns every page to process, tagged with its space key
+	ListPages(config *Config) ([]Page, error)
+	// FetchContent returns the full content of a single listed page, giving up
+	// once ctx is done
+	FetchContent(ctx context.Context, config *Config, page Page) (*ContentResponse, error)
+}
+
+// confluenceSource reads pages from a live Confluence instance over REST
+type confluenceSource struct{}
+
+func (confluenceSource) TestConnection(config *Config) error {
+	testURL := connectionTestURL(config)
+	fmt.Fprintf(os.Stderr, "DEBUG: Testing connection to: %s\n", testURL)
+
+	_, headers, err := makeRequestWithHeaders(testURL, config.Username, config.APIToken)
+	config.RateLimitHeadroom = rateLimitHeadroom(headers)
+	return err
+}
+
+func (confluenceSource) ListPages(config *Config) ([]Page, error) {
+	pages, err := fetchAllPages(config)
+	config.SpaceCache.save()
+	return pages, err
+}
+
+func (confluenceSource) StreamPages(config *Config, emit func([]Page)) error {
+	_, err := listAllPages(config, emit)
+	config.SpaceCache.save()
+	return err
+}
+
+func (confluenceSource) FetchContent(ctx context.Context, config *Config, page Page) (*ContentResponse, error) {
+	if page.Content != nil {
+		return page.Content, nil
+	}
+	if config.APIVersion == apiVersionV2 {
+		return fetchContentV2(ctx, config, page)
+	}
+
+	// Get full page content using v1 API, leaving out labels fetched in a batch
+	expand := config.ContentExpand
+	labels, batched := config.Labels.lookup(page.ID)
+	if batched {
+		expand = withoutLabelsExpansion(expand)
+	}
+	contentURL := fmt.Sprintf("%s/rest/api/content/%s?expand=%s",
+		strings.TrimSuffix(config.ConfluenceURL, "/"), page.ID, url.QueryEscape(expand))
+
+	body, err := fetchWithContext(ctx, config, opContentFetch, contentURL)
+	if err != nil {
+		return nil, err
+	}
+
+	var contentResponse ContentResponse
+	if err := json.Unmarshal(body, &contentResponse); err != nil {
+		return nil, fmt.Errorf("parsing content response: %w", err)
+	}
+	if batched {
+		contentResponse.Metadata = labels.Metadata
+	}
+	return &contentResponse, nil
+}
+
+// newSource returns the content source selected by the configuration
+func newSource(config *Config) (Source, error) {
+	switch config.Source {
+	case "", "confluence":
+		return confluenceSource{}, nil
+	case "mock":
+		return &mockSource{}, nil
+	case "export":
+		return &exportSource{}, nil
+	default:
+		return nil, fmt.Errorf("unknown source %q (expected \"confluence\", \"mock\" or \"export\")", config.Source)
+	}
+}
+
+// isOfflineSource reports whether the source works without Confluence credentials
+func isOfflineSource(config *Config) bool {
+	return config.Source == "mock" || config.Source == "export"
+}
+
+// setOrigin records which system and instance the items came from, so outputs
+// merged with SharePoint or other instances stay distinguishable, and links
+// the items that have no URL yet
+func setOrigin(config *Config, items []*ProcessedItem) {
+	instance := itemInstance(config)
+	for _, item := range items {
+		item.Source = "confluence"
+		item.Instance = instance
+		if item.URL == "" {
+			item.URL = itemURL(config, item)
+		}
+	}
+}
+
+// itemInstance identifies the instance items come from: its base URL, "mock",
+// or the export file name
+func itemInstance(config *Config) string {
+	switch config.Source {
+	case "mock":
+		return "mock"
+	case "export":
+		return "export:" + filepath.Base(config.ExportPath)
+	}
+	return strings.TrimSuffix(firstNonEmpty(config.SiteURL, config.ConfluenceURL), "/")
+}
+
 // Worker function to process pages concurrently
-func pageWorker(config *Config, converter *HTMLConverter, pages <-chan Page, results chan<- *ProcessedItem, wg *sync.WaitGroup) {
+func pageWorker(config *Config, id int, source Source, converter *HTMLConverter, pages <-chan Page, results chan<- *pageResult, wg *sync.WaitGroup) {
 	defer wg.Done()
 
-	for page := range pages {
-		// Get full page content using v1 API
-		contentURL := fmt.Sprintf("%s/rest/api/content/%s?expand=body.storage,metadata.labels",
-			strings.TrimSuffix(config.ConfluenceURL, "/"), page.ID)
-
-		body, err := makeRequest(contentURL, config.Username, config.APIToken)
+	// The memory watchdog retires workers from the highest number down
+	for config.Memory.allows(id) {
+		page, ok := <-pages
+		if !ok {
+			return
+		}
+		if _, stopped := config.Memory.Stopped(); stopped {
+			continue // Drain the pages already queued
+		}
+		items, err := processPageWithTimeout(config, source, converter, page)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "DEBUG: Failed to get content for page %s from space %s: %v\n", page.Title, page.SpaceKey, err)
-			continue
+			config.Failures.add(page, err)
 		}
+		setOrigin(config, items)
+		config.Pseudonyms.items(items)
+		config.Audit.page(config, page, items, err)
+		results <- &pageResult{sequence: page.Sequence, pageID: page.ID, version: page.Version, items: items, failed: err != nil}
+	}
+}
 
-		var contentResponse ContentResponse
-		if err := json.Unmarshal(body, &contentResponse); err != nil {
-			fmt.Fprintf(os.Stderr, "DEBUG: Failed to parse content response for page %s from space %s: %v\n", page.Title, page.SpaceKey, err)
-			continue
+// processPage fetches and converts one page. It returns no items for pages
+// that are skipped, and an error for pages that should have been imported but
+// couldn't be. Its requests are abandoned once ctx is done.
+func processPage(ctx context.Context, config *Config, source Source, converter *HTMLConverter, page Page) ([]*ProcessedItem, error) {
+	// Check the workflow status first so pages that won't be imported aren't fetched
+	var status string
+	if config.WorkflowStatus != "" {
+		var err error
+		status, err = fetchWorkflowStatus(ctx, config, page)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "DEBUG: Failed to get workflow status for page %s from space %s: %v\n", page.Title, page.SpaceKey, err)
 		}
+		if !statusAllowed(config, status) {
+			fmt.Fprintf(os.Stderr, "DEBUG: Skipping page %s from space %s with workflow status %q\n", page.Title, page.SpaceKey, status)
+			return nil, nil
+		}
+	}
 
-		// Convert HTML to text
-		cleanContent := converter.htmlToText(contentResponse.Body.Storage.Value)
+	if len(config.PropertyConditions) > 0 && !propertiesMatch(ctx, config, page) {
+		fmt.Fprintf(os.Stderr, "DEBUG: Skipping page %s from space %s without the required properties\n", page.Title, page.SpaceKey)
+		return nil, nil
+	}
 
-		// Skip empty pages
-		if strings.TrimSpace(cleanContent) == "" {
-			fmt.Fprintf(os.Stderr, "DEBUG: Skipping empty page: %s from space %s\n", page.Title, page.SpaceKey)
-			continue
+	// Pages whose restrictions can't be read are skipped rather than risk leaking them
+	if config.VisibleToGroup != "" {
+		visible, err := pageVisibleToGroup(ctx, config, page)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "DEBUG: Failed to get restrictions for page %s from space %s: %v\n", page.Title, page.SpaceKey, err)
 		}
-
-		// Limit content size
-		if len(cleanContent) > config.MaxContentLength {
-			fmt.Fprintf(os.Stderr, "DEBUG: Truncating large content for page: %s from space %s (%d chars)\n", page.Title, page.SpaceKey, len(cleanContent))
-			cleanContent = cleanContent[:config.MaxContentLength] + "\n\n[Content truncated due to size limits]"
+		if !visible {
+			fmt.Fprintf(os.Stderr, "DEBUG: Skipping page %s from space %s not visible to group %s\n", page.Title, page.SpaceKey, config.VisibleToGroup)
+			return nil, nil
 		}
+	}
 
-		// Extract labels
-		var labels []string
-		for _, label := range contentResponse.Metadata.Labels.Results {
-			labels = append(labels, label.Name)
-		}
+	contentResponse, err := source.FetchContent(ctx, config, page)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "DEBUG: Failed to get content for page %s from space %s: %v\n", page.Title, page.SpaceKey, err)
+		return nil, fmt.Errorf("fetching content: %w", err)
+	}
+
+	// Extract labels
+	var labels []string
+	for _, label := range contentResponse.Metadata.Labels.Results {
+		labels = append(labels, label.Name)
+	}
+
+	if blueprintExcluded(config, labels) {
+		fmt.Fprintf(os.Stderr, "DEBUG: Skipping page %s from space %s created from an excluded blueprint\n", page.Title, page.SpaceKey)
+		return nil, nil
+	}
+	if !labelsSelected(config, labels) {
+		fmt.Fprintf(os.Stderr, "DEBUG: Skipping page %s from space %s not selected by its labels\n", page.Title, page.SpaceKey)
+		return nil, nil
+	}
 
-		// Determine content type
-		contentType := "page"
-		if page.Type == "blogpost" {
-			contentType = "blog"
+	body := contentResponse.Body.Storage.Value
+	var comments []InlineComment
+	if config.InlineComments != "" {
+		comments, err = fetchInlineComments(ctx, config, converter, page)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "DEBUG: Failed to get inline comments for page %s from space %s: %v\n", page.Title, page.SpaceKey, err)
+		}
+		config.Pseudonyms.comments(comments)
+		if config.InlineComments == inlineCommentsInline {
+			body = anchorInlineComments(body, comments)
 		}
+	}
+	if config.OCR != "" {
+		body = ocrEmbeddedImages(ctx, config, page, body)
+	}
+	if config.ExtractPDFs == "true" {
+		body = extractEmbeddedPDFs(ctx, config, page, body)
+	}
+	body = renderDiagrams(ctx, config, page, body)
+
+	// Convert HTML to text. Bodies past stream_threshold_bytes are converted
+	// only up to the content limit, since the rest would be truncated anyway.
+	var cleanContent string
+	if config.StreamThresholdBytes > 0 && len(body) > config.StreamThresholdBytes {
+		fmt.Fprintf(os.Stderr, "DEBUG: Converting the first %d chars of large page %s from space %s (%d bytes)\n", config.MaxContentLength, page.Title, page.SpaceKey, len(body))
+		cleanContent = converter.htmlToTextPrefix(body, config.MaxContentLength)
+	} else {
+		cleanContent = converter.htmlToText(body)
+	}
 
-		item := &ProcessedItem{
-			ID:       contentResponse.ID,
-			Title:    contentResponse.Title,
-			Content:  cleanContent,
-			Type:     contentType,
-			Labels:   strings.Join(labels, ","),
-			SpaceKey: page.SpaceKey,
+	// Skip empty pages
+	if strings.TrimSpace(cleanContent) == "" {
+		fmt.Fprintf(os.Stderr, "DEBUG: Skipping empty page: %s from space %s\n", page.Title, page.SpaceKey)
+		return nil, nil
+	}
+
+	// Limit content size
+	if len(cleanContent) > config.MaxContentLength {
+		fmt.Fprintf(os.Stderr, "DEBUG: Truncating large content for page: %s from space %s (%d chars)\n", page.Title, page.SpaceKey, len(cleanContent))
+		cleanContent = cleanContent[:config.MaxContentLength] + "\n\n[Content truncated due to size limits]"
+	}
+
+	// Determine content type
+	contentType := "page"
+	if page.Type == "blogpost" {
+		contentType = "blog"
+	}
+
+	// Listing titles may have been normalized, e.g. Scroll Versions prefixes removed
+	title := contentResponse.Title
+	if page.Title != "" {
+		title = page.Title
+	}
+
+	item := &ProcessedItem{
+		ID:       contentResponse.ID,
+		Title:    title,
+		Content:  cleanContent,
+		Type:     contentType,
+		Labels:   strings.Join(labels, ","),
+		SpaceKey: page.SpaceKey,
+
+		CreatedAt: firstNonEmpty(contentResponse.History.CreatedDate, contentResponse.CreatedAt),
+		UpdatedAt: firstNonEmpty(contentResponse.Version.When, contentResponse.Version.CreatedAt),
+		Author:    firstNonEmpty(contentResponse.History.CreatedBy.DisplayName, contentResponse.AuthorID),
+		Version:   contentResponse.Version.Number,
+
+		Language:         page.Language,
+		TranslationGroup: page.TranslationGroup,
+		Status:           status,
+		Views:            page.Views,
+	}
+	// The web UI link is relative to the site, which OAuth reaches through the gateway
+	if webUI := contentResponse.Links.WebUI; webUI != "" && !isOfflineSource(config) {
+		item.URL = strings.TrimSuffix(firstNonEmpty(config.SiteURL, config.ConfluenceURL), "/") + webUI
+	}
+	if config.InlineComments == inlineCommentsAnnotations {
+		item.InlineComments = comments
+	}
+	if config.FetchViews == "true" && item.Views == nil && !isOfflineSource(config) {
+		if count, err := fetchViewCount(ctx, config, page); err != nil {
+			fmt.Fprintf(os.Stderr, "DEBUG: Failed to get view count for page %s from space %s: %v\n", page.Title, page.SpaceKey, err)
+		} else {
+			item.Views = &count
+		}
+	}
+	if config.FetchOwners == "true" && !isOfflineSource(config) {
+		item.Owners = config.SpaceOwners[page.SpaceKey]
+		if watchers, err := fetchPageWatchers(ctx, config, page); err != nil {
+			fmt.Fprintf(os.Stderr, "DEBUG: Failed to get watchers for page %s from space %s: %v\n", page.Title, page.SpaceKey, err)
+		} else {
+			item.Watchers = watchers
 		}
+	}
+	if language := labelLanguage(config, labels); language != "" {
+		item.Language = language
+	}
+
+	items := []*ProcessedItem{item}
+	if config.IncludeAttachments == "true" {
+		items = append(items, addAttachments(ctx, config, page, item)...)
+	}
+	fmt.Fprintf(os.Stderr, "DEBUG: Added page: %s from space %s (content length: %d)\n", page.Title, page.SpaceKey, len(cleanContent))
+
+	if config.HistoryVersions > 0 && historySelected(config, page, title) {
+		items = append(items, fetchHistoryItems(ctx, config, converter, page, title)...)
+	}
+	return items, nil
+}
 
-		results <- item
-		fmt.Fprintf(os.Stderr, "DEBUG: Added page: %s from space %s (content length: %d)\n", page.Title, page.SpaceKey, len(cleanContent))
+// modeImport is the default mode, importing the configured spaces
+const modeImport = "import"
+
+// validateMode checks that mode is one of the run modes
+func validateMode(config *Config) error {
+	switch config.Mode {
+	case "", modeImport, modeHealth, modeRetryFailed, modeUpdatePages, modeDecrypt, modeVerify, modeServe, modeCombined:
+		return nil
 	}
+	return fmt.Errorf("unknown mode %q", config.Mode)
+}
+
+// fail writes err as the result and exits, for errors that stop the run
+func fail(err error) {
+	json.NewEncoder(os.Stdout).Encode(Result{Error: err.Error()})
+	os.Exit(1)
 }
 
 func main() {
 	// Read input from stdin
 	input, err := io.ReadAll(os.Stdin)
 	if err != nil {
-		result := Result{Error: fmt.Sprintf("Failed to read input: %v", err)}
-		json.NewEncoder(os.Stdout).Encode(result)
-		os.Exit(1)
+		fail(fmt.Errorf("Failed to read input: %w", err))
 	}
 
 	fmt.Fprintf(os.Stderr, "DEBUG: Received input: %s...\n", string(input)[:min(200, len(input))])
 
+	// Allow empty input when everything comes from a profile
+	if strings.TrimSpace(string(input)) == "" {
+		input = []byte("{}")
+	}
+
 	// Parse JSON input as map first to handle max_pages parameter
 	var inputMap map[string]interface{}
 	if err := json.Unmarshal(input, &inputMap); err != nil {
-		result := Result{Error: fmt.Sprintf("Failed to parse input JSON: %v", err)}
-		json.NewEncoder(os.Stdout).Encode(result)
-		os.Exit(1)
+		fail(fmt.Errorf("Failed to parse input JSON: %w", err))
 	}
 
+	// Merge a named profile from the config file underneath the explicit input
+	if inputMap, err = applyProfile(inputMap); err != nil {
+		fail(fmt.Errorf("Failed to load profile: %w", err))
+	}
+	input, _ = json.Marshal(inputMap)
+
 	// Parse configuration
 	var config Config
 	if err := json.Unmarshal(input, &config); err != nil {
-		result := Result{Error: fmt.Sprintf("Failed to parse input JSON: %v", err)}
-		json.NewEncoder(os.Stdout).Encode(result)
-		os.Exit(1)
+		fail(fmt.Errorf("Failed to parse input JSON: %w", err))
 	}
 
 	// Set defaults
-	if config.MaxWorkers == 0 {
-		config.MaxWorkers = 5 // Concurrent workers for page processing
-	}
+	config.MaxWorkers = intOption(inputMap, "max_workers", config.MaxWorkers) // 0 = sized after the connection test
+	config.RateLimitHeadroom = -1
 	if config.MaxContentLength == 0 {
 		config.MaxContentLength = 250000
 	}
@@ -584,6 +1336,30 @@ func main() {
 			}
 		}
 	}
+	config.MockPages = intOption(inputMap, "mock_pages", 100)
+	config.RateLimitPerSecond = intOption(inputMap, "rate_limit_per_second", 0)
+	config.MockSeed = int64(intOption(inputMap, "mock_seed", 1))
+	config.RequestPolicies = parseRequestPolicies(inputMap)
+	config.Transport = parseTransportSettings(inputMap)
+	httpClient.Transport = newTransport(config.Transport)
+	config.SelectTopViewed = intOption(inputMap, "select_top_viewed", 0)
+	config.PDFMaxPages = intOption(inputMap, "pdf_max_pages", 50)
+	config.HistoryVersions = intOption(inputMap, "history_versions", 0)
+	config.PageBuffer = intOption(inputMap, "page_buffer", defaultPageBuffer)
+	config.ResultBuffer = intOption(inputMap, "result_buffer", defaultResultBuffer)
+	config.ListingConcurrency = intOption(inputMap, "listing_concurrency", 4)
+	config.SpaceCacheHours = intOption(inputMap, "space_cache_hours", 24)
+	config.PageTimeoutSeconds = intOption(inputMap, "page_timeout_seconds", 300)
+	config.BoilerplateThreshold = intOption(inputMap, "boilerplate_threshold", defaultBoilerplateThreshold)
+	config.StreamThresholdBytes = intOption(inputMap, "stream_threshold_bytes", 1<<20)
+	config.ListingLimit = intOption(inputMap, "listing_limit", defaultListingLimit)
+	config.MemoryLimitMB = intOption(inputMap, "memory_limit_mb", 0)
+	if config.ContentExpand == "" {
+		config.ContentExpand = defaultContentExpand
+	}
+	if config.SchemaVersion == "" {
+		config.SchemaVersion = schemaV1
+	}
 
 	// Debug parameter values
 	fmt.Fprintf(os.Stderr, "DEBUG: Parameters received:\n")
@@ -595,94 +1371,519 @@ func main() {
 		}
 		return "EMPTY"
 	}())
+	fmt.Fprintf(os.Stderr, "  deployment: %s\n", config.Deployment)
+	fmt.Fprintf(os.Stderr, "  oauth: %t (oauth_client_id: %s, oauth_token_file: %s, cloud_id: %s)\n", usesOAuth(&config), config.OAuthClientID, config.OAuthTokenFile, config.CloudID)
+	fmt.Fprintf(os.Stderr, "  session_cookie: %s\n", func() string {
+		if config.SessionCookie != "" {
+			return "***"
+		}
+		return "EMPTY"
+	}())
 	fmt.Fprintf(os.Stderr, "  space_keys: %s\n", config.SpaceKeys)
 	fmt.Fprintf(os.Stderr, "  space_key (legacy): %s\n", config.SpaceKey)
+	fmt.Fprintf(os.Stderr, "  space_categories: %s\n", config.SpaceCategories)
+	fmt.Fprintf(os.Stderr, "  exclude_space_keys: %s (space_types: %s)\n", config.ExcludeSpaceKeys, config.SpaceTypes)
 	fmt.Fprintf(os.Stderr, "  include_blogs: %s\n", config.IncludeBlogs)
 	fmt.Fprintf(os.Stderr, "  max_pages: %d\n", config.MaxPages)
 	fmt.Fprintf(os.Stderr, "  max_workers: %d\n", config.MaxWorkers)
+	fmt.Fprintf(os.Stderr, "  source: %s\n", config.Source)
+	fmt.Fprintf(os.Stderr, "  export_path: %s\n", config.ExportPath)
+	fmt.Fprintf(os.Stderr, "  mode: %s\n", config.Mode)
+	fmt.Fprintf(os.Stderr, "  api_version: %s\n", config.APIVersion)
+	fmt.Fprintf(os.Stderr, "  scroll_versions: %s (version: %s)\n", config.ScrollVersions, config.ScrollVersion)
+	fmt.Fprintf(os.Stderr, "  languages: %s (default: %s, preferred: %s)\n", config.Languages, config.DefaultLanguage, config.PreferredLanguage)
+	fmt.Fprintf(os.Stderr, "  workflow_status: %s (required: %s)\n", config.WorkflowStatus, config.RequiredStatus)
+	fmt.Fprintf(os.Stderr, "  required_properties: %s\n", config.RequiredProperties)
+	fmt.Fprintf(os.Stderr, "  fetch_views: %s (select_top_viewed: %d)\n", config.FetchViews, config.SelectTopViewed)
+	fmt.Fprintf(os.Stderr, "  fetch_owners: %s\n", config.FetchOwners)
+	fmt.Fprintf(os.Stderr, "  include_templates: %s (exclude_blueprints: %s)\n", config.IncludeTemplates, config.ExcludeBlueprints)
+	fmt.Fprintf(os.Stderr, "  include_content_types: %s\n", config.IncludeContentTypes)
+	fmt.Fprintf(os.Stderr, "  state_file: %s\n", config.StateFile)
+	fmt.Fprintf(os.Stderr, "  modified_since: %s\n", config.ModifiedSince)
+	fmt.Fprintf(os.Stderr, "  include_labels: %s (exclude_labels: %s)\n", config.IncludeLabels, config.ExcludeLabels)
+	fmt.Fprintf(os.Stderr, "  include_space_overview: %s\n", config.IncludeSpaceOverview)
+	fmt.Fprintf(os.Stderr, "  visible_to_group: %s\n", config.VisibleToGroup)
+	fmt.Fprintf(os.Stderr, "  ocr: %s\n", config.OCR)
+	fmt.Fprintf(os.Stderr, "  extract_pdfs: %s (pdf_max_pages: %d)\n", config.ExtractPDFs, config.PDFMaxPages)
+	fmt.Fprintf(os.Stderr, "  include_attachments: %s (extract_attachments: %s, attachment_mode: %s)\n", config.IncludeAttachments, config.AttachmentText, config.AttachmentMode)
+	fmt.Fprintf(os.Stderr, "  diagrams: %s\n", config.Diagrams)
+	fmt.Fprintf(os.Stderr, "  history_versions: %d (history_pages: %s)\n", config.HistoryVersions, config.HistoryPages)
+	fmt.Fprintf(os.Stderr, "  inline_comments: %s\n", config.InlineComments)
+	fmt.Fprintf(os.Stderr, "  search_listing: %s\n", config.SearchListing)
+	fmt.Fprintf(os.Stderr, "  cql: %s\n", config.CQL)
+	fmt.Fprintf(os.Stderr, "  listing_concurrency: %d\n", config.ListingConcurrency)
+	fmt.Fprintf(os.Stderr, "  cache_dir: %s (space_cache_hours: %d)\n", config.CacheDir, config.SpaceCacheHours)
+	fmt.Fprintf(os.Stderr, "  prefetch_listing: %s\n", config.PrefetchListing)
+	fmt.Fprintf(os.Stderr, "  queue_order: %s (queue_dir: %s)\n", config.QueueOrder, config.QueueDir)
+	fmt.Fprintf(os.Stderr, "  strip_boilerplate: %s (boilerplate_threshold: %d%%)\n", config.StripBoilerplate, config.BoilerplateThreshold)
+	fmt.Fprintf(os.Stderr, "  page_timeout_seconds: %d\n", config.PageTimeoutSeconds)
+	fmt.Fprintf(os.Stderr, "  stream_threshold_bytes: %d\n", config.StreamThresholdBytes)
+	fmt.Fprintf(os.Stderr, "  listing_limit: %d (content_expand: %s)\n", config.ListingLimit, config.ContentExpand)
+	fmt.Fprintf(os.Stderr, "  memory_limit_mb: %d\n", config.MemoryLimitMB)
+	fmt.Fprintf(os.Stderr, "  preserve_order: %s\n", config.PreserveOrder)
+	fmt.Fprintf(os.Stderr, "  batch_labels: %s\n", config.BatchLabels)
+	fmt.Fprintf(os.Stderr, "  schema_version: %s\n", config.SchemaVersion)
+	fmt.Fprintf(os.Stderr, "  diff_report: %s\n", config.DiffReport)
+	fmt.Fprintf(os.Stderr, "  pseudonym_file: %s\n", config.PseudonymFile)
+	fmt.Fprintf(os.Stderr, "  audit_log: %s\n", config.AuditLog)
+	fmt.Fprintf(os.Stderr, "  routes: %s\n", config.Routes)
+	fmt.Fprintf(os.Stderr, "  sinks: %s\n", config.Sinks)
+	fmt.Fprintf(os.Stderr, "  encryption: %s (age_recipients: %s)\n", config.Encryption, config.AgeRecipients)
+	fmt.Fprintf(os.Stderr, "  manifest_file: %s (signed: %t)\n", config.ManifestFile, config.ManifestSigningKey != "")
+	fmt.Fprintf(os.Stderr, "  rate_limit_per_second: %d (rate_limit_file: %s)\n", config.RateLimitPerSecond, config.RateLimitFile)
+	fmt.Fprintf(os.Stderr, "  credentials_file: %s\n", config.CredentialsFile)
+	fmt.Fprintf(os.Stderr, "  act_as_user: %s (act_as_header: %s)\n", config.ActAsUser, config.ActAsHeader)
+	fmt.Fprintf(os.Stderr, "  serve_profiles: %s (serve_addr: %s, serve_state_file: %s)\n", config.ServeProfiles, config.ServeAddr, config.ServeStateFile)
+	fmt.Fprintf(os.Stderr, "  sharepoint_script: %s\n", config.SharePointScript)
+	fmt.Fprintf(os.Stderr, "  webhook_batch_seconds: %s (webhook_secret set: %t)\n", config.WebhookBatchSeconds, config.WebhookSecret != "")
+	fmt.Fprintf(os.Stderr, "  transport: %d idle conns (%d per host), idle timeout %s, dial timeout %s, TLS handshake timeout %s, HTTP/2 %t\n",
+		config.Transport.MaxIdleConns, config.Transport.MaxIdleConnsPerHost, config.Transport.IdleConnTimeout,
+		config.Transport.DialTimeout, config.Transport.TLSHandshakeTimeout, config.Transport.HTTP2)
+	fmt.Fprintf(os.Stderr, "  output_file: %s (page_buffer: %d, result_buffer: %d)\n", config.OutputFile, config.PageBuffer, config.ResultBuffer)
+
+	if err := validateMode(&config); err != nil {
+		fail(err)
+	}
+
+	// Serve mode runs scheduled imports of profiles, each with its own input
+	if config.Mode == modeServe {
+		if err := serve(&config); err != nil {
+			fail(err)
+		}
+		return
+	}
 
-	// Check for required parameters
-	var missingParams []string
-	if config.ConfluenceURL == "" {
-		missingParams = append(missingParams, "CONFLUENCE_URL")
+	// Combined mode runs this importer and the SharePoint one side by side
+	if config.Mode == modeCombined {
+		if err := validateCombined(&config); err != nil {
+			fail(err)
+		}
+		result, err := runCombined(&config, inputMap)
+		if err != nil {
+			result = Result{Error: err.Error()}
+		}
+		json.NewEncoder(os.Stdout).Encode(result)
+		if result.Error != "" {
+			os.Exit(1)
+		}
+		return
 	}
-	if config.Username == "" {
-		missingParams = append(missingParams, "CONFLUENCE_USERNAME")
+
+	if config.APIVersion, err = validateAPIVersion(config.APIVersion); err != nil {
+		fail(err)
 	}
-	if config.APIToken == "" {
-		missingParams = append(missingParams, "CONFLUENCE_API_TOKEN")
+	if err := validateDeployment(&config); err != nil {
+		fail(err)
 	}
-	if config.SpaceKeys == "" && config.SpaceKey == "" {
-		missingParams = append(missingParams, "space_keys or space_key")
+
+	source, err := newSource(&config)
+	if err != nil {
+		fail(err)
 	}
 
-	// If all required parameters are empty, Confluence is disabled - return empty results
-	if config.ConfluenceURL == "" && config.Username == "" && config.APIToken == "" && config.SpaceKeys == "" && config.SpaceKey == "" {
-		fmt.Fprintf(os.Stderr, "DEBUG: Confluence is disabled - returning empty results\n")
-		result := Result{Items: "[]"}
-		json.NewEncoder(os.Stdout).Encode(result)
-		os.Exit(0)
+	if err := validateWorkflowStatus(&config); err != nil {
+		fail(err)
 	}
 
-	if len(missingParams) > 0 {
-		errorMsg := fmt.Sprintf("Missing required parameters: %s", strings.Join(missingParams, ", "))
-		fmt.Fprintf(os.Stderr, "DEBUG: %s\n", errorMsg)
-		result := Result{Error: errorMsg}
-		json.NewEncoder(os.Stdout).Encode(result)
-		os.Exit(1)
+	if err := validateRequiredProperties(&config); err != nil {
+		fail(err)
 	}
 
-	// Test connection
-	testURL := fmt.Sprintf("%s/api/v2/pages?limit=1", strings.TrimSuffix(config.ConfluenceURL, "/"))
-	fmt.Fprintf(os.Stderr, "DEBUG: Testing connection to: %s\n", testURL)
+	if err := validateOCR(&config); err != nil {
+		fail(err)
+	}
 
-	_, err = makeRequest(testURL, config.Username, config.APIToken)
-	if err != nil {
+	if err := validatePDFExtraction(&config); err != nil {
+		fail(err)
+	}
+	if err := validateAttachments(&config); err != nil {
+		fail(err)
+	}
+	if err := validateContentTypes(&config); err != nil {
+		fail(err)
+	}
+
+	if err := validateDiagrams(&config); err != nil {
+		fail(err)
+	}
+
+	if err := validateHistory(&config); err != nil {
+		fail(err)
+	}
+
+	if err := validateInlineComments(&config); err != nil {
+		fail(err)
+	}
+	if err := validateBuffers(&config); err != nil {
+		fail(err)
+	}
+
+	if err := validateSpaceCache(&config); err != nil {
+		fail(err)
+	}
+	config.SpaceCache = loadSpaceCache(&config)
+
+	if err := validateQueueOrder(&config); err != nil {
+		fail(err)
+	}
+
+	if err := validateSpaceTypes(&config); err != nil {
+		fail(err)
+	}
+
+	if err := validateBoilerplate(&config); err != nil {
+		fail(err)
+	}
+
+	if err := validateQueueDir(&config); err != nil {
+		fail(err)
+	}
+
+	if err := validatePrefetchListing(&config); err != nil {
+		fail(err)
+	}
+
+	if err := validatePageTimeout(&config); err != nil {
+		fail(err)
+	}
+
+	if err := validateListing(&config); err != nil {
+		fail(err)
+	}
+
+	if err := validateMemoryLimit(&config); err != nil {
+		fail(err)
+	}
+
+	if err := validateRetryFailed(&config); err != nil {
+		fail(err)
+	}
+
+	if err := validateUpdatePages(&config); err != nil {
+		fail(err)
+	}
+
+	if err := validateBatchLabels(&config); err != nil {
+		fail(err)
+	}
+	if err := validateLabelFilters(&config); err != nil {
+		fail(err)
+	}
+	if err := validateModifiedSince(&config); err != nil {
+		fail(err)
+	}
+	if err := validateStateFile(&config); err != nil {
+		fail(err)
+	}
+	config.Failures = &failureReport{}
+
+	if err := validateSchemaVersion(&config); err != nil {
+		fail(err)
+	}
+
+	if err := validateDiffReport(&config); err != nil {
+		fail(err)
+	}
+
+	if err := validateSinks(&config); err != nil {
+		fail(err)
+	}
+
+	if err := validateRoutes(&config); err != nil {
+		fail(err)
+	}
+
+	if config.Pseudonyms, err = loadPseudonyms(&config); err != nil {
+		fail(err)
+	}
+
+	if err := validateEncryption(&config); err != nil {
+		fail(err)
+	}
+
+	// Decrypt mode only turns encrypted_file back into JSON Lines, without connecting anywhere
+	if config.Mode == modeDecrypt {
+		if err := decryptFile(&config, config.EncryptedFile, config.OutputFile); err != nil {
+			fail(err)
+		}
+		json.NewEncoder(os.Stdout).Encode(Result{OutputFile: config.OutputFile})
+		return
+	}
+
+	if err := validateManifest(&config); err != nil {
+		fail(err)
+	}
+
+	// Verify mode checks a previous run's outputs against its manifest
+	if config.Mode == modeVerify {
+		report := verifyManifest(&config)
+		json.NewEncoder(os.Stdout).Encode(report)
+		if report.Status != "ok" {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if requestLimiter, err = newRateLimiter(&config); err != nil {
+		fail(err)
+	}
+
+	if err := validateActAs(&config); err != nil {
+		fail(err)
+	}
+
+	if err := validateOAuth(&config); err != nil {
+		fail(err)
+	}
+
+	if err := loadCredentials(&config); err != nil {
+		fail(err)
+	}
+
+	// Restrictions can't be evaluated offline, and importing everything would leak restricted pages
+	if config.VisibleToGroup != "" && isOfflineSource(&config) {
+		fail(errors.New("visible_to_group needs the confluence source"))
+	}
+	if config.SpaceCategories != "" && isOfflineSource(&config) {
+		fail(errors.New("space_categories needs the confluence source"))
+	}
+	if config.CQL != "" && isOfflineSource(&config) {
+		fail(errors.New("cql needs the confluence source"))
+	}
+	if slices.Contains(parseSpaceKeys(&config), allSpaces) && isOfflineSource(&config) {
+		fail(fmt.Errorf("space_keys %q needs the confluence source; leave space_keys empty to import every space of an export", allSpaces))
+	}
+
+	// Offline sources need no credentials, so only validate them for Confluence
+	if !isOfflineSource(&config) {
+		// Check for required parameters
+		var missingParams []string
+		if config.ConfluenceURL == "" {
+			missingParams = append(missingParams, "CONFLUENCE_URL")
+		}
+		// A session cookie authenticates without a username and token, and a
+		// Server/Data Center Personal Access Token or OAuth token without a username
+		if config.Username == "" && config.SessionCookie == "" && config.Deployment != deploymentServer && !usesOAuth(&config) {
+			missingParams = append(missingParams, "CONFLUENCE_USERNAME")
+		}
+		if config.APIToken == "" && config.SessionCookie == "" {
+			missingParams = append(missingParams, "CONFLUENCE_API_TOKEN")
+		}
+		if config.SpaceKeys == "" && config.SpaceKey == "" && config.SpaceCategories == "" && config.CQL == "" {
+			missingParams = append(missingParams, "space_keys, space_key, space_categories or cql")
+		}
+
+		// If all required parameters are empty, Confluence is disabled - return empty results
+		if config.ConfluenceURL == "" && config.Username == "" && config.APIToken == "" && config.SessionCookie == "" && config.SpaceKeys == "" && config.SpaceKey == "" && config.SpaceCategories == "" && config.CQL == "" {
+			fmt.Fprintf(os.Stderr, "DEBUG: Confluence is disabled - returning empty results\n")
+			result := Result{Items: "[]", SchemaVersion: config.SchemaVersion}
+			json.NewEncoder(os.Stdout).Encode(result)
+			os.Exit(0)
+		}
+
+		if len(missingParams) > 0 {
+			errorMsg := fmt.Sprintf("Missing required parameters: %s", strings.Join(missingParams, ", "))
+			fmt.Fprintf(os.Stderr, "DEBUG: %s\n", errorMsg)
+			fail(errors.New(errorMsg))
+		}
+	}
+
+	// Spaces selected by wildcard or category are resolved once, before anything lists them
+	if !isOfflineSource(&config) {
+		if err := resolveAllSpaces(&config); err != nil {
+			fail(err)
+		}
+		if err := resolveSpaceCategories(&config); err != nil {
+			fail(err)
+		}
+	}
+	if err := excludeSpaces(&config); err != nil {
+		fail(err)
+	}
+
+	// Health mode reports on every configured space instead of importing
+	if config.Mode == modeHealth {
+		report := runHealthCheck(&config)
+		json.NewEncoder(os.Stdout).Encode(report)
+		if report.Status != healthStatusHealthy {
+			os.Exit(1)
+		}
+		return
+	}
+
+	// Test connection
+	if err := source.TestConnection(&config); err != nil {
 		fmt.Fprintf(os.Stderr, "DEBUG: Connection test failed: %v\n", err)
-		result := Result{Error: fmt.Sprintf("Confluence connection failed: %v", err)}
-		json.NewEncoder(os.Stdout).Encode(result)
-		os.Exit(1)
+		fail(fmt.Errorf("Confluence connection failed: %w", err))
 	}
 
 	fmt.Fprintf(os.Stderr, "DEBUG: Connection test successful\n")
 
-	// Fetch all pages
-	pages, err := fetchAllPages(&config)
+	// Importing with the service account's visibility would leak pages act_as_user can't see
+	if err := verifyActAs(&config); err != nil {
+		fail(err)
+	}
+
+	config.MaxWorkers = resolveWorkerCount(&config, config.MaxWorkers)
+
+	runStarted := time.Now()
+	queue, err := openDiskQueue(&config)
 	if err != nil {
-		result := Result{Error: fmt.Sprintf("Failed to fetch pages: %v", err)}
-		json.NewEncoder(os.Stdout).Encode(result)
-		os.Exit(1)
+		fail(err)
+	}
+	config.Queue = queue
+	if config.Sync, err = openSyncState(&config); err != nil {
+		fail(err)
+	}
+
+	// Fetch all pages, unless prefetch_listing streams them to the workers
+	// below. A retry_failed run takes the previous run's failed pages instead,
+	// and an update_pages run the pages it was given.
+	var pages, removedPages []Page
+	streamer, streaming := source.(pageStreamer)
+	streaming = streaming && config.PrefetchListing == "true" && !mergesIntoOutput(&config)
+	if config.Mode == modeRetryFailed {
+		pages, err = loadFailedPages(&config)
+		if err != nil {
+			fail(fmt.Errorf("Failed to load failed pages: %w", err))
+		}
+	} else if config.Mode == modeUpdatePages {
+		pages, removedPages, err = loadPageUpdates(&config)
+		if err != nil {
+			fail(err)
+		}
+	} else if queue.resuming() {
+		// The queue on disk already holds the listing
+	} else if !streaming {
+		pages, err = source.ListPages(&config)
+		if err != nil {
+			fail(fmt.Errorf("Failed to fetch pages: %w", err))
+		}
+		pages = applyScrollVersions(&config, pages)
+		pages = applyTranslations(&config, pages)
+		if config.SelectTopViewed > 0 && !isOfflineSource(&config) {
+			pages = selectTopViewed(&config, pages, config.SelectTopViewed)
+		}
+		pages = orderQueue(&config, pages)
+		pages = config.Sync.changed(pages)
+	}
+	if !streaming {
+		if config.FetchOwners == "true" && !isOfflineSource(&config) {
+			config.SpaceOwners = fetchSpaceOwners(&config, append(pages, queue.spacePages()...))
+		}
+		if config.VisibleToGroup != "" {
+			config.GroupVisibility = newGroupVisibility(config.VisibleToGroup)
+			pages = filterSpacesVisibleToGroup(&config, pages)
+		}
+	}
+	if queue != nil && !queue.resuming() {
+		if err := queue.enqueue(&config, pages); err != nil {
+			fail(err)
+		}
+		// Workers read the pages back from the queue
+		pages = nil
+	}
+	config.Labels = newLabelCache(&config)
+	if !streaming && queue == nil {
+		config.Labels.fetch(&config, pages)
 	}
 
 	// Create HTML converter
 	converter := NewHTMLConverter()
 
+	var sink itemSink
+	if mergesIntoOutput(&config) {
+		sink, err = newRetrySink(&config, append(append([]Page{}, pages...), removedPages...))
+	} else {
+		sink, err = newItemSink(&config)
+	}
+	if err == nil {
+		sink, err = newRoutingSink(&config, sink)
+	}
+	if err != nil {
+		fail(err)
+	}
+	diff := newDiffSink(&config, sink)
+	if diff != nil {
+		sink = diff
+	}
+	// Outermost, so the diff report and every output see the stripped content
+	if sink, err = newBoilerplateSink(&config, sink); err != nil {
+		fail(err)
+	}
+
+	if config.Audit, err = openAuditLog(&config); err != nil {
+		fail(err)
+	}
+
+	config.Memory = startMemoryWatchdog(&config)
+
 	// Set up concurrent processing
-	pagesChan := make(chan Page, 100)
-	resultsChan := make(chan *ProcessedItem, 100)
+	pagesChan := make(chan Page, config.PageBuffer)
+	resultsChan := make(chan *pageResult, config.ResultBuffer)
 	var wg sync.WaitGroup
 
 	// Start worker goroutines
 	for i := 0; i < config.MaxWorkers; i++ {
 		wg.Add(1)
-		go pageWorker(&config, converter, pagesChan, resultsChan, &wg)
+		go pageWorker(&config, i, source, converter, pagesChan, resultsChan, &wg)
 	}
 
-	// Start result collector goroutine
-	var items []*ProcessedItem
+	// Start result collector goroutine. It hands each item to the sink as it
+	// arrives and keeps draining after a sink error, so workers never block.
+	var sinkErr error
 	var resultWg sync.WaitGroup
 	resultWg.Add(1)
 	go func() {
 		defer resultWg.Done()
-		for item := range resultsChan {
-			items = append(items, item)
+		collector := newResultCollector(&config, sink)
+		for result := range resultsChan {
+			if sinkErr != nil {
+				continue
+			}
+			config.Sync.apply(result)
+			// With queue_dir, items go to disk and reach the sink once all pages are done
+			if queue != nil {
+				sinkErr = queue.record(result)
+			} else {
+				sinkErr = collector.add(result)
+			}
+		}
+		if sinkErr == nil {
+			sinkErr = collector.flush()
 		}
 	}()
 
-	// Send pages to workers
+	// Send pages to workers, numbered in listing order
+	var listErr error
 	go func() {
 		defer close(pagesChan)
+		if queue != nil {
+			listErr = queue.feed(&config, pagesChan)
+			return
+		}
+		sequence := 0
+		if streaming {
+			listErr = streamer.StreamPages(&config, func(batch []Page) {
+				batch = config.Sync.changed(batch)
+				config.Labels.fetch(&config, batch)
+				for _, page := range batch {
+					if _, stopped := config.Memory.Stopped(); stopped {
+						return
+					}
+					page.Sequence = sequence
+					sequence++
+					pagesChan <- page
+				}
+			})
+			return
+		}
 		for _, page := range pages {
+			if _, stopped := config.Memory.Stopped(); stopped {
+				return
+			}
+			page.Sequence = sequence
+			sequence++
 			pagesChan <- page
 		}
 	}()
@@ -693,22 +1894,107 @@ func main() {
 
 	// Wait for result collector
 	resultWg.Wait()
+	config.Memory.Close()
+	if queue != nil && sinkErr == nil && listErr == nil {
+		sinkErr = queue.replay(sink)
+	}
 
-	fmt.Fprintf(os.Stderr, "DEBUG: Final item count: %d\n", len(items))
+	if listErr != nil {
+		sink.Close()
+		config.Audit.Close()
+		fail(fmt.Errorf("Failed to fetch pages: %w", listErr))
+	}
 
-	// Convert items to JSON string
-	itemsJSON, err := json.Marshal(items)
-	if err != nil {
-		result := Result{Error: fmt.Sprintf("Failed to marshal items: %v", err)}
-		json.NewEncoder(os.Stdout).Encode(result)
-		os.Exit(1)
+	var extraItems []*ProcessedItem
+	// A retry_failed run keeps the extra items of the previous output
+	_, stopped := config.Memory.Stopped()
+	skipExtras := stopped || mergesIntoOutput(&config)
+	if config.IncludeTemplates == "true" && !isOfflineSource(&config) && !skipExtras {
+		extraItems = append(extraItems, fetchSpaceTemplates(&config, converter)...)
+	}
+	if config.IncludeContentTypes != "" && !skipExtras {
+		extraItems = append(extraItems, fetchSpaceContentTypes(&config, converter)...)
 	}
+	if config.IncludeSpaceOverview == "true" && !isOfflineSource(&config) && !skipExtras {
+		extraItems = append(extraItems, fetchSpaceOverviews(&config, source, converter)...)
+	}
+	setOrigin(&config, extraItems)
+	config.Pseudonyms.items(extraItems)
+	config.Audit.items(&config, extraItems)
+	extraItems = config.Sync.applyExtra(extraItems)
+	// Pages gone from the listing are only told apart from pages this run
+	// never reached when it listed and processed everything
+	complete := !stopped && config.MaxPages == 0 && config.SelectTopViewed == 0 && config.ModifiedSince == ""
+	extraItems = append(extraItems, config.Sync.deletions(&config, complete)...)
+	for _, item := range extraItems {
+		if sinkErr == nil {
+			sinkErr = sink.Write(item)
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "DEBUG: Final item count: %d\n", sink.Count())
 
 	// Return result
-	result := Result{Items: string(itemsJSON)}
+	result, err := sink.Close()
+	if err == nil {
+		err = sinkErr
+	}
+	if err == nil {
+		// Items already carry the new pseudonyms, so losing them is an error
+		if err = config.Pseudonyms.save(); err != nil {
+			err = fmt.Errorf("saving pseudonym_file: %w", err)
+		}
+	}
+	if err == nil {
+		// The next run compares against the old state again, emitting the same actions
+		if stateErr := config.Sync.save(); stateErr != nil {
+			fmt.Fprintf(os.Stderr, "DEBUG: Failed to write state_file: %v\n", stateErr)
+		}
+	}
+	if auditErr := config.Audit.Close(); err == nil {
+		err = auditErr
+	}
+	if err != nil {
+		fail(fmt.Errorf("Failed to write items: %w", err))
+	}
+	result.FailedPages = config.Failures.String()
+	// An update_pages run leaves the list for retry_failed to the full runs
+	if config.Mode != modeUpdatePages {
+		config.Failures.save(&config)
+	}
+	if reason, stopped := config.Memory.Stopped(); stopped {
+		result.Partial = reason
+	}
+	queue.finish(result.Partial == "")
+	// Only a full listing shows which items were removed
+	if err := diff.finish(complete && !mergesIntoOutput(&config)); err != nil {
+		fmt.Fprintf(os.Stderr, "DEBUG: Failed to write diff report: %v\n", err)
+	}
+	if result.Partial == "" && !mergesIntoOutput(&config) {
+		recordRun(&config, runStarted)
+	}
+	result.SchemaVersion = config.SchemaVersion
+	// Without its manifest, downstream ingestion can't trust the outputs
+	if err := writeManifest(&config, result); err != nil {
+		fail(fmt.Errorf("Failed to write manifest_file: %w", err))
+	}
 	json.NewEncoder(os.Stdout).Encode(result)
 }
 
+// intOption reads an integer parameter that may arrive as a string (Terraform
+// external data sources only pass strings) or as a JSON number
+func intOption(inputMap map[string]interface{}, key string, defaultValue int) int {
+	switch value := inputMap[key].(type) {
+	case string:
+		if parsed, err := strconv.Atoi(strings.TrimSpace(value)); err == nil {
+			return parsed
+		}
+	case float64:
+		return int(value)
+	}
+	return defaultValue
+}
+
 func min(a, b int) int {
 	if a < b {
 		return a
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// The expected outputs are the ones of the converter before the single-pass
+// rewrite, except where noted: those cases were broken before it
+func TestHTMLToText(t *testing.T) {
+	tests := []struct {
+		name string
+		html string
+		want string
+	}{
+		{
+			name: "headings",
+			html: `<h1>Title</h1><p>Intro text.</p><h2>Section</h2><p>Body</p><h3>Sub &amp; more</h3>`,
+			want: "# Title\n\nIntro text.\n\n## Section\n\nBody\n\n### Sub & more",
+		},
+		{
+			name: "unordered list",
+			html: `<ul><li>One</li><li>Two <strong>bold</strong></li><li>Three</li></ul>`,
+			want: "- One\n- Two **bold**\n- Three",
+		},
+		{
+			name: "ordered list",
+			html: `<ol><li>First</li><li>Second</li></ol>`,
+			want: "- First\n- Second",
+		},
+		{
+			// Was "Outer\n- Inner\n\n - Last", losing the outer bullet
+			name: "nested list",
+			html: `<ul><li>Outer<ul><li>Inner</li></ul></li><li>Last</li></ul>`,
+			want: "- Outer\n- Inner\n\n- Last",
+		},
+		{
+			name: "table",
+			html: `<table><tbody><tr><th>Name</th><th>Value</th></tr><tr><td>a</td><td>1</td></tr><tr><td>b</td><td>2</td></tr></tbody></table>`,
+			want: "| Name | Value |\n| --- | --- |\n| a | 1 |\n| b | 2 |",
+		},
+		{
+			// Was "| x | in1 | in2 |", adding a column to the outer table
+			name: "nested table",
+			html: `<table><tbody><tr><th>Outer</th><th>Detail</th></tr><tr><td>x</td><td><table><tbody><tr><td>in1</td><td>in2</td></tr></tbody></table></td></tr></tbody></table>`,
+			want: "| Outer | Detail |\n| --- | --- |\n| x | \\| in1 \\| in2 \\| \\| --- \\| --- \\| |",
+		},
+		{
+			// Was "Run:\n\n bash ]]> \n\nDone", losing the code
+			name: "code macro",
+			html: `<p>Run:</p><ac:structured-macro ac:name="code"><ac:parameter ac:name="language">bash</ac:parameter><ac:plain-text-body><![CDATA[echo "hi" && ls <dir>]]></ac:plain-text-body></ac:structured-macro><p>Done</p>`,
+			want: "Run:\n\nbash\n```\necho \"hi\" && ls <dir>\n```\n\nDone",
+		},
+		{
+			name: "code macro ending in a newline",
+			html: "<ac:plain-text-body><![CDATA[a &amp; b\n]]></ac:plain-text-body>",
+			want: "```\na &amp; b\n```",
+		},
+		{
+			// Was "```\nline 1\n line 2\n```", collapsing the indentation
+			name: "pre",
+			html: "<pre>line 1\n  line 2</pre>",
+			want: "```\nline 1\n  line 2\n```",
+		},
+		{
+			name: "pre after text",
+			html: "See<pre>x</pre>after",
+			want: "See\n```\nx\n```\nafter",
+		},
+		{
+			name: "entities",
+			html: `<p>a&nbsp;b &lt;tag&gt; &quot;q&quot; &rsquo;s &mdash; &hellip; &#39;x&#39; &#x2014; &copy; &unknown;</p>`,
+			want: "a b <tag> \"q\" 's — ... &#39;x&#39; &#x2014; &copy; &unknown;",
+		},
+		{
+			name: "inline",
+			html: `<p>Some <em>em</em>, <code>code</code> and <a href="https://example.com">a link</a>.</p><p>Second<br/>line</p>`,
+			want: "Some *em*, `code` and [a link](https://example.com).\n\nSecond\nline",
+		},
+	}
+
+	converter := NewHTMLConverter()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := converter.htmlToText(tt.html); got != tt.want {
+				t.Errorf("htmlToText() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// largePage generates a page of about 1 MB mixing the elements pages are made of
+func largePage() string {
+	var b strings.Builder
+	for i := 0; b.Len() < 1<<20; i++ {
+		fmt.Fprintf(&b, `<h2>Section %d</h2><p>Some <strong>bold</strong> and <em>emphasized</em> text with <a href="https://example.com/%d">a link</a>, `, i, i)
+		b.WriteString(`entities &amp; &lt;tags&gt; &mdash; and <code>inline code</code>.</p>`)
+		b.WriteString(`<ul><li>One</li><li>Two<ul><li>Nested</li></ul></li></ul>`)
+		b.WriteString(`<table><tbody><tr><th>Name</th><th>Value</th></tr><tr><td>a</td><td>1</td></tr><tr><td>b</td><td>2</td></tr></tbody></table>`)
+		b.WriteString(`<ac:structured-macro ac:name="code"><ac:plain-text-body><![CDATA[for i in 1 2 3; do echo "$i"; done]]></ac:plain-text-body></ac:structured-macro>`)
+	}
+	return b.String()
+}
+
+func BenchmarkHTMLToText(b *testing.B) {
+	converter := NewHTMLConverter()
+	page := largePage()
+	b.SetBytes(int64(len(page)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		converter.htmlToText(page)
+	}
+}
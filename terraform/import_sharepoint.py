@@ -8,6 +8,23 @@ import base64
 import ssl
 import re
 import os
+import io
+import zipfile
+import xml.etree.ElementTree as ET
+import struct
+import datetime
+import email
+import email.policy
+import email.utils
+import shutil
+import subprocess
+import tempfile
+import fnmatch
+import fcntl
+import time
+import hashlib
+import uuid
+import atexit
 
 # Function to convert HTML to plain text with better formatting preservation
 def html_to_text(html_content):
@@ -96,7 +113,7 @@ def html_to_text(html_content):
     return html_content
 
 # Function to get Azure AD access token
-def get_access_token(tenant_id, client_id, client_secret, scope="https://graph.microsoft.com/.default"):
+def get_access_token(tenant_id, client_id, client_secret, scope="https://graph.microsoft.com/.default", certificate=None):
     try:
         # Azure AD token endpoint
         token_url = f"https://login.microsoftonline.com/{tenant_id}/oauth2/v2.0/token"
@@ -105,9 +122,14 @@ def get_access_token(tenant_id, client_id, client_secret, scope="https://graph.m
         data = {
             'grant_type': 'client_credentials',
             'client_id': client_id,
-            'client_secret': client_secret,
             'scope': scope
         }
+        if certificate:
+            # A fresh assertion per request, so token refreshes never reuse an expired one
+            data['client_assertion_type'] = 'urn:ietf:params:oauth:client-assertion-type:jwt-bearer'
+            data['client_assertion'] = client_assertion(token_url, client_id, certificate)
+        else:
+            data['client_secret'] = client_secret
         
         # Encode the data
         data_encoded = urllib.parse.urlencode(data).encode('utf-8')
@@ -122,13 +144,248 @@ def get_access_token(tenant_id, client_id, client_secret, scope="https://graph.m
         
         # Parse the response
         token_data = json.loads(response.read().decode('utf-8'))
-        return token_data.get('access_token')
+        token = token_data.get('access_token')
+        if token:
+            TOKENS["expires"][token] = time.time() + int(token_data.get('expires_in', 3599))
+        return token
         
+    except urllib.error.HTTPError as e:
+        # Azure AD explains rejected credentials in error_description
+        try:
+            detail = json.loads(e.read().decode('utf-8')).get('error_description', '')
+        except Exception:
+            detail = ''
+        print(f"DEBUG: Token request failed: {e.code} {e.reason} {detail.splitlines()[0] if detail else ''}".rstrip(), file=sys.stderr)
+        return None
     except Exception as e:
+        print(f"DEBUG: Token request failed: {e}", file=sys.stderr)
         return None
 
+# Lifetime of the signed assertions authenticating with a client certificate
+ASSERTION_LIFETIME = 600
+
+def base64url(data):
+    return base64.urlsafe_b64encode(data).rstrip(b"=").decode("ascii")
+
+def load_certificate(path, password):
+    """Read a client certificate for token requests from a PEM file (certificate
+    and private key) or a PFX/PKCS#12 file. PFX keys are unpacked with openssl
+    into a private temporary file removed at exit. Returns the key file, its
+    password and the certificate's x5t thumbprint."""
+    env = dict(os.environ, SHAREPOINT_CERTIFICATE_PASSWORD=password or "")
+    if path.lower().endswith((".pfx", ".p12")):
+        pem = None
+        # Older PFX files use ciphers OpenSSL 3 only reads with -legacy
+        for extra in ([], ["-legacy"]):
+            result = subprocess.run(["openssl", "pkcs12", "-in", path, "-nodes", "-passin", "env:SHAREPOINT_CERTIFICATE_PASSWORD"] + extra,
+                                    capture_output=True, env=env, timeout=30)
+            if result.returncode == 0:
+                pem = result.stdout.decode("utf-8", errors="replace")
+                break
+        if pem is None:
+            detail = result.stderr.decode("utf-8", errors="replace").strip().splitlines()
+            raise ValueError(f"could not read {path}: {detail[0] if detail else 'openssl pkcs12 failed'}")
+        fd, key_path = tempfile.mkstemp(suffix=".pem")
+        with os.fdopen(fd, "w") as key_file:
+            key_file.write(pem)
+        atexit.register(os.remove, key_path)
+        password = ""
+    else:
+        with open(path, encoding="utf-8") as pem_file:
+            pem = pem_file.read()
+        key_path = path
+    
+    match = re.search(r"-----BEGIN CERTIFICATE-----(.*?)-----END CERTIFICATE-----", pem, re.DOTALL)
+    if not match:
+        raise ValueError(f"{path} holds no certificate")
+    if "PRIVATE KEY-----" not in pem:
+        raise ValueError(f"{path} holds no private key")
+    der = base64.b64decode("".join(match.group(1).split()))
+    return {"key": key_path, "password": password or "", "x5t": base64url(hashlib.sha1(der).digest())}
+
+def client_assertion(token_url, client_id, certificate):
+    """Sign the JWT Azure AD accepts in place of a client secret, RS256 with
+    the certificate's key through openssl"""
+    now = int(time.time())
+    header = {"alg": "RS256", "typ": "JWT", "x5t": certificate["x5t"]}
+    claims = {"aud": token_url, "iss": client_id, "sub": client_id, "jti": str(uuid.uuid4()),
+              "nbf": now, "exp": now + ASSERTION_LIFETIME}
+    signing_input = f"{base64url(json.dumps(header).encode())}.{base64url(json.dumps(claims).encode())}"
+    env = dict(os.environ, SHAREPOINT_CERTIFICATE_PASSWORD=certificate["password"])
+    result = subprocess.run(["openssl", "dgst", "-sha256", "-sign", certificate["key"], "-passin", "env:SHAREPOINT_CERTIFICATE_PASSWORD"],
+                            input=signing_input.encode(), capture_output=True, env=env, timeout=30)
+    if result.returncode != 0:
+        raise ValueError(f"signing the client assertion failed: {result.stderr.decode('utf-8', errors='replace').strip()}")
+    return f"{signing_input}.{base64url(result.stdout)}"
+
+# Graph request budget, shared with other instances (and the Confluence tool)
+# through a token bucket in rate_limit_file
+RATE_LIMIT = {"rate": 0, "path": "", "state": {}}
+
+def update_rate_limit(change):
+    """Refill the token bucket for the time elapsed and apply change to it,
+    under the file lock when the budget is shared. Returns change's delay."""
+    rate = RATE_LIMIT["rate"]
+    def apply(state):
+        now = time.time_ns()
+        if not state.get("updated_ns"):
+            state["tokens"] = rate
+        else:
+            state["tokens"] = state.get("tokens", 0) + max(0, now - state["updated_ns"]) / 1e9 * rate
+        state["tokens"] = min(state["tokens"], rate)
+        state["updated_ns"] = now
+        return change(state, now)
+    if RATE_LIMIT["path"]:
+        try:
+            with open(RATE_LIMIT["path"], "a+") as f:
+                fcntl.flock(f, fcntl.LOCK_EX)
+                f.seek(0)
+                try:
+                    state = json.loads(f.read() or "{}")
+                except ValueError:
+                    state = {}
+                delay = apply(state)
+                f.seek(0)
+                f.truncate()
+                f.write(json.dumps(state))
+                return delay
+        except OSError as e:
+            print(f"DEBUG: Rate limit file unavailable, pacing locally: {e}", file=sys.stderr)
+            RATE_LIMIT["path"] = ""
+    return apply(RATE_LIMIT["state"])
+
+# Throttled (429) and overloaded (503) requests wait as the response asks and
+# are retried this many times before they count as failed. Without a
+# Retry-After header the wait doubles from THROTTLE_BASE_SECONDS.
+THROTTLE_RETRIES = 6
+THROTTLE_BASE_SECONDS = 5
+THROTTLE_MAX_SECONDS = 300
+
+# Share of the quota left in RateLimit-Remaining below which requests wait for
+# RateLimit-Reset, rather than use it up and be throttled
+RATE_LIMIT_RESERVE = 0.1
+
+def wait_for_rate_limit():
+    """Block until requests aren't paused and the request budget has a token
+    for one request"""
+    rate = RATE_LIMIT["rate"]
+    def take(state, now):
+        if now < state.get("paused_until_ns", 0):
+            return (state["paused_until_ns"] - now) / 1e9
+        if rate <= 0:
+            return 0
+        if state["tokens"] >= 1:
+            state["tokens"] -= 1
+            return 0
+        return (1 - state["tokens"]) / rate
+    while True:
+        delay = update_rate_limit(take)
+        if delay <= 0:
+            return
+        time.sleep(delay)
+
+def pause_requests(seconds, reason):
+    """Hold every request for seconds, those of every instance sharing
+    rate_limit_file too"""
+    print(f"DEBUG: {reason}; pausing requests for {seconds:g}s", file=sys.stderr)
+    def pause(state, now):
+        state["paused_until_ns"] = max(state.get("paused_until_ns", 0), now + int(seconds * 1e9))
+        return 0
+    update_rate_limit(pause)
+
+def header_seconds(value):
+    """Seconds of a Retry-After or RateLimit-Reset header, given as a number of
+    seconds or an HTTP date, or None"""
+    if not value:
+        return None
+    try:
+        return max(0.0, float(value))
+    except ValueError:
+        pass
+    try:
+        return max(0.0, email.utils.parsedate_to_datetime(value).timestamp() - time.time())
+    except (TypeError, ValueError, IndexError):
+        return None
+
+def throttled(error, attempt):
+    """Pause requests as a 429 or 503 response asks. Returns whether the
+    request should be retried."""
+    if error.code not in (429, 503) or attempt >= THROTTLE_RETRIES:
+        return False
+    seconds = header_seconds(error.headers.get("Retry-After"))
+    if seconds is None:
+        seconds = header_seconds(error.headers.get("RateLimit-Reset"))
+    if seconds is None:
+        seconds = THROTTLE_BASE_SECONDS * 2 ** attempt
+    pause_requests(min(seconds, THROTTLE_MAX_SECONDS), f"Request throttled ({error.code}), retry {attempt + 1} of {THROTTLE_RETRIES}")
+    return True
+
+def note_rate_limit(headers):
+    """Wait for the quota to refill once Graph's RateLimit-* headers, sent as a
+    tenant nears its limit, say little of it is left"""
+    remaining = headers.get("RateLimit-Remaining")
+    if remaining is None:
+        return
+    try:
+        remaining = float(remaining)
+        limit = float(headers.get("RateLimit-Limit") or 0)
+    except ValueError:
+        return
+    if remaining > limit * RATE_LIMIT_RESERVE and remaining > 0:
+        return
+    seconds = header_seconds(headers.get("RateLimit-Reset"))
+    if seconds:
+        pause_requests(min(seconds, THROTTLE_MAX_SECONDS), f"Rate limit nearly used up ({remaining:g} of {limit:g} left)")
+
+# Access tokens expire after about an hour, so long runs get a new one shortly
+# before a token expires, or when a request is rejected with 401. Callers keep
+# passing the token they were given; requests swap in its replacement.
+TOKENS = {"refresh": {}, "replaced": {}, "expires": {}}
+
+# Seconds before expiry a token is replaced, and between attempts when the
+# token endpoint can't be reached
+TOKEN_REFRESH_MARGIN = 300
+TOKEN_RETRY_SECONDS = 30
+
+def track_token(token, refresh):
+    """Remember how to get a replacement for token"""
+    if token:
+        TOKENS["refresh"][token] = refresh
+    return token
+
+def current_token(token):
+    """The latest replacement of token, renewed first when it is about to expire"""
+    while token in TOKENS["replaced"]:
+        token = TOKENS["replaced"][token]
+    expires = TOKENS["expires"].get(token)
+    if expires and time.time() >= expires - TOKEN_REFRESH_MARGIN:
+        if refresh_token(token, expiring=True):
+            return TOKENS["replaced"][token]
+        # Keep using the token while it lasts, asking for a new one now and then
+        TOKENS["expires"][token] = time.time() + TOKEN_REFRESH_MARGIN + TOKEN_RETRY_SECONDS
+    return token
+
+def refresh_token(token, expiring=False):
+    """Get a new token in place of token, after a 401 or before it expires.
+    Returns whether there is one to retry with."""
+    if token in TOKENS["replaced"]:
+        return True
+    refresh = TOKENS["refresh"].get(token)
+    new_token = refresh() if refresh else None
+    if not new_token or new_token == token:
+        return False
+    if expiring:
+        print("DEBUG: Access token is about to expire; switched to a new one", file=sys.stderr)
+    else:
+        print("DEBUG: Access token was rejected; retrying with a new one", file=sys.stderr)
+    TOKENS["replaced"][token] = new_token
+    track_token(new_token, refresh)
+    return True
+
 # Simple function to make SharePoint API requests
-def make_sharepoint_request(url, access_token):
+def make_sharepoint_request(url, access_token, retried=False, attempt=0):
+    access_token = current_token(access_token)
+    wait_for_rate_limit()
     try:
         # Create request with headers
         req = urllib.request.Request(url)
@@ -138,27 +395,90 @@ def make_sharepoint_request(url, access_token):
         # Make request with SSL context
         context = ssl.create_default_context()
         response = urllib.request.urlopen(req, context=context, timeout=30)
+        note_rate_limit(response.headers)
         
         # Read and decode response
         data = response.read().decode('utf-8')
         return json.loads(data)
     except urllib.error.HTTPError as e:
+        if throttled(e, attempt):
+            return make_sharepoint_request(url, access_token, retried, attempt + 1)
+        if e.code == 401 and not retried and refresh_token(access_token):
+            return make_sharepoint_request(url, access_token, retried=True)
         return {"error": f"HTTP Error: {e.code} - {e.reason}"}
     except urllib.error.URLError as e:
         return {"error": f"URL Error: {e.reason}"}
     except Exception as e:
         return {"error": f"Error: {str(e)}"}
 
+def download_file(drive_id, item_id, access_token):
+    """Download a drive item's content, returning bytes or None"""
+    return download_url(f"https://graph.microsoft.com/v1.0/drives/{drive_id}/items/{item_id}/content", access_token)
+
+def download_url(url, access_token, retried=False, attempt=0):
+    """Download a file's raw content, returning bytes or None"""
+    access_token = current_token(access_token)
+    wait_for_rate_limit()
+    try:
+        req = urllib.request.Request(url)
+        req.add_header('Authorization', f'Bearer {access_token}')
+        context = ssl.create_default_context()
+        response = urllib.request.urlopen(req, context=context, timeout=120)
+        note_rate_limit(response.headers)
+        return response.read()
+    except urllib.error.HTTPError as e:
+        if throttled(e, attempt):
+            return download_url(url, access_token, retried, attempt + 1)
+        if e.code == 401 and not retried and refresh_token(access_token):
+            return download_url(url, access_token, retried=True)
+        print(f"DEBUG: Failed to download {url}: {e}", file=sys.stderr)
+        return None
+    except Exception as e:
+        print(f"DEBUG: Failed to download {url}: {e}", file=sys.stderr)
+        return None
+
+def make_paged_request(url, access_token):
+    """Follow @odata.nextLink and return all values, or an error dict"""
+    values = []
+    while url:
+        result = make_sharepoint_request(url, access_token)
+        if "error" in result:
+            return result
+        values.extend(result.get("value", []))
+        url = result.get("@odata.nextLink")
+    return {"value": values}
+
+def drive_item_path(drive_id, item):
+    """Path of a drive item below its library root, e.g. "Runbooks/Deploy.docx" """
+    folder = item.get("parentReference", {}).get("path", "").replace("/drives/" + drive_id + "/root:", "")
+    return "/".join(part for part in (folder.strip("/"), item.get("name", "")) if part)
+
+def path_excluded(path, options):
+    """Whether a library path matches an exclude_paths glob (case-insensitive).
+    A folder's path ends with "/", so "Archive/**" excludes the Archive folder."""
+    path = path.lstrip("/").lower()
+    return any(fnmatch.fnmatchcase(path, pattern.lower()) for pattern in options.get("exclude_paths", []))
+
+def path_selected(path, options):
+    """Match a library file's path against the include_paths and exclude_paths
+    globs; no include patterns means every path"""
+    include = options.get("include_paths", [])
+    if include and not any(fnmatch.fnmatchcase(path.lstrip("/").lower(), pattern.lower()) for pattern in include):
+        return False
+    return not path_excluded(path, options)
+
 # Function to recursively scan folders for files
-def scan_drive_items(drive_id, folder_id, access_token, items_list, depth=0, max_depth=3):
+def scan_drive_items(drive_id, folder_id, access_token, items_list, depth=0, max_depth=3, library_name="", options=None):
     """Recursively scan a drive folder for files"""
+    options = options or {}
     if depth > max_depth:
         print(f"DEBUG: Max depth {max_depth} reached, stopping recursion", file=sys.stderr)
         return
     
     # Get items from the folder
     items_url = f"https://graph.microsoft.com/v1.0/drives/{drive_id}/items/{folder_id}/children" if folder_id else f"https://graph.microsoft.com/v1.0/drives/{drive_id}/root/children"
-    items_result = make_sharepoint_request(items_url, access_token)
+    items_url += "?$expand=listItem($select=id,contentType)"
+    items_result = make_paged_request(items_url, access_token)
     
     if "error" in items_result or "value" not in items_result:
         print(f"DEBUG: Error or no items in folder: {items_result}", file=sys.stderr)
@@ -167,54 +487,1339 @@ def scan_drive_items(drive_id, folder_id, access_token, items_list, depth=0, max
     print(f"DEBUG: Scanning folder (depth {depth}), found {len(items_result['value'])} items", file=sys.stderr)
     
     for item in items_result["value"]:
+        if "deleted" in item:
+            continue
+        item_path = drive_item_path(drive_id, item)
         if "file" in item:
-            # It's a file
-            file_name = item.get("name", "")
-            file_extension = file_name.split('.')[-1].lower() if '.' in file_name else ""
-            
-            # For supported file types, add metadata as content
-            if file_extension in ["txt", "md", "docx", "pdf", "xlsx", "pptx", "doc", "ppt"]:
-                # Create content with file metadata and location info
-                file_path = item.get("parentReference", {}).get("path", "").replace("/drives/" + drive_id + "/root:", "")
-                content = f"Document: {file_name}\nType: {file_extension.upper()}\nSize: {item.get('size', 'Unknown')} bytes"
-                if file_path:
-                    content += f"\nLocation: {file_path}"
-                
-                # Add web URL if available
-                if item.get("webUrl"):
-                    content += f"\nURL: {item.get('webUrl')}"
-                
-                items_list.append({
-                    "id": item.get("id", ""),
-                    "title": file_name,
-                    "content": content,
-                    "type": "document",
-                    "labels": f"sharepoint,document,{file_extension}"
-                })
-                print(f"DEBUG: Added document: {file_name} (from depth {depth})", file=sys.stderr)
+            if not path_selected(item_path, options):
+                continue
+            document = document_item(drive_id, item, access_token, library_name, options)
+            if document:
+                items_list.append(document)
+                print(f"DEBUG: Added document: {document['title']} (from depth {depth})", file=sys.stderr)
         elif "folder" in item:
             # It's a folder - scan recursively
             folder_name = item.get("name", "")
             folder_id = item.get("id", "")
+            if path_excluded(item_path + "/", options):
+                print(f"DEBUG: Skipping folder excluded by the path patterns: {item_path}", file=sys.stderr)
+                continue
             print(f"DEBUG: Entering folder: {folder_name} (depth {depth})", file=sys.stderr)
             
             # Recurse into the folder
-            scan_drive_items(drive_id, folder_id, access_token, items_list, depth + 1, max_depth)
+            scan_drive_items(drive_id, folder_id, access_token, items_list, depth + 1, max_depth, library_name, options)
             
             # Also add folder as a knowledge item with its contents summary
-            child_count = item.get("folder", {}).get("childCount", 0)
-            folder_content = f"SharePoint Folder: {folder_name}\nContains: {child_count} items"
-            if item.get("webUrl"):
-                folder_content += f"\nURL: {item.get('webUrl')}"
+            if path_selected(item_path + "/", options):
+                items_list.append(folder_item(drive_id, item, access_token, options))
+                print(f"DEBUG: Added folder metadata: {folder_name}", file=sys.stderr)
+
+# Library files imported as items; the formats in DOCUMENT_EXTRACTORS also get their text
+DOCUMENT_ITEM_EXTENSIONS = ["txt", "md", "docx", "pdf", "xlsx", "pptx", "doc", "ppt", "eml", "msg", "tif", "tiff"]
+
+def file_extension_allowed(file_name, size, options):
+    """Extension of a library file to import, or None for files of another type
+    (allowed_extensions, or the supported formats) or larger than
+    max_file_size_bytes, which are skipped without being downloaded"""
+    file_extension = file_name.split('.')[-1].lower() if '.' in file_name else ""
+    if file_extension not in (options.get("allowed_extensions") or DOCUMENT_ITEM_EXTENSIONS):
+        return None
+    if options.get("max_file_size_bytes") and (size or 0) > options["max_file_size_bytes"]:
+        print(f"DEBUG: Skipping {file_name} ({size} bytes exceeds max_file_size_bytes)", file=sys.stderr)
+        return None
+    return file_extension
+
+def document_item(drive_id, item, access_token, library_name, options):
+    """Item for a library file in a supported format, or None"""
+    file_name = item.get("name", "")
+    
+    # For supported file types, add metadata as content
+    file_extension = file_extension_allowed(file_name, item.get("size"), options)
+    if file_extension is None:
+        return None
+    
+    # Create content with file metadata and location info
+    file_path = item.get("parentReference", {}).get("path", "").replace("/drives/" + drive_id + "/root:", "")
+    content = f"Document: {file_name}\nType: {file_extension.upper()}\nSize: {item.get('size', 'Unknown')} bytes"
+    if file_path:
+        content += f"\nLocation: {file_path}"
+    
+    # Add web URL if available
+    if item.get("webUrl"):
+        content += f"\nURL: {item.get('webUrl')}"
+    
+    # Read the sensitivity label first, so excluded files are never downloaded
+    label = None
+    if options.get("sensitivity_labels") is not None:
+        label = file_sensitivity_label(drive_id, item, access_token, options)
+        if sensitivity_excluded(label, options):
+            print(f"DEBUG: Skipping {file_name}, its sensitivity label is above {options['max_sensitivity_name']}", file=sys.stderr)
+            return None
+    
+    # Append the document text for formats we can extract
+    if options.get("extract_content") and file_extension in DOCUMENT_EXTRACTORS:
+        text = extract_document(drive_id, item, access_token, file_extension, options)
+        if text:
+            content += "\n\n" + text
+    
+    document = {
+        "id": item.get("id", ""),
+        "title": file_name,
+        "content": content,
+        "type": "document",
+        "labels": f"sharepoint,document,{file_extension}",
+        **file_metadata(item, library_name, file_path)
+    }
+    if label:
+        document["sensitivity_label"] = label["name"]
+    document.update(access_fields(f"https://graph.microsoft.com/v1.0/drives/{drive_id}/items/{item.get('id', '')}/permissions", access_token, options))
+    return document
+
+def fetch_sensitivity_labels(access_token):
+    """The tenant's sensitivity labels by ID, with their name and sensitivity
+    (higher is more sensitive), or None when they can't be read"""
+    result = make_paged_request("https://graph.microsoft.com/v1.0/security/informationProtection/sensitivityLabels", access_token)
+    if "error" in result:
+        print(f"DEBUG: Failed to read sensitivity labels: {result['error']}", file=sys.stderr)
+        return None
+    return {label.get("id"): {"name": label.get("name", ""), "sensitivity": label.get("sensitivity", 0)} for label in result["value"]}
+
+def file_sensitivity_label(drive_id, item, access_token, options):
+    """The sensitivity label of a library file, or None when it has none. Labels
+    missing from the catalog get an unknown name and count as most sensitive."""
+    result = make_graph_post(f"https://graph.microsoft.com/v1.0/drives/{drive_id}/items/{item.get('id', '')}/extractSensitivityLabels", {}, access_token)
+    if "error" in result:
+        print(f"DEBUG: Failed to read the sensitivity label of {item.get('name', '')}: {result['error']}", file=sys.stderr)
+        return {"name": "unknown", "sensitivity": float("inf")}
+    # Of several labels (e.g. on different content), the most sensitive one wins
+    label = None
+    for assignment in result.get("labels", []):
+        candidate = options["sensitivity_labels"].get(assignment.get("sensitivityLabelId")) or {"name": "unknown", "sensitivity": float("inf")}
+        if label is None or candidate["sensitivity"] > label["sensitivity"]:
+            label = candidate
+    return label
+
+def sensitivity_excluded(label, options):
+    return options.get("max_sensitivity") is not None and label is not None and label["sensitivity"] > options["max_sensitivity"]
+
+def folder_item(drive_id, item, access_token, options):
+    """Item summarizing a library folder"""
+    folder_name = item.get("name", "")
+    child_count = item.get("folder", {}).get("childCount", 0)
+    folder_content = f"SharePoint Folder: {folder_name}\nContains: {child_count} items"
+    if item.get("webUrl"):
+        folder_content += f"\nURL: {item.get('webUrl')}"
+    
+    folder = {
+        "id": item.get("id", ""),
+        "title": f"📁 {folder_name}",
+        "content": folder_content,
+        "type": "folder",
+        "labels": "sharepoint,folder",
+        "url": item.get("webUrl", ""),
+    }
+    folder.update(access_fields(f"https://graph.microsoft.com/v1.0/drives/{drive_id}/items/{item.get('id', '')}/permissions", access_token, options))
+    return folder
+
+def parse_audience_map(value):
+    """Parse "Group name=tag" pairs; group names may be globs like "*Members" """
+    mapping = []
+    for pair in value.split(","):
+        if "=" in pair:
+            group, tag = pair.rsplit("=", 1)
+            if group.strip() and tag.strip():
+                mapping.append((group.strip().lower(), tag.strip()))
+    return mapping
+
+def permission_groups(permissions):
+    """Names of the groups (and sharing link scopes) a drive item is shared with"""
+    names = set()
+    for permission in permissions:
+        identities = [permission.get("grantedToV2") or {}] + (permission.get("grantedToIdentitiesV2") or [])
+        for identity in identities:
+            for kind in ("siteGroup", "group"):
+                if identity.get(kind, {}).get("displayName"):
+                    names.add(identity[kind]["displayName"])
+        # Organization-wide and anonymous sharing links have no group to map
+        scope = (permission.get("link") or {}).get("scope")
+        if scope in ("organization", "anonymous"):
+            names.add(f"{scope} link")
+    return names
+
+def permission_summary(permissions):
+    """Who can read an item and with which roles: its groups, users and sharing
+    links, as {"principal", "type", "roles"} entries"""
+    summary = {}
+    for permission in permissions:
+        principals = []
+        identities = [permission.get("grantedToV2") or {}] + (permission.get("grantedToIdentitiesV2") or [])
+        for identity in identities:
+            for kind, principal_type in (("siteGroup", "group"), ("group", "group"), ("user", "user"), ("application", "application")):
+                name = identity.get(kind, {}).get("displayName") or identity.get(kind, {}).get("email")
+                if name:
+                    principals.append((principal_type, name))
+                    break
+        scope = (permission.get("link") or {}).get("scope")
+        if scope:
+            principals.append(("link", f"{scope} link"))
+        for principal in principals:
+            roles = summary.setdefault(principal, set())
+            roles.update(permission.get("roles") or [])
+    return [{"principal": name, "type": principal_type, "roles": sorted(roles)}
+            for (principal_type, name), roles in sorted(summary.items())]
+
+def access_fields(permissions_url, access_token, options):
+    """The audiences and permissions fields of an item, as far as audience_map
+    and include_permissions ask for them, from one read of its permissions"""
+    if not options.get("audience_map") and not options.get("include_permissions"):
+        return {}
+    result = make_paged_request(permissions_url, access_token)
+    if "error" in result:
+        # Unread permissions grant nothing; audience_default would fail open
+        print(f"DEBUG: Failed to read permissions {permissions_url}, giving the item no audiences: {result['error']}", file=sys.stderr)
+    permissions = result.get("value", [])
+    fields = {}
+    if options.get("audience_map"):
+        fields["audiences"] = mapped_audiences(permissions, options) if "error" not in result else []
+    if options.get("include_permissions") and "error" not in result:
+        fields["permissions"] = permission_summary(permissions)
+    return fields
+
+def mapped_audiences(permissions, options):
+    """Audience tags of an item: the mapped tags of the groups it is shared with,
+    or the default audience when none of them is mapped"""
+    audiences = set()
+    for group in permission_groups(permissions):
+        for pattern, tag in options["audience_map"]:
+            if fnmatch.fnmatchcase(group.lower(), pattern):
+                audiences.add(tag)
+    if not audiences and options.get("audience_default"):
+        audiences.add(options["audience_default"])
+    return sorted(audiences)
+
+def load_state(state_file):
+    """Read the crawl state (saved Graph cursors) or start empty"""
+    if not state_file or not os.path.exists(state_file):
+        return {"cursors": {}}
+    with open(state_file) as f:
+        state = json.load(f)
+    state.setdefault("cursors", {})
+    return state
+
+def save_state(state_file, state):
+    # Write to a temporary file first so an interrupted run never leaves a truncated state
+    temporary = state_file + ".tmp"
+    with open(temporary, "w") as f:
+        json.dump(state, f, indent=2)
+    os.replace(temporary, state_file)
+
+EMAIL_RE = re.compile(r'[A-Za-z0-9._%+\-]+@[A-Za-z0-9.\-]+\.[A-Za-z]{2,}')
+
+def load_pseudonyms(pseudonym_file):
+    """Read the pseudonym mapping (lowercased name or email -> pseudonym), shared
+    with the Confluence tool. A missing file starts a new mapping."""
+    if not pseudonym_file:
+        return None
+    mapping = {}
+    if os.path.exists(pseudonym_file):
+        with open(pseudonym_file) as f:
+            mapping = json.load(f)
+    return {"mapping": mapping, "assigned": set(mapping.values()), "dirty": False}
+
+def pseudonym(pseudonyms, real):
+    """Stable pseudonym of a name or email address, assigned on first sight"""
+    key = (real or "").strip().lower()
+    if not pseudonyms or not key or real in pseudonyms["assigned"]:
+        return real
+    if key not in pseudonyms["mapping"]:
+        number = len(pseudonyms["mapping"]) + 1
+        pseudonyms["mapping"][key] = f"person{number}@example.invalid" if EMAIL_RE.fullmatch(key) else f"Person {number}"
+        pseudonyms["assigned"].add(pseudonyms["mapping"][key])
+        pseudonyms["dirty"] = True
+    return pseudonyms["mapping"][key]
+
+def pseudonymize_text(pseudonyms, text):
+    """Replace the email addresses in free text"""
+    if not pseudonyms or not text:
+        return text
+    return EMAIL_RE.sub(lambda match: pseudonym(pseudonyms, match.group(0)), text)
+
+def pseudonymize_items(items, pseudonyms):
+    """Replace the user names and email addresses every item carries"""
+    def pseudonymize_comments(comments):
+        for comment in comments:
+            comment["author"] = pseudonym(pseudonyms, comment.get("author", ""))
+            comment["body"] = pseudonymize_text(pseudonyms, comment.get("body", ""))
+            pseudonymize_comments(comment.get("replies", []))
+
+    for item in items:
+        for field in ("author", "modified_by"):
+            if item.get(field):
+                item[field] = pseudonym(pseudonyms, item[field])
+        for field in ("title", "content"):
+            item[field] = pseudonymize_text(pseudonyms, item.get(field, ""))
+        pseudonymize_comments(item.get("comments", []))
+        for permission in item.get("permissions", []):
+            if permission["type"] == "user":
+                permission["principal"] = pseudonym(pseudonyms, permission["principal"])
+
+def save_pseudonyms(pseudonym_file, pseudonyms):
+    # The file maps real identities to pseudonyms, so only its owner may read it
+    if not pseudonyms or not pseudonyms["dirty"]:
+        return
+    temporary = pseudonym_file + ".tmp"
+    with open(os.open(temporary, os.O_WRONLY | os.O_CREAT | os.O_TRUNC, 0o600), "w") as f:
+        json.dump(pseudonyms["mapping"], f, indent=2)
+    os.replace(temporary, pseudonym_file)
+
+def crawl_drive_delta(drive_id, access_token, items_list, library_name, options, state_file, state, max_depth=3):
+    """Enumerate a library through the Graph delta query, keeping the cursor after
+    every page in the state, which is saved once the items are written. A crawl
+    that fails part way resumes from its last page on the next run; a finished
+    crawl keeps the delta link, so later runs only see files changed since.
+    Deleted or recycled files and folders seen before are emitted with action
+    "deleted", and moved or renamed files carry their previous_path so
+    downstream stores can update them in place."""
+    cursor_key = f"drive:{drive_id}"
+    url = state["cursors"].get(cursor_key) or f"https://graph.microsoft.com/v1.0/drives/{drive_id}/root/delta"
+    if cursor_key in state["cursors"]:
+        print(f"DEBUG: Resuming library {library_name} from its saved cursor", file=sys.stderr)
+    
+    # Delta responses carry no parentReference.path, so the tree is tracked as
+    # item ID -> [parent ID, name] to rebuild paths and notice moves
+    tree = state.setdefault("trees", {}).setdefault(drive_id, {})
+    emitted = set()
+    
+    def item_path(item_id):
+        parts = []
+        while item_id in tree and len(parts) < 100:
+            parent_id, name = tree[item_id]
+            parts.append(name)
+            item_id = parent_id
+        return "/".join(reversed(parts))
+    
+    def emit(item, previous_path=""):
+        if item.get("id") in emitted:
+            return
+        folder_path = item_path(item.get("parentReference", {}).get("id"))
+        if len([part for part in folder_path.split("/") if part]) > max_depth:
+            return
+        item.setdefault("parentReference", {})["path"] = f"/drives/{drive_id}/root:/{folder_path}".rstrip("/")
+        path = drive_item_path(drive_id, item)
+        if not path_selected(path if "file" in item else path + "/", options) or path_excluded(folder_path + "/", options):
+            return
+        if "file" in item:
+            entry = document_item(drive_id, item, access_token, library_name, options)
+        else:
+            entry = folder_item(drive_id, item, access_token, options)
+        if entry:
+            if previous_path:
+                entry["previous_path"] = previous_path
+            items_list.append(entry)
+            emitted.add(item.get("id"))
+    
+    while url:
+        result = make_sharepoint_request(url, access_token)
+        if "error" in result:
+            print(f"DEBUG: Library {library_name} crawl stopped, will resume next run: {result['error']}", file=sys.stderr)
+            return
+        
+        for item in result.get("value", []):
+            item_id = item.get("id", "")
+            if "root" in item:
+                continue
+            if "deleted" in item:
+                # Recycled or deleted: downstream stores drop it by its ID. It is
+                # forgotten so it is not mistaken for a move later.
+                if item_id in tree:
+                    name = tree.pop(item_id)[1]
+                    folder = "folder" in item
+                    items_list.append({"id": item_id, "title": f"📁 {name}" if folder else name,
+                                       "type": "folder" if folder else "document", "action": "deleted"})
+                    print(f"DEBUG: {name} was deleted", file=sys.stderr)
+                continue
+            
+            previous_path = item_path(item_id) if item_id in tree else ""
+            tree[item_id] = [item.get("parentReference", {}).get("id", ""), item.get("name", "")]
+            current_path = item_path(item_id)
+            moved = previous_path and previous_path != current_path
+            if moved:
+                print(f"DEBUG: {previous_path} moved to {current_path}", file=sys.stderr)
             
-            items_list.append({
-                "id": item.get("id", ""),
-                "title": f"📁 {folder_name}",
-                "content": folder_content,
-                "type": "folder",
-                "labels": "sharepoint,folder"
+            if "file" in item or "folder" in item:
+                emit(item, previous_path if moved else "")
+            
+            # Descendants of a moved folder are not part of the delta, so
+            # re-read them to publish their new paths
+            if moved and "folder" in item:
+                for descendant_id in list(tree):
+                    descendant_path = item_path(descendant_id)
+                    if descendant_id in emitted or not descendant_path.startswith(current_path + "/"):
+                        continue
+                    descendant = make_sharepoint_request(f"https://graph.microsoft.com/v1.0/drives/{drive_id}/items/{descendant_id}", access_token)
+                    if "error" not in descendant:
+                        emit(descendant, previous_path + descendant_path[len(current_path):])
+        
+        url = result.get("@odata.nextLink")
+        if url:
+            state["cursors"][cursor_key] = url
+        elif result.get("@odata.deltaLink"):
+            state["cursors"][cursor_key] = result["@odata.deltaLink"]
+            print(f"DEBUG: Library {library_name} crawl complete, keeping its delta link", file=sys.stderr)
+
+def changed_page_ids(site_id, access_token, state_file, state):
+    """IDs of the site pages changed since the last run, read through the delta
+    query of the Site Pages library, or None when the library can't be found.
+    The cursor is kept like a library's, so the first run sees every page and
+    a crawl that fails part way resumes next run."""
+    lists_result = make_paged_request(f"https://graph.microsoft.com/v1.0/sites/{site_id}/lists?$select=id,name", access_token)
+    if "error" in lists_result:
+        print(f"DEBUG: Could not list site libraries for the pages delta: {lists_result['error']}", file=sys.stderr)
+        return None
+    site_pages = next((entry for entry in lists_result["value"] if entry.get("name", "").lower() == "sitepages"), None)
+    if not site_pages:
+        return None
+
+    cursor_key = f"pages:{site_id}"
+    url = (state["cursors"].get(cursor_key) or
+           f"https://graph.microsoft.com/v1.0/sites/{site_id}/lists/{site_pages['id']}/drive/root/delta?$select=id,name,file,deleted,sharepointIds")
+    changed = set()
+    while url:
+        result = make_sharepoint_request(url, access_token)
+        if "error" in result:
+            print(f"DEBUG: Pages delta stopped, will resume next run: {result['error']}", file=sys.stderr)
+            break
+        for entry in result.get("value", []):
+            # A page's ID is the unique ID of its list item
+            unique_id = (entry.get("sharepointIds") or {}).get("listItemUniqueId", "")
+            if "file" in entry and "deleted" not in entry and unique_id:
+                changed.add(unique_id.lower())
+        url = result.get("@odata.nextLink")
+        if url:
+            state["cursors"][cursor_key] = url
+        elif result.get("@odata.deltaLink"):
+            state["cursors"][cursor_key] = result["@odata.deltaLink"]
+    print(f"DEBUG: {len(changed)} site pages changed since the last run", file=sys.stderr)
+    return changed
+
+XLSX_NS = {
+    "main": "http://schemas.openxmlformats.org/spreadsheetml/2006/main",
+    "rel": "http://schemas.openxmlformats.org/officeDocument/2006/relationships",
+    "pkg": "http://schemas.openxmlformats.org/package/2006/relationships",
+}
+
+def column_index(cell_ref):
+    """Zero-based column index from a cell reference like AB12"""
+    index = 0
+    for char in cell_ref:
+        if not char.isalpha():
+            break
+        index = index * 26 + (ord(char.upper()) - ord('A') + 1)
+    return index - 1
+
+def markdown_cell(value):
+    return value.replace("|", "\\|").replace("\n", " ").strip()
+
+def extract_xlsx(data, options):
+    """Render the used range of each worksheet as a markdown table"""
+    max_sheets = options.get("xlsx_max_sheets", 10)
+    max_rows = options.get("xlsx_max_rows", 200)
+
+    with zipfile.ZipFile(io.BytesIO(data)) as archive:
+        names = set(archive.namelist())
+
+        shared_strings = []
+        if "xl/sharedStrings.xml" in names:
+            root = ET.fromstring(archive.read("xl/sharedStrings.xml"))
+            for si in root.findall("main:si", XLSX_NS):
+                shared_strings.append("".join(t.text or "" for t in si.iter(f"{{{XLSX_NS['main']}}}t")))
+
+        # Sheet names in workbook order, resolved to their part names
+        targets = {}
+        rels = ET.fromstring(archive.read("xl/_rels/workbook.xml.rels"))
+        for rel in rels.findall("pkg:Relationship", XLSX_NS):
+            target = rel.get("Target", "").lstrip("/")
+            targets[rel.get("Id")] = target if target.startswith("xl/") else "xl/" + target
+        workbook = ET.fromstring(archive.read("xl/workbook.xml"))
+        sheets = [(sheet.get("name"), targets.get(sheet.get(f"{{{XLSX_NS['rel']}}}id")))
+                  for sheet in workbook.iter(f"{{{XLSX_NS['main']}}}sheet")]
+
+        sections = []
+        for sheet_name, part in sheets[:max_sheets]:
+            if part not in names:
+                continue
+            rows = []
+            for row in ET.fromstring(archive.read(part)).iter(f"{{{XLSX_NS['main']}}}row"):
+                cells = {}
+                for cell in row.findall("main:c", XLSX_NS):
+                    cell_type = cell.get("t", "n")
+                    value_node = cell.find("main:v", XLSX_NS)
+                    value = value_node.text if value_node is not None and value_node.text else ""
+                    if cell_type == "s" and value:
+                        value = shared_strings[int(value)]
+                    elif cell_type == "inlineStr":
+                        value = "".join(t.text or "" for t in cell.iter(f"{{{XLSX_NS['main']}}}t"))
+                    elif cell_type == "b":
+                        value = "TRUE" if value == "1" else "FALSE"
+                    if value.strip():
+                        cells[column_index(cell.get("r", "A"))] = markdown_cell(value)
+                if cells:
+                    rows.append(cells)
+
+            if not rows:
+                continue
+
+            # Used range: only the columns that hold a value somewhere
+            columns = sorted({column for row in rows for column in row})
+            table = ["| " + " | ".join(rows[0].get(c, "") for c in columns) + " |",
+                     "|" + " --- |" * len(columns)]
+            for row in rows[1:max_rows]:
+                table.append("| " + " | ".join(row.get(c, "") for c in columns) + " |")
+            if len(rows) > max_rows:
+                table.append(f"\n[{len(rows) - max_rows} more rows not shown]")
+            sections.append(f"## Sheet: {sheet_name}\n\n" + "\n".join(table))
+
+        if len(sheets) > max_sheets:
+            sections.append(f"[{len(sheets) - max_sheets} more sheets not shown]")
+        return "\n\n".join(sections)
+
+PPTX_NS = {
+    "p": "http://schemas.openxmlformats.org/presentationml/2006/main",
+    "a": "http://schemas.openxmlformats.org/drawingml/2006/main",
+    "rel": "http://schemas.openxmlformats.org/officeDocument/2006/relationships",
+    "pkg": "http://schemas.openxmlformats.org/package/2006/relationships",
+}
+
+def part_relationships(archive, part):
+    """Map relationship IDs of an OOXML part to (type, absolute part name)"""
+    folder, name = part.rsplit("/", 1)
+    rels_name = f"{folder}/_rels/{name}.rels"
+    if rels_name not in archive.namelist():
+        return {}
+    relationships = {}
+    for rel in ET.fromstring(archive.read(rels_name)).findall("pkg:Relationship", PPTX_NS):
+        target = rel.get("Target", "")
+        if target.startswith("/"):
+            target = target.lstrip("/")
+        else:
+            # Resolve "../notesSlides/notesSlide1.xml" against the part's folder
+            parts = folder.split("/")
+            for segment in target.split("/"):
+                if segment == "..":
+                    parts.pop()
+                elif segment != ".":
+                    parts.append(segment)
+            target = "/".join(parts)
+        relationships[rel.get("Id")] = (rel.get("Type", ""), target)
+    return relationships
+
+def shape_paragraphs(shape):
+    """Text of each paragraph in a shape, skipping empty ones"""
+    paragraphs = []
+    for paragraph in shape.iter(f"{{{PPTX_NS['a']}}}p"):
+        text = "".join(t.text or "" for t in paragraph.iter(f"{{{PPTX_NS['a']}}}t")).strip()
+        if text:
+            paragraphs.append(text)
+    return paragraphs
+
+def placeholder_type(shape):
+    placeholder = shape.find("p:nvSpPr/p:nvPr/p:ph", PPTX_NS)
+    if placeholder is None:
+        return None
+    return placeholder.get("type", "body")
+
+def extract_pptx(data, options):
+    """Slide titles, body text and speaker notes in slide order"""
+    with zipfile.ZipFile(io.BytesIO(data)) as archive:
+        presentation_rels = part_relationships(archive, "ppt/presentation.xml")
+        presentation = ET.fromstring(archive.read("ppt/presentation.xml"))
+        slide_parts = [presentation_rels.get(slide.get(f"{{{PPTX_NS['rel']}}}id"), ("", ""))[1]
+                       for slide in presentation.iter(f"{{{PPTX_NS['p']}}}sldId")]
+
+        sections = []
+        for number, part in enumerate(slide_parts, start=1):
+            if part not in archive.namelist():
+                continue
+            slide = ET.fromstring(archive.read(part))
+
+            title = ""
+            body = []
+            for shape in slide.iter(f"{{{PPTX_NS['p']}}}sp"):
+                paragraphs = shape_paragraphs(shape)
+                if placeholder_type(shape) in ("title", "ctrTitle") and not title:
+                    title = " ".join(paragraphs)
+                elif placeholder_type(shape) not in ("sldNum", "dt", "ftr"):
+                    body.extend(paragraphs)
+            # Tables live in graphic frames rather than shapes
+            for frame in slide.iter(f"{{{PPTX_NS['p']}}}graphicFrame"):
+                for row in frame.iter(f"{{{PPTX_NS['a']}}}tr"):
+                    cells = [" ".join(shape_paragraphs(cell)) for cell in row.findall("a:tc", PPTX_NS)]
+                    body.append("| " + " | ".join(markdown_cell(c) for c in cells) + " |")
+
+            notes = []
+            for rel_type, target in part_relationships(archive, part).values():
+                if rel_type.endswith("/notesSlide") and target in archive.namelist():
+                    for shape in ET.fromstring(archive.read(target)).iter(f"{{{PPTX_NS['p']}}}sp"):
+                        if placeholder_type(shape) == "body":
+                            notes.extend(shape_paragraphs(shape))
+
+            section = f"## Slide {number}" + (f": {title}" if title else "")
+            if body:
+                section += "\n\n" + "\n".join(body)
+            if notes:
+                section += "\n\nSpeaker notes: " + "\n".join(notes)
+            sections.append(section)
+
+        return "\n\n".join(sections)
+
+DOCX_NS = {
+    "w": "http://schemas.openxmlformats.org/wordprocessingml/2006/main",
+}
+
+def docx_paragraph_text(paragraph):
+    """Text of a Word paragraph, keeping tabs and line breaks"""
+    parts = []
+    for node in paragraph.iter():
+        if node.tag == f"{{{DOCX_NS['w']}}}t":
+            parts.append(node.text or "")
+        elif node.tag == f"{{{DOCX_NS['w']}}}tab":
+            parts.append("\t")
+        elif node.tag in (f"{{{DOCX_NS['w']}}}br", f"{{{DOCX_NS['w']}}}cr"):
+            parts.append("\n")
+    return "".join(parts).strip()
+
+def extract_docx(data, options):
+    """Body text of a Word document: headings as markdown headings, list
+    paragraphs as bullets and tables as markdown tables"""
+    with zipfile.ZipFile(io.BytesIO(data)) as archive:
+        body = ET.fromstring(archive.read("word/document.xml")).find("w:body", DOCX_NS)
+        if body is None:
+            return ""
+
+        blocks = []
+        for element in body:
+            if element.tag == f"{{{DOCX_NS['w']}}}p":
+                text = docx_paragraph_text(element)
+                if not text:
+                    continue
+                style = element.find("w:pPr/w:pStyle", DOCX_NS)
+                style = style.get(f"{{{DOCX_NS['w']}}}val", "") if style is not None else ""
+                heading = re.match(r'(?i)^heading\s*([1-6])$', style)
+                if heading:
+                    text = "#" * int(heading.group(1)) + " " + text
+                elif style.lower() == "title":
+                    text = "# " + text
+                elif element.find("w:pPr/w:numPr", DOCX_NS) is not None:
+                    text = "- " + text
+                blocks.append(text)
+            elif element.tag == f"{{{DOCX_NS['w']}}}tbl":
+                rows = [[" ".join(docx_paragraph_text(p) for p in cell.findall("w:p", DOCX_NS))
+                         for cell in row.findall("w:tc", DOCX_NS)]
+                        for row in element.findall("w:tr", DOCX_NS)]
+                if rows:
+                    table = ["| " + " | ".join(markdown_cell(c) for c in row) + " |" for row in rows]
+                    table.insert(1, "|" + " --- |" * len(rows[0]))
+                    blocks.append("\n".join(table))
+
+        # Consecutive list paragraphs read as one list
+        text = "\n\n".join(blocks)
+        return re.sub(r'(^- [^\n]*)\n\n(?=- )', r'\1\n', text, flags=re.MULTILINE)
+
+def extract_eml(data, options):
+    """Subject, sender, date and body text of a saved RFC 822 message"""
+    message = email.message_from_bytes(data, policy=email.policy.default)
+    body = ""
+    part = message.get_body(preferencelist=("plain", "html"))
+    if part is not None:
+        body = part.get_content()
+        if part.get_content_type() == "text/html":
+            body = html_to_text(body)
+    return format_email(message.get("subject", ""), message.get("from", ""), message.get("date", ""), body)
+
+def format_email(subject, sender, date, body):
+    lines = [f"Subject: {subject}" if subject else "", f"From: {sender}" if sender else "", f"Date: {date}" if date else ""]
+    header = "\n".join(line for line in lines if line)
+    body = body.replace("\r\n", "\n").strip()
+    return f"{header}\n\n{body}".strip()
+
+def read_compound_file(data):
+    """Streams directly under the root storage of an OLE compound file (the
+    container of Outlook .msg files), by name"""
+    if data[:8] != b"\xd0\xcf\x11\xe0\xa1\xb1\x1a\xe1":
+        raise ValueError("not an OLE compound file")
+    sector_size = 1 << struct.unpack_from("<H", data, 0x1E)[0]
+    mini_sector_size = 1 << struct.unpack_from("<H", data, 0x20)[0]
+    first_dir_sector, = struct.unpack_from("<I", data, 0x30)
+    mini_cutoff, first_minifat_sector = struct.unpack_from("<II", data, 0x38)
+    first_difat_sector, difat_count = struct.unpack_from("<II", data, 0x44)
+    end_of_chain = 0xFFFFFFFE
+
+    def sector(number):
+        offset = (number + 1) * sector_size
+        return data[offset:offset + sector_size]
+
+    # The FAT sectors are listed in the header and continued in DIFAT sectors
+    fat_sectors = [s for s in struct.unpack_from("<109I", data, 0x4C) if s < end_of_chain]
+    next_difat = first_difat_sector
+    for _ in range(difat_count):
+        if next_difat >= end_of_chain:
+            break
+        entries = struct.unpack(f"<{sector_size // 4}I", sector(next_difat))
+        fat_sectors.extend(s for s in entries[:-1] if s < end_of_chain)
+        next_difat = entries[-1]
+    fat = []
+    for number in fat_sectors:
+        fat.extend(struct.unpack(f"<{sector_size // 4}I", sector(number)))
+
+    def chain(start, table):
+        seen = set()
+        while start < end_of_chain and start < len(table) and start not in seen:
+            seen.add(start)
+            yield start
+            start = table[start]
+
+    def read_chain(start):
+        return b"".join(sector(number) for number in chain(start, fat))
+
+    directory = read_chain(first_dir_sector)
+    entries = []
+    for offset in range(0, len(directory) - 127, 128):
+        name_length, = struct.unpack_from("<H", directory, offset + 64)
+        name = directory[offset:offset + max(name_length - 2, 0)].decode("utf-16-le", errors="replace")
+        entry_type = directory[offset + 66]
+        left, right, child = struct.unpack_from("<III", directory, offset + 68)
+        start, size = struct.unpack_from("<II", directory, offset + 116)
+        entries.append((name, entry_type, left, right, child, start, size))
+    if not entries:
+        return {}
+
+    root = entries[0]
+    mini_stream = read_chain(root[5])
+    minifat = []
+    if first_minifat_sector < end_of_chain:
+        minifat_data = read_chain(first_minifat_sector)
+        minifat = list(struct.unpack(f"<{len(minifat_data) // 4}I", minifat_data))
+
+    def read_stream(start, size):
+        if size < mini_cutoff:
+            return b"".join(mini_stream[n * mini_sector_size:(n + 1) * mini_sector_size] for n in chain(start, minifat))[:size]
+        return read_chain(start)[:size]
+
+    # Walk the red-black tree of the root's children
+    streams = {}
+    pending = [root[4]]
+    while pending:
+        index = pending.pop()
+        if index >= len(entries) or index >= end_of_chain:
+            continue
+        name, entry_type, left, right, _, start, size = entries[index]
+        if entry_type == 2:
+            streams[name] = read_stream(start, size)
+        pending.extend([left, right])
+    return streams
+
+# MAPI properties of an Outlook message, stored as __substg1.0_<ID><TYPE> streams
+MSG_SUBJECT = "0037"
+MSG_SENDER_NAME = "0C1A"
+MSG_SENDER_EMAIL = "0C1F"
+MSG_BODY = "1000"
+MSG_BODY_HTML = "1013"
+MSG_SUBMIT_TIME = 0x0039
+MSG_DELIVERY_TIME = 0x0E06
+
+def extract_msg(data, options):
+    """Subject, sender, date and body text of a saved Outlook message"""
+    streams = read_compound_file(data)
+
+    def text_property(property_id):
+        if f"__substg1.0_{property_id}001F" in streams:
+            return streams[f"__substg1.0_{property_id}001F"].decode("utf-16-le", errors="replace").rstrip("\x00")
+        if f"__substg1.0_{property_id}001E" in streams:
+            return streams[f"__substg1.0_{property_id}001E"].decode("cp1252", errors="replace").rstrip("\x00")
+        return ""
+
+    # Dates are fixed-size properties in the property stream, after a 32 byte header
+    date = ""
+    properties = streams.get("__properties_version1.0", b"")
+    times = {}
+    for offset in range(32, len(properties) - 15, 16):
+        tag, = struct.unpack_from("<I", properties, offset)
+        if tag & 0xFFFF == 0x0040:
+            times[tag >> 16], = struct.unpack_from("<Q", properties, offset + 8)
+    filetime = times.get(MSG_SUBMIT_TIME) or times.get(MSG_DELIVERY_TIME)
+    if filetime:
+        date = (datetime.datetime(1601, 1, 1, tzinfo=datetime.timezone.utc) + datetime.timedelta(microseconds=filetime // 10)).strftime("%Y-%m-%d %H:%M UTC")
+
+    sender = text_property(MSG_SENDER_NAME)
+    sender_email = text_property(MSG_SENDER_EMAIL)
+    if sender_email and "@" in sender_email and sender_email != sender:
+        sender = f"{sender} <{sender_email}>" if sender else sender_email
+
+    body = text_property(MSG_BODY)
+    if not body.strip() and f"__substg1.0_{MSG_BODY_HTML}0102" in streams:
+        body = html_to_text(streams[f"__substg1.0_{MSG_BODY_HTML}0102"].decode("utf-8", errors="replace"))
+    return format_email(text_property(MSG_SUBJECT), sender, date, body)
+
+OCR_TIMEOUT = 60
+
+def validate_ocr(options):
+    """Check the OCR options, returning an error message or None"""
+    engine = options.get("ocr")
+    if not engine:
+        return None
+    if engine == "tesseract":
+        if not shutil.which("tesseract") or not shutil.which("pdftoppm"):
+            return "ocr is 'tesseract' but tesseract or pdftoppm (poppler-utils) was not found in PATH"
+    elif engine == "endpoint":
+        if not options.get("ocr_endpoint"):
+            return "ocr_endpoint is required when ocr is 'endpoint'"
+    else:
+        return f"unknown ocr '{engine}' (expected 'tesseract' or 'endpoint')"
+    return None
+
+def recognize_text(image, content_type, options):
+    """Run the configured OCR engine on an image, returning its text"""
+    if options.get("ocr") == "tesseract":
+        args = ["tesseract", "stdin", "stdout"]
+        if options.get("ocr_language"):
+            args += ["-l", options["ocr_language"]]
+        result = subprocess.run(args, input=image, capture_output=True, timeout=OCR_TIMEOUT)
+        if result.returncode != 0:
+            raise RuntimeError(f"tesseract: {result.stderr.decode(errors='replace').strip()}")
+        return result.stdout.decode(errors="replace")
+
+    # The endpoint receives the raw image and answers with plain text or {"text": "..."}
+    req = urllib.request.Request(options["ocr_endpoint"], data=image, method="POST")
+    req.add_header("Content-Type", content_type)
+    if options.get("ocr_language"):
+        req.add_header("Content-Language", options["ocr_language"])
+    response = urllib.request.urlopen(req, timeout=OCR_TIMEOUT).read().decode(errors="replace")
+    try:
+        return json.loads(response).get("text") or response
+    except (ValueError, AttributeError):
+        return response
+
+def take_ocr_pages(options, pages):
+    """Charge pages against the per-run OCR page budget, False when it is spent"""
+    if options["ocr_pages_left"] < pages:
+        print(f"DEBUG: OCR page budget spent, skipping a {pages} page scan", file=sys.stderr)
+        return False
+    options["ocr_pages_left"] -= pages
+    return True
+
+def extract_pdf(data, options):
+    """Text layer of a PDF, or the OCR'd text of its rendered pages when it is a scan"""
+    if not shutil.which("pdftotext"):
+        print("DEBUG: pdftotext not found, skipping PDF content", file=sys.stderr)
+        return ""
+    with tempfile.TemporaryDirectory() as workdir:
+        pdf_path = os.path.join(workdir, "document.pdf")
+        with open(pdf_path, "wb") as f:
+            f.write(data)
+        max_pages = str(options.get("pdf_max_pages", 50))
+        result = subprocess.run(["pdftotext", "-layout", "-l", max_pages, pdf_path, "-"], capture_output=True, timeout=120)
+        if result.returncode != 0:
+            raise RuntimeError(f"pdftotext: {result.stderr.decode(errors='replace').strip()}")
+        text = result.stdout.decode(errors="replace")
+        # pdftotext ends every page with a form feed
+        pages = text.split("\f")[:-1] or [text]
+        if text.replace("\f", "").strip():
+            return text.replace("\f", "\n").strip()
+
+        if not options.get("ocr"):
+            return f"[No text layer ({len(pages)} pages, probably scanned)]"
+        if not take_ocr_pages(options, len(pages)):
+            return ""
+        subprocess.run(["pdftoppm", "-r", "300", "-png", "-l", max_pages, pdf_path, os.path.join(workdir, "page")],
+                       check=True, capture_output=True, timeout=300)
+        recognized = []
+        for number, image_name in enumerate(sorted(n for n in os.listdir(workdir) if n.endswith(".png")), start=1):
+            with open(os.path.join(workdir, image_name), "rb") as f:
+                page_text = recognize_text(f.read(), "image/png", options).strip()
+            if page_text:
+                recognized.append(f"[Page {number}]\n{page_text}")
+        print(f"DEBUG: OCR'd {len(pages)} scanned pages", file=sys.stderr)
+        return "\n\n".join(recognized)
+
+def tiff_page_count(data):
+    """Number of images (IFDs) in a TIFF file"""
+    order = "<" if data[:2] == b"II" else ">"
+    offset, = struct.unpack_from(f"{order}I", data, 4)
+    pages = 0
+    while 0 < offset < len(data) - 2 and pages < 10000:
+        pages += 1
+        entries, = struct.unpack_from(f"{order}H", data, offset)
+        next_offset = offset + 2 + entries * 12
+        if next_offset + 4 > len(data):
+            break
+        offset, = struct.unpack_from(f"{order}I", data, next_offset)
+    return max(pages, 1)
+
+def extract_tiff(data, options):
+    """OCR'd text of a scanned TIFF"""
+    if not options.get("ocr"):
+        return ""
+    if not take_ocr_pages(options, tiff_page_count(data)):
+        return ""
+    return recognize_text(data, "image/tiff", options).strip()
+
+# File extensions with a text extractor
+DOCUMENT_EXTRACTORS = {
+    "docx": extract_docx,
+    "xlsx": extract_xlsx,
+    "pptx": extract_pptx,
+    "eml": extract_eml,
+    "msg": extract_msg,
+    "pdf": extract_pdf,
+    "tif": extract_tiff,
+    "tiff": extract_tiff,
+}
+
+def extract_document(drive_id, item, access_token, file_extension, options):
+    """Download a library file and extract its text, within the configured size limit"""
+    file_name = item.get("name", "")
+    size = item.get("size") or 0
+    if size > options.get("max_document_bytes", 0):
+        print(f"DEBUG: Skipping content of {file_name} ({size} bytes exceeds the size limit)", file=sys.stderr)
+        return ""
+
+    data = download_file(drive_id, item.get("id", ""), access_token)
+    if not data:
+        return ""
+    try:
+        text = DOCUMENT_EXTRACTORS[file_extension](data, options)
+    except Exception as e:
+        print(f"DEBUG: Failed to extract text from {file_name}: {e}", file=sys.stderr)
+        return ""
+    print(f"DEBUG: Extracted {len(text)} chars from {file_name}", file=sys.stderr)
+    return text
+
+def file_metadata(item, library_name, folder_path):
+    """Provenance fields for a library file: who created and changed it, when, and where it lives"""
+    def identity_name(identity_set):
+        identity = (identity_set or {}).get("user") or (identity_set or {}).get("application") or {}
+        return identity.get("displayName") or identity.get("email", "")
+
+    return {
+        "url": item.get("webUrl", ""),
+        "author": identity_name(item.get("createdBy")),
+        "modified_by": identity_name(item.get("lastModifiedBy")),
+        "created_at": item.get("createdDateTime", ""),
+        "updated_at": item.get("lastModifiedDateTime", ""),
+        "content_type": item.get("listItem", {}).get("contentType", {}).get("name") or item.get("file", {}).get("mimeType", ""),
+        "library_path": "/".join(part for part in (library_name, folder_path.strip("/")) if part),
+    }
+
+# Multilingual sites keep each translation in a folder named after its language,
+# e.g. SitePages/fr-fr/Launch.aspx next to SitePages/Launch.aspx
+PAGE_LANGUAGE_RE = re.compile(r'/SitePages/([a-z]{2,3}(?:-[a-z]{2,4})?)/[^/]+$', re.IGNORECASE)
+
+def page_language(page):
+    """Language of a translated page, or "" for a page in the site's default language"""
+    match = PAGE_LANGUAGE_RE.search(urllib.parse.urlparse(page.get("webUrl", "")).path)
+    return match.group(1).lower() if match else ""
+
+def translation_sources(pages):
+    """Map each translated page's ID to the ID of the page it translates"""
+    originals = {page.get("name", "").lower(): page.get("id") for page in pages if not page_language(page)}
+    return {page.get("id"): originals[page.get("name", "").lower()]
+            for page in pages if page_language(page) and page.get("name", "").lower() in originals}
+
+def select_page_language(pages, language):
+    """Keep one variant of each page: the preferred language when it exists,
+    otherwise the original (or every variant when there is no original)"""
+    language = language.lower()
+    variants = {}
+    for page in pages:
+        variants.setdefault(page.get("name", "").lower(), []).append(page)
+    selected = []
+    for group in variants.values():
+        preferred = [page for page in group if page_language(page) == language]
+        originals = [page for page in group if not page_language(page)]
+        selected.extend(preferred or originals or group)
+    print(f"DEBUG: Kept {len(selected)} of {len(pages)} pages for language {language}", file=sys.stderr)
+    return selected
+
+def fetch_page_comments(web_url, page_id, options):
+    """Comments and their replies on a modern page. Graph has no comments API,
+    so this uses the SharePoint REST API with a token for the SharePoint host."""
+    url = f"{web_url}/_api/web/lists/GetByTitle('Site Pages')/GetItemByUniqueId('{page_id}')/Comments?$expand=replies&$top=100"
+    result = make_sharepoint_request(url, options["sharepoint_token"])
+    if "error" in result:
+        print(f"DEBUG: Failed to read comments of page {page_id}: {result['error']}", file=sys.stderr)
+        return []
+    
+    # Pseudonyms go in before inline comments are rendered into the page text
+    def comment(entry):
+        return {
+            "author": pseudonym(options.get("pseudonyms"), (entry.get("author") or {}).get("name", "")),
+            "body": pseudonymize_text(options.get("pseudonyms"), html_to_text(entry.get("text") or "")),
+            "created_at": entry.get("createdDate", ""),
+        }
+    
+    comments = []
+    for entry in result.get("value", []):
+        top_level = comment(entry)
+        replies = [comment(reply) for reply in entry.get("replies") or []]
+        if replies:
+            top_level["replies"] = replies
+        comments.append(top_level)
+    return comments
+
+def render_comment(comment):
+    """A comment and its replies as one line of text, like the Confluence inline comments"""
+    text = f"[Comment by {comment['author']}: {comment['body']}" if comment["author"] else f"[Comment: {comment['body']}"
+    for reply in comment.get("replies", []):
+        text += f" / Reply by {reply['author']}: {reply['body']}" if reply["author"] else f" / Reply: {reply['body']}"
+    return text + "]"
+
+def processed_entries(processed, name):
+    """(key, value) pairs of a serverProcessedContent collection, which Graph
+    gives as a list of key/value objects and the canvas JSON as a map"""
+    value = processed.get(name) or []
+    if isinstance(value, dict):
+        return list(value.items())
+    return [(entry.get("key", ""), entry.get("value", "")) for entry in value if isinstance(entry, dict)]
+
+def web_part_markdown(part):
+    """Markdown of a modern page web part. Text web parts are converted from
+    their HTML; the others (quick links, images, hero, call to action, ...)
+    from the texts, links and images their server-processed content keeps,
+    each entry of a collection ("items[0].title", "items[0].url") as one bullet."""
+    if part.get("innerHtml"):
+        return html_to_text(part["innerHtml"])
+    data = part.get("data") or {}
+    processed = data.get("serverProcessedContent") or {}
+    properties = data.get("properties") or {}
+
+    def collection_entry(key):
+        head = key.split(".")[0]
+        return head if "[" in head else ""
+
+    heading = ""
+    paragraphs = []
+    entries = {}  # Collection entry -> texts and link
+    for key, value in processed_entries(processed, "searchablePlainTexts"):
+        value = str(value).strip()
+        if not value:
+            continue
+        if key == "title":
+            heading = value
+        elif collection_entry(key):
+            entries.setdefault(collection_entry(key), {"texts": [], "url": ""})["texts"].append(value)
+        else:
+            paragraphs.append(value)
+    for _, value in processed_entries(processed, "htmlStrings"):
+        text = html_to_text(value) if value else ""
+        if text:
+            paragraphs.append(text)
+    for key, value in processed_entries(processed, "links"):
+        if value and collection_entry(key):
+            entry = entries.setdefault(collection_entry(key), {"texts": [], "url": ""})
+            entry["url"] = entry["url"] or value
+        elif value:
+            paragraphs.append(f"[{value}]({value})")
+
+    blocks = [f"### {heading}"] if heading else []
+    blocks += paragraphs
+    bullets = []
+    for entry in entries.values():
+        text = " - ".join(entry["texts"])
+        if entry["url"]:
+            bullets.append(f"- [{text or entry['url']}]({entry['url']})")
+        elif text:
+            bullets.append(f"- {text}")
+    if bullets:
+        blocks.append("\n".join(bullets))
+    alt = properties.get("altText") or properties.get("captionText") or ""
+    for _, source in processed_entries(processed, "imageSources"):
+        if source:
+            blocks.append(f"![{alt}]({source})")
+    if properties.get("captionText") and properties.get("captionText") != alt:
+        blocks.append(properties["captionText"])
+    return "\n\n".join(blocks)
+
+def canvas_text_parts(site_id, page_id, access_token):
+    """Markdown of a modern page's web parts, in layout order, from its canvas
+    layout: sections of columns, plus the optional vertical section"""
+    url = f"https://graph.microsoft.com/v1.0/sites/{site_id}/pages/{page_id}/microsoft.graph.sitePage?$expand=canvasLayout"
+    page_data = make_sharepoint_request(url, access_token)
+    if "error" in page_data:
+        print(f"DEBUG: Could not read the canvas of page {page_id}: {page_data['error']}", file=sys.stderr)
+        return []
+    layout = page_data.get("canvasLayout") or {}
+    web_parts = []
+    for section in layout.get("horizontalSections") or []:
+        for column in section.get("columns") or []:
+            web_parts.extend(column.get("webparts") or [])
+    web_parts.extend((layout.get("verticalSection") or {}).get("webparts") or [])
+    return [text for text in (web_part_markdown(part) for part in web_parts) if text]
+
+def import_wiki_pages(site_id, access_token, items):
+    """Import classic wiki pages, whose HTML lives in the WikiField column of wiki page libraries"""
+    lists_url = f"https://graph.microsoft.com/v1.0/sites/{site_id}/lists?$select=id,displayName,list"
+    lists_result = make_paged_request(lists_url, access_token)
+    if "error" in lists_result:
+        print(f"DEBUG: Could not list site libraries: {lists_result['error']}", file=sys.stderr)
+        return
+
+    for library in lists_result["value"]:
+        # Wiki page libraries (including Site Pages on older sites) use the webPageLibrary template
+        if library.get("list", {}).get("template") != "webPageLibrary":
+            continue
+
+        library_name = library.get("displayName", "")
+        items_url = (f"https://graph.microsoft.com/v1.0/sites/{site_id}/lists/{library['id']}/items"
+                     "?$expand=fields($select=Title,FileLeafRef,WikiField)&$top=200")
+        library_items = make_paged_request(items_url, access_token)
+        if "error" in library_items:
+            print(f"DEBUG: Could not read library {library_name}: {library_items['error']}", file=sys.stderr)
+            continue
+
+        added = 0
+        for list_item in library_items["value"]:
+            fields = list_item.get("fields", {})
+            wiki_html = fields.get("WikiField") or ""
+            if not wiki_html.strip():
+                continue  # Modern pages keep their content in web parts instead
+
+            clean_content = html_to_text(wiki_html)
+            if not clean_content:
+                continue
+
+            file_name = fields.get("FileLeafRef", "")
+            title = fields.get("Title") or re.sub(r'\.aspx$', '', file_name, flags=re.IGNORECASE) or "Untitled"
+            items.append({
+                "id": list_item.get("id", ""),
+                "title": title,
+                "content": clean_content,
+                "type": "wiki_page",
+                "labels": "sharepoint,page,wiki",
+                "url": list_item.get("webUrl", ""),
             })
-            print(f"DEBUG: Added folder metadata: {folder_name}", file=sys.stderr)
+            added += 1
+            print(f"DEBUG: Added wiki page: {title}", file=sys.stderr)
+
+        print(f"DEBUG: Imported {added} wiki pages from library {library_name}", file=sys.stderr)
+
+# List columns that are bookkeeping rather than content
+LIST_SYSTEM_COLUMNS = {"ContentType", "Attachments", "Edit", "LinkTitle", "LinkTitleNoMenu", "DocIcon",
+                       "ItemChildCount", "FolderChildCount", "AppAuthor", "AppEditor", "ComplianceAssetId"}
+
+def list_selected(sharepoint_list, patterns):
+    """Match a list's display name against the sharepoint_lists globs. Libraries
+    and hidden lists are never imported as lists."""
+    info = sharepoint_list.get("list") or {}
+    if info.get("hidden") or info.get("template", "").endswith("Library"):
+        return False
+    name = sharepoint_list.get("displayName", "").lower()
+    return any(fnmatch.fnmatchcase(name, pattern.lower()) for pattern in patterns)
+
+def list_field_text(value):
+    """A list field value as one line of table text"""
+    if isinstance(value, bool):
+        return "Yes" if value else "No"
+    if isinstance(value, list):
+        return ", ".join(list_field_text(v) for v in value if v not in (None, ""))
+    if isinstance(value, dict):
+        # Hyperlink, lookup, person and managed metadata values
+        if value.get("Url"):
+            return f"[{value.get('Description') or value['Url']}]({value['Url']})"
+        return str(value.get("LookupValue") or value.get("Label") or value.get("displayName") or value.get("Email") or "")
+    if value is None:
+        return ""
+    text = str(value)
+    if "<" in text and ">" in text:
+        # Enhanced rich text columns hold HTML
+        text = html_to_text(text)
+    return markdown_cell(text)
+
+def list_item_attachments(web_url, list_id, item_id, options):
+    """Text of a list item's attachments, as sections under the item. Graph has
+    no attachments API, so this uses the SharePoint REST API."""
+    url = f"{web_url}/_api/web/lists(guid'{list_id}')/items({item_id})/AttachmentFiles"
+    result = make_sharepoint_request(url, options["sharepoint_token"])
+    if "error" in result:
+        print(f"DEBUG: Failed to read attachments of list item {item_id}: {result['error']}", file=sys.stderr)
+        return []
+
+    sections = []
+    for attachment in result.get("value", []):
+        file_name = attachment.get("FileName", "")
+        file_extension = file_name.split('.')[-1].lower() if '.' in file_name else ""
+        if file_extension not in DOCUMENT_EXTRACTORS and file_extension not in ("txt", "md"):
+            continue
+        if options.get("allowed_extensions") and file_extension not in options["allowed_extensions"]:
+            continue
+        server_url = urllib.parse.quote(attachment.get("ServerRelativeUrl", "").replace("'", "''"))
+        file_url = f"{web_url}/_api/web/GetFileByServerRelativeUrl('{server_url}')"
+        # The attachment listing has no sizes, so the limit is checked on the
+        # file's metadata before downloading it, as for library files
+        metadata = make_sharepoint_request(f"{file_url}?$select=Length", options["sharepoint_token"])
+        if "error" in metadata:
+            print(f"DEBUG: Failed to read the size of attachment {file_name}: {metadata['error']}", file=sys.stderr)
+            continue
+        size = int(metadata.get("Length") or 0)
+        if size > options.get("max_document_bytes", 0) or size > (options.get("max_file_size_bytes") or float("inf")):
+            print(f"DEBUG: Skipping content of attachment {file_name} ({size} bytes exceeds the size limit)", file=sys.stderr)
+            continue
+        data = download_url(f"{file_url}/$value", options["sharepoint_token"])
+        if not data:
+            continue
+        try:
+            if file_extension in DOCUMENT_EXTRACTORS:
+                text = DOCUMENT_EXTRACTORS[file_extension](data, options)
+            else:
+                text = data.decode("utf-8", errors="replace")
+        except Exception as e:
+            print(f"DEBUG: Failed to extract text from attachment {file_name}: {e}", file=sys.stderr)
+            continue
+        if text.strip():
+            sections.append(f"### Attachment: {file_name}\n\n{text.strip()}")
+    return sections
+
+def import_lists(site_id, access_token, items, options, web_url=""):
+    """Import the lists named in sharepoint_lists as markdown tables, one item
+    per list or, with list_output "item", one item per list row"""
+    lists_url = f"https://graph.microsoft.com/v1.0/sites/{site_id}/lists?$select=id,displayName,description,list,webUrl"
+    lists_result = make_paged_request(lists_url, access_token)
+    if "error" in lists_result:
+        print(f"DEBUG: Could not list site lists: {lists_result['error']}", file=sys.stderr)
+        return
+
+    for sharepoint_list in lists_result["value"]:
+        if not list_selected(sharepoint_list, options["lists"]):
+            continue
+        list_id = sharepoint_list.get("id", "")
+        list_name = sharepoint_list.get("displayName", "")
+
+        # Visible, editable columns in the list's order, Title first
+        columns_result = make_paged_request(f"https://graph.microsoft.com/v1.0/sites/{site_id}/lists/{list_id}/columns", access_token)
+        if "error" in columns_result:
+            print(f"DEBUG: Could not read the columns of list {list_name}: {columns_result['error']}", file=sys.stderr)
+            continue
+        columns = [(column["name"], column.get("displayName") or column["name"]) for column in columns_result["value"]
+                   if not column.get("hidden") and not column.get("readOnly") and column.get("name")
+                   and column["name"] not in LIST_SYSTEM_COLUMNS and not column["name"].startswith("_")]
+        columns.sort(key=lambda column: column[0] != "Title")
+
+        list_items = make_paged_request(f"https://graph.microsoft.com/v1.0/sites/{site_id}/lists/{list_id}/items?expand=fields&$top=200", access_token)
+        if "error" in list_items:
+            print(f"DEBUG: Could not read list {list_name}: {list_items['error']}", file=sys.stderr)
+            continue
+        rows = [list_item for list_item in list_items["value"] if list_item.get("fields")]
+        # Only the columns some row fills in
+        columns = [column for column in columns if any(list_field_text(row["fields"].get(column[0])) for row in rows)]
+
+        def attachments(list_item):
+            if not options.get("list_attachments") or not list_item["fields"].get("Attachments") or not web_url:
+                return []
+            return list_item_attachments(web_url, list_id, list_item.get("id", ""), options)
+
+        if options["list_output"] == "item":
+            for list_item in rows:
+                fields = list_item["fields"]
+                table = ["| Field | Value |", "| --- | --- |"]
+                table += [f"| {markdown_cell(label)} | {list_field_text(fields.get(name))} |"
+                          for name, label in columns if list_field_text(fields.get(name))]
+                content = f"List: {list_name}\n\n" + "\n".join(table)
+                sections = attachments(list_item)
+                if sections:
+                    content += "\n\n## Attachments\n\n" + "\n\n".join(sections)
+                items.append({
+                    "id": f"{list_id}:{list_item.get('id', '')}",
+                    "title": fields.get("Title") or f"{list_name} item {list_item.get('id', '')}",
+                    "content": content,
+                    "type": "list_item",
+                    "labels": "sharepoint,list,list_item",
+                    **file_metadata(list_item, list_name, "")
+                })
+            print(f"DEBUG: Imported {len(rows)} items of list {list_name}", file=sys.stderr)
+            continue
+
+        max_rows = options["list_max_rows"]
+        table = ["| " + " | ".join(markdown_cell(label) for _, label in columns) + " |",
+                 "|" + " --- |" * len(columns)]
+        sections = []
+        for list_item in rows[:max_rows]:
+            table.append("| " + " | ".join(list_field_text(list_item["fields"].get(name)) for name, _ in columns) + " |")
+            sections += attachments(list_item)
+        if len(rows) > max_rows:
+            table.append(f"\n[{len(rows) - max_rows} more rows not shown]")
+        content = f"List: {list_name}"
+        if sharepoint_list.get("description"):
+            content += f"\n\n{sharepoint_list['description']}"
+        content += "\n\n" + ("\n".join(table) if columns and rows else "(empty list)")
+        if sections:
+            content += "\n\n## Attachments\n\n" + "\n\n".join(sections)
+        items.append({
+            "id": list_id,
+            "title": list_name,
+            "content": content,
+            "type": "list",
+            "labels": "sharepoint,list",
+            "url": sharepoint_list.get("webUrl", ""),
+            "library_path": list_name,
+        })
+        print(f"DEBUG: Imported list {list_name} ({len(rows)} rows)", file=sys.stderr)
+
+def import_onenote(site_id, access_token, items):
+    """Import the pages of the site's OneNote notebooks, one item per page"""
+    sections = make_paged_request(f"https://graph.microsoft.com/v1.0/sites/{site_id}/onenote/sections"
+                                  "?$expand=parentNotebook($select=displayName),parentSectionGroup($select=displayName)", access_token)
+    if "error" in sections:
+        print(f"DEBUG: Could not list OneNote sections: {sections['error']}", file=sys.stderr)
+        return
+
+    for section in sections["value"]:
+        notebook = (section.get("parentNotebook") or {}).get("displayName", "")
+        section_name = section.get("displayName", "")
+        # Sections in section groups keep the group in their path
+        group = (section.get("parentSectionGroup") or {}).get("displayName", "")
+        section_path = "/".join(part for part in (group, section_name) if part)
+        pages = make_paged_request(f"https://graph.microsoft.com/v1.0/sites/{site_id}/onenote/sections/{section['id']}/pages"
+                                   "?$select=id,title,createdDateTime,lastModifiedDateTime,links&$top=100", access_token)
+        if "error" in pages:
+            print(f"DEBUG: Could not list the pages of OneNote section {section_name}: {pages['error']}", file=sys.stderr)
+            continue
+        for page in pages["value"]:
+            html = download_url(f"https://graph.microsoft.com/v1.0/sites/{site_id}/onenote/pages/{page['id']}/content", access_token)
+            if html is None:
+                continue
+            items.append({
+                "id": page.get("id", ""),
+                "title": page.get("title") or "Untitled",
+                "content": html_to_text(html.decode("utf-8", errors="replace")),
+                "type": "onenote_page",
+                "labels": "sharepoint,onenote",
+                "notebook": notebook,
+                "section": section_path,
+                "url": ((page.get("links") or {}).get("oneNoteWebUrl") or {}).get("href", ""),
+                "created_at": page.get("createdDateTime", ""),
+                "updated_at": page.get("lastModifiedDateTime", ""),
+            })
+        print(f"DEBUG: Imported {len(pages['value'])} OneNote pages from {notebook}/{section_path}", file=sys.stderr)
+
+def resolve_site(site_ref, access_token):
+    """Look up a site by URL or Graph site ID ("hostname,site collection ID,web ID")"""
+    if site_ref.startswith(("https://", "http://")):
+        hostname, site_path = extract_site_info(site_ref)
+        if not hostname:
+            return {"error": f"Invalid SharePoint site URL: {site_ref}"}
+        url = f"https://graph.microsoft.com/v1.0/sites/{hostname}:{site_path}"
+    else:
+        url = f"https://graph.microsoft.com/v1.0/sites/{site_ref}"
+    print(f"DEBUG: Requesting site info from: {url}", file=sys.stderr)
+    site = make_sharepoint_request(url, access_token)
+    if "error" not in site and not site.get("id"):
+        return {"error": f"Could not retrieve the site ID of {site_ref}"}
+    return site
+
+def site_hostname(site_ref):
+    """Hostname of a site URL or Graph site ID"""
+    if site_ref.startswith(("https://", "http://")):
+        return extract_site_info(site_ref)[0]
+    return site_ref.split(",")[0]
 
 def extract_site_info(site_url):
     """Extract hostname and site path from SharePoint URL"""
@@ -236,81 +1841,70 @@ def extract_site_info(site_url):
     except Exception:
         return None, None
 
-def main():
-    # Read input from stdin
-    try:
-        input_data = json.loads(sys.stdin.read())
-    except json.JSONDecodeError:
-        print(json.dumps({"error": "Failed to parse input JSON"}), file=sys.stderr)
-        sys.exit(1)
-    
-    # Extract parameters
-    site_url = input_data.get("SHAREPOINT_SITE_URL", "").rstrip('/')
-    include_documents = input_data.get("include_documents", "true").lower() == "true"
-    document_libraries = input_data.get("document_libraries", "Documents").split(',')
-    
-    # Get Azure credentials from input parameters (passed from Terraform)
-    client_id = input_data.get("AZURE_CLIENT_ID", "")
-    client_secret = input_data.get("AZURE_CLIENT_SECRET", "")
-    tenant_id = input_data.get("AZURE_TENANT_ID", "")
-    
-    # Check for required parameters - if all are empty, SharePoint is disabled
-    if not site_url and not client_id and not client_secret and not tenant_id:
-        print(f"DEBUG: SharePoint is disabled - returning empty results", file=sys.stderr)
-        print(json.dumps({"items": "[]"}))
-        sys.exit(0)
-    
-    # Check for required parameters when SharePoint is enabled
-    if not site_url or not client_id or not client_secret or not tenant_id:
-        print(json.dumps({"error": "Missing required parameters. Ensure AZURE_CLIENT_ID, AZURE_CLIENT_SECRET, and AZURE_TENANT_ID are set as environment variables."}), file=sys.stderr)
-        sys.exit(1)
-    
-    print(f"DEBUG: Connecting to site: {site_url}", file=sys.stderr)
-    
-    # Get access token
-    access_token = get_access_token(tenant_id, client_id, client_secret)
-    if not access_token:
-        print(json.dumps({"error": "Failed to get access token"}), file=sys.stderr)
-        sys.exit(1)
-    
-    print("DEBUG: Successfully obtained access token", file=sys.stderr)
-    
-    # Extract site information
-    hostname, site_path = extract_site_info(site_url)
-    if not hostname:
-        print(json.dumps({"error": "Invalid SharePoint site URL"}), file=sys.stderr)
-        sys.exit(1)
-    
-    print(f"DEBUG: Extracted hostname: {hostname}, site_path: {site_path}", file=sys.stderr)
-    
-    # Get site ID using Microsoft Graph API
-    graph_site_url = f"https://graph.microsoft.com/v1.0/sites/{hostname}:{site_path}"
-    print(f"DEBUG: Requesting site info from: {graph_site_url}", file=sys.stderr)
-    site_result = make_sharepoint_request(graph_site_url, access_token)
-    
-    if "error" in site_result:
-        print(json.dumps({"error": f"SharePoint connection failed: {site_result['error']}"}), file=sys.stderr)
-        sys.exit(1)
-    
-    site_id = site_result.get('id')
-    if not site_id:
-        print(json.dumps({"error": "Could not retrieve site ID"}), file=sys.stderr)
-        sys.exit(1)
-    
-    print(f"DEBUG: Successfully retrieved site ID: {site_id}", file=sys.stderr)
-    
-    items = []
+PROFILE_ENV_REFERENCE = re.compile(r"\$\{([A-Za-z_][A-Za-z0-9_]*)\}")
+
+def apply_profile(input_data):
+    """Merge a named profile from a shared config file underneath the explicit input.
+
+    Uses the same file format as the Confluence importer: {"defaults": {...}, "profiles": {"name": {...}}}.
+    Precedence is file defaults, then the profile, then any non-empty value given on stdin.
+    """
+    config_file = input_data.get("config_file") or os.environ.get("IMPORT_CONFIG_FILE", "")
+    profile_name = input_data.get("profile") or os.environ.get("IMPORT_PROFILE", "")
+    if not profile_name:
+        return input_data
+    if not config_file:
+        raise ValueError(f"profile '{profile_name}' selected but no config_file given")
+
+    with open(config_file) as f:
+        file_data = json.load(f)
+
+    profiles = file_data.get("profiles", {})
+    if profile_name not in profiles:
+        available = ", ".join(sorted(profiles))
+        raise ValueError(f"profile '{profile_name}' not found in {config_file} (available: {available})")
+
+    def as_string(value):
+        # Terraform passes every value as a string, so normalize file values the same way
+        if isinstance(value, bool):
+            return "true" if value else "false"
+        # Only ${VAR} is expanded: secrets may contain a bare "$"
+        return PROFILE_ENV_REFERENCE.sub(lambda match: os.environ.get(match.group(1), ""), str(value))
+
+    merged = {}
+    for layer in (file_data.get("defaults", {}), profiles[profile_name]):
+        for key, value in layer.items():
+            merged[key] = as_string(value)
+    for key, value in input_data.items():
+        if value not in ("", None):
+            merged[key] = value
+
+    print(f"DEBUG: Using profile '{profile_name}' from {config_file}", file=sys.stderr)
+    return merged
+
+def import_site(site_id, access_token, items, include_documents, include_wiki_pages, document_libraries, extraction_options, state_file="", state=None, web_url=""):
+    """Import the pages, wiki pages and library documents of one site"""
+    first_item = len(items)
     
     # Get site pages
     pages_url = f"https://graph.microsoft.com/v1.0/sites/{site_id}/pages"
     print(f"DEBUG: Requesting pages from: {pages_url}", file=sys.stderr)
-    pages_result = make_sharepoint_request(pages_url, access_token)
-    
-    print(f"DEBUG: Pages result: {pages_result}", file=sys.stderr)
+    pages_result = make_paged_request(pages_url, access_token)
     
     if "error" not in pages_result and "value" in pages_result:
         print(f"DEBUG: Found {len(pages_result['value'])} pages", file=sys.stderr)
-        for page in pages_result["value"]:
+        pages = pages_result["value"]
+        sources = translation_sources(pages)
+        if extraction_options.get("preferred_language"):
+            pages = select_page_language(pages, extraction_options["preferred_language"])
+        if state_file:
+            changed = changed_page_ids(site_id, access_token, state_file, state)
+            if changed is not None:
+                pages = [page for page in pages if (page.get("id") or "").lower() in changed]
+        # News posts are site pages promoted to news
+        if not extraction_options.get("include_news", True):
+            pages = [page for page in pages if page.get("promotionKind") != "newsPost"]
+        for page in pages:
             page_id = page.get("id")
             if page_id:
                 # Get page content
@@ -318,19 +1912,17 @@ def main():
                 page_data = make_sharepoint_request(page_content_url, access_token)
                 
                 if "error" not in page_data:
-                    # Extract content from web parts
+                    # Extract content from web parts, in page order
                     content_parts = []
                     if "webParts" in page_data and "value" in page_data["webParts"]:
-                        for webpart in page_data["webParts"]["value"]:
-                            if "innerHtml" in webpart:
-                                content_parts.append(webpart["innerHtml"])
+                        content_parts = [text for text in (web_part_markdown(part) for part in page_data["webParts"]["value"]) if text]
+                    if not content_parts:
+                        content_parts = canvas_text_parts(site_id, page_id, access_token)
                     
                     # If no webParts content, use page description or title
-                    content = " ".join(content_parts)
-                    if not content and page_data.get("description"):
-                        content = page_data.get("description", "")
-                    
-                    clean_content = html_to_text(content) if content else ""
+                    clean_content = "\n\n".join(content_parts)
+                    if not clean_content and page_data.get("description"):
+                        clean_content = html_to_text(page_data.get("description", ""))
                     
                     # If still no content, create a basic summary from page metadata
                     if not clean_content or clean_content.strip() == "":
@@ -343,18 +1935,53 @@ def main():
                         
                         print(f"DEBUG: Creating basic content for page: {title}", file=sys.stderr)
                     
-                    # Add to items
-                    items.append({
+                    page_item = {
                         "id": page_data.get("id", ""),
                         "title": page_data.get("title", "Untitled"),
                         "content": clean_content,
                         "type": "page",
-                        "labels": "sharepoint,page"
-                    })
+                        "labels": "sharepoint,page",
+                        "url": absolute_url(web_url, page_data.get("webUrl") or page.get("webUrl", "")),
+                    }
+                    if (page_data.get("promotionKind") or page.get("promotionKind")) == "newsPost":
+                        if not extraction_options.get("include_news", True):
+                            continue
+                        page_item["type"], page_item["labels"] = "news", "sharepoint,news"
+                        page_item["published_at"] = page_data.get("firstPublishedDateTime") or page.get("firstPublishedDateTime", "")
+                    
+                    # Translations live in a language folder of Site Pages
+                    language = page_language(page) or extraction_options.get("default_language", "")
+                    if language:
+                        page_item["language"] = language
+                    if page_id in sources:
+                        page_item["translation_of"] = sources[page_id]
+                    
+                    # Discussions under pages and news posts, in the text or as structured comments
+                    if extraction_options.get("page_comments") and web_url:
+                        comments = fetch_page_comments(web_url, page_id, extraction_options)
+                        if comments and extraction_options["page_comments"] == "inline":
+                            page_item["content"] += "\n\n## Comments\n\n" + "\n".join(render_comment(c) for c in comments)
+                        elif comments:
+                            page_item["comments"] = comments
+                    
+                    # Add to items
+                    items.append(page_item)
                     print(f"DEBUG: Added page: {page_data.get('title', 'Untitled')}", file=sys.stderr)
     else:
         print(f"DEBUG: No pages found or error accessing pages: {pages_result}", file=sys.stderr)
     
+    # Get classic wiki pages
+    if include_wiki_pages:
+        import_wiki_pages(site_id, access_token, items)
+    
+    # OneNote notebooks stored in the site
+    if extraction_options.get("include_onenote"):
+        import_onenote(site_id, access_token, items)
+    
+    # Lists, rendered as markdown tables
+    if extraction_options.get("lists"):
+        import_lists(site_id, access_token, items, extraction_options, web_url)
+    
     # Get documents from specified libraries if requested
     if include_documents:
         print(f"DEBUG: Checking document libraries: {document_libraries}", file=sys.stderr)
@@ -385,17 +2012,605 @@ def main():
                     print(f"DEBUG: Found target drive ID: {target_drive_id}", file=sys.stderr)
                     # Recursively scan the drive for files and folders
                     print(f"DEBUG: Starting recursive scan of drive: {library_name}", file=sys.stderr)
-                    scan_drive_items(target_drive_id, None, access_token, items)
+                    if state_file:
+                        crawl_drive_delta(target_drive_id, access_token, items, library_name, extraction_options, state_file, state)
+                    else:
+                        scan_drive_items(target_drive_id, None, access_token, items, library_name=library_name, options=extraction_options)
                 else:
                     print(f"DEBUG: Could not find drive for library: {library_name}", file=sys.stderr)
     
+    # Pages have no permissions of their own in Graph; they get the audiences and
+    # permissions of the site, read from the root of its default document library
+    site_access = access_fields(f"https://graph.microsoft.com/v1.0/sites/{site_id}/drive/root/permissions", access_token, extraction_options)
+    for item in items[first_item:]:
+        if item.get("action") == "deleted":
+            continue
+        for field, value in site_access.items():
+            item.setdefault(field, value)
+
+def make_graph_post(url, body, access_token, retried=False, attempt=0):
+    """POST a JSON body to Microsoft Graph, returning the parsed response or an error dict"""
+    access_token = current_token(access_token)
+    wait_for_rate_limit()
+    try:
+        req = urllib.request.Request(url, data=json.dumps(body).encode('utf-8'), method='POST')
+        req.add_header('Authorization', f'Bearer {access_token}')
+        req.add_header('Content-Type', 'application/json')
+        req.add_header('Accept', 'application/json')
+        context = ssl.create_default_context()
+        response = urllib.request.urlopen(req, context=context, timeout=30)
+        note_rate_limit(response.headers)
+        return json.loads(response.read().decode('utf-8'))
+    except urllib.error.HTTPError as e:
+        if throttled(e, attempt):
+            return make_graph_post(url, body, access_token, retried, attempt + 1)
+        if e.code == 401 and not retried and refresh_token(access_token):
+            return make_graph_post(url, body, access_token, retried=True)
+        return {"error": f"HTTP Error: {e.code} - {e.reason}"}
+    except Exception as e:
+        return {"error": f"Error: {str(e)}"}
+
+def search_sites(query, access_token, region):
+    """Sites matching a KQL query through the Graph search API"""
+    sites = []
+    offset = 0
+    while True:
+        result = make_graph_post("https://graph.microsoft.com/v1.0/search/query", {"requests": [{
+            "entityTypes": ["site"],
+            "query": {"queryString": query},
+            "from": offset,
+            "size": 50,
+            "region": region,
+        }]}, access_token)
+        if "error" in result:
+            print(f"DEBUG: Site search failed: {result['error']}", file=sys.stderr)
+            return sites
+        containers = [c for response in result.get("value", []) for c in response.get("hitsContainers", [])]
+        hits = [hit.get("resource", {}) for c in containers for hit in c.get("hits", [])]
+        sites.extend(hits)
+        if not hits or not any(c.get("moreResultsAvailable") for c in containers):
+            return sites
+        offset += len(hits)
+
+def parse_patterns(value):
+    return [pattern.strip().strip("/") for pattern in value.split(",") if pattern.strip()]
+
+def site_selected(web_url, include_patterns, exclude_patterns):
+    """Match a site's path (e.g. "sites/Engineering") against the include and
+    exclude globs; no include patterns means every site"""
+    site_path = urllib.parse.urlparse(web_url or "").path.strip("/").lower()
+    if include_patterns and not any(fnmatch.fnmatchcase(site_path, p.lower()) for p in include_patterns):
+        return False
+    return not any(fnmatch.fnmatchcase(site_path, p.lower()) for p in exclude_patterns)
+
+def find_hub_sites(hub_site, access_token, max_depth, max_sites, region, include_patterns=(), exclude_patterns=()):
+    """Sites associated with a hub site, breadth first through hubs associated
+    with it, up to max_depth levels and max_sites sites. Sites filtered out by
+    the include/exclude globs are neither imported nor followed."""
+    found = []
+    seen = {hub_site.get("id")}
+    level = [hub_site]
+    for depth in range(max_depth):
+        next_level = []
+        for hub in level:
+            # Graph site IDs are "hostname,site collection ID,web ID"; associated
+            # sites carry their hub's site collection ID as DepartmentId
+            parts = (hub.get("id") or "").split(",")
+            if len(parts) < 2:
+                continue
+            for site in search_sites(f"DepartmentId:{{{parts[1]}}}", access_token, region):
+                if not site.get("id") or site.get("id") in seen:
+                    continue
+                seen.add(site.get("id"))
+                if not site_selected(site.get("webUrl"), include_patterns, exclude_patterns):
+                    print(f"DEBUG: Skipping site excluded by the site patterns: {site.get('webUrl')}", file=sys.stderr)
+                    continue
+                if len(found) >= max_sites:
+                    print(f"DEBUG: Hub site limit of {max_sites} reached", file=sys.stderr)
+                    return found
+                found.append(site)
+                next_level.append(site)
+                print(f"DEBUG: Found hub site (depth {depth + 1}): {site.get('webUrl', site.get('id'))}", file=sys.stderr)
+        level = next_level
+    return found
+
+def discover_sites(access_token, max_sites, include_patterns=(), exclude_patterns=()):
+    """Every site of the tenant, except OneDrive sites and those filtered out by
+    the include/exclude globs, up to max_sites"""
+    result = make_paged_request("https://graph.microsoft.com/v1.0/sites/getAllSites?$select=id,webUrl,displayName,isPersonalSite&$top=200", access_token)
+    if "error" in result:
+        return result
+    found = []
+    for site in result["value"]:
+        if site.get("isPersonalSite") or "/personal/" in (site.get("webUrl") or ""):
+            continue
+        if not site_selected(site.get("webUrl"), include_patterns, exclude_patterns):
+            print(f"DEBUG: Skipping site excluded by the site patterns: {site.get('webUrl')}", file=sys.stderr)
+            continue
+        if len(found) >= max_sites:
+            print(f"DEBUG: Discovered site limit of {max_sites} reached", file=sys.stderr)
+            break
+        found.append(site)
+    print(f"DEBUG: Discovered {len(found)} of the tenant's {len(result['value'])} sites", file=sys.stderr)
+    return {"value": found}
+
+# SharePoint Server (2016/2019) sites aren't reachable through Graph, so with
+# sharepoint_api "rest" they're read through the classic _api/web endpoints,
+# authenticated with NTLM (through curl, which speaks it) or an add-in token
+REST_LIBRARY_TEMPLATE = 101
+REST_PAGE_LIBRARY_TEMPLATE = 119
+
+def validate_rest(input_data, options):
+    """Check the sharepoint_api options, returning an error message or None"""
+    api = input_data.get("sharepoint_api", "graph")
+    if api == "graph":
+        return None
+    if api != "rest":
+        return f"unknown sharepoint_api '{api}' (expected 'graph' or 'rest')"
+    auth = options["rest_auth"]
+    if auth == "ntlm":
+        if not input_data.get("SHAREPOINT_USERNAME") or not input_data.get("SHAREPOINT_PASSWORD"):
+            return "sharepoint_auth 'ntlm' needs SHAREPOINT_USERNAME (DOMAIN\\user) and SHAREPOINT_PASSWORD"
+        if not shutil.which("curl"):
+            return "sharepoint_auth 'ntlm' needs curl in PATH"
+    elif auth == "addin":
+        if not all(input_data.get(key) for key in ("AZURE_CLIENT_ID", "AZURE_CLIENT_SECRET", "AZURE_TENANT_ID")):
+            return "sharepoint_auth 'addin' needs AZURE_CLIENT_ID, AZURE_CLIENT_SECRET and AZURE_TENANT_ID (the realm)"
+    else:
+        return f"unknown sharepoint_auth '{auth}' (expected 'ntlm' or 'addin')"
+    for key in ("include_hub_sites", "include_sensitivity_labels", "include_onenote", "discover_sites", "include_permissions"):
+        if input_data.get(key, "false").lower() == "true":
+            return f"{key} needs Graph and can't be combined with sharepoint_api 'rest'"
+    for key in ("sharepoint_lists", "audience_map", "max_sensitivity", "state_file", "page_comments"):
+        if input_data.get(key):
+            return f"{key} can't be combined with sharepoint_api 'rest'"
+    return None
+
+def get_addin_token(realm, client_id, client_secret, hostname):
+    """App-only token of a SharePoint add-in, issued by Azure ACS for one host"""
+    try:
+        data = urllib.parse.urlencode({
+            "grant_type": "client_credentials",
+            "client_id": f"{client_id}@{realm}",
+            "client_secret": client_secret,
+            "resource": f"00000003-0000-0ff1-ce00-000000000000/{hostname}@{realm}",
+        }).encode("utf-8")
+        req = urllib.request.Request(f"https://accounts.accesscontrol.windows.net/{realm}/tokens/OAuth/2", data=data, method="POST")
+        req.add_header("Content-Type", "application/x-www-form-urlencoded")
+        response = urllib.request.urlopen(req, context=ssl.create_default_context(), timeout=30)
+        token_data = json.loads(response.read().decode("utf-8"))
+        token = token_data.get("access_token")
+        if token:
+            TOKENS["expires"][token] = time.time() + int(token_data.get("expires_in", 3599))
+        return token
+    except Exception as e:
+        print(f"DEBUG: Add-in token request failed: {e}", file=sys.stderr)
+        return None
+
+def rest_fetch(url, options, accept="application/json;odata=nometadata", retried=False, attempt=0):
+    """GET a SharePoint REST URL, returning the body bytes or None"""
+    wait_for_rate_limit()
+    if options["rest_auth"] == "ntlm":
+        # Credentials go through curl's config on stdin, not the command line.
+        # curl retries 429 and 503 responses itself, waiting their Retry-After.
+        user = f'{options["rest_username"]}:{options["rest_password"]}'.replace("\\", "\\\\").replace('"', '\\"')
+        result = subprocess.run(["curl", "--silent", "--show-error", "--fail", "--globoff", "--ntlm", "--config", "-",
+                                 "--retry", str(THROTTLE_RETRIES), "--retry-max-time", str(THROTTLE_MAX_SECONDS * THROTTLE_RETRIES),
+                                 "--header", f"Accept: {accept}", "--max-time", "120", url],
+                                input=f'user = "{user}"\n'.encode("utf-8"), capture_output=True)
+        if result.returncode != 0:
+            print(f"DEBUG: Request to {url} failed: {result.stderr.decode(errors='replace').strip()}", file=sys.stderr)
+            return None
+        return result.stdout
+
+    access_token = current_token(options["rest_token"])
+    try:
+        req = urllib.request.Request(url)
+        req.add_header("Authorization", f"Bearer {access_token}")
+        req.add_header("Accept", accept)
+        response = urllib.request.urlopen(req, context=ssl.create_default_context(), timeout=120)
+        note_rate_limit(response.headers)
+        return response.read()
+    except urllib.error.HTTPError as e:
+        if throttled(e, attempt):
+            return rest_fetch(url, options, accept, retried, attempt + 1)
+        if e.code == 401 and not retried and refresh_token(access_token):
+            return rest_fetch(url, options, accept, retried=True)
+        print(f"DEBUG: Request to {url} failed: {e}", file=sys.stderr)
+        return None
+    except Exception as e:
+        print(f"DEBUG: Request to {url} failed: {e}", file=sys.stderr)
+        return None
+
+def rest_paged(url, options):
+    """Follow odata.nextLink of a REST collection and return all values, or None"""
+    values = []
+    while url:
+        body = rest_fetch(url, options)
+        if body is None:
+            return None
+        try:
+            result = json.loads(body.decode("utf-8"))
+        except ValueError as e:
+            print(f"DEBUG: Unexpected response from {url}: {e}", file=sys.stderr)
+            return None
+        values.extend(result.get("value", []))
+        url = result.get("odata.nextLink") or result.get("@odata.nextLink")
+    return values
+
+def rest_file_url(web_url, server_relative_url):
+    quoted = urllib.parse.quote(server_relative_url.replace("'", "''"))
+    return f"{web_url}/_api/web/GetFileByServerRelativeUrl('{quoted}')/$value"
+
+def absolute_url(web_url, url):
+    """url made absolute: server-relative paths join the site's host, and paths
+    relative to the site, like those of Graph site pages, the site URL"""
+    if not url or url.startswith(("https://", "http://")) or not web_url:
+        return url
+    if url.startswith("/"):
+        return urllib.parse.urljoin(web_url, url)
+    return web_url.rstrip("/") + "/" + url
+
+def rest_metadata(entry, library_path, web_url):
+    """Provenance fields of a REST list item, like file_metadata's"""
+    return {
+        "url": absolute_url(web_url, urllib.parse.quote(entry.get("FileRef") or "")) if entry.get("FileRef") else "",
+        "author": (entry.get("Author") or {}).get("Title", ""),
+        "modified_by": (entry.get("Editor") or {}).get("Title", ""),
+        "created_at": entry.get("Created", ""),
+        "updated_at": entry.get("Modified", ""),
+        "library_path": library_path,
+    }
+
+def import_rest_site(web_url, items, include_documents, include_wiki_pages, document_libraries, options):
+    """Import the pages, wiki pages and library documents of one site through
+    the SharePoint REST API"""
+    lists = rest_paged(f"{web_url}/_api/web/lists?$select=Id,Title,BaseTemplate,Hidden,RootFolder/ServerRelativeUrl"
+                       "&$expand=RootFolder&$filter=Hidden%20eq%20false", options)
+    if lists is None:
+        print(f"DEBUG: Could not list the libraries of {web_url}", file=sys.stderr)
+        return False
+    libraries = {name.strip().lower() for name in document_libraries if name.strip()}
+    provenance = "Created,Modified,Author/Title,Editor/Title&$expand=Author,Editor&$top=500"
+
+    for sharepoint_list in lists:
+        list_url = f"{web_url}/_api/web/lists(guid'{sharepoint_list['Id']}')/items"
+        title = sharepoint_list.get("Title", "")
+        root = (sharepoint_list.get("RootFolder") or {}).get("ServerRelativeUrl", "")
+
+        if sharepoint_list.get("BaseTemplate") == REST_PAGE_LIBRARY_TEMPLATE:
+            # Modern pages keep their web parts in CanvasContent1, wiki pages in WikiField
+            entries = rest_paged(f"{list_url}?$select=Id,Title,FileLeafRef,FileRef,CanvasContent1,WikiField,PromotedState,FirstPublishedDate,{provenance}", options)
+            for entry in entries or []:
+                html = entry.get("CanvasContent1") or ""
+                item_type, labels = "page", "sharepoint,page"
+                # A PromotedState of 2 is a published news post
+                if str(entry.get("PromotedState")) == "2":
+                    if not options.get("include_news", True):
+                        continue
+                    item_type, labels = "news", "sharepoint,news"
+                if not html.strip():
+                    if not include_wiki_pages:
+                        continue
+                    html, item_type, labels = entry.get("WikiField") or "", "wiki_page", "sharepoint,page,wiki"
+                content = html_to_text(html) if html.strip() else ""
+                if not content:
+                    continue
+                file_name = entry.get("FileLeafRef") or ""
+                page_item = {
+                    "id": f"{sharepoint_list['Id']}:{entry.get('Id', '')}",
+                    "title": entry.get("Title") or re.sub(r'\.aspx$', '', file_name, flags=re.IGNORECASE) or "Untitled",
+                    "content": content,
+                    "type": item_type,
+                    "labels": labels,
+                    **rest_metadata(entry, title, web_url)
+                }
+                if item_type == "news":
+                    page_item["published_at"] = entry.get("FirstPublishedDate") or ""
+                items.append(page_item)
+            print(f"DEBUG: Read {len(entries or [])} entries of page library {title}", file=sys.stderr)
+
+        elif (sharepoint_list.get("BaseTemplate") == REST_LIBRARY_TEMPLATE and include_documents
+              and title.lower() in libraries):
+            # Items of a library include the files of every folder
+            entries = rest_paged(f"{list_url}?$select=Id,FileLeafRef,FileRef,FSObjType,File_x0020_Size,{provenance}", options)
+            added = 0
+            for entry in entries or []:
+                file_name = entry.get("FileLeafRef") or ""
+                size = int(entry.get("File_x0020_Size") or 0)
+                if str(entry.get("FSObjType")) != "0":
+                    continue
+                file_extension = file_extension_allowed(file_name, size, options)
+                if file_extension is None:
+                    continue
+                file_ref = entry.get("FileRef") or ""
+                folder_path = file_ref[len(root):].rsplit("/", 1)[0].strip("/") if file_ref.startswith(root) else ""
+                if not path_selected("/".join(part for part in (folder_path, file_name) if part), options):
+                    continue
+                content = f"Document: {file_name}\nType: {file_extension.upper()}\nSize: {size} bytes"
+                if folder_path:
+                    content += f"\nLocation: /{folder_path}"
+                if options.get("extract_content") and file_extension in DOCUMENT_EXTRACTORS:
+                    if size > options.get("max_document_bytes", 0):
+                        print(f"DEBUG: Skipping content of {file_name} ({size} bytes exceeds the size limit)", file=sys.stderr)
+                    else:
+                        data = rest_fetch(rest_file_url(web_url, file_ref), options, accept="*/*")
+                        try:
+                            text = DOCUMENT_EXTRACTORS[file_extension](data, options) if data else ""
+                        except Exception as e:
+                            print(f"DEBUG: Failed to extract text from {file_name}: {e}", file=sys.stderr)
+                            text = ""
+                        if text:
+                            content += "\n\n" + text
+                items.append({
+                    "id": f"{sharepoint_list['Id']}:{entry.get('Id', '')}",
+                    "title": file_name,
+                    "content": content,
+                    "type": "document",
+                    "labels": f"sharepoint,document,{file_extension}",
+                    **rest_metadata(entry, "/".join(part for part in (title, folder_path) if part), web_url)
+                })
+                added += 1
+            print(f"DEBUG: Added {added} documents from library {title}", file=sys.stderr)
+    return True
+
+def import_rest_sites(input_data, site_refs, include_documents, include_wiki_pages, document_libraries, options, pseudonym_file):
+    """Import the configured sites through the SharePoint REST API and print the items"""
+    if not site_refs or any(not ref.startswith(("https://", "http://")) for ref in site_refs):
+        print(json.dumps({"error": "sharepoint_api 'rest' needs site URLs in SHAREPOINT_SITE_URL or sharepoint_sites"}), file=sys.stderr)
+        sys.exit(1)
+    options["rest_username"] = input_data.get("SHAREPOINT_USERNAME", "")
+    options["rest_password"] = input_data.get("SHAREPOINT_PASSWORD", "")
+    if options["rest_auth"] == "addin":
+        # Sites of one farm share a hostname, like the sites of a tenant
+        realm, client_id, client_secret = input_data["AZURE_TENANT_ID"], input_data["AZURE_CLIENT_ID"], input_data["AZURE_CLIENT_SECRET"]
+        hostname = site_hostname(site_refs[0])
+        options["rest_token"] = track_token(get_addin_token(realm, client_id, client_secret, hostname),
+                                            lambda: get_addin_token(realm, client_id, client_secret, hostname))
+        if not options["rest_token"]:
+            print(json.dumps({"error": "Failed to get an add-in access token"}), file=sys.stderr)
+            sys.exit(1)
+
+    items = []
+    for web_url in dict.fromkeys(site_refs):
+        print(f"DEBUG: Importing site through the REST API: {web_url}", file=sys.stderr)
+        first_item = len(items)
+        if not import_rest_site(web_url, items, include_documents, include_wiki_pages, document_libraries, options):
+            print(json.dumps({"error": f"SharePoint connection failed: could not read {web_url}"}), file=sys.stderr)
+            sys.exit(1)
+        for item in items[first_item:]:
+            item["source"] = "sharepoint"
+            item["instance"] = web_url
+            item["site_url"] = web_url
+    write_items(items, options, pseudonym_file)
+
+def write_items(items, extraction_options, pseudonym_file):
+    """Print the items as the data source's result"""
     print(f"DEBUG: Total items found: {len(items)}", file=sys.stderr)
     
+    if extraction_options["pseudonyms"]:
+        pseudonymize_items(items, extraction_options["pseudonyms"])
+        save_pseudonyms(pseudonym_file, extraction_options["pseudonyms"])
+    
     # Convert the items list to a JSON string
     items_json = json.dumps(items)
     
     # Return the items as a string value
     print(json.dumps({"items": items_json}))
 
+def main():
+    # Read input from stdin (may be empty when everything comes from a profile)
+    try:
+        raw_input = sys.stdin.read()
+        input_data = json.loads(raw_input) if raw_input.strip() else {}
+    except json.JSONDecodeError:
+        print(json.dumps({"error": "Failed to parse input JSON"}), file=sys.stderr)
+        sys.exit(1)
+
+    try:
+        input_data = apply_profile(input_data)
+    except (OSError, ValueError) as e:
+        print(json.dumps({"error": f"Failed to load profile: {e}"}), file=sys.stderr)
+        sys.exit(1)
+    
+    # Extract parameters
+    site_url = input_data.get("SHAREPOINT_SITE_URL", "").rstrip('/')
+    # Further sites by URL or Graph site ID, imported like SHAREPOINT_SITE_URL.
+    # Site IDs contain commas, so the list is separated by semicolons.
+    site_refs = [site_url] if site_url else []
+    site_refs += [ref.strip().rstrip('/') for ref in input_data.get("sharepoint_sites", "").split(';') if ref.strip()]
+    include_documents = input_data.get("include_documents", "true").lower() == "true"
+    include_wiki_pages = input_data.get("include_wiki_pages", "true").lower() == "true"
+    extraction_options = {
+        "extract_content": input_data.get("extract_document_content", "true").lower() == "true",
+        "max_document_bytes": int(input_data.get("max_document_size_mb", "25")) * 1024 * 1024,
+        "xlsx_max_sheets": int(input_data.get("xlsx_max_sheets", "10")),
+        "xlsx_max_rows": int(input_data.get("xlsx_max_rows", "200")),
+        "pdf_max_pages": int(input_data.get("pdf_max_pages", "50")),
+        "ocr": input_data.get("ocr", ""),
+        "ocr_endpoint": input_data.get("ocr_endpoint", ""),
+        "ocr_language": input_data.get("ocr_language", ""),
+        "ocr_pages_left": int(input_data.get("ocr_page_budget", "200")),
+        "audience_map": parse_audience_map(input_data.get("audience_map", "")),
+        "audience_default": input_data.get("audience_default", ""),
+    }
+    ocr_error = validate_ocr(extraction_options)
+    if ocr_error:
+        print(json.dumps({"error": ocr_error}), file=sys.stderr)
+        sys.exit(1)
+    document_libraries = input_data.get("document_libraries", "Documents").split(',')
+    include_hub_sites = input_data.get("include_hub_sites", "false").lower() == "true"
+    hub_max_depth = int(input_data.get("hub_max_depth", "1"))
+    hub_max_sites = int(input_data.get("hub_max_sites", "50"))
+    search_region = input_data.get("search_region", "NAM")
+    discover_all_sites = input_data.get("discover_sites", "false").lower() == "true"
+    discover_max_sites = int(input_data.get("discover_max_sites", "500"))
+    include_sites = parse_patterns(input_data.get("include_sites", ""))
+    exclude_sites = parse_patterns(input_data.get("exclude_sites", ""))
+    state_file = input_data.get("state_file", "")
+    include_sensitivity_labels = input_data.get("include_sensitivity_labels", "false").lower() == "true"
+    max_sensitivity = input_data.get("max_sensitivity", "")
+    extraction_options["page_comments"] = input_data.get("page_comments", "")
+    extraction_options["preferred_language"] = input_data.get("preferred_language", "")
+    extraction_options["default_language"] = input_data.get("default_language", "").lower()
+    extraction_options["allowed_extensions"] = [ext.strip().lstrip(".").lower() for ext in input_data.get("allowed_extensions", "").split(",") if ext.strip()]
+    extraction_options["max_file_size_bytes"] = int(input_data.get("max_file_size_bytes", "0"))
+    extraction_options["include_permissions"] = input_data.get("include_permissions", "false").lower() == "true"
+    extraction_options["include_paths"] = parse_patterns(input_data.get("include_paths", ""))
+    extraction_options["exclude_paths"] = parse_patterns(input_data.get("exclude_paths", ""))
+    extraction_options["include_news"] = input_data.get("include_news", "true").lower() == "true"
+    extraction_options["include_onenote"] = input_data.get("include_onenote", "false").lower() == "true"
+    extraction_options["lists"] = parse_patterns(input_data.get("sharepoint_lists", ""))
+    extraction_options["list_output"] = input_data.get("list_output", "table")
+    extraction_options["list_max_rows"] = int(input_data.get("list_max_rows", "500"))
+    extraction_options["list_attachments"] = input_data.get("list_attachments", "false").lower() == "true"
+    if extraction_options["list_output"] not in ("table", "item"):
+        print(json.dumps({"error": f"unknown list_output '{extraction_options['list_output']}' (expected 'table' or 'item')"}), file=sys.stderr)
+        sys.exit(1)
+    if extraction_options["page_comments"] not in ("", "inline", "annotations"):
+        print(json.dumps({"error": f"unknown page_comments '{extraction_options['page_comments']}' (expected 'inline' or 'annotations')"}), file=sys.stderr)
+        sys.exit(1)
+    try:
+        state = load_state(state_file)
+    except (OSError, ValueError) as e:
+        print(json.dumps({"error": f"Failed to read state file: {e}"}), file=sys.stderr)
+        sys.exit(1)
+    RATE_LIMIT["rate"] = int(input_data.get("rate_limit_per_second", "0"))
+    RATE_LIMIT["path"] = input_data.get("rate_limit_file", "")
+    if RATE_LIMIT["path"] and RATE_LIMIT["rate"] <= 0:
+        print(json.dumps({"error": "rate_limit_file needs rate_limit_per_second"}), file=sys.stderr)
+        sys.exit(1)
+    pseudonym_file = input_data.get("pseudonym_file", "")
+    try:
+        extraction_options["pseudonyms"] = load_pseudonyms(pseudonym_file)
+    except (OSError, ValueError) as e:
+        print(json.dumps({"error": f"Failed to read pseudonym file: {e}"}), file=sys.stderr)
+        sys.exit(1)
+    
+    # SharePoint Server sites are read through the REST API instead of Graph
+    extraction_options["rest_auth"] = input_data.get("sharepoint_auth", "ntlm")
+    rest_error = validate_rest(input_data, extraction_options)
+    if rest_error:
+        print(json.dumps({"error": rest_error}), file=sys.stderr)
+        sys.exit(1)
+    if input_data.get("sharepoint_api", "graph") == "rest":
+        import_rest_sites(input_data, site_refs, include_documents, include_wiki_pages, document_libraries, extraction_options, pseudonym_file)
+        return
+    
+    # Get Azure credentials from input parameters (passed from Terraform)
+    client_id = input_data.get("AZURE_CLIENT_ID", "")
+    client_secret = input_data.get("AZURE_CLIENT_SECRET", "")
+    tenant_id = input_data.get("AZURE_TENANT_ID", "")
+    # Tenants that forbid client secrets authenticate with a certificate instead
+    certificate_path = input_data.get("AZURE_CLIENT_CERTIFICATE_PATH", "")
+    
+    # Check for required parameters - if all are empty, SharePoint is disabled
+    if not site_refs and not discover_all_sites and not client_id and not client_secret and not certificate_path and not tenant_id:
+        print(f"DEBUG: SharePoint is disabled - returning empty results", file=sys.stderr)
+        print(json.dumps({"items": "[]"}))
+        sys.exit(0)
+    
+    # Check for required parameters when SharePoint is enabled
+    if not (site_refs or discover_all_sites) or not client_id or not (client_secret or certificate_path) or not tenant_id:
+        print(json.dumps({"error": "Missing required parameters. Ensure SHAREPOINT_SITE_URL (or sharepoint_sites, or discover_sites), AZURE_CLIENT_ID, AZURE_CLIENT_SECRET (or AZURE_CLIENT_CERTIFICATE_PATH), and AZURE_TENANT_ID are set."}), file=sys.stderr)
+        sys.exit(1)
+    
+    certificate = None
+    if certificate_path:
+        try:
+            certificate = load_certificate(certificate_path, input_data.get("AZURE_CLIENT_CERTIFICATE_PASSWORD", ""))
+        except (OSError, ValueError, subprocess.SubprocessError) as e:
+            print(json.dumps({"error": f"Failed to load the client certificate: {e}"}), file=sys.stderr)
+            sys.exit(1)
+        print(f"DEBUG: Authenticating with the client certificate {certificate_path} (x5t {certificate['x5t']})", file=sys.stderr)
+    
+    print(f"DEBUG: Connecting to sites: {', '.join(site_refs) or 'every site of the tenant'}", file=sys.stderr)
+    
+    # Get access token
+    access_token = track_token(get_access_token(tenant_id, client_id, client_secret, certificate=certificate),
+                               lambda: get_access_token(tenant_id, client_id, client_secret, certificate=certificate))
+    if not access_token:
+        print(json.dumps({"error": "Failed to get access token"}), file=sys.stderr)
+        sys.exit(1)
+    
+    print("DEBUG: Successfully obtained access token", file=sys.stderr)
+    
+    # Sensitivity labels are read when requested or needed for max_sensitivity;
+    # without the label catalog nothing could be excluded, so that is fatal
+    extraction_options["sensitivity_labels"] = None
+    extraction_options["max_sensitivity"] = None
+    extraction_options["max_sensitivity_name"] = max_sensitivity
+    if include_sensitivity_labels or max_sensitivity:
+        extraction_options["sensitivity_labels"] = fetch_sensitivity_labels(access_token)
+        if extraction_options["sensitivity_labels"] is None:
+            print(json.dumps({"error": "Failed to read sensitivity labels (needs InformationProtectionPolicy.Read.All)"}), file=sys.stderr)
+            sys.exit(1)
+    if max_sensitivity:
+        matching = [label for label in extraction_options["sensitivity_labels"].values() if label["name"].lower() == max_sensitivity.lower()]
+        if not matching:
+            print(json.dumps({"error": f"max_sensitivity '{max_sensitivity}' is not a sensitivity label of the tenant"}), file=sys.stderr)
+            sys.exit(1)
+        extraction_options["max_sensitivity"] = matching[0]["sensitivity"]
+    
+    # Get site IDs using Microsoft Graph API
+    items = []
+    sites = []
+    seen_sites = set()
+    if discover_all_sites:
+        discovered = discover_sites(access_token, discover_max_sites, include_sites, exclude_sites)
+        if "error" in discovered:
+            print(json.dumps({"error": f"SharePoint site discovery failed (needs Sites.Read.All): {discovered['error']}"}), file=sys.stderr)
+            sys.exit(1)
+        for site in discovered["value"]:
+            seen_sites.add(site.get("id"))
+            sites.append((site.get("id"), site.get("webUrl", "")))
+    for site_ref in site_refs:
+        site_result = resolve_site(site_ref, access_token)
+        if "error" in site_result:
+            print(json.dumps({"error": f"SharePoint connection failed: {site_result['error']}"}), file=sys.stderr)
+            sys.exit(1)
+        
+        site_id = site_result["id"]
+        print(f"DEBUG: Successfully retrieved site ID: {site_id}", file=sys.stderr)
+        found = [site_result]
+        if include_hub_sites:
+            found += find_hub_sites(site_result, access_token, hub_max_depth, hub_max_sites, search_region, include_sites, exclude_sites)
+        for site in found:
+            if site.get("id") not in seen_sites:
+                seen_sites.add(site.get("id"))
+                sites.append((site.get("id"), site.get("webUrl", site_ref if site is site_result else "")))
+    print(f"DEBUG: Importing {len(sites)} sites", file=sys.stderr)
+    
+    # Sites of one tenant share a hostname
+    hostname = site_hostname(site_refs[0] if site_refs else sites[0][1] if sites else "")
+    if sites and not hostname:
+        print(json.dumps({"error": "Invalid SharePoint site URL"}), file=sys.stderr)
+        sys.exit(1)
+    
+    if sites and (extraction_options["page_comments"] or extraction_options["list_attachments"]):
+        sharepoint_scope = f"https://{hostname}/.default"
+        extraction_options["sharepoint_token"] = track_token(get_access_token(tenant_id, client_id, client_secret, scope=sharepoint_scope, certificate=certificate),
+                                                             lambda: get_access_token(tenant_id, client_id, client_secret, scope=sharepoint_scope, certificate=certificate))
+        if not extraction_options["sharepoint_token"]:
+            print(json.dumps({"error": "Failed to get a SharePoint access token for page_comments and list_attachments"}), file=sys.stderr)
+            sys.exit(1)
+    
+    for import_site_id, web_url in sites:
+        print(f"DEBUG: Importing site: {web_url}", file=sys.stderr)
+        first_item = len(items)
+        import_site(import_site_id, access_token, items, include_documents, include_wiki_pages, document_libraries, extraction_options, state_file, state, web_url)
+        # The fields of the Confluence importer's items, with the site as the instance
+        for item in items[first_item:]:
+            item["source"] = "sharepoint"
+            item["instance"] = web_url
+            item["site_id"] = import_site_id
+            item["site_url"] = web_url
+    
+    write_items(items, extraction_options, pseudonym_file)
+    # Only now are the items behind the cursors written; a run that dies
+    # before this point crawls from the previous cursors again
+    if state_file:
+        save_state(state_file, state)
+
 if __name__ == "__main__":
     main() 
\ No newline at end of file
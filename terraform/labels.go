@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// labelBatchSize is the number of pages whose labels one search call returns
+const labelBatchSize = 50
+
+// labelCache holds labels fetched for many pages at once through CQL search,
+// so content calls can skip the per-page labels expansion or request
+type labelCache struct {
+	mu       sync.Mutex
+	metadata map[string]*ContentResponse // Page ID -> response carrying only labels
+}
+
+// validateBatchLabels checks the batch_labels option
+func validateBatchLabels(config *Config) error {
+	if config.BatchLabels != "true" {
+		return nil
+	}
+	if isOfflineSource(config) {
+		return fmt.Errorf("batch_labels needs the confluence source")
+	}
+	if config.APIVersion == apiVersionV2 {
+		return fmt.Errorf("batch_labels uses the v1 search API and can't be combined with api_version %q", apiVersionV2)
+	}
+	return nil
+}
+
+func newLabelCache(config *Config) *labelCache {
+	if config.BatchLabels != "true" {
+		return nil
+	}
+	return &labelCache{metadata: map[string]*ContentResponse{}}
+}
+
+// fetch looks up the labels of pages the listing didn't already return content
+// for, labelBatchSize pages per request. Pages missing from the results keep
+// the per-page labels lookup.
+func (c *labelCache) fetch(config *Config, pages []Page) {
+	if c == nil {
+		return
+	}
+	var ids []string
+	for _, page := range pages {
+		if page.Content == nil {
+			ids = append(ids, page.ID)
+		}
+	}
+
+	baseURL := strings.TrimSuffix(config.ConfluenceURL, "/")
+	for start := 0; start < len(ids); start += labelBatchSize {
+		batch := ids[start:min(start+labelBatchSize, len(ids))]
+		cql := fmt.Sprintf("id in (%s)", strings.Join(batch, ","))
+		searchURL := fmt.Sprintf("%s/rest/api/content/search?cql=%s&expand=metadata.labels&limit=%d", baseURL, url.QueryEscape(cql), labelBatchSize)
+
+		body, err := fetchWithPolicy(config, opPageListing, searchURL)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "DEBUG: Failed to fetch labels for %d pages: %v\n", len(batch), err)
+			continue
+		}
+		var response struct {
+			Results []ContentResponse `json:"results"`
+		}
+		if err := json.Unmarshal(body, &response); err != nil {
+			fmt.Fprintf(os.Stderr, "DEBUG: Failed to parse labels for %d pages: %v\n", len(batch), err)
+			continue
+		}
+
+		c.mu.Lock()
+		for i := range response.Results {
+			c.metadata[response.Results[i].ID] = &response.Results[i]
+		}
+		c.mu.Unlock()
+		fmt.Fprintf(os.Stderr, "DEBUG: Fetched labels for %d of %d pages in one request\n", len(response.Results), len(batch))
+	}
+}
+
+// lookup returns a page's batched labels, if any
+func (c *labelCache) lookup(pageID string) (*ContentResponse, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	labels, ok := c.metadata[pageID]
+	return labels, ok
+}
+
+// withoutLabelsExpansion drops metadata.labels from an expansion set
+func withoutLabelsExpansion(expand string) string {
+	var kept []string
+	for _, expansion := range strings.Split(expand, ",") {
+		if expansion = strings.TrimSpace(expansion); expansion != "" && expansion != "metadata.labels" {
+			kept = append(kept, expansion)
+		}
+	}
+	return strings.Join(kept, ",")
+}
+
+// validateLabelFilters checks that include_labels and exclude_labels see the
+// labels of every page
+func validateLabelFilters(config *Config) error {
+	if config.IncludeLabels == "" && config.ExcludeLabels == "" {
+		return nil
+	}
+	if isOfflineSource(config) || config.APIVersion == apiVersionV2 || config.BatchLabels == "true" {
+		return nil
+	}
+	for _, expansion := range strings.Split(config.ContentExpand, ",") {
+		if strings.TrimSpace(expansion) == "metadata.labels" {
+			return nil
+		}
+	}
+	return fmt.Errorf("include_labels and exclude_labels need metadata.labels in content_expand")
+}
+
+// filterLabels splits a comma-separated label option
+func filterLabels(option string) []string {
+	var labels []string
+	for _, label := range strings.Split(option, ",") {
+		if label = strings.TrimSpace(label); label != "" {
+			labels = append(labels, label)
+		}
+	}
+	return labels
+}
+
+// labelsSelected reports whether a page with these labels passes
+// include_labels and exclude_labels. Labels compare case-insensitively.
+func labelsSelected(config *Config, labels []string) bool {
+	carries := func(option string) bool {
+		for _, wanted := range filterLabels(option) {
+			for _, label := range labels {
+				if strings.EqualFold(label, wanted) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	if config.IncludeLabels != "" && !carries(config.IncludeLabels) {
+		return false
+	}
+	return !carries(config.ExcludeLabels)
+}
+
+// labelClauses returns include_labels and exclude_labels as CQL clauses
+func labelClauses(config *Config) []string {
+	var clauses []string
+	for _, filter := range []struct{ option, operator string }{
+		{config.IncludeLabels, "in"},
+		{config.ExcludeLabels, "not in"},
+	} {
+		labels := filterLabels(filter.option)
+		if len(labels) == 0 {
+			continue
+		}
+		quoted := make([]string, len(labels))
+		for i, label := range labels {
+			quoted[i] = strconv.Quote(strings.ToLower(label))
+		}
+		clauses = append(clauses, fmt.Sprintf("label %s (%s)", filter.operator, strings.Join(quoted, ", ")))
+	}
+	return clauses
+}
@@ -108,8 +108,8 @@ resource "kubiya_secret" "confluence_api_token" {
 # Build the Go binary automatically during terraform apply (always build since we always call confluence data source)
 resource "null_resource" "build_go_binary" {
   triggers = {
-    # Rebuild when Go source code changes
-    go_source_hash = filesha256("${path.module}/import_confluence.go")
+    # Rebuild when any Go source file changes
+    go_source_hash = sha256(join("", [for f in sort(fileset(path.module, "*.go")) : filesha256("${path.module}/${f}")]))
     # Also rebuild when build script changes
     build_script_hash = filesha256("${path.module}/build.sh")
   }
@@ -131,11 +131,16 @@ data "external" "sharepoint_content" {
   # Set parameters for the Python script
   query = {
     SHAREPOINT_SITE_URL = var.enable_sharepoint ? var.sharepoint_site_url : ""
+    sharepoint_sites = var.enable_sharepoint ? join(";", var.sharepoint_additional_sites) : ""
+    discover_sites = var.enable_sharepoint && var.sharepoint_discover_sites ? "true" : "false"
     AZURE_CLIENT_ID = var.enable_sharepoint ? var.azure_client_id : ""
     AZURE_CLIENT_SECRET = var.enable_sharepoint ? var.azure_client_secret : ""
+    AZURE_CLIENT_CERTIFICATE_PATH = var.enable_sharepoint ? var.azure_client_certificate_path : ""
+    AZURE_CLIENT_CERTIFICATE_PASSWORD = var.enable_sharepoint ? var.azure_client_certificate_password : ""
     AZURE_TENANT_ID = var.enable_sharepoint ? var.azure_tenant_id : ""
     include_documents = var.enable_sharepoint && var.import_sharepoint_documents ? "true" : "false"
     document_libraries = var.enable_sharepoint ? join(",", var.sharepoint_document_libraries) : ""
+    sharepoint_lists = var.enable_sharepoint ? join(",", var.sharepoint_lists) : ""
   }
 }
 
@@ -149,6 +154,8 @@ data "external" "confluence_content" {
     CONFLUENCE_USERNAME = var.confluence_username
     CONFLUENCE_API_TOKEN = var.confluence_api_token
     space_keys = local.space_keys_string
+    exclude_space_keys = join(",", var.confluence_exclude_space_keys)
+    space_types = join(",", var.confluence_space_types)
     include_blogs = var.import_confluence_blogs ? "true" : "false"
     max_pages = var.max_pages
   }
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// modeVerify checks the artifacts listed in manifest_file instead of importing
+const modeVerify = "verify"
+
+// manifestSignatureSuffix is appended to manifest_file for its signature
+const manifestSignatureSuffix = ".sig"
+
+// Kinds of artifacts listed in the manifest
+const (
+	artifactOutput     = "output"
+	artifactSink       = "sink"
+	artifactRoute      = "route"
+	artifactDiffReport = "diff_report"
+)
+
+// manifestArtifact is a file the run wrote, as it was when the run finished
+type manifestArtifact struct {
+	Path   string `json:"path"`
+	Kind   string `json:"kind"`
+	Bytes  int64  `json:"bytes"`
+	SHA256 string `json:"sha256"`
+}
+
+// outputManifest is written to manifest_file after every output is closed
+type outputManifest struct {
+	GeneratedAt   string             `json:"generated_at"`
+	SchemaVersion string             `json:"schema_version"`
+	ItemCount     string             `json:"item_count,omitempty"`
+	Partial       string             `json:"partial,omitempty"`
+	Encryption    string             `json:"encryption,omitempty"` // Checksums are of the encrypted files
+	Artifacts     []manifestArtifact `json:"artifacts"`
+	PublicKey     string             `json:"public_key,omitempty"` // Ed25519 key the .sig file verifies with
+}
+
+// manifestCheck is the outcome of verifying one artifact
+type manifestCheck struct {
+	Path  string `json:"path"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// manifestVerification is printed by the verify mode
+type manifestVerification struct {
+	Status    string          `json:"status"`    // "ok" or "failed"
+	Signature string          `json:"signature"` // "valid", "invalid" or "unchecked"
+	Artifacts []manifestCheck `json:"artifacts"`
+	Error     string          `json:"error,omitempty"`
+}
+
+// validateManifest checks the manifest options
+func validateManifest(config *Config) error {
+	if config.ManifestSigningKey != "" {
+		if config.ManifestFile == "" {
+			return fmt.Errorf("manifest_signing_key needs manifest_file")
+		}
+		if _, err := manifestSigningKey(config); err != nil {
+			return err
+		}
+	}
+	if config.ManifestPublicKey != "" {
+		if _, err := manifestPublicKey(config); err != nil {
+			return err
+		}
+	}
+	if config.Mode == modeVerify && config.ManifestFile == "" {
+		return fmt.Errorf("mode %q needs manifest_file", modeVerify)
+	}
+	if config.ManifestFile != "" && config.ManifestFile == config.OutputFile {
+		return fmt.Errorf("manifest_file must differ from output_file")
+	}
+	return nil
+}
+
+// manifestSigningKey decodes manifest_signing_key, a base64-encoded Ed25519
+// seed (32 bytes) or private key (64 bytes)
+func manifestSigningKey(config *Config) (ed25519.PrivateKey, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(config.ManifestSigningKey))
+	switch {
+	case err != nil:
+	case len(key) == ed25519.SeedSize:
+		return ed25519.NewKeyFromSeed(key), nil
+	case len(key) == ed25519.PrivateKeySize:
+		return ed25519.PrivateKey(key), nil
+	}
+	return nil, fmt.Errorf("manifest_signing_key must be a base64-encoded Ed25519 seed (32 bytes) or private key (64 bytes)")
+}
+
+// manifestPublicKey decodes manifest_public_key, a base64-encoded Ed25519 public key
+func manifestPublicKey(config *Config) (ed25519.PublicKey, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(config.ManifestPublicKey))
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("manifest_public_key must be a base64-encoded Ed25519 public key (32 bytes)")
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+// manifestArtifacts lists the files the run wrote: output_file, file sinks,
+// route files and the diff report
+func manifestArtifacts(config *Config) []manifestArtifact {
+	var artifacts []manifestArtifact
+	seen := map[string]bool{}
+	add := func(path, kind string) {
+		if path != "" && !seen[path] {
+			seen[path] = true
+			artifacts = append(artifacts, manifestArtifact{Path: path, Kind: kind})
+		}
+	}
+	add(config.OutputFile, artifactOutput)
+	if config.Sinks != "" {
+		for _, spec := range strings.Split(config.Sinks, ",") {
+			if kind, target, _ := parseSink(strings.TrimSpace(spec)); kind == sinkFile {
+				add(target, artifactSink)
+			}
+		}
+	}
+	for _, rule := range config.RouteRules {
+		add(rule.path, artifactRoute)
+	}
+	// The diff report is best effort, so it's only listed when it was written
+	if _, err := os.Stat(config.DiffReport); err == nil {
+		add(config.DiffReport, artifactDiffReport)
+	}
+	return artifacts
+}
+
+// fileChecksum returns the size and hex SHA-256 of a file
+func fileChecksum(path string) (int64, string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, "", err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return 0, "", err
+	}
+	return size, hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// writeManifest checksums every artifact and writes manifest_file, signing it
+// to manifest_file.sig when manifest_signing_key is set
+func writeManifest(config *Config, result Result) error {
+	if config.ManifestFile == "" {
+		return nil
+	}
+	manifest := outputManifest{
+		GeneratedAt:   time.Now().UTC().Format(time.RFC3339),
+		SchemaVersion: config.SchemaVersion,
+		ItemCount:     result.ItemCount,
+		Partial:       result.Partial,
+		Encryption:    config.Encryption,
+		Artifacts:     manifestArtifacts(config),
+	}
+	for i := range manifest.Artifacts {
+		artifact := &manifest.Artifacts[i]
+		size, sum, err := fileChecksum(artifact.Path)
+		if err != nil {
+			return fmt.Errorf("checksumming %s: %w", artifact.Path, err)
+		}
+		artifact.Bytes, artifact.SHA256 = size, sum
+	}
+	var key ed25519.PrivateKey
+	if config.ManifestSigningKey != "" {
+		key, _ = manifestSigningKey(config)
+		manifest.PublicKey = base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey))
+	}
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(config.ManifestFile, data, 0o644); err != nil {
+		return err
+	}
+	if key == nil {
+		return nil
+	}
+	signature := base64.StdEncoding.EncodeToString(ed25519.Sign(key, data))
+	return os.WriteFile(config.ManifestFile+manifestSignatureSuffix, []byte(signature+"\n"), 0o644)
+}
+
+// verifyManifest checks manifest_file's signature against manifest_public_key,
+// when set, and every artifact against its size and checksum
+func verifyManifest(config *Config) manifestVerification {
+	report := manifestVerification{Status: "failed", Signature: "unchecked"}
+	data, err := os.ReadFile(config.ManifestFile)
+	if err != nil {
+		report.Error = err.Error()
+		return report
+	}
+	if config.ManifestPublicKey != "" {
+		key, _ := manifestPublicKey(config)
+		report.Signature = "invalid"
+		encoded, err := os.ReadFile(config.ManifestFile + manifestSignatureSuffix)
+		if err != nil {
+			report.Error = fmt.Sprintf("reading signature: %v", err)
+			return report
+		}
+		signature, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(encoded)))
+		if err != nil || !ed25519.Verify(key, data, signature) {
+			report.Error = "the manifest's signature doesn't match manifest_public_key"
+			return report
+		}
+		report.Signature = "valid"
+	}
+	var manifest outputManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		report.Error = fmt.Sprintf("parsing manifest: %v", err)
+		return report
+	}
+	failed := false
+	for _, artifact := range manifest.Artifacts {
+		check := manifestCheck{Path: artifact.Path}
+		size, sum, err := fileChecksum(artifact.Path)
+		switch {
+		case err != nil:
+			check.Error = err.Error()
+		case size != artifact.Bytes:
+			check.Error = fmt.Sprintf("%d bytes, expected %d (truncated or modified)", size, artifact.Bytes)
+		case sum != artifact.SHA256:
+			check.Error = "checksum mismatch"
+		default:
+			check.OK = true
+		}
+		failed = failed || !check.OK
+		report.Artifacts = append(report.Artifacts, check)
+	}
+	if !failed {
+		report.Status = "ok"
+	}
+	return report
+}
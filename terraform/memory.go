@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Memory watchdog tuning. Past the throttle share of memory_limit_mb the
+// workers are halved, at most once per throttle interval; past the limit
+// itself the run stops taking pages and returns what it has.
+const (
+	memoryCheckInterval    = time.Second
+	memoryThrottleShare    = 0.8
+	memoryThrottleInterval = 5 * time.Second
+)
+
+// memoryWatchdog samples the process memory during the run so a large import
+// degrades gracefully instead of being OOM-killed. A nil watchdog never
+// intervenes.
+type memoryWatchdog struct {
+	limit   uint64       // Bytes
+	workers atomic.Int32 // Workers allowed to take another page
+	stopped atomic.Bool
+	reason  atomic.Value // string, set when stopped
+	done    chan struct{}
+}
+
+// validateMemoryLimit checks the memory_limit_mb option
+func validateMemoryLimit(config *Config) error {
+	if config.MemoryLimitMB < 0 {
+		return fmt.Errorf("memory_limit_mb must not be negative")
+	}
+	return nil
+}
+
+// startMemoryWatchdog starts sampling memory when memory_limit_mb is set. The
+// limit also becomes the Go runtime's soft memory limit, so the garbage
+// collector works harder before the watchdog has to step in.
+func startMemoryWatchdog(config *Config) *memoryWatchdog {
+	if config.MemoryLimitMB <= 0 {
+		return nil
+	}
+	w := &memoryWatchdog{limit: uint64(config.MemoryLimitMB) << 20, done: make(chan struct{})}
+	w.workers.Store(int32(config.MaxWorkers))
+	debug.SetMemoryLimit(int64(w.limit))
+
+	go func() {
+		ticker := time.NewTicker(memoryCheckInterval)
+		defer ticker.Stop()
+		var lastThrottle time.Time
+		for {
+			select {
+			case <-w.done:
+				return
+			case <-ticker.C:
+			}
+
+			used := processMemory()
+			switch {
+			case used >= w.limit:
+				w.stop(fmt.Sprintf("memory use reached %d MB of memory_limit_mb %d; stopped taking new pages", used>>20, config.MemoryLimitMB))
+				return
+			case float64(used) >= memoryThrottleShare*float64(w.limit) && time.Since(lastThrottle) >= memoryThrottleInterval:
+				if workers := w.workers.Load(); workers > 1 {
+					w.workers.Store(workers / 2)
+					lastThrottle = time.Now()
+					fmt.Fprintf(os.Stderr, "DEBUG: Memory use %d MB is near memory_limit_mb %d, reducing workers to %d\n", used>>20, config.MemoryLimitMB, workers/2)
+				}
+			}
+		}
+	}()
+	return w
+}
+
+func (w *memoryWatchdog) stop(reason string) {
+	fmt.Fprintf(os.Stderr, "DEBUG: %s\n", reason)
+	w.reason.Store(reason)
+	w.stopped.Store(true)
+}
+
+// Close stops sampling
+func (w *memoryWatchdog) Close() {
+	if w != nil {
+		close(w.done)
+	}
+}
+
+// allows reports whether worker number id may take another page
+func (w *memoryWatchdog) allows(id int) bool {
+	return w == nil || int32(id) < w.workers.Load()
+}
+
+// Stopped reports whether the run was cut short, and why
+func (w *memoryWatchdog) Stopped() (string, bool) {
+	if w == nil || !w.stopped.Load() {
+		return "", false
+	}
+	return w.reason.Load().(string), true
+}
+
+// processMemory returns the resident set size on Linux, or the memory the Go
+// runtime holds from the OS elsewhere
+func processMemory() uint64 {
+	if statm, err := os.ReadFile("/proc/self/statm"); err == nil {
+		if fields := strings.Fields(string(statm)); len(fields) > 1 {
+			if pages, err := strconv.ParseUint(fields[1], 10, 64); err == nil {
+				return pages * uint64(os.Getpagesize())
+			}
+		}
+	}
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	return stats.Sys - stats.HeapReleased
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"os"
+	"strings"
+	"time"
+)
+
+// mockSource generates synthetic Confluence pages so the conversion pipeline and
+// downstream consumers can be exercised without credentials or network access.
+// Page bodies are derived from the page index and MockSeed, so the same
+// configuration always produces the same corpus.
+type mockSource struct{}
+
+var mockWords = []string{
+	"deployment", "cluster", "runbook", "incident", "service", "latency", "database",
+	"rollback", "pipeline", "certificate", "gateway", "alert", "escalation", "backup",
+	"migration", "release", "on-call", "terraform", "kubernetes", "dashboard", "quota",
+	"replica", "failover", "retention", "approval", "policy", "onboarding", "vendor",
+}
+
+// mockEpoch anchors the modification times of mock pages, keeping them the
+// same from run to run
+var mockEpoch = time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+var mockLabels = []string{"runbook", "architecture", "how-to", "postmortem", "policy", "onboarding", "reference"}
+
+var mockMacros = []string{"info", "note", "warning", "tip", "expand", "toc", "jira", "children"}
+
+func (m *mockSource) TestConnection(config *Config) error {
+	fmt.Fprintf(os.Stderr, "DEBUG: Mock source enabled - generating %d synthetic pages (seed %d)\n", config.MockPages, config.MockSeed)
+	return nil
+}
+
+func (m *mockSource) ListPages(config *Config) ([]Page, error) {
+	spaceKeys := mockSpaceKeys(config)
+	total := config.MockPages
+	if config.MaxPages > 0 && total > config.MaxPages {
+		total = config.MaxPages
+	}
+
+	pages := make([]Page, 0, total)
+	for i := 0; i < config.MockPages && len(pages) < total; i++ {
+		rng := m.rng(config, i)
+		pageType := "page"
+		if config.IncludeBlogs == "true" && i%7 == 6 {
+			pageType = "blogpost"
+		}
+		title := mockTitle(rng, i)
+		// Modified within the year before the mock epoch
+		modified := mockEpoch.Add(-time.Duration(rng.Intn(365*24)) * time.Hour)
+		page := Page{
+			ID:       fmt.Sprintf("mock-%d", i+1),
+			Title:    title,
+			Type:     pageType,
+			SpaceKey: spaceKeys[i%len(spaceKeys)],
+			Version:  &listedVersion{Number: 1, CreatedAt: modified.Format(time.RFC3339)},
+		}
+		if !stale(config, page) {
+			pages = append(pages, page)
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "DEBUG: Mock source listed %d pages across spaces %v\n", len(pages), spaceKeys)
+	return pages, nil
+}
+
+func (m *mockSource) FetchContent(_ context.Context, config *Config, page Page) (*ContentResponse, error) {
+	var index int
+	if _, err := fmt.Sscanf(page.ID, "mock-%d", &index); err != nil {
+		return nil, fmt.Errorf("unknown mock page ID %q", page.ID)
+	}
+	index--
+
+	rng := m.rng(config, index)
+	response := &ContentResponse{ID: page.ID, Title: page.Title}
+	response.Body.Storage.Value = mockBody(rng, index, config.MaxContentLength)
+
+	for _, label := range rng.Perm(len(mockLabels))[:rng.Intn(3)] {
+		response.Metadata.Labels.Results = append(response.Metadata.Labels.Results, struct {
+			Name string `json:"name"`
+		}{Name: mockLabels[label]})
+	}
+	return response, nil
+}
+
+// rng returns a generator seeded per page so listing and content agree
+func (m *mockSource) rng(config *Config, index int) *rand.Rand {
+	return rand.New(rand.NewSource(config.MockSeed*1000003 + int64(index)))
+}
+
+func mockSpaceKeys(config *Config) []string {
+	keys := parseSpaceKeys(config)
+	if len(keys) == 0 {
+		keys = []string{"MOCK"}
+	}
+	return keys
+}
+
+func mockTitle(rng *rand.Rand, index int) string {
+	return fmt.Sprintf("%s %s %s (%d)", capitalize(mockWord(rng)), mockWord(rng), mockWord(rng), index+1)
+}
+
+func mockWord(rng *rand.Rand) string {
+	return mockWords[rng.Intn(len(mockWords))]
+}
+
+func mockSentence(rng *rand.Rand) string {
+	words := make([]string, 6+rng.Intn(10))
+	for i := range words {
+		words[i] = mockWord(rng)
+	}
+	return capitalize(strings.Join(words, " ")) + "."
+}
+
+func capitalize(s string) string {
+	if s == "" {
+		return s
+	}
+	return strings.ToUpper(s[:1]) + s[1:]
+}
+
+func mockParagraph(rng *rand.Rand) string {
+	sentences := make([]string, 2+rng.Intn(4))
+	for i := range sentences {
+		sentences[i] = mockSentence(rng)
+	}
+	return "<p>" + strings.Join(sentences, " ") + "</p>"
+}
+
+// mockBody builds a storage-format body mixing the constructs the converter has
+// to handle. Every tenth page is oversized so truncation is exercised as well.
+func mockBody(rng *rand.Rand, index, maxContentLength int) string {
+	var b strings.Builder
+
+	b.WriteString("<h1>Overview</h1>")
+	b.WriteString(mockParagraph(rng))
+
+	// Confluence macros with and without rich text bodies
+	macro := mockMacros[rng.Intn(len(mockMacros))]
+	fmt.Fprintf(&b, `<ac:structured-macro ac:name="%s" ac:schema-version="1"><ac:parameter ac:name="title">%s</ac:parameter><ac:rich-text-body>%s</ac:rich-text-body></ac:structured-macro>`,
+		macro, mockWord(rng), mockParagraph(rng))
+	b.WriteString(`<p>See <ac:link><ri:page ri:content-title="Related page" /></ac:link> and <a href="https://example.com/docs">the external docs</a> for details &mdash; it&rsquo;s &quot;required&quot; reading.</p>`)
+
+	// Nested lists
+	b.WriteString("<h2>Steps</h2><ol>")
+	for i := 0; i < 3+rng.Intn(3); i++ {
+		fmt.Fprintf(&b, "<li><strong>%s</strong> %s", mockWord(rng), mockSentence(rng))
+		if rng.Intn(2) == 0 {
+			b.WriteString("<ul>")
+			for j := 0; j < 2+rng.Intn(3); j++ {
+				fmt.Fprintf(&b, "<li>%s</li>", mockSentence(rng))
+			}
+			b.WriteString("</ul>")
+		}
+		b.WriteString("</li>")
+	}
+	b.WriteString("</ol>")
+
+	// Table with a header row and a cell containing a pipe
+	b.WriteString("<h2>Reference</h2><table><tbody><tr><th>Name</th><th>Owner</th><th>Notes</th></tr>")
+	for i := 0; i < 2+rng.Intn(6); i++ {
+		fmt.Fprintf(&b, "<tr><td>%s</td><td>team-%s</td><td>%s | <em>%s</em></td></tr>", mockWord(rng), mockWord(rng), mockWord(rng), mockWord(rng))
+	}
+	b.WriteString("</tbody></table>")
+
+	// Code macro
+	fmt.Fprintf(&b, `<ac:structured-macro ac:name="code"><ac:parameter ac:name="language">bash</ac:parameter><ac:plain-text-body><![CDATA[kubectl rollout restart deployment/%s]]></ac:plain-text-body></ac:structured-macro>`, mockWord(rng))
+	fmt.Fprintf(&b, "<pre>%s --dry-run</pre>", mockWord(rng))
+
+	// Huge bodies
+	if index%10 == 9 {
+		target := maxContentLength + maxContentLength/2
+		b.WriteString("<h2>Appendix</h2>")
+		for b.Len() < target {
+			b.WriteString(mockParagraph(rng))
+		}
+	}
+
+	return b.String()
+}
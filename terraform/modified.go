@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// validateModifiedSince parses modified_since: an RFC 3339 time, a date, or an
+// age counted back from now like "30d", "2w" or "12h"
+func validateModifiedSince(config *Config) error {
+	if config.ModifiedSince == "" {
+		return nil
+	}
+	since, err := parseModifiedSince(config.ModifiedSince, time.Now())
+	if err != nil {
+		return err
+	}
+	config.ModifiedAfter = since
+	fmt.Fprintf(os.Stderr, "DEBUG: Importing only content modified since %s\n", since.UTC().Format(time.RFC3339))
+	return nil
+}
+
+func parseModifiedSince(value string, now time.Time) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	if since, err := time.Parse(time.RFC3339, value); err == nil {
+		return since, nil
+	}
+	if since, err := time.Parse(time.DateOnly, value); err == nil {
+		return since, nil
+	}
+	days := map[string]int{"d": 1, "w": 7}
+	if unit := value[max(len(value)-1, 0):]; days[unit] > 0 {
+		if count, err := strconv.Atoi(value[:len(value)-1]); err == nil && count >= 0 {
+			return now.AddDate(0, 0, -count*days[unit]), nil
+		}
+	} else if age, err := time.ParseDuration(value); err == nil && age >= 0 {
+		return now.Add(-age), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid modified_since %q (expected an RFC 3339 time, a date, or an age like \"30d\")", value)
+}
+
+// stale reports whether a page was last modified before modified_since. Pages
+// the listing gave no time for aren't stale.
+func stale(config *Config, page Page) bool {
+	if config.ModifiedAfter.IsZero() {
+		return false
+	}
+	modified := page.lastModified()
+	return !modified.IsZero() && modified.Before(config.ModifiedAfter)
+}
+
+// dropStale removes the pages modified before modified_since from a listing
+// batch, before they count against max_pages or get fetched, and returns the
+// fresh ones and how many it dropped
+func dropStale(config *Config, pages []Page) ([]Page, int) {
+	if config.ModifiedAfter.IsZero() {
+		return pages, 0
+	}
+	fresh := pages[:0]
+	for _, page := range pages {
+		if !stale(config, page) {
+			fresh = append(fresh, page)
+		}
+	}
+	return fresh, len(pages) - len(fresh)
+}
+
+// modifiedSinceClause is the CQL form of modified_since. CQL compares dates
+// in the account's time zone, so the clause reaches a day further back and
+// dropStale trims the results to the exact time.
+func modifiedSinceClause(config *Config) string {
+	if config.ModifiedAfter.IsZero() {
+		return ""
+	}
+	return fmt.Sprintf(`lastmodified >= "%s"`, config.ModifiedAfter.UTC().AddDate(0, 0, -1).Format(time.DateOnly))
+}
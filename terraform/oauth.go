@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// Atlassian's OAuth 2.0 (3LO) endpoints. OAuth tokens aren't accepted by the
+// site itself, only through the API gateway at oauthGatewayURL + cloud ID.
+var (
+	oauthTokenURL     = "https://auth.atlassian.com/oauth/token"
+	oauthResourcesURL = "https://api.atlassian.com/oauth/token/accessible-resources"
+	oauthGatewayURL   = "https://api.atlassian.com/ex/confluence/"
+)
+
+const (
+	oauthRefreshMargin = 5 * time.Minute // Access tokens are replaced this long before they expire
+	oauthTokenTimeout  = 30 * time.Second
+)
+
+// oauthSession keeps an OAuth access token current. Atlassian rotates refresh
+// tokens: each refresh returns a new one and retires the old, so the newest is
+// written to oauth_token_file for the next run to start from.
+type oauthSession struct {
+	clientID     string
+	clientSecret string
+	refreshToken string
+	tokenFile    string
+	expires      time.Time // Zero when unknown, e.g. for a given oauth_access_token
+}
+
+// oauthTokens is the shape of oauth_token_file and of the token endpoint's response
+type oauthTokens struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int    `json:"expires_in,omitempty"`
+	ExpiresAt    string `json:"expires_at,omitempty"`
+}
+
+// usesOAuth reports whether requests authenticate with OAuth access tokens
+func usesOAuth(config *Config) bool {
+	return config.OAuthRefreshToken != "" || config.OAuthAccessToken != "" || config.OAuthTokenFile != ""
+}
+
+// validateOAuth checks that the OAuth options are complete and combined with
+// options they support
+func validateOAuth(config *Config) error {
+	if !usesOAuth(config) {
+		return nil
+	}
+	switch {
+	case isOfflineSource(config):
+		return fmt.Errorf("OAuth needs the confluence source")
+	case config.Deployment == deploymentServer:
+		return fmt.Errorf("OAuth 2.0 (3LO) is Cloud only and can't be combined with deployment %q", deploymentServer)
+	case config.APIToken != "" || config.SessionCookie != "" || config.CredentialsFile != "":
+		return fmt.Errorf("OAuth can't be combined with CONFLUENCE_API_TOKEN, session_cookie or credentials_file")
+	case config.OAuthAccessToken == "" && (config.OAuthClientID == "" || config.OAuthClientSecret == ""):
+		return fmt.Errorf("refreshing OAuth tokens needs oauth_client_id and oauth_client_secret")
+	case config.ConfluenceURL == "" && config.CloudID == "":
+		return fmt.Errorf("OAuth needs CONFLUENCE_URL or cloud_id")
+	}
+	if config.OAuthRefreshToken != "" && config.OAuthTokenFile == "" {
+		fmt.Fprintf(os.Stderr, "DEBUG: No oauth_token_file; the rotated refresh token is lost after this run\n")
+	}
+	return nil
+}
+
+// startOAuth gets the first access token, from oauth_access_token or by
+// refreshing, and points CONFLUENCE_URL at the API gateway of the site's
+// cloud ID. The site URL is kept in SiteURL for the links of items.
+func startOAuth(config *Config) (*oauthSession, error) {
+	session := &oauthSession{
+		clientID:     config.OAuthClientID,
+		clientSecret: config.OAuthClientSecret,
+		refreshToken: config.OAuthRefreshToken,
+		tokenFile:    config.OAuthTokenFile,
+	}
+	accessToken := config.OAuthAccessToken
+	if session.tokenFile != "" {
+		saved, err := readOAuthTokens(session.tokenFile)
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+		case err != nil:
+			return nil, err
+		case saved.RefreshToken != "":
+			// The saved token replaced the one given as input, which is retired
+			session.refreshToken = saved.RefreshToken
+			if expires, err := time.Parse(time.RFC3339, saved.ExpiresAt); err == nil && saved.AccessToken != "" && accessToken == "" {
+				accessToken, session.expires = saved.AccessToken, expires
+			}
+		}
+	}
+	if session.refreshToken == "" && accessToken == "" {
+		return nil, fmt.Errorf("OAuth needs oauth_refresh_token, oauth_access_token or a saved oauth_token_file")
+	}
+	if accessToken == "" || session.expiring() {
+		var err error
+		if accessToken, err = session.refresh(); err != nil {
+			return nil, err
+		}
+	}
+	config.Username, config.APIToken = "", accessToken
+
+	if err := useGateway(config, accessToken); err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+// expiring reports whether the access token is due to be replaced. Without a
+// refresh token it's used until it's rejected.
+func (o *oauthSession) expiring() bool {
+	return o.refreshToken != "" && !o.expires.IsZero() && time.Until(o.expires) < oauthRefreshMargin
+}
+
+// refresh trades the refresh token for a new access token and refresh token,
+// saving them to oauth_token_file
+func (o *oauthSession) refresh() (string, error) {
+	if o.refreshToken == "" {
+		return "", fmt.Errorf("no oauth_refresh_token to get a new access token with")
+	}
+	request, _ := json.Marshal(map[string]string{
+		"grant_type":    "refresh_token",
+		"client_id":     o.clientID,
+		"client_secret": o.clientSecret,
+		"refresh_token": o.refreshToken,
+	})
+	body, err := oauthRequest("POST", oauthTokenURL, "", request)
+	if err != nil {
+		return "", fmt.Errorf("refreshing OAuth token: %w", err)
+	}
+	var tokens oauthTokens
+	if err := json.Unmarshal(body, &tokens); err != nil {
+		return "", fmt.Errorf("parsing OAuth token response: %w", err)
+	}
+	if tokens.AccessToken == "" {
+		return "", fmt.Errorf("refreshing OAuth token: no access_token in the response")
+	}
+	if tokens.RefreshToken != "" {
+		o.refreshToken = tokens.RefreshToken
+	}
+	o.expires = time.Time{}
+	if tokens.ExpiresIn > 0 {
+		o.expires = time.Now().Add(time.Duration(tokens.ExpiresIn) * time.Second)
+	}
+	fmt.Fprintf(os.Stderr, "DEBUG: Got a new OAuth access token (expires in %ds)\n", tokens.ExpiresIn)
+
+	if o.tokenFile != "" {
+		saved := oauthTokens{AccessToken: tokens.AccessToken, RefreshToken: o.refreshToken}
+		if !o.expires.IsZero() {
+			saved.ExpiresAt = o.expires.UTC().Format(time.RFC3339)
+		}
+		if err := writeOAuthTokens(o.tokenFile, saved); err != nil {
+			// The refresh token in use is the only one left that works; keep going
+			fmt.Fprintf(os.Stderr, "DEBUG: Failed to save the rotated OAuth tokens: %v\n", err)
+		}
+	}
+	return tokens.AccessToken, nil
+}
+
+// useGateway rewrites CONFLUENCE_URL to the API gateway form. A site URL is
+// matched against the sites the token can access, unless cloud_id names one;
+// a gateway URL is kept, and its site looked up for SiteURL.
+func useGateway(config *Config, accessToken string) error {
+	cloudID := config.CloudID
+	if id, ok := gatewayCloudID(config.ConfluenceURL); ok {
+		cloudID = id
+	} else if config.ConfluenceURL != "" {
+		config.SiteURL = strings.TrimSuffix(config.ConfluenceURL, "/")
+	}
+
+	if cloudID == "" || config.SiteURL == "" {
+		body, err := oauthRequest("GET", oauthResourcesURL, accessToken, nil)
+		if err != nil {
+			return fmt.Errorf("listing the sites the OAuth token can access: %w", err)
+		}
+		var resources []struct {
+			ID  string `json:"id"`
+			URL string `json:"url"`
+		}
+		if err := json.Unmarshal(body, &resources); err != nil {
+			return fmt.Errorf("parsing accessible resources: %w", err)
+		}
+		for _, resource := range resources {
+			switch {
+			case cloudID == "" && sameHost(resource.URL, config.SiteURL):
+				cloudID = resource.ID
+			case cloudID != "" && resource.ID == cloudID && config.SiteURL == "":
+				config.SiteURL = strings.TrimSuffix(resource.URL, "/") + "/wiki"
+			}
+		}
+		if cloudID == "" {
+			return fmt.Errorf("the OAuth token can't access %s; set cloud_id or authorize the app for the site", config.SiteURL)
+		}
+	}
+
+	config.ConfluenceURL = oauthGatewayURL + cloudID + "/wiki"
+	fmt.Fprintf(os.Stderr, "DEBUG: Using the API gateway %s for %s\n", config.ConfluenceURL, config.SiteURL)
+	return nil
+}
+
+// gatewayCloudID returns the cloud ID of an api.atlassian.com/ex/confluence URL
+func gatewayCloudID(confluenceURL string) (string, bool) {
+	rest, ok := strings.CutPrefix(strings.TrimSuffix(confluenceURL, "/"), strings.TrimSuffix(oauthGatewayURL, "/")+"/")
+	if !ok {
+		return "", false
+	}
+	cloudID, _, _ := strings.Cut(rest, "/")
+	return cloudID, cloudID != ""
+}
+
+func sameHost(a, b string) bool {
+	parsedA, errA := url.Parse(a)
+	parsedB, errB := url.Parse(b)
+	return errA == nil && errB == nil && parsedA.Host != "" && strings.EqualFold(parsedA.Host, parsedB.Host)
+}
+
+// oauthRequest sends a request to an OAuth endpoint, outside the retry and
+// rate-limit handling of Confluence requests
+func oauthRequest(method, endpoint, accessToken string, body []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), oauthTokenTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, method, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("creating request: %w", err)
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if accessToken != "" {
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("making request: %w", err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("reading response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, &HTTPStatusError{StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+	return data, nil
+}
+
+func readOAuthTokens(path string) (oauthTokens, error) {
+	var tokens oauthTokens
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return tokens, fmt.Errorf("reading oauth_token_file: %w", err)
+	}
+	if err := json.Unmarshal(data, &tokens); err != nil {
+		return tokens, fmt.Errorf("parsing oauth_token_file: %w", err)
+	}
+	return tokens, nil
+}
+
+func writeOAuthTokens(path string, tokens oauthTokens) error {
+	data, err := json.Marshal(tokens)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path+".tmp", data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
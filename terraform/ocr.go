@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// OCR engines for text in embedded images. Architecture decisions often only
+// exist as screenshots of whiteboards, which are otherwise invisible.
+const (
+	ocrTesseract = "tesseract"
+	ocrEndpoint  = "endpoint"
+)
+
+// maxOCRImageBytes skips images too large to be worth recognizing
+const maxOCRImageBytes = 20 * 1024 * 1024
+
+const ocrTimeout = 60 * time.Second
+
+var (
+	embeddedImageRegex   = regexp.MustCompile(`(?is)<ac:image[^>]*>(.*?)</ac:image>`)
+	imageAttachmentRegex = regexp.MustCompile(`(?i)<ri:attachment[^>]*ri:filename="([^"]+)"[^>]*>`)
+	imageURLRegex        = regexp.MustCompile(`(?i)<ri:url[^>]*ri:value="([^"]+)"`)
+	imageOtherPageRegex  = regexp.MustCompile(`(?i)<ri:(?:page|blog-post)\b`)
+)
+
+var ocrImageExtensions = map[string]bool{
+	".png": true, ".jpg": true, ".jpeg": true, ".gif": true,
+	".bmp": true, ".tif": true, ".tiff": true, ".webp": true,
+}
+
+var ocrTextEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+// validateOCR checks the OCR options
+func validateOCR(config *Config) error {
+	switch config.OCR {
+	case "":
+		return nil
+	case ocrTesseract:
+		if _, err := exec.LookPath("tesseract"); err != nil {
+			return fmt.Errorf("ocr is %q but the tesseract binary was not found in PATH", ocrTesseract)
+		}
+	case ocrEndpoint:
+		if config.OCREndpoint == "" {
+			return fmt.Errorf("ocr_endpoint is required when ocr is %q", ocrEndpoint)
+		}
+	default:
+		return fmt.Errorf("unknown ocr %q (expected %q or %q)", config.OCR, ocrTesseract, ocrEndpoint)
+	}
+	if isOfflineSource(config) {
+		return fmt.Errorf("ocr needs the confluence source")
+	}
+	return nil
+}
+
+// ocrEmbeddedImages replaces each image embedded in a storage-format body with
+// the text recognized in it, so the text lands where the image was. Images that
+// can't be downloaded or contain no text are left for the converter to drop.
+func ocrEmbeddedImages(ctx context.Context, config *Config, page Page, body string) string {
+	return embeddedImageRegex.ReplaceAllStringFunc(body, func(element string) string {
+		inner := embeddedImageRegex.FindStringSubmatch(element)[1]
+
+		var name, imageURL string
+		authenticated := true
+		if match := imageAttachmentRegex.FindStringSubmatch(inner); match != nil {
+			if imageOtherPageRegex.MatchString(inner) {
+				return element // Attachment of another page
+			}
+			name = match[1]
+			imageURL = fmt.Sprintf("%s/download/attachments/%s/%s", strings.TrimSuffix(config.ConfluenceURL, "/"), page.ID, url.PathEscape(name))
+		} else if match := imageURLRegex.FindStringSubmatch(inner); match != nil {
+			imageURL = strings.ReplaceAll(match[1], "&amp;", "&")
+			name = path.Base(imageURL)
+			authenticated = false // Never send Confluence credentials to another host
+		} else {
+			return element
+		}
+
+		extension := strings.ToLower(path.Ext(strings.SplitN(name, "?", 2)[0]))
+		if !ocrImageExtensions[extension] {
+			return element
+		}
+
+		image, err := downloadImage(ctx, config, imageURL, authenticated)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "DEBUG: Failed to download image %s on page %s: %v\n", name, page.Title, err)
+			return element
+		}
+		if len(image) > maxOCRImageBytes {
+			fmt.Fprintf(os.Stderr, "DEBUG: Skipping OCR of image %s on page %s (%d bytes)\n", name, page.Title, len(image))
+			return element
+		}
+
+		text, err := recognizeText(ctx, config, image, extension)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "DEBUG: OCR failed for image %s on page %s: %v\n", name, page.Title, err)
+			return element
+		}
+		if text = strings.TrimSpace(text); text == "" {
+			return element
+		}
+
+		fmt.Fprintf(os.Stderr, "DEBUG: Recognized %d chars in image %s on page %s\n", len(text), name, page.Title)
+		return fmt.Sprintf("<p>[Image: %s]<br/>%s</p>", ocrTextEscaper.Replace(name), strings.ReplaceAll(ocrTextEscaper.Replace(text), "\n", "<br/>"))
+	})
+}
+
+// downloadImage fetches an image, with Confluence credentials only for attachments
+func downloadImage(ctx context.Context, config *Config, imageURL string, authenticated bool) ([]byte, error) {
+	if authenticated {
+		return fetchWithContext(ctx, config, opAttachmentDownload, imageURL)
+	}
+
+	policy := requestPolicy(config, opAttachmentDownload)
+	ctx, cancel := context.WithTimeout(ctx, policy.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", imageURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("creating request: %w", err)
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("making request: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, &HTTPStatusError{StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, maxOCRImageBytes+1))
+}
+
+// recognizeText runs the configured OCR engine on an image
+func recognizeText(ctx context.Context, config *Config, image []byte, extension string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, ocrTimeout)
+	defer cancel()
+
+	if config.OCR == ocrTesseract {
+		args := []string{"stdin", "stdout"}
+		if config.OCRLanguage != "" {
+			args = append(args, "-l", config.OCRLanguage)
+		}
+		cmd := exec.CommandContext(ctx, "tesseract", args...)
+		cmd.Stdin = bytes.NewReader(image)
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		output, err := cmd.Output()
+		if err != nil {
+			return "", fmt.Errorf("tesseract: %w: %s", err, strings.TrimSpace(stderr.String()))
+		}
+		return string(output), nil
+	}
+
+	// The endpoint receives the raw image and answers with plain text or {"text": "..."}
+	req, err := http.NewRequestWithContext(ctx, "POST", config.OCREndpoint, bytes.NewReader(image))
+	if err != nil {
+		return "", fmt.Errorf("creating request: %w", err)
+	}
+	contentType := "image/" + strings.TrimPrefix(extension, ".")
+	if extension == ".jpg" {
+		contentType = "image/jpeg"
+	}
+	req.Header.Set("Content-Type", contentType)
+	if config.OCRLanguage != "" {
+		req.Header.Set("Content-Language", config.OCRLanguage)
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("calling OCR endpoint: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", &HTTPStatusError{StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("reading OCR response: %w", err)
+	}
+
+	var response struct {
+		Text string `json:"text"`
+	}
+	if json.Unmarshal(body, &response) == nil && response.Text != "" {
+		return response.Text, nil
+	}
+	return string(body), nil
+}
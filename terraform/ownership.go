@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// confluenceUser is the user shape shared by the watch and permission responses
+type confluenceUser struct {
+	AccountID   string `json:"accountId"`
+	Username    string `json:"username"`
+	DisplayName string `json:"displayName"`
+}
+
+// name returns the most readable identifier the instance exposes for a user
+func (u confluenceUser) name() string {
+	return firstNonEmpty(u.DisplayName, u.Username, u.AccountID)
+}
+
+// fetchSpaceOwners looks up the administrators of every space the listed pages
+// belong to. Spaces whose permissions can't be read get no owners.
+func fetchSpaceOwners(config *Config, pages []Page) map[string][]string {
+	owners := make(map[string][]string)
+	for _, page := range pages {
+		if _, done := owners[page.SpaceKey]; done {
+			continue
+		}
+		admins, err := fetchSpaceAdmins(config, page.SpaceKey)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "DEBUG: Failed to get admins for space %s: %v\n", page.SpaceKey, err)
+		}
+		owners[page.SpaceKey] = admins
+		fmt.Fprintf(os.Stderr, "DEBUG: Space %s has %d admins\n", page.SpaceKey, len(admins))
+	}
+	return owners
+}
+
+// spacePermission is one operation granted on a space and who it's granted to
+type spacePermission struct {
+	Operation struct {
+		Operation  string `json:"operation"`
+		TargetType string `json:"targetType"`
+	} `json:"operation"`
+	Subjects struct {
+		User struct {
+			Results []confluenceUser `json:"results"`
+		} `json:"user"`
+		Group struct {
+			Results []struct {
+				Name string `json:"name"`
+			} `json:"results"`
+		} `json:"group"`
+	} `json:"subjects"`
+}
+
+// fetchSpacePermissions returns a space's permission grants. Confluence only
+// expands them for credentials with space admin rights; others get none.
+func fetchSpacePermissions(config *Config, spaceKey string) ([]spacePermission, error) {
+	spaceURL := fmt.Sprintf("%s/rest/api/space/%s?expand=permissions", strings.TrimSuffix(config.ConfluenceURL, "/"), url.PathEscape(spaceKey))
+	body, err := fetchWithPolicy(config, opSpaceLookup, spaceURL)
+	if err != nil {
+		return nil, err
+	}
+
+	var space struct {
+		Permissions []spacePermission `json:"permissions"`
+	}
+	if err := json.Unmarshal(body, &space); err != nil {
+		return nil, fmt.Errorf("parsing space permissions: %w", err)
+	}
+	return space.Permissions, nil
+}
+
+// fetchSpaceAdmins returns the users holding the administer permission on a space
+func fetchSpaceAdmins(config *Config, spaceKey string) ([]string, error) {
+	permissions, err := fetchSpacePermissions(config, spaceKey)
+	if err != nil {
+		return nil, err
+	}
+
+	var admins []string
+	seen := make(map[string]bool)
+	for _, permission := range permissions {
+		if permission.Operation.Operation != "administer" || permission.Operation.TargetType != "space" {
+			continue
+		}
+		for _, user := range permission.Subjects.User.Results {
+			if name := user.name(); name != "" && !seen[name] {
+				seen[name] = true
+				admins = append(admins, name)
+			}
+		}
+	}
+	return admins, nil
+}
+
+// fetchPageWatchers returns the users watching a page
+func fetchPageWatchers(ctx context.Context, config *Config, page Page) ([]string, error) {
+	baseURL := strings.TrimSuffix(config.ConfluenceURL, "/")
+
+	var watchers []string
+	start := 0
+	limit := 100
+	for {
+		watchesURL := fmt.Sprintf("%s/rest/api/content/%s/notification/child-created?start=%d&limit=%d", baseURL, page.ID, start, limit)
+		body, err := fetchWithContext(ctx, config, opContentFetch, watchesURL)
+		if err != nil {
+			return watchers, err
+		}
+
+		var response struct {
+			Results []struct {
+				Watcher confluenceUser `json:"watcher"`
+			} `json:"results"`
+			Links struct {
+				Next string `json:"next"`
+			} `json:"_links"`
+		}
+		if err := json.Unmarshal(body, &response); err != nil {
+			return watchers, fmt.Errorf("parsing watchers: %w", err)
+		}
+
+		for _, watch := range response.Results {
+			if name := watch.Watcher.name(); name != "" {
+				watchers = append(watchers, name)
+			}
+		}
+
+		if response.Links.Next == "" || len(response.Results) == 0 {
+			break
+		}
+		start += len(response.Results)
+	}
+	return watchers, nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// modeUpdatePages re-imports the pages in page_updates and drops the pages in
+// removed_page_ids, merging the result into the previous output_file. Serve
+// mode runs it for the pages Confluence webhooks reported.
+const modeUpdatePages = "update_pages"
+
+// mergesIntoOutput reports whether the run merges a few pages into the
+// previous run's output_file instead of writing a new one
+func mergesIntoOutput(config *Config) bool {
+	return config.Mode == modeRetryFailed || config.Mode == modeUpdatePages
+}
+
+// validateUpdatePages checks that an update_pages run has pages and the
+// output to merge them into
+func validateUpdatePages(config *Config) error {
+	if config.Mode != modeUpdatePages {
+		return nil
+	}
+	if config.PageUpdates == "" && config.RemovedPageIDs == "" {
+		return fmt.Errorf("mode %q needs page_updates or removed_page_ids", modeUpdatePages)
+	}
+	if config.OutputFile == "" {
+		return fmt.Errorf("mode %q needs the output_file to merge into", modeUpdatePages)
+	}
+	if _, err := os.Stat(config.OutputFile); err != nil {
+		return fmt.Errorf("output_file to merge into not found: %w", err)
+	}
+	return nil
+}
+
+// loadPageUpdates returns the pages to re-import, from the page_updates JSON
+// array of {"id", "title", "space_key", "type"} objects, and the pages whose
+// items are only dropped. Webhooks report pages of the whole site, so pages of
+// spaces the run doesn't import are left out.
+func loadPageUpdates(config *Config) (updated, removed []Page, err error) {
+	if config.PageUpdates != "" {
+		var pages []Page
+		if err := json.Unmarshal([]byte(config.PageUpdates), &pages); err != nil {
+			return nil, nil, fmt.Errorf("parsing page_updates: %w", err)
+		}
+		for _, page := range pages {
+			if !spaceImported(config, page.SpaceKey) {
+				fmt.Fprintf(os.Stderr, "DEBUG: Ignoring update of page %s from space %q, which isn't imported\n", page.ID, page.SpaceKey)
+				continue
+			}
+			updated = append(updated, page)
+		}
+	}
+	for _, id := range strings.Split(config.RemovedPageIDs, ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			removed = append(removed, Page{ID: id})
+		}
+	}
+	fmt.Fprintf(os.Stderr, "DEBUG: Updating %d pages and removing %d from the previous output\n", len(updated), len(removed))
+	return updated, removed, nil
+}
+
+// spaceImported reports whether the run imports pages of the space: it isn't
+// excluded, and is one of the space keys when the run has any. A page without
+// a space key can't be placed, so it only passes runs without space keys.
+func spaceImported(config *Config, key string) bool {
+	if spaceExcluded(config, key) {
+		return false
+	}
+	keys := parseSpaceKeys(config)
+	if len(keys) == 0 {
+		return true
+	}
+	for _, imported := range keys {
+		if key != "" && strings.EqualFold(imported, key) {
+			return true
+		}
+	}
+	return false
+}
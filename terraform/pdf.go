@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"html"
+	"net/url"
+	"os"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// maxPDFBytes skips PDFs too large to download and convert
+const maxPDFBytes = 50 * 1024 * 1024
+
+const pdfTimeout = 2 * time.Minute
+
+// PDFs shown on a page through the PDF viewer or file macros
+var (
+	pdfMacroRegex      = regexp.MustCompile(`(?is)<ac:structured-macro[^>]*ac:name="(?:viewpdf|view-file)"[^>]*>(.*?)</ac:structured-macro>`)
+	pdfAttachmentRegex = regexp.MustCompile(`(?i)<ri:attachment[^>]*ri:filename="([^"]+\.pdf)"[^>]*>`)
+)
+
+// pdfDocument is the pdftohtml -xml output: positioned text runs per page
+type pdfDocument struct {
+	Pages []struct {
+		Fonts []struct {
+			ID   string  `xml:"id,attr"`
+			Size float64 `xml:"size,attr"`
+		} `xml:"fontspec"`
+		Texts []pdfText `xml:"text"`
+	} `xml:"page"`
+}
+
+type pdfText struct {
+	Top   int    `xml:"top,attr"`
+	Left  int    `xml:"left,attr"`
+	Width int    `xml:"width,attr"`
+	Font  string `xml:"font,attr"`
+	Inner string `xml:",innerxml"`
+
+	size float64
+	text string
+}
+
+var pdfTagRegex = regexp.MustCompile(`<[^>]+>`)
+
+// validatePDFExtraction checks that PDF extraction can run
+func validatePDFExtraction(config *Config) error {
+	if config.ExtractPDFs != "true" {
+		return nil
+	}
+	if _, err := exec.LookPath("pdftohtml"); err != nil {
+		return fmt.Errorf("extract_pdfs needs the pdftohtml binary (poppler-utils) in PATH")
+	}
+	if isOfflineSource(config) {
+		return fmt.Errorf("extract_pdfs needs the confluence source")
+	}
+	return nil
+}
+
+// extractEmbeddedPDFs replaces PDF viewer macros in a storage-format body with
+// the text of the attached PDF. PDFs that can't be read keep their macro.
+func extractEmbeddedPDFs(ctx context.Context, config *Config, page Page, body string) string {
+	return pdfMacroRegex.ReplaceAllStringFunc(body, func(element string) string {
+		match := pdfAttachmentRegex.FindStringSubmatch(element)
+		if match == nil || imageOtherPageRegex.MatchString(element) {
+			return element
+		}
+		name := html.UnescapeString(match[1])
+
+		pdfURL := fmt.Sprintf("%s/download/attachments/%s/%s", strings.TrimSuffix(config.ConfluenceURL, "/"), page.ID, url.PathEscape(name))
+		data, err := fetchWithContext(ctx, config, opAttachmentDownload, pdfURL)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "DEBUG: Failed to download PDF %s on page %s: %v\n", name, page.Title, err)
+			return element
+		}
+		if len(data) > maxPDFBytes {
+			fmt.Fprintf(os.Stderr, "DEBUG: Skipping PDF %s on page %s (%d bytes)\n", name, page.Title, len(data))
+			return element
+		}
+
+		text, err := extractPDFText(ctx, config, data, name)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "DEBUG: Failed to extract PDF %s on page %s: %v\n", name, page.Title, err)
+			return element
+		}
+
+		fmt.Fprintf(os.Stderr, "DEBUG: Extracted %d chars from PDF %s on page %s\n", len(text), name, page.Title)
+		return fmt.Sprintf("<p>[PDF: %s]<br/>%s</p>", ocrTextEscaper.Replace(name), strings.ReplaceAll(ocrTextEscaper.Replace(text), "\n", "<br/>"))
+	})
+}
+
+// extractPDFText converts a PDF to Markdown-ish text, keeping headings (runs in
+// a noticeably larger font) and tables (lines split into aligned columns). Only
+// the first pdf_max_pages pages are read. PDFs without a text layer, usually
+// scans, get a placeholder instead.
+func extractPDFText(ctx context.Context, config *Config, data []byte, name string) (string, error) {
+	file, err := os.CreateTemp("", "import-*.pdf")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(file.Name())
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return "", err
+	}
+	file.Close()
+
+	ctx, cancel := context.WithTimeout(ctx, pdfTimeout)
+	defer cancel()
+	args := []string{"-xml", "-i", "-q", "-stdout"}
+	if config.PDFMaxPages > 0 {
+		args = append(args, "-l", fmt.Sprint(config.PDFMaxPages))
+	}
+	cmd := exec.CommandContext(ctx, "pdftohtml", append(args, file.Name())...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("pdftohtml: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	var document pdfDocument
+	decoder := xml.NewDecoder(bytes.NewReader(output))
+	decoder.Strict = false
+	decoder.Entity = xml.HTMLEntity
+	if err := decoder.Decode(&document); err != nil {
+		return "", fmt.Errorf("parsing pdftohtml output: %w", err)
+	}
+
+	text := document.markdown()
+	if strings.TrimSpace(text) == "" {
+		return fmt.Sprintf("[%s has no text layer (%d pages, probably scanned)]", name, len(document.Pages)), nil
+	}
+	return text, nil
+}
+
+// markdown lays out the text runs of every page as headings, tables and paragraphs
+func (d *pdfDocument) markdown() string {
+	// Resolve font sizes and find the body size, the one covering the most text.
+	// Fonts are only declared on the first page that uses them.
+	fonts := make(map[string]float64)
+	sizeChars := make(map[float64]int)
+	for p := range d.Pages {
+		for _, font := range d.Pages[p].Fonts {
+			fonts[font.ID] = font.Size
+		}
+		for t := range d.Pages[p].Texts {
+			run := &d.Pages[p].Texts[t]
+			run.size = fonts[run.Font]
+			run.text = strings.TrimSpace(html.UnescapeString(pdfTagRegex.ReplaceAllString(run.Inner, "")))
+			sizeChars[run.size] += len(run.text)
+		}
+	}
+	bodySize := 0.0
+	for size, chars := range sizeChars {
+		if chars > sizeChars[bodySize] || (chars == sizeChars[bodySize] && size < bodySize) {
+			bodySize = size
+		}
+	}
+
+	var out strings.Builder
+	for _, page := range d.Pages {
+		inTable := false
+		for _, line := range pdfLines(page.Texts) {
+			columns := pdfColumns(line)
+			lineSize := 0.0
+			for _, run := range line {
+				lineSize = max(lineSize, run.size)
+			}
+			text := strings.Join(columns, " ")
+
+			switch {
+			case len(columns) > 1:
+				out.WriteString("| " + strings.Join(columns, " | ") + " |\n")
+				if !inTable {
+					out.WriteString("|" + strings.Repeat(" --- |", len(columns)) + "\n")
+				}
+				inTable = true
+				continue
+			case bodySize > 0 && lineSize >= bodySize*1.8 && len(text) < 120:
+				out.WriteString("\n# " + text + "\n\n")
+			case bodySize > 0 && lineSize >= bodySize*1.25 && len(text) < 120:
+				out.WriteString("\n## " + text + "\n\n")
+			default:
+				if inTable {
+					out.WriteString("\n")
+				}
+				out.WriteString(text + "\n")
+			}
+			inTable = false
+		}
+		out.WriteString("\n")
+	}
+	return strings.TrimSpace(out.String())
+}
+
+// pdfLines groups text runs sharing a baseline into lines, top to bottom and left to right
+func pdfLines(texts []pdfText) [][]pdfText {
+	runs := make([]pdfText, 0, len(texts))
+	for _, run := range texts {
+		if run.text != "" {
+			runs = append(runs, run)
+		}
+	}
+	sort.SliceStable(runs, func(i, j int) bool {
+		if abs(runs[i].Top-runs[j].Top) > 3 {
+			return runs[i].Top < runs[j].Top
+		}
+		return runs[i].Left < runs[j].Left
+	})
+
+	var lines [][]pdfText
+	for _, run := range runs {
+		if n := len(lines); n > 0 && abs(lines[n-1][0].Top-run.Top) <= 3 {
+			lines[n-1] = append(lines[n-1], run)
+			continue
+		}
+		lines = append(lines, []pdfText{run})
+	}
+	return lines
+}
+
+// pdfColumns joins the runs of a line into columns, starting a new column
+// wherever the horizontal gap is wider than about two characters
+func pdfColumns(line []pdfText) []string {
+	var columns []string
+	for i, run := range line {
+		if i > 0 {
+			previous := line[i-1]
+			if gap := run.Left - (previous.Left + previous.Width); float64(gap) <= max(previous.size, 8)*1.5 {
+				columns[len(columns)-1] += " " + run.text
+				continue
+			}
+		}
+		columns = append(columns, run.text)
+	}
+	return columns
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
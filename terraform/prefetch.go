@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// pageStreamer is implemented by sources that can hand pages to the workers
+// while the listing is still running, instead of listing everything first
+type pageStreamer interface {
+	// StreamPages lists every page like ListPages, passing each batch to emit
+	StreamPages(config *Config, emit func([]Page)) error
+}
+
+// listingFetch is the outcome of a listing request made ahead of time
+type listingFetch struct {
+	body []byte
+	err  error
+}
+
+// prefetchListing requests the next listing batch in the background
+func prefetchListing(config *Config, listURL string) <-chan listingFetch {
+	fmt.Fprintf(os.Stderr, "DEBUG: Prefetching %s\n", listURL)
+	done := make(chan listingFetch, 1)
+	go func() {
+		body, err := fetchWithPolicy(config, opPageListing, listURL)
+		done <- listingFetch{body: body, err: err}
+	}()
+	return done
+}
+
+// validatePrefetchListing checks that prefetch_listing isn't combined with an
+// option that needs the whole listing before the first page is processed
+func validatePrefetchListing(config *Config) error {
+	if config.PrefetchListing != "true" {
+		return nil
+	}
+	switch {
+	case isOfflineSource(config):
+		return fmt.Errorf("prefetch_listing needs the confluence source")
+	case config.ScrollVersions != "" && config.ScrollVersions != "off":
+		return fmt.Errorf(`prefetch_listing can't detect Scroll Versions spaces; leave scroll_versions unset or "off"`)
+	case len(parseLanguages(config)) > 0:
+		return fmt.Errorf("prefetch_listing can't be combined with languages")
+	case config.SelectTopViewed > 0:
+		return fmt.Errorf("prefetch_listing can't be combined with select_top_viewed")
+	case config.FetchOwners == "true":
+		return fmt.Errorf("prefetch_listing can't be combined with fetch_owners")
+	case config.VisibleToGroup != "":
+		return fmt.Errorf("prefetch_listing can't be combined with visible_to_group")
+	case config.QueueOrder == queueOrderRecency:
+		return fmt.Errorf(`prefetch_listing can't be combined with queue_order "recency"`)
+	case config.QueueDir != "":
+		return fmt.Errorf("prefetch_listing can't be combined with queue_dir")
+	}
+	// Detection needs every page of a space, which streamed batches don't have
+	if config.ScrollVersions == "" {
+		fmt.Fprintf(os.Stderr, "DEBUG: Skipping Scroll Versions detection, which prefetch_listing doesn't support\n")
+		config.ScrollVersions = "off"
+	}
+	return nil
+}
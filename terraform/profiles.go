@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// profileEnvReference matches the ${VAR} references expanded in profile
+// values. A bare $VAR is left alone, as tokens and secrets may contain "$".
+var profileEnvReference = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// ProfileFile holds several named input configurations so one deployment can
+// drive multiple recurring imports. Values use the same keys as stdin input.
+//
+//	{
+//	  "defaults": {"max_workers": "8"},
+//	  "profiles": {
+//	    "prod-wiki": {"CONFLUENCE_URL": "https://example.atlassian.net/wiki", "space_keys": "ENG,OPS"},
+//	    "legacy-dc": {"CONFLUENCE_URL": "https://wiki.internal", "api_version": "v1"}
+//	  }
+//	}
+type ProfileFile struct {
+	Defaults map[string]interface{}            `json:"defaults"`
+	Profiles map[string]map[string]interface{} `json:"profiles"`
+}
+
+// applyProfile merges the selected profile into the raw input. Precedence is
+// file defaults, then the profile, then any non-empty value given on stdin.
+// The file and profile come from config_file/profile or the IMPORT_CONFIG_FILE
+// and IMPORT_PROFILE environment variables.
+func applyProfile(inputMap map[string]interface{}) (map[string]interface{}, error) {
+	configFile := firstNonEmpty(stringValue(inputMap["config_file"]), os.Getenv("IMPORT_CONFIG_FILE"))
+	profileName := firstNonEmpty(stringValue(inputMap["profile"]), os.Getenv("IMPORT_PROFILE"))
+
+	if profileName == "" {
+		return inputMap, nil
+	}
+	if configFile == "" {
+		return nil, fmt.Errorf("profile %q selected but no config_file given", profileName)
+	}
+
+	file, err := readProfileFile(configFile)
+	if err != nil {
+		return nil, err
+	}
+
+	profile, ok := file.Profiles[profileName]
+	if !ok {
+		available := make([]string, 0, len(file.Profiles))
+		for name := range file.Profiles {
+			available = append(available, name)
+		}
+		sort.Strings(available)
+		return nil, fmt.Errorf("profile %q not found in %s (available: %s)", profileName, configFile, strings.Join(available, ", "))
+	}
+
+	merged := make(map[string]interface{})
+	for _, layer := range []map[string]interface{}{file.Defaults, profile} {
+		for key, value := range layer {
+			merged[key] = expandEnvReferences(stringValue(value))
+		}
+	}
+	for key, value := range inputMap {
+		if stringValue(value) != "" {
+			merged[key] = value
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "DEBUG: Using profile %q from %s\n", profileName, configFile)
+	return merged, nil
+}
+
+// expandEnvReferences replaces each ${VAR} in a profile value with the
+// variable's value, empty when it isn't set
+func expandEnvReferences(value string) string {
+	return profileEnvReference.ReplaceAllStringFunc(value, func(reference string) string {
+		return os.Getenv(profileEnvReference.FindStringSubmatch(reference)[1])
+	})
+}
+
+// readProfileFile reads and parses a config file of profiles
+func readProfileFile(configFile string) (ProfileFile, error) {
+	var file ProfileFile
+	data, err := os.ReadFile(configFile)
+	if err != nil {
+		return file, fmt.Errorf("reading config file: %w", err)
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return file, fmt.Errorf("parsing config file %s: %w", configFile, err)
+	}
+	return file, nil
+}
+
+// stringValue renders a scalar input value the way Terraform would pass it
+func stringValue(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case bool:
+		return strconv.FormatBool(v)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// propertyCondition requires a content property, or a field of its JSON
+// value, to have a given value
+type propertyCondition struct {
+	key   string
+	path  string // Dot path into the property value, "" for the value itself
+	value string
+}
+
+// validateRequiredProperties parses the required_properties option:
+// comma-separated key=value conditions, where the key may be followed by a
+// dot path into a JSON value, e.g. "ingest=true,review.state=approved"
+func validateRequiredProperties(config *Config) error {
+	var conditions []propertyCondition
+	for _, condition := range strings.Split(config.RequiredProperties, ",") {
+		if condition = strings.TrimSpace(condition); condition == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(condition, "=")
+		key, path, _ := strings.Cut(strings.TrimSpace(name), ".")
+		if !ok || key == "" {
+			return fmt.Errorf("invalid required_properties condition %q (expected key=value)", condition)
+		}
+		conditions = append(conditions, propertyCondition{key: key, path: path, value: strings.TrimSpace(value)})
+	}
+	if len(conditions) > 0 && isOfflineSource(config) {
+		return fmt.Errorf("required_properties needs the confluence source")
+	}
+	config.PropertyConditions = conditions
+	return nil
+}
+
+// propertiesMatch reports whether a page meets every required_properties
+// condition. Values compare case-insensitively; a page without the property,
+// or whose property can't be read, doesn't match.
+func propertiesMatch(ctx context.Context, config *Config, page Page) bool {
+	values := map[string]interface{}{}
+	for _, condition := range config.PropertyConditions {
+		value, fetched := values[condition.key]
+		if !fetched {
+			var err error
+			value, err = fetchContentProperty(ctx, config, page, condition.key)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "DEBUG: Failed to get property %s of page %s from space %s: %v\n", condition.key, page.Title, page.SpaceKey, err)
+				return false
+			}
+			values[condition.key] = value
+		}
+		if value == nil || !strings.EqualFold(stringAtPath(value, condition.path), condition.value) {
+			return false
+		}
+	}
+	return true
+}
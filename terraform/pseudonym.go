@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// emailPattern finds email addresses in free text
+var emailPattern = regexp.MustCompile(`[A-Za-z0-9._%+\-]+@[A-Za-z0-9.\-]+\.[A-Za-z]{2,}`)
+
+// pseudonymizer replaces user names and email addresses with stable
+// pseudonyms ("Person 7", "person7@example.invalid"). The mapping is kept in
+// pseudonym_file so every run, and the SharePoint importer given the same
+// file, uses the same pseudonym for the same person. A nil pseudonymizer
+// leaves everything as it is.
+type pseudonymizer struct {
+	mu       sync.Mutex
+	path     string
+	mapping  map[string]string // Lowercased name or email -> pseudonym
+	assigned map[string]bool   // Pseudonyms handed out, so they aren't mapped again
+	dirty    bool
+}
+
+// loadPseudonyms reads the mapping from pseudonym_file. A missing file starts
+// a new mapping; an unreadable one is an error, since starting over would give
+// people different pseudonyms than in earlier outputs.
+func loadPseudonyms(config *Config) (*pseudonymizer, error) {
+	if config.PseudonymFile == "" {
+		return nil, nil
+	}
+	p := &pseudonymizer{path: config.PseudonymFile, mapping: map[string]string{}, assigned: map[string]bool{}}
+	data, err := os.ReadFile(p.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return p, nil
+		}
+		return nil, fmt.Errorf("reading pseudonym_file: %w", err)
+	}
+	if err := json.Unmarshal(data, &p.mapping); err != nil {
+		return nil, fmt.Errorf("parsing pseudonym_file: %w", err)
+	}
+	for _, pseudonym := range p.mapping {
+		p.assigned[pseudonym] = true
+	}
+	fmt.Fprintf(os.Stderr, "DEBUG: Loaded %d pseudonyms from %s\n", len(p.mapping), p.path)
+	return p, nil
+}
+
+// pseudonym returns the pseudonym of a name or email address, assigning the
+// next free one on first sight
+func (p *pseudonymizer) pseudonym(real string) string {
+	key := strings.ToLower(strings.TrimSpace(real))
+	if key == "" {
+		return real
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.assigned[real] {
+		return real
+	}
+	if pseudonym, ok := p.mapping[key]; ok {
+		return pseudonym
+	}
+	pseudonym := fmt.Sprintf("Person %d", len(p.mapping)+1)
+	if emailPattern.MatchString(key) {
+		pseudonym = fmt.Sprintf("person%d@example.invalid", len(p.mapping)+1)
+	}
+	p.mapping[key] = pseudonym
+	p.assigned[pseudonym] = true
+	p.dirty = true
+	return pseudonym
+}
+
+func (p *pseudonymizer) names(names []string) []string {
+	if p == nil || names == nil {
+		return names
+	}
+	replaced := make([]string, len(names))
+	for i, name := range names {
+		replaced[i] = p.pseudonym(name)
+	}
+	return replaced
+}
+
+// text replaces the email addresses in free text
+func (p *pseudonymizer) text(text string) string {
+	if p == nil {
+		return text
+	}
+	return emailPattern.ReplaceAllStringFunc(text, p.pseudonym)
+}
+
+// comments replaces the authors of inline comments and their replies, and the
+// email addresses in what they say. Applied before comments are placed in the
+// content, so the rendered text carries the pseudonyms too.
+func (p *pseudonymizer) comments(comments []InlineComment) {
+	if p == nil {
+		return
+	}
+	for i := range comments {
+		comment := &comments[i]
+		if comment.Author != "" {
+			comment.Author = p.pseudonym(comment.Author)
+		}
+		comment.Body = p.text(comment.Body)
+		comment.Selection = p.text(comment.Selection)
+		p.comments(comment.Replies)
+	}
+}
+
+// items replaces every user name and email address the items carry
+func (p *pseudonymizer) items(items []*ProcessedItem) {
+	if p == nil {
+		return
+	}
+	for _, item := range items {
+		item.Title = p.text(item.Title)
+		item.Content = p.text(item.Content)
+		item.Owners = p.names(item.Owners)
+		item.Watchers = p.names(item.Watchers)
+		if item.VersionAuthor != "" {
+			item.VersionAuthor = p.pseudonym(item.VersionAuthor)
+		}
+		if item.Author != "" {
+			item.Author = p.pseudonym(item.Author)
+		}
+		item.VersionComment = p.text(item.VersionComment)
+		p.comments(item.InlineComments)
+	}
+}
+
+// save writes the mapping back if new people were seen. The file maps real
+// identities to pseudonyms, so it is only readable by its owner.
+func (p *pseudonymizer) save() error {
+	if p == nil {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.dirty {
+		return nil
+	}
+	data, err := json.MarshalIndent(p.mapping, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(p.path+".tmp", data, 0o600); err != nil {
+		return err
+	}
+	if err := os.Rename(p.path+".tmp", p.path); err != nil {
+		return err
+	}
+	p.dirty = false
+	return nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Orders of the page queue
+const (
+	queueOrderListing = "listing"
+	queueOrderRecency = "recency"
+)
+
+// lastRunFile is the file in cache_dir recording when the last complete run
+// started, which the recency order compares modification times against
+const lastRunFile = "last_run.json"
+
+// listedVersion is the version a listing reports for a page. v2 listings give
+// createdAt, v1 listings and search results when.
+type listedVersion struct {
+	Number    int    `json:"number,omitempty"`
+	CreatedAt string `json:"createdAt,omitempty"`
+	When      string `json:"when,omitempty"`
+}
+
+// lastModified returns when the page was last changed, or the zero time when
+// the listing didn't say
+func (p Page) lastModified() time.Time {
+	if p.Version == nil {
+		return time.Time{}
+	}
+	modified, err := time.Parse(time.RFC3339, firstNonEmpty(p.Version.CreatedAt, p.Version.When))
+	if err != nil {
+		return time.Time{}
+	}
+	return modified
+}
+
+// validateQueueOrder checks the queue_order option
+func validateQueueOrder(config *Config) error {
+	switch config.QueueOrder {
+	case "":
+		config.QueueOrder = queueOrderListing
+	case queueOrderListing, queueOrderRecency:
+	default:
+		return fmt.Errorf("invalid queue_order %q (expected %q or %q)", config.QueueOrder, queueOrderListing, queueOrderRecency)
+	}
+	return nil
+}
+
+// orderQueue sorts the listed pages for the recency order: pages changed since
+// the last complete run with the same cache_dir first, then by last
+// modification, newest first. A run cut short by memory_limit_mb or a timeout
+// has then captured the freshest content. Pages the listing gave no time for
+// keep their listing order at the end.
+func orderQueue(config *Config, pages []Page) []Page {
+	if config.QueueOrder != queueOrderRecency {
+		return pages
+	}
+	lastRun, known := previousRun(config)
+	changed := func(page Page) bool {
+		if known != nil {
+			if _, ok := known[page.ID]; !ok {
+				return true
+			}
+		}
+		return !lastRun.IsZero() && page.lastModified().After(lastRun)
+	}
+
+	changedCount := 0
+	sort.SliceStable(pages, func(i, j int) bool {
+		if a, b := changed(pages[i]), changed(pages[j]); a != b {
+			return a
+		}
+		return pages[i].lastModified().After(pages[j].lastModified())
+	})
+	for _, page := range pages {
+		if changed(page) {
+			changedCount++
+		}
+	}
+	fmt.Fprintf(os.Stderr, "DEBUG: Queued %d pages by recency, %d changed since the last run\n", len(pages), changedCount)
+	return pages
+}
+
+// previousRun returns when the last complete run started and the items it
+// emitted, as far as cache_dir remembers them. known is nil without a
+// previous diff_report state.
+func previousRun(config *Config) (started time.Time, known map[string]itemFingerprint) {
+	if config.CacheDir == "" {
+		return time.Time{}, nil
+	}
+	var lastRun struct {
+		StartedAt string `json:"started_at"`
+	}
+	if data, err := os.ReadFile(filepath.Join(config.CacheDir, lastRunFile)); err == nil && json.Unmarshal(data, &lastRun) == nil {
+		started, _ = time.Parse(time.RFC3339, lastRun.StartedAt)
+	}
+	if data, err := os.ReadFile(filepath.Join(config.CacheDir, itemStateFile)); err == nil {
+		if json.Unmarshal(data, &known) != nil {
+			known = nil
+		}
+	}
+	return started, known
+}
+
+// recordRun notes in cache_dir when a complete run started, so the next run
+// queues the pages changed since then first
+func recordRun(config *Config, started time.Time) {
+	if config.QueueOrder != queueOrderRecency || config.CacheDir == "" {
+		return
+	}
+	path := filepath.Join(config.CacheDir, lastRunFile)
+	data, _ := json.Marshal(map[string]string{"started_at": started.UTC().Format(time.RFC3339)})
+	err := os.MkdirAll(config.CacheDir, 0o755)
+	if err == nil {
+		err = os.WriteFile(path+".tmp", data, 0o644)
+	}
+	if err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "DEBUG: Failed to write %s: %v\n", lastRunFile, err)
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// rateLimitState is the token bucket shared through rate_limit_file
+type rateLimitState struct {
+	Tokens      float64 `json:"tokens"`
+	Updated     int64   `json:"updated_ns"`
+	PausedUntil int64   `json:"paused_until_ns,omitempty"` // Set when an instance was throttled
+}
+
+// rateLimiter spaces Confluence requests to rate_limit_per_second. With
+// rate_limit_file, the budget lives in that file and is shared by every
+// instance pointing at it, e.g. imports sharded by space against one tenant;
+// the file is locked while a request takes its token. A nil limiter never
+// waits.
+type rateLimiter struct {
+	mu    sync.Mutex
+	rate  float64
+	path  string
+	state rateLimitState // Used when there is no file
+}
+
+// requestLimiter applies to every request made with Confluence credentials
+var requestLimiter *rateLimiter
+
+// newRateLimiter returns the limiter for the rate-limit options, or nil when
+// rate_limit_per_second is unset
+func newRateLimiter(config *Config) (*rateLimiter, error) {
+	if config.RateLimitFile != "" && config.RateLimitPerSecond <= 0 {
+		return nil, fmt.Errorf("rate_limit_file needs rate_limit_per_second")
+	}
+	if config.RateLimitPerSecond <= 0 {
+		return nil, nil
+	}
+	limiter := &rateLimiter{rate: float64(config.RateLimitPerSecond), path: config.RateLimitFile}
+	if limiter.path != "" {
+		// Fail now rather than on the first request
+		file, err := os.OpenFile(limiter.path, os.O_RDWR|os.O_CREATE, 0o644)
+		if err != nil {
+			return nil, fmt.Errorf("opening rate_limit_file: %w", err)
+		}
+		file.Close()
+	}
+	return limiter, nil
+}
+
+// wait blocks until the shared budget has a token for one request
+func (l *rateLimiter) wait() {
+	if l == nil {
+		return
+	}
+	for {
+		delay := l.update(func(state *rateLimitState, now time.Time) time.Duration {
+			if paused := time.Unix(0, state.PausedUntil); now.Before(paused) {
+				return paused.Sub(now)
+			}
+			if state.Tokens >= 1 {
+				state.Tokens--
+				return 0
+			}
+			return time.Duration((1 - state.Tokens) / l.rate * float64(time.Second))
+		})
+		if delay <= 0 {
+			return
+		}
+		time.Sleep(delay)
+	}
+}
+
+// pause stops every instance sharing the budget for d, after the tenant
+// throttled one of them
+func (l *rateLimiter) pause(d time.Duration) {
+	if l == nil || d <= 0 {
+		return
+	}
+	l.update(func(state *rateLimitState, now time.Time) time.Duration {
+		if until := now.Add(d).UnixNano(); until > state.PausedUntil {
+			state.PausedUntil = until
+		}
+		return 0
+	})
+}
+
+// update refills the bucket for the time elapsed and applies change to it,
+// under the file lock when the budget is shared
+func (l *rateLimiter) update(change func(state *rateLimitState, now time.Time) time.Duration) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.path != "" {
+		delay, err := l.updateFile(change)
+		if err == nil {
+			return delay
+		}
+		// A broken coordination file mustn't stop the import, so this
+		// instance paces itself from here on
+		fmt.Fprintf(os.Stderr, "DEBUG: Rate limit file unavailable, pacing locally: %v\n", err)
+		l.path = ""
+	}
+	return l.apply(&l.state, change)
+}
+
+// updateFile is update on the bucket in rate_limit_file, locked against the
+// other instances
+func (l *rateLimiter) updateFile(change func(state *rateLimitState, now time.Time) time.Duration) (time.Duration, error) {
+	file, err := os.OpenFile(l.path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX); err != nil {
+		return 0, err
+	}
+	defer syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+
+	var state rateLimitState
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return 0, err
+	}
+	if len(data) > 0 {
+		// A file left corrupt by a crash only resets the bucket
+		json.Unmarshal(data, &state)
+	}
+	delay := l.apply(&state, change)
+	if data, err = json.Marshal(state); err != nil {
+		return 0, err
+	}
+	if err := file.Truncate(0); err != nil {
+		return 0, err
+	}
+	if _, err := file.WriteAt(data, 0); err != nil {
+		return 0, err
+	}
+	return delay, nil
+}
+
+func (l *rateLimiter) apply(state *rateLimitState, change func(state *rateLimitState, now time.Time) time.Duration) time.Duration {
+	now := time.Now()
+	if state.Updated == 0 {
+		// A new bucket starts full: one second's worth of requests
+		state.Tokens = l.rate
+	} else if elapsed := now.Sub(time.Unix(0, state.Updated)); elapsed > 0 {
+		state.Tokens += elapsed.Seconds() * l.rate
+	}
+	if state.Tokens > l.rate {
+		state.Tokens = l.rate
+	}
+	state.Updated = now.UnixNano()
+	return change(state, now)
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Operation classes with independent timeout and retry settings. Space lookups
+// are cheap and should fail fast, while body fetches and attachment downloads
+// can legitimately take much longer and are more expensive to lose.
+const (
+	opSpaceLookup        = "space_lookup"
+	opPageListing        = "page_listing"
+	opContentFetch       = "content_fetch"
+	opAttachmentDownload = "attachment_download"
+)
+
+// maxRetryBackoff caps the exponential backoff between attempts
+const maxRetryBackoff = 30 * time.Second
+
+// RequestPolicy controls how one class of requests is timed out and retried
+type RequestPolicy struct {
+	Timeout time.Duration // Per-attempt timeout
+	Retries int           // Attempts after the first one
+	Backoff time.Duration // Initial wait between attempts, doubled each retry
+}
+
+// defaultRequestPolicy applies to requests outside any operation class
+var defaultRequestPolicy = RequestPolicy{Timeout: 30 * time.Second}
+
+var defaultRequestPolicies = map[string]RequestPolicy{
+	opSpaceLookup:        {Timeout: 15 * time.Second, Retries: 3, Backoff: time.Second},
+	opPageListing:        {Timeout: 30 * time.Second, Retries: 3, Backoff: 2 * time.Second},
+	opContentFetch:       {Timeout: 30 * time.Second, Retries: 2, Backoff: time.Second},
+	opAttachmentDownload: {Timeout: 120 * time.Second, Retries: 1, Backoff: 5 * time.Second},
+}
+
+// parseRequestPolicies reads <operation>_timeout_seconds and <operation>_retries
+// overrides on top of the defaults for each operation class
+func parseRequestPolicies(inputMap map[string]interface{}) map[string]RequestPolicy {
+	policies := make(map[string]RequestPolicy, len(defaultRequestPolicies))
+	for op, policy := range defaultRequestPolicies {
+		if seconds := intOption(inputMap, op+"_timeout_seconds", 0); seconds > 0 {
+			policy.Timeout = time.Duration(seconds) * time.Second
+		}
+		if retries := intOption(inputMap, op+"_retries", -1); retries >= 0 {
+			policy.Retries = retries
+		}
+		policies[op] = policy
+	}
+	return policies
+}
+
+// requestPolicy returns the policy for an operation class
+func requestPolicy(config *Config, op string) RequestPolicy {
+	if policy, ok := config.RequestPolicies[op]; ok {
+		return policy
+	}
+	if policy, ok := defaultRequestPolicies[op]; ok {
+		return policy
+	}
+	return defaultRequestPolicy
+}
+
+// fetchWithPolicy performs a GET using the credentials and policy for op
+func fetchWithPolicy(config *Config, op, url string) ([]byte, error) {
+	return fetchWithContext(context.Background(), config, op, url)
+}
+
+// fetchWithContext is fetchWithPolicy for requests made while processing a
+// page, which are abandoned once ctx is done
+func fetchWithContext(ctx context.Context, config *Config, op, url string) ([]byte, error) {
+	body, _, err := makeRequestWithPolicy(ctx, url, config.Username, config.APIToken, requestPolicy(config, op))
+	return body, err
+}
+
+// makeRequestWithPolicy retries retryable failures with exponential backoff,
+// honouring Retry-After when the server sends one. No attempt starts once ctx
+// is done.
+func makeRequestWithPolicy(ctx context.Context, url, username, apiToken string, policy RequestPolicy) ([]byte, http.Header, error) {
+	username, apiToken = credentials.current(username, apiToken)
+	refreshed := false
+	for attempt := 0; ; attempt++ {
+		generation := credentials.currentGeneration()
+		body, headers, err := makeSingleRequest(ctx, url, username, apiToken, policy.Timeout)
+		if isUnauthorized(err) && !refreshed && credentials.refresh(apiToken, generation) {
+			// Rotated credentials don't use up an attempt
+			username, apiToken = credentials.current(username, apiToken)
+			refreshed = true
+			attempt--
+			continue
+		}
+		if err == nil || attempt >= policy.Retries || !isRetryable(err) || ctx.Err() != nil {
+			return body, headers, err
+		}
+
+		wait := retryDelay(policy, attempt, headers)
+		if isThrottled(err) {
+			// Every instance sharing the rate limit backs off, not just this one
+			requestLimiter.pause(wait)
+		}
+		fmt.Fprintf(os.Stderr, "DEBUG: Request to %s failed (%v), retrying in %s (attempt %d/%d)\n", url, err, wait, attempt+1, policy.Retries)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return nil, headers, ctx.Err()
+		}
+	}
+}
+
+// isRetryable reports whether a failed request is worth repeating: throttling,
+// server-side errors, timeouts and transient network failures. Only GETs go
+// through the retry loop, so repeating them is always safe.
+func isRetryable(err error) bool {
+	var statusErr *HTTPStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode == http.StatusTooManyRequests || statusErr.StatusCode >= 500
+	}
+	return isTimeout(err) || isTransientNetworkError(err)
+}
+
+// isTransientNetworkError matches failures a fresh connection usually cures: a
+// keep-alive connection reset or closed by the server, a response cut short,
+// or a DNS lookup that failed
+func isTransientNetworkError(err error) bool {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNABORTED) || errors.Is(err, syscall.EPIPE) {
+		return true
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return true
+	}
+	return strings.Contains(err.Error(), "server closed idle connection")
+}
+
+// isUnauthorized reports whether err is an HTTP 401
+func isUnauthorized(err error) bool {
+	var statusErr *HTTPStatusError
+	return errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusUnauthorized
+}
+
+// isThrottled reports whether err is an HTTP 429
+func isThrottled(err error) bool {
+	var statusErr *HTTPStatusError
+	return errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusTooManyRequests
+}
+
+func isTimeout(err error) bool {
+	var timeoutErr interface{ Timeout() bool }
+	return errors.As(err, &timeoutErr) && timeoutErr.Timeout()
+}
+
+func retryDelay(policy RequestPolicy, attempt int, headers http.Header) time.Duration {
+	if headers != nil {
+		if seconds, err := strconv.Atoi(headers.Get("Retry-After")); err == nil && seconds >= 0 {
+			return time.Duration(seconds) * time.Second
+		}
+	}
+	wait := policy.Backoff << attempt
+	if wait <= 0 || wait > maxRetryBackoff {
+		wait = maxRetryBackoff
+	}
+	return wait
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Item fields a routing rule can match on
+const (
+	routeBySpace    = "space"
+	routeByLabel    = "label"
+	routeByInstance = "instance"
+)
+
+// routeRule sends the items matching one field value to a file of their own
+type routeRule struct {
+	field string
+	value string
+	path  string
+}
+
+// parseRoutes parses the routes option: semicolon-separated rules of the form
+// field:value=file, e.g. "label:security=restricted.jsonl;space:HR=hr.jsonl"
+func parseRoutes(spec string) ([]routeRule, error) {
+	var rules []routeRule
+	for _, rule := range strings.Split(spec, ";") {
+		if rule = strings.TrimSpace(rule); rule == "" {
+			continue
+		}
+		match, path, ok := strings.Cut(rule, "=")
+		field, value, hasValue := strings.Cut(match, ":")
+		field, value, path = strings.TrimSpace(field), strings.TrimSpace(value), strings.TrimSpace(path)
+		if !ok || !hasValue || value == "" || path == "" {
+			return nil, fmt.Errorf("invalid route %q (expected field:value=file)", rule)
+		}
+		switch field {
+		case routeBySpace, routeByLabel, routeByInstance:
+		default:
+			return nil, fmt.Errorf("unknown route field %q (expected %q, %q or %q)", field, routeBySpace, routeByLabel, routeByInstance)
+		}
+		rules = append(rules, routeRule{field: field, value: value, path: path})
+	}
+	return rules, nil
+}
+
+// validateRoutes parses the routes option into config.RouteRules
+func validateRoutes(config *Config) error {
+	rules, err := parseRoutes(config.Routes)
+	if err != nil {
+		return err
+	}
+	if len(rules) > 0 && mergesIntoOutput(config) {
+		return fmt.Errorf("routes can't be combined with mode %q, which only merges into output_file", config.Mode)
+	}
+	for _, rule := range rules {
+		if rule.path == config.OutputFile {
+			return fmt.Errorf("route file %s is also the output_file", rule.path)
+		}
+	}
+	config.RouteRules = rules
+	return nil
+}
+
+// matches reports whether an item belongs to the route. Space keys and labels
+// compare case-insensitively.
+func (r routeRule) matches(item *ProcessedItem) bool {
+	switch r.field {
+	case routeBySpace:
+		return strings.EqualFold(item.SpaceKey, r.value)
+	case routeByLabel:
+		for _, label := range strings.Split(item.Labels, ",") {
+			if strings.EqualFold(strings.TrimSpace(label), r.value) {
+				return true
+			}
+		}
+	case routeByInstance:
+		return strings.TrimSuffix(item.Instance, "/") == strings.TrimSuffix(r.value, "/")
+	}
+	return false
+}
+
+// routingSink hands each item to the file of the first route it matches, and
+// the rest to the default sink
+type routingSink struct {
+	itemSink
+	rules []routeRule
+	files map[string]*fileSink // Route file -> sink
+}
+
+// newRoutingSink wraps the default sink when routes are configured
+func newRoutingSink(config *Config, sink itemSink) (itemSink, error) {
+	if len(config.RouteRules) == 0 {
+		return sink, nil
+	}
+	routing := &routingSink{itemSink: sink, rules: config.RouteRules, files: map[string]*fileSink{}}
+	for _, rule := range config.RouteRules {
+		if _, ok := routing.files[rule.path]; ok {
+			continue
+		}
+		file, err := newFileSink(config, rule.path)
+		if err != nil {
+			routing.closeFiles()
+			return nil, fmt.Errorf("creating route file: %w", err)
+		}
+		routing.files[rule.path] = file
+	}
+	return routing, nil
+}
+
+func (s *routingSink) Write(item *ProcessedItem) error {
+	for _, rule := range s.rules {
+		if rule.matches(item) {
+			return s.files[rule.path].Write(item)
+		}
+	}
+	return s.itemSink.Write(item)
+}
+
+func (s *routingSink) Count() int {
+	count := s.itemSink.Count()
+	for _, file := range s.files {
+		count += file.Count()
+	}
+	return count
+}
+
+// Close closes the route files and the default sink, adding how many items
+// went to each route file to the Result
+func (s *routingSink) Close() (Result, error) {
+	routed := make(map[string]int, len(s.files))
+	for path, file := range s.files {
+		routed[path] = file.Count()
+	}
+	if err := s.closeFiles(); err != nil {
+		s.itemSink.Close()
+		return Result{}, err
+	}
+	result, err := s.itemSink.Close()
+	if err != nil {
+		return result, err
+	}
+	data, err := json.Marshal(routed)
+	if err != nil {
+		return result, err
+	}
+	result.RoutedItems = string(data)
+	if result.ItemCount != "" {
+		result.ItemCount = strconv.Itoa(s.Count())
+	}
+	return result, nil
+}
+
+func (s *routingSink) closeFiles() error {
+	var firstErr error
+	for _, file := range s.files {
+		if _, err := file.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
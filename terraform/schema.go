@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Output schema versions. v1 is the original flat item shape with every value
+// as Terraform reads it today; v2 uses typed fields, arrays and a nested
+// metadata object. Existing fields only ever change in a new version, so v1
+// consumers never see a field renamed or retyped under them.
+const (
+	schemaV1 = "1"
+	schemaV2 = "2"
+)
+
+// validateSchemaVersion checks the schema_version option
+func validateSchemaVersion(config *Config) error {
+	switch config.SchemaVersion {
+	case schemaV1, schemaV2:
+		return nil
+	}
+	return fmt.Errorf("schema_version must be %q or %q", schemaV1, schemaV2)
+}
+
+// itemV2 is an item in schema version 2
+type itemV2 struct {
+	SchemaVersion string         `json:"schema_version"`
+	ID            string         `json:"id"`
+	Type          string         `json:"type"`
+	Source        string         `json:"source"`
+	Instance      string         `json:"instance,omitempty"`
+	URL           string         `json:"url,omitempty"`
+	Title         string         `json:"title"`
+	Content       string         `json:"content"`
+	Labels        []string       `json:"labels"`
+	Space         spaceV2        `json:"space"`
+	Metadata      itemMetadataV2 `json:"metadata"`
+	Action        string         `json:"action,omitempty"`
+}
+
+type spaceV2 struct {
+	Key string `json:"key"`
+}
+
+// itemMetadataV2 holds everything about an item besides its text
+type itemMetadataV2 struct {
+	Language         string          `json:"language,omitempty"`
+	TranslationGroup string          `json:"translation_group,omitempty"`
+	Status           string          `json:"status,omitempty"`
+	Views            *int            `json:"views,omitempty"`
+	Owners           []string        `json:"owners,omitempty"`
+	Watchers         []string        `json:"watchers,omitempty"`
+	Template         bool            `json:"template"`
+	CreatedAt        string          `json:"created_at,omitempty"`
+	UpdatedAt        string          `json:"updated_at,omitempty"`
+	Author           string          `json:"author,omitempty"`
+	Version          *versionV2      `json:"version,omitempty"` // Set on pages and page_version items
+	InlineComments   []InlineComment `json:"inline_comments,omitempty"`
+	Attachments      []Attachment    `json:"attachments,omitempty"`
+	ParentPageID     string          `json:"parent_page_id,omitempty"` // Set on attachment items
+	MediaType        string          `json:"media_type,omitempty"`
+	DownloadURL      string          `json:"download_url,omitempty"`
+}
+
+type versionV2 struct {
+	PageID  string `json:"page_id"`
+	Number  int    `json:"number"`
+	Comment string `json:"comment,omitempty"`
+	Author  string `json:"author,omitempty"`
+	Date    string `json:"date,omitempty"`
+}
+
+// encodeItem returns the value marshaled for an item in the given schema
+// version
+func encodeItem(item *ProcessedItem, schemaVersion string) interface{} {
+	if schemaVersion != schemaV2 {
+		v1 := *item
+		v1.SchemaVersion = schemaV1
+		return &v1
+	}
+
+	labels := []string{}
+	for _, label := range strings.Split(item.Labels, ",") {
+		if label = strings.TrimSpace(label); label != "" {
+			labels = append(labels, label)
+		}
+	}
+	v2 := &itemV2{
+		SchemaVersion: schemaV2,
+		ID:            item.ID,
+		Type:          item.Type,
+		Source:        item.Source,
+		Instance:      item.Instance,
+		URL:           item.URL,
+		Title:         item.Title,
+		Content:       item.Content,
+		Labels:        labels,
+		Space:         spaceV2{Key: item.SpaceKey},
+		Action:        item.Action,
+		Metadata: itemMetadataV2{
+			Language:         item.Language,
+			TranslationGroup: item.TranslationGroup,
+			Status:           item.Status,
+			Views:            item.Views,
+			Owners:           item.Owners,
+			Watchers:         item.Watchers,
+			Template:         item.Template,
+			CreatedAt:        item.CreatedAt,
+			UpdatedAt:        item.UpdatedAt,
+			Author:           item.Author,
+			InlineComments:   item.InlineComments,
+			Attachments:      item.Attachments,
+			ParentPageID:     item.ParentPageID,
+			MediaType:        item.MediaType,
+			DownloadURL:      item.DownloadURL,
+		},
+	}
+	if item.PageID != "" || item.Version > 0 {
+		v2.Metadata.Version = &versionV2{
+			PageID:  firstNonEmpty(item.PageID, item.ID),
+			Number:  item.Version,
+			Comment: item.VersionComment,
+			Author:  item.VersionAuthor,
+			Date:    item.VersionDate,
+		}
+	}
+	return v2
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Scroll Versions stores every versioned copy of a page as its own Confluence
+// page titled ".<Page title> v<version name>". Importing those spaces naively
+// mixes every version (and working drafts of the next one) into one corpus.
+var scrollVersionTitleRegex = regexp.MustCompile(`^\.(.+) v(\S+)$`)
+
+// applyScrollVersions keeps only one version of each page in Scroll
+// Versions-managed spaces. The target is the configured scroll_version, or the
+// newest version found. As in Scroll Versions itself, a page unchanged in the
+// target version is represented by its newest copy from an earlier version.
+// Pages in spaces without versioned titles pass through untouched.
+func applyScrollVersions(config *Config, pages []Page) []Page {
+	if config.ScrollVersions == "off" {
+		return pages
+	}
+
+	type versionedPage struct {
+		index   int
+		version string
+	}
+
+	// space -> base title -> versioned copies
+	versioned := make(map[string]map[string][]versionedPage)
+	spaceVersions := make(map[string][]string)
+	for i, page := range pages {
+		match := scrollVersionTitleRegex.FindStringSubmatch(page.Title)
+		if match == nil {
+			continue
+		}
+		if versioned[page.SpaceKey] == nil {
+			versioned[page.SpaceKey] = make(map[string][]versionedPage)
+		}
+		versioned[page.SpaceKey][match[1]] = append(versioned[page.SpaceKey][match[1]], versionedPage{index: i, version: match[2]})
+		spaceVersions[page.SpaceKey] = append(spaceVersions[page.SpaceKey], match[2])
+	}
+	if len(versioned) == 0 {
+		return pages
+	}
+
+	keep := make([]bool, len(pages))
+	for i := range pages {
+		keep[i] = true
+	}
+
+	for spaceKey, titles := range versioned {
+		target := config.ScrollVersion
+		if target == "" {
+			target = latestVersion(spaceVersions[spaceKey])
+		}
+		fmt.Fprintf(os.Stderr, "DEBUG: Space %s is managed by Scroll Versions; importing version %s\n", spaceKey, target)
+
+		kept := 0
+		for title, copies := range titles {
+			best := -1
+			bestVersion := ""
+			for _, c := range copies {
+				keep[c.index] = false
+				if compareVersions(c.version, target) > 0 {
+					continue // Newer than the target, e.g. a working draft
+				}
+				if best == -1 || compareVersions(c.version, bestVersion) > 0 {
+					best, bestVersion = c.index, c.version
+				}
+			}
+			if best >= 0 {
+				keep[best] = true
+				pages[best].Title = title
+				kept++
+			}
+		}
+		fmt.Fprintf(os.Stderr, "DEBUG: Kept %d of %d versioned pages in space %s\n", kept, len(spaceVersions[spaceKey]), spaceKey)
+	}
+
+	var result []Page
+	for i, page := range pages {
+		if keep[i] {
+			result = append(result, page)
+		}
+	}
+	return result
+}
+
+func latestVersion(versions []string) string {
+	latest := ""
+	for _, version := range versions {
+		if latest == "" || compareVersions(version, latest) > 0 {
+			latest = version
+		}
+	}
+	return latest
+}
+
+// compareVersions orders version names naturally, so "1.10" sorts after "1.9".
+// Non-numeric names that differ are only equal to themselves and compare by text.
+func compareVersions(a, b string) int {
+	partsA, partsB := versionParts(a), versionParts(b)
+	for i := 0; i < len(partsA) && i < len(partsB); i++ {
+		numA, errA := strconv.Atoi(partsA[i])
+		numB, errB := strconv.Atoi(partsB[i])
+		switch {
+		case errA == nil && errB == nil && numA != numB:
+			if numA < numB {
+				return -1
+			}
+			return 1
+		case (errA != nil || errB != nil) && partsA[i] != partsB[i]:
+			return strings.Compare(partsA[i], partsB[i])
+		}
+	}
+	switch {
+	case len(partsA) < len(partsB):
+		return -1
+	case len(partsA) > len(partsB):
+		return 1
+	}
+	return 0
+}
+
+// versionParts splits a version name into alternating digit and non-digit runs, dropping separators
+func versionParts(version string) []string {
+	var parts []string
+	var current strings.Builder
+	lastDigit := false
+	for _, r := range version {
+		if r == '.' || r == '-' || r == '_' {
+			if current.Len() > 0 {
+				parts = append(parts, current.String())
+				current.Reset()
+			}
+			continue
+		}
+		digit := unicode.IsDigit(r)
+		if current.Len() > 0 && digit != lastDigit {
+			parts = append(parts, current.String())
+			current.Reset()
+		}
+		current.WriteRune(r)
+		lastDigit = digit
+	}
+	if current.Len() > 0 {
+		parts = append(parts, current.String())
+	}
+	return parts
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// searchListingLimit caps the page size of search listings. Results carry their
+// bodies, so Confluence caps it well below the plain listing's 100.
+const searchListingLimit = 50
+
+// fetchSpacePagesSearch lists a space through the CQL search API, expanding
+// bodies and labels so pages arrive ready to convert and workers skip the
+// per-page content request
+func fetchSpacePagesSearch(config *Config, spaceKey string, pagesPerSpace int) ([]Page, error) {
+	space, err := resolveSpace(config, spaceKey, true)
+	if err != nil {
+		if errors.Is(err, errSpaceNotFound) {
+			return nil, unknownSpaceError(config, spaceKey)
+		}
+		fmt.Fprintf(os.Stderr, "DEBUG: Failed to get space info for %s: %v\n", spaceKey, err)
+		return nil, nil // Skip this space and continue with others
+	}
+	spaceKey = firstNonEmpty(space.Key, spaceKey) // A personal space may have been named by its owner
+
+	cql := fmt.Sprintf(`space = "%s" and type in (%s) order by id`, spaceKey, strings.Join(listedTypes(config), ", "))
+	if config.QueueOrder == queueOrderRecency {
+		// So max_pages keeps the most recently modified pages
+		cql = fmt.Sprintf(`space = "%s" and type in (%s) order by lastmodified desc`, spaceKey, strings.Join(listedTypes(config), ", "))
+	}
+	pages := searchPages(config, withFilters(config, cql), pagesPerSpace, "space "+spaceKey)
+	for i := range pages {
+		pages[i].SpaceKey = spaceKey
+	}
+	return pages, nil
+}
+
+// fetchCQLPages lists the pages and blog posts the cql option selects, across
+// spaces, in place of the space listing. max_pages caps the total.
+func fetchCQLPages(config *Config) []Page {
+	fmt.Fprintf(os.Stderr, "DEBUG: Selecting content with CQL: %s\n", config.CQL)
+	var pages []Page
+	for _, page := range searchPages(config, withFilters(config, config.CQL), config.MaxPages, "the CQL query") {
+		if !spaceExcluded(config, page.SpaceKey) {
+			pages = append(pages, page)
+		}
+	}
+	fmt.Fprintf(os.Stderr, "DEBUG: CQL query selected %d pages\n", len(pages))
+	return pages
+}
+
+// withFilters adds include_labels, exclude_labels and modified_since to a CQL
+// query, ahead of its order by clause, so the search only returns the pages
+// they select and max_pages counts those alone
+func withFilters(config *Config, cql string) string {
+	clauses := labelClauses(config)
+	if clause := modifiedSinceClause(config); clause != "" {
+		clauses = append(clauses, clause)
+	}
+	if len(clauses) == 0 {
+		return cql
+	}
+	query, order := cql, ""
+	if i := strings.LastIndex(strings.ToLower(cql), "order by"); i >= 0 {
+		query, order = strings.TrimSpace(cql[:i]), " "+cql[i:]
+	}
+	return fmt.Sprintf("(%s) and %s%s", query, strings.Join(clauses, " and "), order)
+}
+
+// searchPages runs a CQL search with pagination, expanding bodies, labels
+// and spaces so pages arrive ready to convert and workers skip the per-page
+// content request. Results other than pages and blog posts (attachments,
+// comments) are skipped. what names the listing in log messages.
+func searchPages(config *Config, cql string, maxPages int, what string) []Page {
+	baseURL := strings.TrimSuffix(config.ConfluenceURL, "/")
+	expand := config.ContentExpand + ",space"
+	if listsVersions(config) && !hasExpansion(expand, "version") {
+		expand += ",version"
+	}
+	endpoint := fmt.Sprintf("/rest/api/content/search?cql=%s&expand=%s&limit=%d", url.QueryEscape(cql), url.QueryEscape(expand), min(config.ListingLimit, searchListingLimit))
+
+	var pages []Page
+	for endpoint != "" {
+		if maxPages > 0 && len(pages) >= maxPages {
+			fmt.Fprintf(os.Stderr, "DEBUG: Reached max pages limit (%d) for %s, stopping\n", maxPages, what)
+			break
+		}
+
+		fullURL := baseURL + endpoint
+		fmt.Fprintf(os.Stderr, "DEBUG: Fetching %s\n", fullURL)
+		body, err := fetchWithPolicy(config, opPageListing, fullURL)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "DEBUG: Failed to search pages of %s: %v\n", what, err)
+			break
+		}
+
+		var response struct {
+			Results []struct {
+				ContentResponse
+				Type  string `json:"type"`
+				Space struct {
+					Key string `json:"key"`
+				} `json:"space"`
+			} `json:"results"`
+			Links struct {
+				Next string `json:"next"`
+			} `json:"_links"`
+		}
+		if err := json.Unmarshal(body, &response); err != nil {
+			fmt.Fprintf(os.Stderr, "DEBUG: Failed to parse search response for %s: %v\n", what, err)
+			break
+		}
+
+		for _, result := range response.Results {
+			if maxPages > 0 && len(pages) >= maxPages {
+				break
+			}
+			if result.Type != "page" && result.Type != "blogpost" {
+				fmt.Fprintf(os.Stderr, "DEBUG: Skipping %s %s (%s) of %s\n", result.Type, result.ID, result.Title, what)
+				continue
+			}
+			content := result.ContentResponse
+			page := Page{ID: result.ID, Title: result.Title, Type: result.Type, SpaceKey: result.Space.Key, Version: result.Version.listed(), Content: &content}
+			if stale(config, page) {
+				continue
+			}
+			pages = append(pages, page)
+		}
+		fmt.Fprintf(os.Stderr, "DEBUG: Fetched %d pages with content from %s, total: %d\n", len(response.Results), what, len(pages))
+
+		if len(response.Results) == 0 {
+			break
+		}
+		// Cloud pages with a cursor, Data Center with start; both put it in the next link
+		endpoint = strings.TrimPrefix(response.Links.Next, "/wiki")
+	}
+	return pages
+}
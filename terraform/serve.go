@@ -0,0 +1,389 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// modeServe keeps running and imports each scheduled profile on its schedule
+const modeServe = "serve"
+
+// defaultServeAddr is where serve mode exposes its status and webhook endpoints
+const defaultServeAddr = ":8080"
+
+// Outcomes of a scheduled import
+const (
+	serveRunOK      = "ok"
+	serveRunPartial = "partial"
+	serveRunFailed  = "failed"
+)
+
+// serveJobStatus is a profile's entry in the status endpoint and serve_state_file
+type serveJobStatus struct {
+	Profile       string `json:"profile"`
+	Schedule      string `json:"schedule"`
+	Running       bool   `json:"running"`
+	NextRun       string `json:"next_run,omitempty"`
+	LastStarted   string `json:"last_started,omitempty"`
+	LastFinished  string `json:"last_finished,omitempty"`
+	LastStatus    string `json:"last_status,omitempty"`
+	LastItemCount string `json:"last_item_count,omitempty"`
+	LastError     string `json:"last_error,omitempty"`
+	Runs          int    `json:"runs"`
+	// Webhook updates
+	PendingUpdates     int    `json:"pending_updates"`
+	LastUpdateFinished string `json:"last_update_finished,omitempty"`
+	LastUpdateStatus   string `json:"last_update_status,omitempty"`
+	LastUpdatePages    int    `json:"last_update_pages,omitempty"`
+	LastUpdateError    string `json:"last_update_error,omitempty"`
+}
+
+// serveJob imports one profile on its schedule and applies its webhook
+// updates, one run at a time
+type serveJob struct {
+	schedule   *cronSchedule
+	webhookErr string     // Why the profile can't take webhook updates, if it can't
+	runMu      sync.Mutex // Held for the duration of a run
+	mu         sync.Mutex
+	status     serveJobStatus
+	pending    pendingUpdates
+}
+
+// daemon runs the scheduled imports of serve mode. Each import is a child
+// process of this binary given the profile as input, so runs can't leak state
+// into each other; what carries over between cycles is what the profile keeps
+// in its cache_dir (failed pages, the diff report's item state, cached spaces).
+type daemon struct {
+	configFile    string
+	executable    string
+	statePath     string
+	webhookSecret string
+	webhookBatch  time.Duration
+	jobs          []*serveJob
+	stateMu       sync.Mutex
+	runs          sync.WaitGroup
+	mu            sync.Mutex
+	stopping      bool
+}
+
+// serve runs the daemon until it receives SIGINT or SIGTERM, then waits for
+// the imports in progress to finish
+func serve(config *Config) error {
+	d, err := newDaemon(config)
+	if err != nil {
+		return err
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	addr := firstNonEmpty(config.ServeAddr, defaultServeAddr)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", d.handleStatus)
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("ok\n")) })
+	// Webhook updates rewrite output_file, so they're only taken when signed
+	if d.webhookSecret != "" {
+		mux.HandleFunc("/webhook/", d.handleWebhook)
+	} else {
+		fmt.Fprintf(os.Stderr, "DEBUG: No webhook_secret, webhook updates are off\n")
+	}
+	server := &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	serverErr := make(chan error, 1)
+	go func() { serverErr <- server.ListenAndServe() }()
+	fmt.Fprintf(os.Stderr, "DEBUG: Serving %d scheduled profiles, status on %s/status\n", len(d.jobs), addr)
+
+	for _, job := range d.jobs {
+		go d.schedule(ctx, job)
+	}
+
+	select {
+	case <-ctx.Done():
+	case err := <-serverErr:
+		stop()
+		d.stop()
+		return fmt.Errorf("status endpoint: %w", err)
+	}
+	fmt.Fprintf(os.Stderr, "DEBUG: Shutting down, waiting for running imports\n")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	server.Shutdown(shutdownCtx)
+	d.stop()
+	return nil
+}
+
+// startRun registers a run, unless the daemon is shutting down
+func (d *daemon) startRun() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.stopping {
+		return false
+	}
+	d.runs.Add(1)
+	return true
+}
+
+// stop refuses new runs and waits for the running ones. Webhook updates still
+// pending are dropped; the next scheduled run picks their pages up.
+func (d *daemon) stop() {
+	d.mu.Lock()
+	d.stopping = true
+	d.mu.Unlock()
+	d.runs.Wait()
+}
+
+// newDaemon loads the scheduled profiles: those named in serve_profiles, or
+// every profile of config_file with a schedule
+func newDaemon(config *Config) (*daemon, error) {
+	configFile := firstNonEmpty(config.ConfigFile, os.Getenv("IMPORT_CONFIG_FILE"))
+	if configFile == "" {
+		return nil, fmt.Errorf("mode %q needs a config_file of profiles", modeServe)
+	}
+	file, err := readProfileFile(configFile)
+	if err != nil {
+		return nil, err
+	}
+	executable, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("finding the importer binary: %w", err)
+	}
+
+	var names []string
+	if config.ServeProfiles != "" {
+		for _, name := range strings.Split(config.ServeProfiles, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, name)
+			}
+		}
+	} else {
+		for name := range file.Profiles {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	}
+
+	batch := defaultWebhookBatch
+	if config.WebhookBatchSeconds != "" && config.WebhookSecret == "" {
+		return nil, fmt.Errorf("webhook_batch_seconds is set but webhooks need webhook_secret")
+	}
+	if config.WebhookBatchSeconds != "" {
+		seconds, err := strconv.Atoi(config.WebhookBatchSeconds)
+		if err != nil || seconds < 0 {
+			return nil, fmt.Errorf("invalid webhook_batch_seconds %q", config.WebhookBatchSeconds)
+		}
+		batch = time.Duration(seconds) * time.Second
+	}
+
+	d := &daemon{configFile: configFile, executable: executable, statePath: config.ServeStateFile, webhookSecret: config.WebhookSecret, webhookBatch: batch}
+	previous := d.loadState()
+	for _, name := range names {
+		input, err := applyProfile(map[string]interface{}{"config_file": configFile, "profile": name})
+		if err != nil {
+			return nil, err
+		}
+		spec := stringValue(input["schedule"])
+		if spec == "" {
+			if config.ServeProfiles != "" {
+				return nil, fmt.Errorf("profile %q has no schedule", name)
+			}
+			continue
+		}
+		schedule, err := parseCron(spec)
+		if err != nil {
+			return nil, fmt.Errorf("profile %q: %w", name, err)
+		}
+		if stringValue(input["SHAREPOINT_SITE_URL"]) != "" {
+			return nil, fmt.Errorf("profile %q is a SharePoint import, which serve mode can't run", name)
+		}
+		if stringValue(input["mode"]) == modeServe {
+			return nil, fmt.Errorf("profile %q can't itself use mode %q", name, modeServe)
+		}
+		// Items printed on stdout go nowhere in serve mode
+		if stringValue(input["output_file"]) == "" && stringValue(input["sinks"]) == "" {
+			return nil, fmt.Errorf("profile %q needs output_file or sinks to keep its items in serve mode", name)
+		}
+		job := &serveJob{schedule: schedule, status: previous[name]}
+		job.status.Profile, job.status.Schedule, job.status.Running, job.status.PendingUpdates = name, spec, false, 0
+		// Webhook updates merge into output_file like retry_failed does
+		switch {
+		case stringValue(input["output_file"]) == "":
+			job.webhookErr = fmt.Sprintf("profile %q has no output_file for webhook updates to merge into", name)
+		case stringValue(input["sinks"]) != "" || stringValue(input["routes"]) != "" || stringValue(input["encryption"]) == encryptionAge:
+			job.webhookErr = fmt.Sprintf("profile %q uses sinks, routes or age encryption, which webhook updates can't merge into", name)
+		}
+		d.jobs = append(d.jobs, job)
+	}
+	if len(d.jobs) == 0 {
+		return nil, fmt.Errorf("no profile in %s has a schedule", configFile)
+	}
+	return d, nil
+}
+
+// schedule runs a job at each time its schedule fires. A job that never ran,
+// or missed a run while the daemon was down, runs at once.
+func (d *daemon) schedule(ctx context.Context, job *serveJob) {
+	job.mu.Lock()
+	next := time.Now()
+	if started, err := time.Parse(time.RFC3339, job.status.LastStarted); err == nil {
+		// Schedules are in local time
+		if missed := job.schedule.next(started.Local()); missed.After(next) {
+			next = missed
+		}
+	}
+	job.mu.Unlock()
+
+	for {
+		job.mu.Lock()
+		job.status.NextRun = next.Format(time.RFC3339)
+		job.mu.Unlock()
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		d.run(job)
+		// Runs that overlap a scheduled time skip it rather than queueing up
+		next = job.schedule.next(time.Now())
+		if next.IsZero() {
+			return
+		}
+	}
+}
+
+// run imports a job's profile in a child process and records the outcome
+func (d *daemon) run(job *serveJob) {
+	if !d.startRun() {
+		return
+	}
+	defer d.runs.Done()
+	job.runMu.Lock()
+	defer job.runMu.Unlock()
+	job.mu.Lock()
+	name := job.status.Profile
+	job.status.Running = true
+	job.status.LastStarted = time.Now().UTC().Format(time.RFC3339)
+	job.mu.Unlock()
+	d.saveState()
+	fmt.Fprintf(os.Stderr, "DEBUG: Starting scheduled import of profile %q\n", name)
+
+	result, outcome, message := d.runChild(map[string]string{}, name)
+
+	job.mu.Lock()
+	job.status.Running = false
+	job.status.LastFinished = time.Now().UTC().Format(time.RFC3339)
+	job.status.LastStatus, job.status.LastError, job.status.LastItemCount = outcome, message, result.ItemCount
+	job.status.Runs++
+	job.mu.Unlock()
+	d.saveState()
+	fmt.Fprintf(os.Stderr, "DEBUG: Scheduled import of profile %q finished: %s\n", name, strings.TrimSpace(outcome+" "+message))
+}
+
+// runChild runs the importer on a profile, with input overriding the
+// profile's options, and returns its result and outcome
+func (d *daemon) runChild(input map[string]string, profile string) (Result, string, string) {
+	input["config_file"], input["profile"] = d.configFile, profile
+	data, _ := json.Marshal(input)
+	cmd := exec.Command(d.executable)
+	cmd.Stdin = bytes.NewReader(data)
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = os.Stderr
+	// The child finishes its run on shutdown instead of receiving our signal
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	runErr := cmd.Run()
+
+	var result Result
+	parseErr := json.Unmarshal(stdout.Bytes(), &result)
+	switch {
+	case parseErr == nil && result.Error != "":
+		return result, serveRunFailed, result.Error
+	case runErr != nil:
+		return result, serveRunFailed, runErr.Error()
+	case parseErr != nil:
+		return result, serveRunFailed, fmt.Sprintf("unreadable result: %v", parseErr)
+	case result.Partial != "":
+		return result, serveRunPartial, result.Partial
+	}
+	return result, serveRunOK, ""
+}
+
+// job returns the job of a served profile
+func (d *daemon) job(profile string) *serveJob {
+	for _, job := range d.jobs {
+		if job.status.Profile == profile {
+			return job
+		}
+	}
+	return nil
+}
+
+// statuses returns a snapshot of every job's status
+func (d *daemon) statuses() []serveJobStatus {
+	statuses := make([]serveJobStatus, len(d.jobs))
+	for i, job := range d.jobs {
+		job.mu.Lock()
+		statuses[i] = job.status
+		job.mu.Unlock()
+	}
+	return statuses
+}
+
+func (d *daemon) handleStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"profiles": d.statuses()})
+}
+
+// loadState reads serve_state_file, so run history survives restarts
+func (d *daemon) loadState() map[string]serveJobStatus {
+	state := map[string]serveJobStatus{}
+	if d.statePath == "" {
+		return state
+	}
+	data, err := os.ReadFile(d.statePath)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			fmt.Fprintf(os.Stderr, "DEBUG: Failed to read serve_state_file, starting afresh: %v\n", err)
+		}
+		return state
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		fmt.Fprintf(os.Stderr, "DEBUG: Failed to parse serve_state_file, starting afresh: %v\n", err)
+	}
+	return state
+}
+
+// saveState writes every job's status to serve_state_file
+func (d *daemon) saveState() {
+	if d.statePath == "" {
+		return
+	}
+	d.stateMu.Lock()
+	defer d.stateMu.Unlock()
+	state := map[string]serveJobStatus{}
+	for _, status := range d.statuses() {
+		state[status.Profile] = status
+	}
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err == nil {
+		err = os.WriteFile(d.statePath+".tmp", data, 0o644)
+	}
+	if err == nil {
+		err = os.Rename(d.statePath+".tmp", d.statePath)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "DEBUG: Failed to write serve_state_file: %v\n", err)
+	}
+}
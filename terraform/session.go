@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"strings"
+)
+
+// loginPath is where Data Center redirects requests whose session expired
+const loginPath = "/login.action"
+
+// installSessionCookie puts the cookies of session_cookie, e.g.
+// "JSESSIONID=...; crowd.token_key=...", in the HTTP client's cookie jar for
+// the Confluence host. For instances where API tokens and Basic auth are
+// disabled. The jar also keeps the cookies the server renews with Set-Cookie.
+func installSessionCookie(baseURL, header string) error {
+	cookies, err := http.ParseCookie(strings.TrimSpace(header))
+	if err != nil {
+		return fmt.Errorf("invalid session_cookie (expected name=value pairs separated by \"; \"): %w", err)
+	}
+	base, err := url.Parse(baseURL)
+	if err != nil || base.Host == "" {
+		return fmt.Errorf("session_cookie needs a valid CONFLUENCE_URL")
+	}
+	if httpClient.Jar == nil {
+		jar, err := cookiejar.New(nil)
+		if err != nil {
+			return err
+		}
+		httpClient.Jar = jar
+	}
+	for _, cookie := range cookies {
+		// Data Center scopes its session cookies to the context path or the root
+		cookie.Path = "/"
+	}
+	httpClient.Jar.SetCookies(&url.URL{Scheme: base.Scheme, Host: base.Host, Path: "/"}, cookies)
+	return nil
+}
+
+// sessionExpired reports whether a request was redirected to the login page,
+// which is how an expired session shows up instead of a 401
+func sessionExpired(resp *http.Response) bool {
+	return resp.Request != nil && strings.HasSuffix(resp.Request.URL.Path, loginPath)
+}
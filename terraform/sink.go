@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+)
+
+// Default channel capacities between the page feeder, the workers and the collector
+const (
+	defaultPageBuffer   = 100
+	defaultResultBuffer = 100
+)
+
+// itemSink receives items as workers finish them. Close flushes the sink and
+// returns the Result printed on stdout.
+type itemSink interface {
+	Write(item *ProcessedItem) error
+	Close() (Result, error)
+	Count() int
+}
+
+// newItemSink returns the sink selected by output_file: a JSON Lines file that
+// keeps memory flat however many pages are imported, or by default the items
+// string of the stdout Result, which Terraform needs in one piece. The sinks
+// option writes to several at once.
+func newItemSink(config *Config) (itemSink, error) {
+	if config.Sinks != "" {
+		return newFanoutSink(config)
+	}
+	if config.OutputFile == "" {
+		return &resultSink{schemaVersion: config.SchemaVersion}, nil
+	}
+	sink, err := newFileSink(config, config.OutputFile)
+	if err != nil {
+		return nil, fmt.Errorf("creating output_file: %w", err)
+	}
+	return sink, nil
+}
+
+// newFileSink creates a JSON Lines file at path, encrypted when encryption is set
+func newFileSink(config *Config, path string) (*fileSink, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	out, err := encryptOutput(config, file)
+	if err != nil {
+		file.Close()
+		os.Remove(path)
+		return nil, err
+	}
+	return &fileSink{file: out, writer: bufio.NewWriter(out), path: path, schemaVersion: config.SchemaVersion}, nil
+}
+
+// validateBuffers checks the channel capacity options
+func validateBuffers(config *Config) error {
+	if config.PageBuffer < 0 || config.ResultBuffer < 0 {
+		return fmt.Errorf("page_buffer and result_buffer must not be negative")
+	}
+	return nil
+}
+
+// resultSink collects every item for the items field of the Result
+type resultSink struct {
+	items         []interface{}
+	schemaVersion string
+}
+
+func (s *resultSink) Write(item *ProcessedItem) error {
+	s.items = append(s.items, encodeItem(item, s.schemaVersion))
+	return nil
+}
+
+func (s *resultSink) Count() int { return len(s.items) }
+
+func (s *resultSink) Close() (Result, error) {
+	itemsJSON, err := json.Marshal(s.items)
+	if err != nil {
+		return Result{}, fmt.Errorf("failed to marshal items: %w", err)
+	}
+	return Result{Items: string(itemsJSON)}, nil
+}
+
+// fileSink streams items to a file, one JSON object per line
+type fileSink struct {
+	file          io.WriteCloser // The file, or an encrypting writer over it
+	writer        *bufio.Writer
+	path          string
+	count         int
+	finalPath     string // Renamed to on Close when path is a temporary file
+	schemaVersion string
+}
+
+func (s *fileSink) Write(item *ProcessedItem) error {
+	line, err := json.Marshal(encodeItem(item, s.schemaVersion))
+	if err != nil {
+		return fmt.Errorf("marshaling item %s: %w", item.ID, err)
+	}
+	if _, err := s.writer.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("writing output_file: %w", err)
+	}
+	s.count++
+	return nil
+}
+
+func (s *fileSink) Count() int { return s.count }
+
+func (s *fileSink) Close() (Result, error) {
+	flushErr := s.writer.Flush()
+	closeErr := s.file.Close()
+	if flushErr != nil {
+		return Result{}, fmt.Errorf("writing output_file: %w", flushErr)
+	}
+	if closeErr != nil {
+		return Result{}, fmt.Errorf("closing output_file: %w", closeErr)
+	}
+	path := s.path
+	if s.finalPath != "" {
+		if err := os.Rename(s.path, s.finalPath); err != nil {
+			return Result{}, fmt.Errorf("replacing output_file: %w", err)
+		}
+		path = s.finalPath
+	}
+	// Terraform's external data source only accepts string values
+	return Result{Items: "[]", OutputFile: path, ItemCount: strconv.Itoa(s.count)}, nil
+}
+
+// pageResult is what a worker produced for one page: its items, possibly none
+type pageResult struct {
+	sequence int
+	pageID   string
+	version  *listedVersion // As listed, recorded in state_file
+	items    []*ProcessedItem
+	failed   bool
+}
+
+// resultCollector hands worker results to the sink. With preserve_order it
+// holds results back until every earlier page is done, so items come out in
+// listing order rather than completion order.
+type resultCollector struct {
+	sink    itemSink
+	ordered bool
+	next    int                 // Sequence number the ordered output waits for
+	pending map[int]*pageResult // Finished pages ahead of next
+}
+
+func newResultCollector(config *Config, sink itemSink) *resultCollector {
+	return &resultCollector{sink: sink, ordered: config.PreserveOrder == "true", pending: map[int]*pageResult{}}
+}
+
+func (c *resultCollector) add(result *pageResult) error {
+	if !c.ordered {
+		return c.write(result.items)
+	}
+	c.pending[result.sequence] = result
+	for {
+		ready, ok := c.pending[c.next]
+		if !ok {
+			return nil
+		}
+		delete(c.pending, c.next)
+		c.next++
+		if err := c.write(ready.items); err != nil {
+			return err
+		}
+	}
+}
+
+// flush writes results still held back, which happens when pages before them
+// were never processed, e.g. after the memory watchdog stopped the run
+func (c *resultCollector) flush() error {
+	sequences := make([]int, 0, len(c.pending))
+	for sequence := range c.pending {
+		sequences = append(sequences, sequence)
+	}
+	sort.Ints(sequences)
+	for _, sequence := range sequences {
+		if err := c.write(c.pending[sequence].items); err != nil {
+			return err
+		}
+		delete(c.pending, sequence)
+	}
+	return nil
+}
+
+func (c *resultCollector) write(items []*ProcessedItem) error {
+	for _, item := range items {
+		if err := c.sink.Write(item); err != nil {
+			return err
+		}
+	}
+	return nil
+}
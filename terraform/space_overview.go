@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// spaceInfo is the part of a space that describes what it's for
+type spaceInfo struct {
+	Name        string
+	Description string
+	HomepageID  string
+}
+
+// fetchSpaceOverviews builds one space_overview item per configured space from
+// its description and homepage, so the corpus says what each space is for even
+// when limits leave the homepage out of the page crawl
+func fetchSpaceOverviews(config *Config, source Source, converter *HTMLConverter) []*ProcessedItem {
+	var items []*ProcessedItem
+	for _, spaceKey := range parseSpaceKeys(config) {
+		info, err := fetchSpaceInfo(config, spaceKey)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "DEBUG: Failed to get overview for space %s: %v\n", spaceKey, err)
+			continue
+		}
+
+		var sections []string
+		if description := strings.TrimSpace(info.Description); description != "" {
+			sections = append(sections, description)
+		}
+		if info.HomepageID != "" {
+			homepage, err := source.FetchContent(context.Background(), config, Page{ID: info.HomepageID, Type: "page", SpaceKey: spaceKey})
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "DEBUG: Failed to get homepage of space %s: %v\n", spaceKey, err)
+			} else if text := strings.TrimSpace(converter.htmlToText(homepage.Body.Storage.Value)); text != "" {
+				sections = append(sections, text)
+			}
+		}
+		if len(sections) == 0 {
+			fmt.Fprintf(os.Stderr, "DEBUG: Space %s has no description or homepage content\n", spaceKey)
+			continue
+		}
+
+		content := strings.Join(sections, "\n\n")
+		if len(content) > config.MaxContentLength {
+			content = content[:config.MaxContentLength] + "\n\n[Content truncated due to size limits]"
+		}
+		items = append(items, &ProcessedItem{
+			ID:       "space-" + spaceKey,
+			Title:    firstNonEmpty(info.Name, spaceKey),
+			Content:  content,
+			Type:     "space_overview",
+			SpaceKey: spaceKey,
+		})
+	}
+
+	fmt.Fprintf(os.Stderr, "DEBUG: Added %d space overviews\n", len(items))
+	return items
+}
+
+// fetchSpaceInfo reads a space's name, plain-text description and homepage
+func fetchSpaceInfo(config *Config, spaceKey string) (*spaceInfo, error) {
+	baseURL := strings.TrimSuffix(config.ConfluenceURL, "/")
+
+	if config.APIVersion == apiVersionV2 {
+		body, err := fetchWithPolicy(config, opSpaceLookup, fmt.Sprintf("%s/api/v2/spaces?keys=%s&description-format=plain", baseURL, url.QueryEscape(spaceKey)))
+		if err != nil {
+			return nil, err
+		}
+		var response struct {
+			Results []struct {
+				Name        string `json:"name"`
+				HomepageID  string `json:"homepageId"`
+				Description struct {
+					Plain struct {
+						Value string `json:"value"`
+					} `json:"plain"`
+				} `json:"description"`
+			} `json:"results"`
+		}
+		if err := json.Unmarshal(body, &response); err != nil {
+			return nil, fmt.Errorf("parsing space response: %w", err)
+		}
+		if len(response.Results) == 0 {
+			return nil, fmt.Errorf("space %s not found", spaceKey)
+		}
+		space := response.Results[0]
+		return &spaceInfo{Name: space.Name, Description: space.Description.Plain.Value, HomepageID: space.HomepageID}, nil
+	}
+
+	body, err := fetchWithPolicy(config, opSpaceLookup, fmt.Sprintf("%s/rest/api/space/%s?expand=description.plain,homepage", baseURL, url.PathEscape(spaceKey)))
+	if err != nil {
+		return nil, err
+	}
+	var space struct {
+		Name        string `json:"name"`
+		Description struct {
+			Plain struct {
+				Value string `json:"value"`
+			} `json:"plain"`
+		} `json:"description"`
+		Homepage struct {
+			ID string `json:"id"`
+		} `json:"homepage"`
+	}
+	if err := json.Unmarshal(body, &space); err != nil {
+		return nil, fmt.Errorf("parsing space response: %w", err)
+	}
+	return &spaceInfo{Name: space.Name, Description: space.Description.Plain.Value, HomepageID: space.Homepage.ID}, nil
+}
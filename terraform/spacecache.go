@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// spaceCacheFile is the file in cache_dir holding resolved spaces
+const spaceCacheFile = "spaces.json"
+
+// errSpaceNotFound is returned by resolveSpace for a space key the instance doesn't have
+var errSpaceNotFound = errors.New("space not found")
+
+// cachedSpace is a resolved space key with the metadata returned by the lookup
+type cachedSpace struct {
+	ID       string    `json:"id"`
+	Key      string    `json:"key"`
+	Name     string    `json:"name,omitempty"`
+	Type     string    `json:"type,omitempty"`
+	Resolved time.Time `json:"resolved"`
+}
+
+// spaceCache persists space lookups across runs so scheduled imports skip the
+// per-space round trip and keep working while the spaces endpoint is down. A
+// nil cache is valid and caches nothing.
+type spaceCache struct {
+	path   string
+	maxAge time.Duration
+	spaces map[string]cachedSpace // Instance URL + "|" + space key -> space
+	dirty  bool
+}
+
+// loadSpaceCache reads the space cache from cache_dir, starting empty when the
+// file doesn't exist yet or can't be parsed
+func loadSpaceCache(config *Config) *spaceCache {
+	if config.CacheDir == "" {
+		return nil
+	}
+	cache := &spaceCache{
+		path:   filepath.Join(config.CacheDir, spaceCacheFile),
+		maxAge: time.Duration(config.SpaceCacheHours) * time.Hour,
+		spaces: map[string]cachedSpace{},
+	}
+	data, err := os.ReadFile(cache.path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			fmt.Fprintf(os.Stderr, "DEBUG: Failed to read space cache %s: %v\n", cache.path, err)
+		}
+		return cache
+	}
+	if err := json.Unmarshal(data, &cache.spaces); err != nil {
+		fmt.Fprintf(os.Stderr, "DEBUG: Ignoring unreadable space cache %s: %v\n", cache.path, err)
+		cache.spaces = map[string]cachedSpace{}
+	}
+	fmt.Fprintf(os.Stderr, "DEBUG: Loaded %d cached spaces from %s\n", len(cache.spaces), cache.path)
+	return cache
+}
+
+// validateSpaceCache checks the space cache options
+func validateSpaceCache(config *Config) error {
+	if config.SpaceCacheHours < 0 {
+		return fmt.Errorf("space_cache_hours must not be negative")
+	}
+	if config.CacheDir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(config.CacheDir, 0o755); err != nil {
+		return fmt.Errorf("creating cache_dir: %w", err)
+	}
+	return nil
+}
+
+func spaceCacheKey(config *Config, spaceKey string) string {
+	return strings.TrimSuffix(config.ConfluenceURL, "/") + "|" + spaceKey
+}
+
+// save writes the cache back if a lookup changed it, replacing the file
+// atomically so an interrupted run can't leave it truncated
+func (c *spaceCache) save() {
+	if c == nil || !c.dirty {
+		return
+	}
+	data, err := json.MarshalIndent(c.spaces, "", "  ")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "DEBUG: Failed to encode space cache: %v\n", err)
+		return
+	}
+	tmp := c.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		fmt.Fprintf(os.Stderr, "DEBUG: Failed to write space cache: %v\n", err)
+		return
+	}
+	if err := os.Rename(tmp, c.path); err != nil {
+		fmt.Fprintf(os.Stderr, "DEBUG: Failed to write space cache: %v\n", err)
+		return
+	}
+	c.dirty = false
+}
+
+// resolveSpace returns a space's ID and metadata, from the cache while the
+// entry is younger than space_cache_hours. When the lookup fails for any reason
+// other than the space not existing, an older cached entry is used instead.
+// v1 selects the v1 space endpoint, for Data Center and the v1 listings.
+func resolveSpace(config *Config, spaceKey string, v1 bool) (cachedSpace, error) {
+	cache := config.SpaceCache
+	var cached cachedSpace
+	found := false
+	if cache != nil {
+		cached, found = cache.spaces[spaceCacheKey(config, spaceKey)]
+		if found && time.Since(cached.Resolved) < cache.maxAge {
+			fmt.Fprintf(os.Stderr, "DEBUG: Using cached space ID %s for space key: %s\n", cached.ID, spaceKey)
+			return cached, nil
+		}
+	}
+
+	lookup := lookupSpaceV2
+	if v1 {
+		lookup = lookupSpaceV1
+	}
+	space, err := lookup(config, spaceKey)
+	if errors.Is(err, errSpaceNotFound) && strings.HasPrefix(spaceKey, personalSpacePrefix) {
+		if personalKey, ok := personalSpaceKey(config, strings.TrimPrefix(spaceKey, personalSpacePrefix)); ok && personalKey != spaceKey {
+			fmt.Fprintf(os.Stderr, "DEBUG: Personal space %s has the key %s\n", spaceKey, personalKey)
+			space, err = lookup(config, personalKey)
+		}
+	}
+	if err != nil {
+		if found && !errors.Is(err, errSpaceNotFound) {
+			fmt.Fprintf(os.Stderr, "DEBUG: Space lookup for %s failed (%v), using the ID cached %s\n", spaceKey, err, cached.Resolved.Format(time.RFC3339))
+			return cached, nil
+		}
+		return cachedSpace{}, err
+	}
+
+	if cache != nil {
+		space.Resolved = time.Now().UTC()
+		cache.spaces[spaceCacheKey(config, spaceKey)] = space
+		cache.dirty = true
+	}
+	return space, nil
+}
+
+func lookupSpaceV2(config *Config, spaceKey string) (cachedSpace, error) {
+	spaceInfoURL := fmt.Sprintf("%s/api/v2/spaces?keys=%s", strings.TrimSuffix(config.ConfluenceURL, "/"), url.QueryEscape(spaceKey))
+	fmt.Fprintf(os.Stderr, "DEBUG: Getting space ID from: %s\n", spaceInfoURL)
+
+	body, err := fetchWithPolicy(config, opSpaceLookup, spaceInfoURL)
+	if err != nil {
+		return cachedSpace{}, err
+	}
+	var response struct {
+		Results []cachedSpace `json:"results"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil {
+		return cachedSpace{}, fmt.Errorf("parsing space response: %w", err)
+	}
+	if len(response.Results) == 0 {
+		return cachedSpace{}, errSpaceNotFound
+	}
+	return response.Results[0], nil
+}
+
+func lookupSpaceV1(config *Config, spaceKey string) (cachedSpace, error) {
+	body, err := fetchWithPolicy(config, opSpaceLookup, fmt.Sprintf("%s/rest/api/space/%s", strings.TrimSuffix(config.ConfluenceURL, "/"), url.PathEscape(spaceKey)))
+	if err != nil {
+		if isNotFound(err) {
+			return cachedSpace{}, errSpaceNotFound
+		}
+		return cachedSpace{}, err
+	}
+	var response struct {
+		ID   json.Number `json:"id"`
+		Key  string      `json:"key"`
+		Name string      `json:"name"`
+		Type string      `json:"type"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil {
+		return cachedSpace{}, fmt.Errorf("parsing space response: %w", err)
+	}
+	return cachedSpace{ID: response.ID.String(), Key: response.Key, Name: response.Name, Type: response.Type}, nil
+}
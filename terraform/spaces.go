@@ -0,0 +1,311 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// maxSpaceSuggestions caps how many close matches are offered for an unknown key
+const maxSpaceSuggestions = 3
+
+// Space types space_types selects from
+const (
+	spaceTypeGlobal   = "global"
+	spaceTypePersonal = "personal"
+)
+
+// personalSpacePrefix starts the key of every personal space, followed by the
+// owner's username on Data Center or a form of the account ID on Cloud
+const personalSpacePrefix = "~"
+
+// listVisibleSpaceKeys returns the keys of every space the credential can see
+func listVisibleSpaceKeys(config *Config) ([]string, error) {
+	return listSpaceKeys(config, "", nil)
+}
+
+// discoverSpaceKeys returns the keys of the visible spaces of the space_types,
+// only those labelled with category when it isn't empty
+func discoverSpaceKeys(config *Config, category string) ([]string, error) {
+	return listSpaceKeys(config, category, parseSpaceTypes(config))
+}
+
+// listSpaceKeys returns the keys of the visible spaces, only those labelled
+// with category when it isn't empty and those of the types when given
+func listSpaceKeys(config *Config, category string, types []string) ([]string, error) {
+	if config.APIVersion == apiVersionV1 {
+		return listVisibleSpaceKeysV1(config, category, types)
+	}
+
+	var keys []string
+	endpoint := "/api/v2/spaces?limit=250"
+	if category != "" {
+		endpoint += "&labels=" + url.QueryEscape(category)
+	}
+
+	for endpoint != "" {
+		body, err := fetchWithPolicy(config, opSpaceLookup, strings.TrimSuffix(config.ConfluenceURL, "/")+endpoint)
+		if err != nil {
+			return nil, fmt.Errorf("listing spaces: %w", err)
+		}
+
+		var response struct {
+			Results []struct {
+				Key  string `json:"key"`
+				Type string `json:"type"`
+			} `json:"results"`
+			Links struct {
+				Next string `json:"next"`
+			} `json:"_links"`
+		}
+		if err := json.Unmarshal(body, &response); err != nil {
+			return nil, fmt.Errorf("parsing spaces response: %w", err)
+		}
+
+		for _, space := range response.Results {
+			if len(types) == 0 || slices.Contains(types, space.Type) {
+				keys = append(keys, space.Key)
+			}
+		}
+		endpoint = strings.TrimPrefix(response.Links.Next, "/wiki")
+	}
+	return keys, nil
+}
+
+// allSpaces is the space_keys entry selecting every visible space
+const allSpaces = "*"
+
+// parseSpaceTypes returns the space_types, or nil for every type
+func parseSpaceTypes(config *Config) []string {
+	var types []string
+	for _, spaceType := range strings.Split(config.SpaceTypes, ",") {
+		if spaceType = strings.ToLower(strings.TrimSpace(spaceType)); spaceType != "" {
+			types = append(types, spaceType)
+		}
+	}
+	return types
+}
+
+// validateSpaceTypes checks the space_types option
+func validateSpaceTypes(config *Config) error {
+	for _, spaceType := range parseSpaceTypes(config) {
+		if spaceType != spaceTypeGlobal && spaceType != spaceTypePersonal {
+			return fmt.Errorf("invalid space_types entry %q (expected %q or %q)", spaceType, spaceTypeGlobal, spaceTypePersonal)
+		}
+	}
+	return nil
+}
+
+// personalSpaceKey looks up the key of a user's personal space, the user given
+// by Cloud account ID or Data Center username
+func personalSpaceKey(config *Config, user string) (string, bool) {
+	baseURL := strings.TrimSuffix(config.ConfluenceURL, "/")
+	for _, param := range []string{"accountId", "username"} {
+		body, err := fetchWithPolicy(config, opSpaceLookup, fmt.Sprintf("%s/rest/api/user?%s=%s&expand=personalSpace", baseURL, param, url.QueryEscape(user)))
+		if err != nil {
+			continue
+		}
+		var response struct {
+			PersonalSpace struct {
+				Key string `json:"key"`
+			} `json:"personalSpace"`
+		}
+		if json.Unmarshal(body, &response) == nil && response.PersonalSpace.Key != "" {
+			return response.PersonalSpace.Key, true
+		}
+	}
+	return "", false
+}
+
+// resolveAllSpaces replaces a "*" in space_keys with the key of every visible
+// space, so spaces teams add are imported without editing the list
+func resolveAllSpaces(config *Config) error {
+	keys := parseSpaceKeys(config)
+	if !slices.Contains(keys, allSpaces) {
+		return nil
+	}
+	visible, err := discoverSpaceKeys(config, "")
+	if err != nil {
+		return fmt.Errorf("resolving space_keys %q: %w", allSpaces, err)
+	}
+	fmt.Fprintf(os.Stderr, "DEBUG: space_keys %q matched %d visible space(s)\n", allSpaces, len(visible))
+	selected := make(map[string]bool, len(keys)+len(visible))
+	var resolved []string
+	for _, key := range append(keys, visible...) {
+		if key != allSpaces && !selected[key] {
+			selected[key] = true
+			resolved = append(resolved, key)
+		}
+	}
+	if len(resolved) == 0 {
+		return fmt.Errorf("space_keys %q matched no visible spaces", allSpaces)
+	}
+	config.SpaceKeys = strings.Join(resolved, ",")
+	return nil
+}
+
+// spaceExcluded reports whether exclude_space_keys names the space. Keys are
+// compared case-insensitively.
+func spaceExcluded(config *Config, key string) bool {
+	for _, excluded := range strings.Split(config.ExcludeSpaceKeys, ",") {
+		if excluded = strings.TrimSpace(excluded); excluded != "" && strings.EqualFold(excluded, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// excludeSpaces drops the exclude_space_keys from the resolved space keys
+func excludeSpaces(config *Config) error {
+	if config.ExcludeSpaceKeys == "" || len(parseSpaceKeys(config)) == 0 {
+		return nil
+	}
+	var kept, dropped []string
+	for _, key := range parseSpaceKeys(config) {
+		if spaceExcluded(config, key) {
+			dropped = append(dropped, key)
+		} else {
+			kept = append(kept, key)
+		}
+	}
+	fmt.Fprintf(os.Stderr, "DEBUG: Excluded %d space(s): %v\n", len(dropped), dropped)
+	if len(kept) == 0 {
+		return fmt.Errorf("exclude_space_keys leaves no spaces to import")
+	}
+	config.SpaceKeys, config.SpaceKey = strings.Join(kept, ","), ""
+	return nil
+}
+
+// resolveSpaceCategories adds the spaces labelled with any of the
+// space_categories to the configured space keys, so which spaces are imported
+// can be managed in Confluence
+func resolveSpaceCategories(config *Config) error {
+	if config.SpaceCategories == "" {
+		return nil
+	}
+	keys := parseSpaceKeys(config)
+	selected := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		selected[key] = true
+	}
+	for _, category := range strings.Split(config.SpaceCategories, ",") {
+		if category = strings.TrimSpace(category); category == "" {
+			continue
+		}
+		categoryKeys, err := discoverSpaceKeys(config, category)
+		if err != nil {
+			return fmt.Errorf("resolving space category %s: %w", category, err)
+		}
+		fmt.Fprintf(os.Stderr, "DEBUG: Space category %s has %d space(s): %v\n", category, len(categoryKeys), categoryKeys)
+		for _, key := range categoryKeys {
+			if !selected[key] {
+				selected[key] = true
+				keys = append(keys, key)
+			}
+		}
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("no visible spaces have the space categories %s", config.SpaceCategories)
+	}
+	config.SpaceKeys = strings.Join(keys, ",")
+	return nil
+}
+
+// unknownSpaceError builds the error for a space key that could not be resolved,
+// suggesting visible spaces with similar keys when there are any
+func unknownSpaceError(config *Config, spaceKey string) error {
+	visible, err := listVisibleSpaceKeys(config)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "DEBUG: Could not list spaces for suggestions: %v\n", err)
+	}
+
+	suggestions := suggestSpaceKeys(spaceKey, visible)
+	if len(suggestions) == 0 {
+		return fmt.Errorf("space '%s' not found or not visible to this user", spaceKey)
+	}
+
+	quoted := make([]string, len(suggestions))
+	for i, suggestion := range suggestions {
+		quoted[i] = "'" + suggestion + "'"
+	}
+	options := quoted[0]
+	if len(quoted) > 1 {
+		options = strings.Join(quoted[:len(quoted)-1], ", ") + " or " + quoted[len(quoted)-1]
+	}
+	return fmt.Errorf("space '%s' not found; did you mean %s?", spaceKey, options)
+}
+
+// suggestSpaceKeys returns the candidates closest to key, best match first.
+// Keys are compared case-insensitively with punctuation removed, so "ENGOPS"
+// matches "ENG-OPS" exactly and "ENGOPS2" by a single edit.
+func suggestSpaceKeys(key string, candidates []string) []string {
+	type match struct {
+		key      string
+		distance int
+	}
+
+	normalizedKey := normalizeSpaceKey(key)
+	threshold := max(1, len(normalizedKey)/3)
+
+	var matches []match
+	for _, candidate := range candidates {
+		if candidate == key {
+			continue
+		}
+		normalized := normalizeSpaceKey(candidate)
+		distance := levenshtein(normalizedKey, normalized)
+		if distance <= threshold || (normalizedKey != "" && strings.HasPrefix(normalized, normalizedKey)) {
+			matches = append(matches, match{key: candidate, distance: distance})
+		}
+	}
+
+	sort.SliceStable(matches, func(i, j int) bool {
+		if matches[i].distance != matches[j].distance {
+			return matches[i].distance < matches[j].distance
+		}
+		return matches[i].key < matches[j].key
+	})
+
+	var suggestions []string
+	for _, m := range matches[:min(maxSpaceSuggestions, len(matches))] {
+		suggestions = append(suggestions, m.key)
+	}
+	return suggestions
+}
+
+func normalizeSpaceKey(key string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return unicode.ToUpper(r)
+		}
+		return -1
+	}, key)
+}
+
+// levenshtein returns the edit distance between two strings
+func levenshtein(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	previous := make([]int, len(rb)+1)
+	current := make([]int, len(rb)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+
+	for i := 1; i <= len(ra); i++ {
+		current[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			current[j] = min(min(previous[j]+1, current[j-1]+1), previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+	return previous[len(rb)]
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+)
+
+// Actions of an incremental run's items
+const (
+	actionAdded   = "added"
+	actionUpdated = "updated"
+	actionDeleted = "deleted"
+)
+
+// pageState is what state_file remembers about a page, or about an extra item
+// (template, space overview) keyed by its item ID
+type pageState struct {
+	Version  int         `json:"version,omitempty"`
+	Modified string      `json:"modified,omitempty"`
+	Hash     string      `json:"hash"` // Of the title, labels and content of every item
+	Items    []stateItem `json:"items"`
+}
+
+// stateItem is an item a page produced, kept to emit it as deleted later
+type stateItem struct {
+	ID       string `json:"id"`
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	SpaceKey string `json:"space_key"`
+}
+
+// syncState compares a run against the pages of the last run recorded in
+// state_file. Pages whose listed version didn't change aren't fetched, pages
+// whose content didn't change emit nothing, and the items that are emitted
+// carry an action for downstream indexes to apply.
+type syncState struct {
+	path     string
+	mu       sync.Mutex
+	previous map[string]pageState
+	current  map[string]pageState
+	listed   map[string]bool
+}
+
+// validateStateFile checks that state_file is combined with options it supports
+func validateStateFile(config *Config) error {
+	if config.StateFile == "" {
+		return nil
+	}
+	switch {
+	case mergesIntoOutput(config):
+		return fmt.Errorf("state_file can't be combined with mode %q", config.Mode)
+	case config.QueueDir != "":
+		return fmt.Errorf("state_file can't be combined with queue_dir")
+	}
+	return nil
+}
+
+// openSyncState reads state_file, which is missing before the first run. It
+// returns nil without state_file.
+func openSyncState(config *Config) (*syncState, error) {
+	if config.StateFile == "" {
+		return nil, nil
+	}
+	s := &syncState{path: config.StateFile, previous: map[string]pageState{}, current: map[string]pageState{}, listed: map[string]bool{}}
+	data, err := os.ReadFile(config.StateFile)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		fmt.Fprintf(os.Stderr, "DEBUG: No state_file yet, every item is added\n")
+		return s, nil
+	case err != nil:
+		return nil, fmt.Errorf("reading state_file: %w", err)
+	}
+	var state struct {
+		Pages map[string]pageState `json:"pages"`
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("parsing state_file: %w", err)
+	}
+	if state.Pages != nil {
+		s.previous = state.Pages
+	}
+	fmt.Fprintf(os.Stderr, "DEBUG: Loaded the state of %d pages from %s\n", len(s.previous), config.StateFile)
+	return s, nil
+}
+
+// changed returns the listed pages to fetch: those the last run didn't see,
+// and those whose listed version differs from the one it recorded. Pages the
+// listing gave no version for are fetched and compared by content.
+func (s *syncState) changed(pages []Page) []Page {
+	if s == nil {
+		return pages
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fetch := pages[:0]
+	for _, page := range pages {
+		s.listed[page.ID] = true
+		old, known := s.previous[page.ID]
+		if known && page.Version != nil && sameRevision(old, page) {
+			s.current[page.ID] = old
+			continue
+		}
+		fetch = append(fetch, page)
+	}
+	if skipped := len(pages) - len(fetch); skipped > 0 {
+		fmt.Fprintf(os.Stderr, "DEBUG: Skipping %d pages unchanged since the last run\n", skipped)
+	}
+	return fetch
+}
+
+func sameRevision(old pageState, page Page) bool {
+	if page.Version.Number > 0 {
+		return old.Version == page.Version.Number
+	}
+	modified := firstNonEmpty(page.Version.CreatedAt, page.Version.When)
+	return modified != "" && old.Modified == modified
+}
+
+// apply records the items of a fetched page and sets their action. Items
+// of a page whose content didn't change are dropped; a failed page keeps its
+// previous state so it's compared again next run.
+func (s *syncState) apply(result *pageResult) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if result.failed {
+		if old, ok := s.previous[result.pageID]; ok {
+			s.current[result.pageID] = old
+		}
+		return
+	}
+	result.items = s.record(result.pageID, result.version, result.items)
+}
+
+// applyExtra records items that don't come from a page, each under its own ID
+func (s *syncState) applyExtra(items []*ProcessedItem) []*ProcessedItem {
+	if s == nil {
+		return items
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var kept []*ProcessedItem
+	for _, item := range items {
+		s.listed[item.ID] = true
+		kept = append(kept, s.record(item.ID, nil, []*ProcessedItem{item})...)
+	}
+	return kept
+}
+
+func (s *syncState) record(key string, version *listedVersion, items []*ProcessedItem) []*ProcessedItem {
+	hash := sha256.New()
+	state := pageState{Items: []stateItem{}}
+	for _, item := range items {
+		hash.Write([]byte(item.ID + "\x00" + item.Title + "\x00" + item.Labels + "\x00" + item.Content + "\x00"))
+		state.Items = append(state.Items, stateItem{ID: item.ID, Type: item.Type, Title: item.Title, SpaceKey: item.SpaceKey})
+	}
+	state.Hash = hex.EncodeToString(hash.Sum(nil)[:16])
+	if version != nil {
+		state.Version, state.Modified = version.Number, firstNonEmpty(version.CreatedAt, version.When)
+	}
+
+	old, known := s.previous[key]
+	s.current[key] = state
+	if known && old.Hash == state.Hash {
+		return nil
+	}
+	had := map[string]bool{}
+	for _, item := range old.Items {
+		had[item.ID] = true
+	}
+	for _, item := range items {
+		item.Action = actionAdded
+		if had[item.ID] {
+			item.Action = actionUpdated
+		}
+	}
+	return items
+}
+
+// deletions returns deleted items for the items of the last run that this
+// run no longer produced: those of pages it changed, and, when complete,
+// those of pages that are gone from the listing. Without a complete listing,
+// pages it didn't see keep their state.
+func (s *syncState) deletions(config *Config, complete bool) []*ProcessedItem {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var deleted []*ProcessedItem
+	gone := func(items []stateItem, kept map[string]bool) {
+		for _, item := range items {
+			if !kept[item.ID] {
+				deleted = append(deleted, &ProcessedItem{ID: item.ID, Title: item.Title, Type: item.Type, SpaceKey: item.SpaceKey, Action: actionDeleted})
+			}
+		}
+	}
+	keys := make([]string, 0, len(s.previous))
+	for key := range s.previous {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		old := s.previous[key]
+		current, seen := s.current[key]
+		switch {
+		case seen:
+			kept := map[string]bool{}
+			for _, item := range current.Items {
+				kept[item.ID] = true
+			}
+			gone(old.Items, kept)
+		case complete && !s.listed[key]:
+			gone(old.Items, nil)
+		default:
+			s.current[key] = old
+		}
+	}
+	setOrigin(config, deleted)
+	if len(deleted) > 0 {
+		fmt.Fprintf(os.Stderr, "DEBUG: %d items of the last run are deleted\n", len(deleted))
+	}
+	return deleted
+}
+
+// itemIDs returns the items the state holds after the run, including those
+// of pages it skipped or found unchanged, which emitted nothing
+func (s *syncState) itemIDs() map[string]bool {
+	ids := map[string]bool{}
+	if s == nil {
+		return ids
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, state := range s.current {
+		for _, item := range state.Items {
+			ids[item.ID] = true
+		}
+	}
+	return ids
+}
+
+// save writes this run's state for the next run
+func (s *syncState) save() error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, err := json.Marshal(map[string]interface{}{"pages": s.current})
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(s.path+".tmp", data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(s.path+".tmp", s.path)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// fetchSpaceTemplates returns the page templates defined in each configured
+// space as items flagged template=true. Blueprints without a stored body
+// (the built-in ones) have no content to import and are skipped.
+func fetchSpaceTemplates(config *Config, converter *HTMLConverter) []*ProcessedItem {
+	baseURL := strings.TrimSuffix(config.ConfluenceURL, "/")
+
+	var items []*ProcessedItem
+	for _, spaceKey := range parseSpaceKeys(config) {
+		start := 0
+		limit := 50
+		for {
+			templatesURL := fmt.Sprintf("%s/rest/api/template/page?spaceKey=%s&expand=body&start=%d&limit=%d", baseURL, url.QueryEscape(spaceKey), start, limit)
+			body, err := fetchWithPolicy(config, opPageListing, templatesURL)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "DEBUG: Failed to get templates for space %s: %v\n", spaceKey, err)
+				break
+			}
+
+			var response struct {
+				Results []struct {
+					TemplateID string `json:"templateId"`
+					Name       string `json:"name"`
+					Body       struct {
+						Storage struct {
+							Value string `json:"value"`
+						} `json:"storage"`
+					} `json:"body"`
+					Labels []struct {
+						Name string `json:"name"`
+					} `json:"labels"`
+				} `json:"results"`
+				Links struct {
+					Next string `json:"next"`
+				} `json:"_links"`
+			}
+			if err := json.Unmarshal(body, &response); err != nil {
+				fmt.Fprintf(os.Stderr, "DEBUG: Failed to parse templates for space %s: %v\n", spaceKey, err)
+				break
+			}
+
+			for _, template := range response.Results {
+				content := converter.htmlToText(template.Body.Storage.Value)
+				if strings.TrimSpace(content) == "" {
+					continue
+				}
+				if len(content) > config.MaxContentLength {
+					content = content[:config.MaxContentLength] + "\n\n[Content truncated due to size limits]"
+				}
+				var labels []string
+				for _, label := range template.Labels {
+					labels = append(labels, label.Name)
+				}
+				items = append(items, &ProcessedItem{
+					ID:       "template-" + template.TemplateID,
+					Title:    template.Name,
+					Content:  content,
+					Type:     "template",
+					Labels:   strings.Join(labels, ","),
+					SpaceKey: spaceKey,
+					Template: true,
+				})
+			}
+
+			if response.Links.Next == "" || len(response.Results) == 0 {
+				break
+			}
+			start += len(response.Results)
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "DEBUG: Added %d space templates\n", len(items))
+	return items
+}
+
+// blueprintExcluded reports whether a page carries the label of a blueprint
+// listed in exclude_blueprints. Blueprints tag the pages they create with their
+// own label (e.g. "meeting-notes", "retrospective", "kb-how-to-article").
+func blueprintExcluded(config *Config, labels []string) bool {
+	if config.ExcludeBlueprints == "" {
+		return false
+	}
+	for _, excluded := range strings.Split(config.ExcludeBlueprints, ",") {
+		excluded = strings.TrimSpace(excluded)
+		for _, label := range labels {
+			if excluded != "" && strings.EqualFold(label, excluded) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Translation add-ons and manual conventions keep each language as a separate
+// page, usually marked with a language suffix on the title ("Setup (de)",
+// "Setup [FR]", "Setup - es") or a "lang-xx" label. Only the codes listed in the
+// languages option are recognized, so titles like "Release (IT)" aren't
+// mistaken for Italian unless "it" is configured.
+var languageSuffixRegexes = []*regexp.Regexp{
+	regexp.MustCompile(`^(.+?)\s*\(([A-Za-z]{2}(?:[-_][A-Za-z]{2})?)\)$`),
+	regexp.MustCompile(`^(.+?)\s*\[([A-Za-z]{2}(?:[-_][A-Za-z]{2})?)\]$`),
+	regexp.MustCompile(`^(.+?)\s+-\s+([A-Za-z]{2}(?:[-_][A-Za-z]{2})?)$`),
+}
+
+var languageLabelRegex = regexp.MustCompile(`^(?:lang|language)[-_]([a-z]{2}(?:[-_][a-z]{2})?)$`)
+
+// parseLanguages returns the recognized language codes, normalized to lower case with dashes
+func parseLanguages(config *Config) map[string]bool {
+	languages := make(map[string]bool)
+	for _, code := range strings.Split(config.Languages, ",") {
+		if code = normalizeLanguage(code); code != "" {
+			languages[code] = true
+		}
+	}
+	return languages
+}
+
+func normalizeLanguage(code string) string {
+	return strings.ReplaceAll(strings.ToLower(strings.TrimSpace(code)), "_", "-")
+}
+
+// splitLanguageSuffix returns the title without its language marker and the language
+func splitLanguageSuffix(title string, languages map[string]bool) (string, string) {
+	for _, regex := range languageSuffixRegexes {
+		if match := regex.FindStringSubmatch(title); match != nil {
+			if language := normalizeLanguage(match[2]); languages[language] {
+				return match[1], language
+			}
+		}
+	}
+	return title, ""
+}
+
+// applyTranslations tags pages with their language and translation group, and
+// when preferred_language is set keeps only one page per group: the preferred
+// translation if it exists, otherwise the page in the default language.
+func applyTranslations(config *Config, pages []Page) []Page {
+	languages := parseLanguages(config)
+	if len(languages) == 0 {
+		return pages
+	}
+
+	defaultLanguage := normalizeLanguage(config.DefaultLanguage)
+	preferred := normalizeLanguage(config.PreferredLanguage)
+
+	groups := make(map[string][]int)
+	var order []string
+	for i := range pages {
+		baseTitle, language := splitLanguageSuffix(pages[i].Title, languages)
+		if language == "" {
+			language = defaultLanguage
+		}
+		group := pages[i].SpaceKey + ":" + baseTitle
+		pages[i].Language = language
+		pages[i].TranslationGroup = group
+		if _, seen := groups[group]; !seen {
+			order = append(order, group)
+		}
+		groups[group] = append(groups[group], i)
+	}
+
+	if preferred == "" {
+		return pages
+	}
+
+	var result []Page
+	dropped := 0
+	for _, group := range order {
+		members := groups[group]
+		chosen := members[0]
+		for _, i := range members {
+			if pages[i].Language == defaultLanguage {
+				chosen = i
+				break
+			}
+		}
+		for _, i := range members {
+			if pages[i].Language == preferred {
+				chosen = i
+				break
+			}
+		}
+		result = append(result, pages[chosen])
+		dropped += len(members) - 1
+	}
+
+	fmt.Fprintf(os.Stderr, "DEBUG: Kept %d pages in preferred language %s, dropped %d other translations\n", len(result), preferred, dropped)
+	return result
+}
+
+// labelLanguage returns the language from a lang-xx/language-xx label, if any recognized one is present
+func labelLanguage(config *Config, labels []string) string {
+	languages := parseLanguages(config)
+	for _, label := range labels {
+		if match := languageLabelRegex.FindStringSubmatch(strings.ToLower(label)); match != nil {
+			if language := normalizeLanguage(match[1]); languages[language] {
+				return language
+			}
+		}
+	}
+	return ""
+}
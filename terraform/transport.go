@@ -0,0 +1,73 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"time"
+)
+
+// TransportSettings tune the shared HTTP transport. A small Data Center node
+// wants few, short-lived connections; a large Cloud run wants one idle
+// connection per worker kept open between requests.
+type TransportSettings struct {
+	MaxIdleConns        int
+	MaxIdleConnsPerHost int
+	IdleConnTimeout     time.Duration
+	DialTimeout         time.Duration
+	TLSHandshakeTimeout time.Duration
+	HTTP2               bool
+}
+
+var defaultTransportSettings = TransportSettings{
+	MaxIdleConns:        100,
+	MaxIdleConnsPerHost: 10,
+	IdleConnTimeout:     90 * time.Second,
+	DialTimeout:         30 * time.Second,
+	TLSHandshakeTimeout: 10 * time.Second,
+	HTTP2:               true,
+}
+
+// parseTransportSettings reads max_idle_conns, max_idle_conns_per_host,
+// idle_conn_timeout_seconds, dial_timeout_seconds, tls_handshake_timeout_seconds
+// and http2 on top of the defaults
+func parseTransportSettings(inputMap map[string]interface{}) TransportSettings {
+	settings := defaultTransportSettings
+	if n := intOption(inputMap, "max_idle_conns", 0); n > 0 {
+		settings.MaxIdleConns = n
+	}
+	if n := intOption(inputMap, "max_idle_conns_per_host", 0); n > 0 {
+		settings.MaxIdleConnsPerHost = n
+	}
+	if seconds := intOption(inputMap, "idle_conn_timeout_seconds", 0); seconds > 0 {
+		settings.IdleConnTimeout = time.Duration(seconds) * time.Second
+	}
+	if seconds := intOption(inputMap, "dial_timeout_seconds", 0); seconds > 0 {
+		settings.DialTimeout = time.Duration(seconds) * time.Second
+	}
+	if seconds := intOption(inputMap, "tls_handshake_timeout_seconds", 0); seconds > 0 {
+		settings.TLSHandshakeTimeout = time.Duration(seconds) * time.Second
+	}
+	if stringValue(inputMap["http2"]) == "false" {
+		settings.HTTP2 = false
+	}
+	return settings
+}
+
+// newTransport builds the HTTP transport for the given settings
+func newTransport(settings TransportSettings) *http.Transport {
+	transport := &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		DialContext:         (&net.Dialer{Timeout: settings.DialTimeout, KeepAlive: 30 * time.Second}).DialContext,
+		MaxIdleConns:        settings.MaxIdleConns,
+		MaxIdleConnsPerHost: settings.MaxIdleConnsPerHost,
+		IdleConnTimeout:     settings.IdleConnTimeout,
+		TLSHandshakeTimeout: settings.TLSHandshakeTimeout,
+		ForceAttemptHTTP2:   settings.HTTP2,
+	}
+	if !settings.HTTP2 {
+		// A non-nil, empty map keeps the transport from negotiating HTTP/2
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+	return transport
+}
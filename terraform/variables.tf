@@ -40,6 +40,24 @@ variable "sharepoint_site_url" {
   default     = ""
 }
 
+variable "sharepoint_additional_sites" {
+  description = "Further SharePoint site URLs or Graph site IDs to import alongside sharepoint_site_url"
+  type        = list(string)
+  default     = []
+}
+
+variable "sharepoint_discover_sites" {
+  description = "Import every site of the tenant instead of only the listed ones"
+  type        = bool
+  default     = false
+}
+
+variable "sharepoint_lists" {
+  description = "Names (or globs) of SharePoint lists to import as markdown tables"
+  type        = list(string)
+  default     = []
+}
+
 variable "azure_client_id" {
   description = "Azure AD Client ID for SharePoint access"
   type        = string
@@ -53,6 +71,19 @@ variable "azure_client_secret" {
   default     = ""
 }
 
+variable "azure_client_certificate_path" {
+  description = "PEM or PFX client certificate authenticating to Azure AD instead of azure_client_secret"
+  type        = string
+  default     = ""
+}
+
+variable "azure_client_certificate_password" {
+  description = "Password of the client certificate's private key or PFX file"
+  type        = string
+  sensitive   = true
+  default     = ""
+}
+
 variable "azure_tenant_id" {
   description = "Azure AD Tenant ID for SharePoint access"
   type        = string
@@ -101,7 +132,19 @@ variable "confluence_api_token" {
 }
 
 variable "confluence_space_keys" {
-  description = "List of Confluence space keys to import. For single space: ['DSO'], for multiple: ['DSO', 'DOCS', 'TECH']"
+  description = "List of Confluence space keys to import. For single space: ['DSO'], for multiple: ['DSO', 'DOCS', 'TECH'], for every visible space: ['*']"
+  type        = list(string)
+  default     = []
+}
+
+variable "confluence_exclude_space_keys" {
+  description = "Confluence space keys left out of the import, e.g. when confluence_space_keys is [\"*\"]"
+  type        = list(string)
+  default     = []
+}
+
+variable "confluence_space_types" {
+  description = "Space types [\"*\"] selects: \"global\", \"personal\" or both when empty"
   type        = list(string)
   default     = []
 }
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// groupVisibility decides whether content is readable by the visible_to_group
+// group. A page is readable when the group can view its space and every page in
+// its ancestry either has no read restrictions or lists the group. Restrictions
+// granted to individual users only are treated as hiding the page, since group
+// membership isn't resolved.
+type groupVisibility struct {
+	group string
+
+	mu           sync.Mutex
+	restrictions map[string][]string // content ID -> groups allowed to read (nil = unrestricted)
+}
+
+func newGroupVisibility(group string) *groupVisibility {
+	return &groupVisibility{group: group, restrictions: make(map[string][]string)}
+}
+
+// filterSpacesVisibleToGroup drops pages from spaces whose permissions show the
+// group can't read them. Spaces whose permissions can't be read, or come back
+// empty, are dropped too: the page-level check only sees explicit restrictions.
+func filterSpacesVisibleToGroup(config *Config, pages []Page) []Page {
+	visible := make(map[string]bool)
+	for _, page := range pages {
+		if _, done := visible[page.SpaceKey]; done {
+			continue
+		}
+		permissions, err := fetchSpacePermissions(config, page.SpaceKey)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "DEBUG: Failed to get permissions for space %s, skipping it: %v\n", page.SpaceKey, err)
+			visible[page.SpaceKey] = false
+			continue
+		}
+		visible[page.SpaceKey] = spaceReadableByGroup(permissions, config.VisibleToGroup)
+		if !visible[page.SpaceKey] {
+			fmt.Fprintf(os.Stderr, "DEBUG: Space %s is not visible to group %s, skipping it\n", page.SpaceKey, config.VisibleToGroup)
+		}
+	}
+
+	var result []Page
+	for _, page := range pages {
+		if visible[page.SpaceKey] {
+			result = append(result, page)
+		}
+	}
+	return result
+}
+
+// spaceReadableByGroup reports whether a read grant on the space names the
+// group. No permissions at all grant nothing.
+func spaceReadableByGroup(permissions []spacePermission, group string) bool {
+	for _, permission := range permissions {
+		if permission.Operation.Operation != "read" || permission.Operation.TargetType != "space" {
+			continue
+		}
+		for _, grantee := range permission.Subjects.Group.Results {
+			if strings.EqualFold(grantee.Name, group) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// pageVisibleToGroup checks the read restrictions of a page and its ancestors
+func pageVisibleToGroup(ctx context.Context, config *Config, page Page) (bool, error) {
+	chain, err := fetchAncestorIDs(ctx, config, page)
+	if err != nil {
+		return false, err
+	}
+	chain = append(chain, page.ID)
+
+	for _, id := range chain {
+		groups, restricted, err := config.GroupVisibility.readRestrictions(ctx, config, id)
+		if err != nil {
+			return false, err
+		}
+		if !restricted {
+			continue
+		}
+		allowed := false
+		for _, group := range groups {
+			if strings.EqualFold(group, config.VisibleToGroup) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// fetchAncestorIDs returns the IDs of a page's ancestors, root first
+func fetchAncestorIDs(ctx context.Context, config *Config, page Page) ([]string, error) {
+	ancestorsURL := fmt.Sprintf("%s/rest/api/content/%s?expand=ancestors", strings.TrimSuffix(config.ConfluenceURL, "/"), page.ID)
+	body, err := fetchWithContext(ctx, config, opContentFetch, ancestorsURL)
+	if err != nil {
+		return nil, err
+	}
+
+	var content struct {
+		Ancestors []struct {
+			ID string `json:"id"`
+		} `json:"ancestors"`
+	}
+	if err := json.Unmarshal(body, &content); err != nil {
+		return nil, fmt.Errorf("parsing ancestors: %w", err)
+	}
+
+	var ids []string
+	for _, ancestor := range content.Ancestors {
+		ids = append(ids, ancestor.ID)
+	}
+	return ids, nil
+}
+
+// readRestrictions returns the groups allowed to read a piece of content and
+// whether it's restricted at all. Results are cached since siblings share ancestors.
+func (v *groupVisibility) readRestrictions(ctx context.Context, config *Config, contentID string) ([]string, bool, error) {
+	v.mu.Lock()
+	groups, cached := v.restrictions[contentID]
+	v.mu.Unlock()
+	if cached {
+		return groups, groups != nil, nil
+	}
+
+	restrictionURL := fmt.Sprintf("%s/rest/api/content/%s/restriction/byOperation/read", strings.TrimSuffix(config.ConfluenceURL, "/"), contentID)
+	body, err := fetchWithContext(ctx, config, opContentFetch, restrictionURL)
+	if err != nil {
+		return nil, false, err
+	}
+
+	var response struct {
+		Restrictions struct {
+			User struct {
+				Results []confluenceUser `json:"results"`
+			} `json:"user"`
+			Group struct {
+				Results []struct {
+					Name string `json:"name"`
+				} `json:"results"`
+			} `json:"group"`
+		} `json:"restrictions"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil {
+		return nil, false, fmt.Errorf("parsing read restrictions: %w", err)
+	}
+
+	restricted := len(response.Restrictions.User.Results) > 0 || len(response.Restrictions.Group.Results) > 0
+	groups = nil
+	if restricted {
+		groups = []string{}
+		for _, group := range response.Restrictions.Group.Results {
+			groups = append(groups, group.Name)
+		}
+	}
+
+	v.mu.Lock()
+	v.restrictions[contentID] = groups
+	v.mu.Unlock()
+	return groups, restricted, nil
+}
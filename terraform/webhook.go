@@ -0,0 +1,216 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// defaultWebhookBatch is how long webhook events are collected before their
+// pages are imported, so a burst of edits to a page costs one fetch
+const defaultWebhookBatch = 30 * time.Second
+
+// maxWebhookBody bounds the payloads the webhook endpoint reads
+const maxWebhookBody = 1 << 20
+
+// webhookPage is the page or blog post object of a Confluence webhook payload.
+// Cloud sends the ID as a number, Data Center as a string.
+type webhookPage struct {
+	ID       json.RawMessage `json:"id"`
+	Title    string          `json:"title"`
+	SpaceKey string          `json:"spaceKey"`
+}
+
+type webhookEvent struct {
+	Event string       `json:"event"`
+	Page  *webhookPage `json:"page"`
+	Blog  *webhookPage `json:"blog"`
+}
+
+// pendingUpdates holds a profile's pages reported by webhooks and not yet
+// imported. A page is in at most one of the two maps, the latest event wins.
+type pendingUpdates struct {
+	updated map[string]Page
+	removed map[string]bool
+	flushAt *time.Timer
+}
+
+func (p *pendingUpdates) count() int {
+	return len(p.updated) + len(p.removed)
+}
+
+// handleWebhook accepts a Confluence webhook at /webhook/<profile> and queues
+// the page it reports for the profile's next update run
+func (d *daemon) handleWebhook(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "webhooks must be POSTed", http.StatusMethodNotAllowed)
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, "/webhook/")
+	job := d.job(name)
+	if job == nil {
+		http.Error(w, fmt.Sprintf("no served profile %q", name), http.StatusNotFound)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxWebhookBody))
+	if err != nil {
+		http.Error(w, "reading payload: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !d.webhookAuthorized(r, body) {
+		http.Error(w, "invalid webhook signature or token", http.StatusUnauthorized)
+		return
+	}
+	if job.webhookErr != "" {
+		http.Error(w, job.webhookErr, http.StatusConflict)
+		return
+	}
+
+	var event webhookEvent
+	if err := json.Unmarshal(body, &event); err != nil {
+		http.Error(w, "parsing payload: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	name = firstNonEmpty(event.Event, r.Header.Get("X-Event-Key"), r.URL.Query().Get("event"))
+	page, contentType := event.Page, "page"
+	if page == nil {
+		page, contentType = event.Blog, "blogpost"
+	}
+	removed, relevant := webhookAction(name)
+	if page == nil || !relevant {
+		// Other events (comments, spaces, labels) don't change page content
+		w.WriteHeader(http.StatusAccepted)
+		fmt.Fprintf(w, "ignored event %q\n", name)
+		return
+	}
+	id := strings.Trim(string(page.ID), `"`)
+	if id == "" || id == "null" {
+		http.Error(w, "payload has no page ID", http.StatusBadRequest)
+		return
+	}
+
+	d.queueUpdate(job, Page{ID: id, Title: page.Title, SpaceKey: page.SpaceKey, Type: contentType}, removed)
+	w.WriteHeader(http.StatusAccepted)
+	fmt.Fprintf(w, "queued %s %s\n", name, id)
+}
+
+// webhookAction maps a webhook event name to whether the page was removed, and
+// whether the event changes page content at all
+func webhookAction(event string) (removed, relevant bool) {
+	event = strings.ToLower(event)
+	if !strings.HasPrefix(event, "page_") && !strings.HasPrefix(event, "blog_") {
+		return false, false
+	}
+	for _, suffix := range []string{"_removed", "_trashed", "_deleted"} {
+		if strings.HasSuffix(event, suffix) {
+			return true, true
+		}
+	}
+	for _, suffix := range []string{"_created", "_updated", "_restored", "_moved"} {
+		if strings.HasSuffix(event, suffix) {
+			return false, true
+		}
+	}
+	return false, false
+}
+
+// webhookAuthorized checks the payload's X-Hub-Signature HMAC, or a token
+// query parameter for senders that can't sign, against webhook_secret. Without
+// a secret nothing is authorized.
+func (d *daemon) webhookAuthorized(r *http.Request, body []byte) bool {
+	if d.webhookSecret == "" {
+		return false
+	}
+	if token := r.URL.Query().Get("token"); token != "" {
+		return subtle.ConstantTimeCompare([]byte(token), []byte(d.webhookSecret)) == 1
+	}
+	signature, ok := strings.CutPrefix(r.Header.Get("X-Hub-Signature"), "sha256=")
+	if !ok {
+		return false
+	}
+	got, err := hex.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(d.webhookSecret))
+	mac.Write(body)
+	return hmac.Equal(got, mac.Sum(nil))
+}
+
+// queueUpdate adds a page to the job's pending updates and makes sure an
+// update run follows once the batch window passes
+func (d *daemon) queueUpdate(job *serveJob, page Page, removed bool) {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	if job.pending.updated == nil {
+		job.pending.updated, job.pending.removed = map[string]Page{}, map[string]bool{}
+	}
+	if removed {
+		delete(job.pending.updated, page.ID)
+		job.pending.removed[page.ID] = true
+	} else {
+		delete(job.pending.removed, page.ID)
+		job.pending.updated[page.ID] = page
+	}
+	job.status.PendingUpdates = job.pending.count()
+	if job.pending.flushAt == nil {
+		job.pending.flushAt = time.AfterFunc(d.webhookBatch, func() { d.update(job) })
+	}
+}
+
+// update imports the job's pending pages in a child process in update_pages
+// mode, which merges them into the profile's output_file. Pages reported while
+// it runs wait for the next batch.
+func (d *daemon) update(job *serveJob) {
+	if !d.startRun() {
+		return
+	}
+	defer d.runs.Done()
+	job.runMu.Lock()
+	defer job.runMu.Unlock()
+
+	job.mu.Lock()
+	name := job.status.Profile
+	updated, removed := job.pending.updated, job.pending.removed
+	job.pending = pendingUpdates{}
+	job.status.PendingUpdates = 0
+	job.status.Running = true
+	job.mu.Unlock()
+
+	pages := make([]Page, 0, len(updated))
+	for _, page := range updated {
+		pages = append(pages, page)
+	}
+	sort.Slice(pages, func(i, j int) bool { return pages[i].ID < pages[j].ID })
+	removedIDs := make([]string, 0, len(removed))
+	for id := range removed {
+		removedIDs = append(removedIDs, id)
+	}
+	sort.Strings(removedIDs)
+	pageUpdates, _ := json.Marshal(pages)
+	fmt.Fprintf(os.Stderr, "DEBUG: Applying webhook updates to profile %q: %d updated, %d removed\n", name, len(pages), len(removedIDs))
+
+	_, outcome, message := d.runChild(map[string]string{
+		"mode":             modeUpdatePages,
+		"page_updates":     string(pageUpdates),
+		"removed_page_ids": strings.Join(removedIDs, ","),
+	}, name)
+
+	job.mu.Lock()
+	job.status.Running = false
+	job.status.LastUpdateFinished = time.Now().UTC().Format(time.RFC3339)
+	job.status.LastUpdateStatus, job.status.LastUpdateError = outcome, message
+	job.status.LastUpdatePages = len(pages) + len(removedIDs)
+	job.mu.Unlock()
+	d.saveState()
+	fmt.Fprintf(os.Stderr, "DEBUG: Webhook updates of profile %q finished: %s\n", name, strings.TrimSpace(outcome+" "+message))
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// Worker count bounds. Cloud tolerates far more parallel requests than a typical
+// Data Center node, which shares its capacity with interactive users.
+const (
+	minWorkers           = 1
+	cloudMaxWorkers      = 20
+	dataCenterMaxWorkers = 8
+	workersPerCPU        = 4 // Workers spend nearly all their time waiting on HTTP
+)
+
+// isCloudInstance reports whether the URL points at Atlassian Cloud
+func isCloudInstance(confluenceURL string) bool {
+	parsed, err := url.Parse(confluenceURL)
+	if err != nil {
+		return false
+	}
+	host := strings.ToLower(parsed.Hostname())
+	return strings.HasSuffix(host, ".atlassian.net") || host == "api.atlassian.com"
+}
+
+// maxWorkersFor returns the upper bound on concurrent workers for the configured source
+func maxWorkersFor(config *Config) int {
+	if isOfflineSource(config) || (config.Deployment != deploymentServer && isCloudInstance(config.ConfluenceURL)) {
+		return cloudMaxWorkers
+	}
+	return dataCenterMaxWorkers
+}
+
+// resolveWorkerCount clamps a requested worker count to safe bounds, or derives
+// one from the CPU count and rate-limit headroom when none was requested
+func resolveWorkerCount(config *Config, requested int) int {
+	upper := maxWorkersFor(config)
+
+	if requested > 0 {
+		workers := max(minWorkers, min(requested, upper))
+		if workers != requested {
+			fmt.Fprintf(os.Stderr, "DEBUG: Clamped max_workers from %d to %d (limit %d for this instance)\n", requested, workers, upper)
+		}
+		return workers
+	}
+
+	workers := min(runtime.NumCPU()*workersPerCPU, upper)
+	switch headroom := config.RateLimitHeadroom; {
+	case headroom < 0:
+		// No rate-limit headers; CPU-based sizing only
+	case headroom < 0.2:
+		workers = minWorkers
+	case headroom < 0.5:
+		workers = max(minWorkers, workers/2)
+	}
+
+	fmt.Fprintf(os.Stderr, "DEBUG: Automatically sized workers to %d (CPUs: %d, rate-limit headroom: %.2f, limit: %d)\n",
+		workers, runtime.NumCPU(), config.RateLimitHeadroom, upper)
+	return workers
+}
+
+// rateLimitHeadroom returns the fraction of the rate-limit budget remaining
+// according to the response headers, or -1 when the server doesn't report one
+func rateLimitHeadroom(headers http.Header) float64 {
+	if headers == nil {
+		return -1
+	}
+	if strings.EqualFold(headers.Get("X-RateLimit-NearLimit"), "true") {
+		return 0
+	}
+
+	for _, prefix := range []string{"X-RateLimit-", "RateLimit-"} {
+		limit, limitErr := strconv.ParseFloat(headers.Get(prefix+"Limit"), 64)
+		remaining, remainingErr := strconv.ParseFloat(headers.Get(prefix+"Remaining"), 64)
+		if limitErr == nil && remainingErr == nil && limit > 0 {
+			return math.Max(0, math.Min(1, remaining/limit))
+		}
+	}
+	return -1
+}
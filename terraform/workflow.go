@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Workflow status sources. Comala Document Management on Server/Data Center
+// exposes the document state over its own REST API; other workflow add-ons (and
+// Comala on Cloud) keep it in a content property whose value is read by path.
+const (
+	workflowStatusComala   = "comala"
+	workflowStatusProperty = "property"
+)
+
+// validateWorkflowStatus checks the workflow status options
+func validateWorkflowStatus(config *Config) error {
+	switch config.WorkflowStatus {
+	case "", workflowStatusComala:
+	case workflowStatusProperty:
+		if config.WorkflowPropertyKey == "" {
+			return fmt.Errorf("workflow_property_key is required when workflow_status is %q", workflowStatusProperty)
+		}
+	default:
+		return fmt.Errorf("unknown workflow_status %q (expected %q or %q)", config.WorkflowStatus, workflowStatusComala, workflowStatusProperty)
+	}
+	if config.WorkflowStatus != "" && isOfflineSource(config) {
+		return fmt.Errorf("workflow_status needs the confluence source")
+	}
+	if config.RequiredStatus != "" && config.WorkflowStatus == "" {
+		return fmt.Errorf("required_status needs workflow_status to be set")
+	}
+	return nil
+}
+
+// fetchWorkflowStatus returns the workflow state name of a page, or "" when it has none
+func fetchWorkflowStatus(ctx context.Context, config *Config, page Page) (string, error) {
+	baseURL := strings.TrimSuffix(config.ConfluenceURL, "/")
+
+	switch config.WorkflowStatus {
+	case workflowStatusComala:
+		body, err := fetchWithContext(ctx, config, opContentFetch, fmt.Sprintf("%s/rest/cw/1/content/%s/status", baseURL, page.ID))
+		if err != nil {
+			return "", err
+		}
+		var status struct {
+			State struct {
+				Name string `json:"name"`
+			} `json:"state"`
+		}
+		if err := json.Unmarshal(body, &status); err != nil {
+			return "", fmt.Errorf("parsing workflow status: %w", err)
+		}
+		return status.State.Name, nil
+
+	case workflowStatusProperty:
+		value, err := fetchContentProperty(ctx, config, page, config.WorkflowPropertyKey)
+		if err != nil || value == nil {
+			return "", err
+		}
+		return stringAtPath(value, config.WorkflowPropertyPath), nil
+	}
+	return "", nil
+}
+
+// fetchContentProperty returns the decoded value of a content property, or nil if the page doesn't have it
+func fetchContentProperty(ctx context.Context, config *Config, page Page, key string) (interface{}, error) {
+	baseURL := strings.TrimSuffix(config.ConfluenceURL, "/")
+
+	if config.APIVersion == apiVersionV2 {
+		body, err := fetchWithContext(ctx, config, opContentFetch, fmt.Sprintf("%s/api/v2/%s/%s/properties?key=%s", baseURL, contentCollection(page), page.ID, url.QueryEscape(key)))
+		if err != nil {
+			return nil, err
+		}
+		var response struct {
+			Results []struct {
+				Value interface{} `json:"value"`
+			} `json:"results"`
+		}
+		if err := json.Unmarshal(body, &response); err != nil {
+			return nil, fmt.Errorf("parsing content property: %w", err)
+		}
+		if len(response.Results) == 0 {
+			return nil, nil
+		}
+		return response.Results[0].Value, nil
+	}
+
+	body, err := fetchWithContext(ctx, config, opContentFetch, fmt.Sprintf("%s/rest/api/content/%s/property/%s", baseURL, page.ID, url.PathEscape(key)))
+	if err != nil {
+		if isNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var property struct {
+		Value interface{} `json:"value"`
+	}
+	if err := json.Unmarshal(body, &property); err != nil {
+		return nil, fmt.Errorf("parsing content property: %w", err)
+	}
+	return property.Value, nil
+}
+
+// stringAtPath walks a dot-separated path through decoded JSON and returns the string found there
+func stringAtPath(value interface{}, path string) string {
+	if path != "" {
+		for _, segment := range strings.Split(path, ".") {
+			object, ok := value.(map[string]interface{})
+			if !ok {
+				return ""
+			}
+			value = object[segment]
+		}
+	}
+	return stringValue(value)
+}
+
+// statusAllowed reports whether a page with the given status may be imported
+func statusAllowed(config *Config, status string) bool {
+	if config.RequiredStatus == "" {
+		return true
+	}
+	for _, allowed := range strings.Split(config.RequiredStatus, ",") {
+		if strings.EqualFold(strings.TrimSpace(allowed), status) {
+			return true
+		}
+	}
+	return false
+}